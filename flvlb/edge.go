@@ -0,0 +1,280 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The load balance strategy to pick edge.
+const (
+	// Consistent hash by the stream url, the same stream always goes to the same edge,
+	// to reduce the streams pulled from origin.
+	LoadBalanceHash = "hash"
+	// Pick the edge with least connections, by the summaries of SRS.
+	LoadBalanceLoad = "load"
+)
+
+// The virtual nodes for each edge in consistent hash ring.
+const hashVirtualNodes = 160
+
+// The SRS edge server, for example:
+//
+//	-edge http://10.0.0.1:8080?api=http://10.0.0.1:1985
+//
+// The api is the HTTP API of SRS, default to port 1985 of the same host.
+type Edge struct {
+	// The HTTP-FLV server of edge.
+	URL *url.URL
+	// The HTTP API server of edge.
+	API *url.URL
+
+	// The connections of SRS in summaries, and the streams picked after the summaries.
+	conns  int64
+	picked int64
+	// Whether the edge is up, 0 for down, by the summaries.
+	up int32
+}
+
+func NewEdge(s string) (*Edge, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, oe.Wrapf(err, "parse %v", s)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, oe.Errorf("invalid scheme of %v", s)
+	}
+
+	v := &Edge{URL: u, up: 1}
+
+	api := u.Query().Get("api")
+	if api == "" {
+		api = fmt.Sprintf("http://%v:1985", u.Hostname())
+	}
+	if v.API, err = url.Parse(api); err != nil {
+		return nil, oe.Wrapf(err, "parse api %v", api)
+	}
+
+	u.RawQuery = ""
+	return v, nil
+}
+
+func (v *Edge) String() string {
+	return fmt.Sprintf("%v(api=%v)", v.URL, v.API)
+}
+
+// Whether the edge is up.
+func (v *Edge) Up() bool {
+	return atomic.LoadInt32(&v.up) == 1
+}
+
+// The load of edge, the connections and the streams picked after the summaries.
+func (v *Edge) Load() int64 {
+	return atomic.LoadInt64(&v.conns) + atomic.LoadInt64(&v.picked)
+}
+
+// The summaries of SRS, see https://ossrs.io/lts/en-us/docs/v5/doc/http-api#summaries
+type srsSummaries struct {
+	Code int `json:"code"`
+	Data struct {
+		OK     bool `json:"ok"`
+		System struct {
+			ConnSRS int64 `json:"conn_srs"`
+		} `json:"system"`
+	} `json:"data"`
+}
+
+// Poll the summaries of edge, to update the load and status.
+func (v *Edge) Poll(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	api := fmt.Sprintf("%v/api/v1/summaries", v.API)
+	err := func() error {
+		r, err := http.NewRequestWithContext(ctx, http.MethodGet, api, nil)
+		if err != nil {
+			return oe.Wrapf(err, "create request %v", api)
+		}
+
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			return oe.Wrapf(err, "request %v", api)
+		}
+		defer res.Body.Close()
+
+		b, err := ioutil.ReadAll(io.LimitReader(res.Body, 1024*1024))
+		if err != nil {
+			return oe.Wrapf(err, "read %v", api)
+		}
+		if res.StatusCode != http.StatusOK {
+			return oe.Errorf("status %v of %v", res.StatusCode, api)
+		}
+
+		s := &srsSummaries{}
+		if err := json.Unmarshal(b, s); err != nil {
+			return oe.Wrapf(err, "parse %v", string(b))
+		}
+		if s.Code != 0 {
+			return oe.Errorf("code %v of %v", s.Code, api)
+		}
+
+		atomic.StoreInt64(&v.conns, s.Data.System.ConnSRS)
+		atomic.StoreInt64(&v.picked, 0)
+		return nil
+	}()
+
+	if err != nil {
+		if atomic.CompareAndSwapInt32(&v.up, 1, 0) {
+			ol.Wf(ctx, "Edge %v down, err %+v", v.URL, err)
+		}
+		return err
+	}
+
+	if atomic.CompareAndSwapInt32(&v.up, 0, 1) {
+		ol.Tf(ctx, "Edge %v up, conns=%v", v.URL, v.Load())
+	}
+	return nil
+}
+
+type hashNode struct {
+	hash uint32
+	edge *Edge
+}
+
+// The edges to pick for stream.
+type Edges struct {
+	Strategy string
+	Edges    []*Edge
+	// The consistent hash ring, sorted by hash.
+	ring []hashNode
+}
+
+func NewEdges(strategy string, edges []*Edge) (*Edges, error) {
+	if strategy != LoadBalanceHash && strategy != LoadBalanceLoad {
+		return nil, oe.Errorf("invalid lb %v", strategy)
+	}
+	if len(edges) == 0 {
+		return nil, oe.New("no edge")
+	}
+
+	v := &Edges{Strategy: strategy, Edges: edges}
+	for _, edge := range edges {
+		for i := 0; i < hashVirtualNodes; i++ {
+			v.ring = append(v.ring, hashNode{hash: hashOf(fmt.Sprintf("%v#%v", edge.URL.Host, i)), edge: edge})
+		}
+	}
+	sort.Slice(v.ring, func(i, j int) bool {
+		return v.ring[i].hash < v.ring[j].hash
+	})
+
+	return v, nil
+}
+
+func hashOf(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// Pick the edge for stream, nil if all edges are down.
+func (v *Edges) Pick(stream string) (edge *Edge) {
+	if v.Strategy == LoadBalanceLoad {
+		for _, e := range v.Edges {
+			if e.Up() && (edge == nil || e.Load() < edge.Load()) {
+				edge = e
+			}
+		}
+	} else {
+		// The first up edge clockwise on the ring.
+		h := hashOf(stream)
+		i := sort.Search(len(v.ring), func(i int) bool {
+			return v.ring[i].hash >= h
+		})
+		for n := 0; n < len(v.ring); n++ {
+			if node := v.ring[(i+n)%len(v.ring)]; node.edge.Up() {
+				edge = node.edge
+				break
+			}
+		}
+	}
+
+	if edge != nil {
+		atomic.AddInt64(&edge.picked, 1)
+	}
+	return
+}
+
+// Poll the summaries of edges every interval, until ctx done.
+func (v *Edges) Start(ctx context.Context, interval time.Duration, wg *sync.WaitGroup) {
+	for _, edge := range v.Edges {
+		wg.Add(1)
+		go func(ctx context.Context, edge *Edge) {
+			defer wg.Done()
+
+			for {
+				edge.Poll(ctx, interval)
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(interval):
+				}
+			}
+		}(ol.WithContext(ctx), edge)
+	}
+}
+
+// The state of edge, for api.
+type EdgeState struct {
+	URL   string `json:"url"`
+	API   string `json:"api"`
+	Up    bool   `json:"up"`
+	Conns int64  `json:"conns"`
+	// The streams picked after the last summaries.
+	Picked int64 `json:"picked"`
+}
+
+func (v *Edges) State() (states []*EdgeState) {
+	for _, edge := range v.Edges {
+		states = append(states, &EdgeState{
+			URL: edge.URL.String(), API: edge.API.String(), Up: edge.Up(),
+			Conns: atomic.LoadInt64(&edge.conns), Picked: atomic.LoadInt64(&edge.picked),
+		})
+	}
+	return
+}
@@ -0,0 +1,117 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseStream(t *testing.T) {
+	streams := map[string]string{
+		"/live/livestream.flv":         "/live/livestream.flv",
+		"live/livestream.flv":          "/live/livestream.flv",
+		"/vhost/live/livestream.flv":   "/vhost/live/livestream.flv",
+		"/livestream.flv":              "",
+		"/live/livestream.m3u8":        "",
+		"/live/../livestream.flv":      "",
+		"/live//livestream.flv":        "",
+		"/flvlb/v1/../../livestream.x": "",
+	}
+	for path, expect := range streams {
+		if v := parseStream(path); v != expect {
+			t.Errorf("path %v expect %v, got %v", path, expect, v)
+		}
+	}
+}
+
+func TestEdges(t *testing.T) {
+	if _, err := NewEdge("rtmp://10.0.0.1"); err == nil {
+		t.Errorf("should fail for rtmp")
+	}
+
+	e0, _ := NewEdge("http://10.0.0.1:8080")
+	e1, _ := NewEdge("http://10.0.0.2:8080?api=http://127.0.0.1:1985")
+	if e0.API.String() != "http://10.0.0.1:1985" || e1.API.String() != "http://127.0.0.1:1985" || e1.URL.RawQuery != "" {
+		t.Errorf("invalid edges %v, %v", e0, e1)
+	}
+
+	// The same stream always goes to the same edge, unless it's down.
+	v, err := NewEdges(LoadBalanceHash, []*Edge{e0, e1})
+	if err != nil {
+		t.Fatalf("err %+v", err)
+	}
+	picked := v.Pick("/live/livestream.flv")
+	for i := 0; i < 10; i++ {
+		if edge := v.Pick("/live/livestream.flv"); edge != picked {
+			t.Errorf("should pick %v, got %v", picked, edge)
+		}
+	}
+	picked.up = 0
+	if edge := v.Pick("/live/livestream.flv"); edge == picked || edge == nil {
+		t.Errorf("should pick other, got %v", edge)
+	}
+	e0.up, e1.up = 0, 0
+	if edge := v.Pick("/live/livestream.flv"); edge != nil {
+		t.Errorf("should pick none, got %v", edge)
+	}
+
+	// Pick the least load, and count the picked streams.
+	e0.up, e1.up, e0.conns, e1.conns, e0.picked, e1.picked = 1, 1, 10, 9, 0, 0
+	v.Strategy = LoadBalanceLoad
+	if edge := v.Pick("/live/a.flv"); edge != e1 {
+		t.Errorf("should pick e1, got %v", edge)
+	}
+	if edge := v.Pick("/live/b.flv"); edge != e0 {
+		t.Errorf("should pick e0, got %v", edge)
+	}
+}
+
+func TestEdgePoll(t *testing.T) {
+	var code int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/summaries" || atomic.LoadInt32(&code) != 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"code":0,"data":{"ok":true,"system":{"conn_srs":100}}}`))
+	}))
+	defer api.Close()
+
+	edge, _ := NewEdge("http://10.0.0.1:8080?api=" + api.URL)
+	edge.picked = 3
+	if err := edge.Poll(context.Background(), time.Second); err != nil || edge.Load() != 100 || !edge.Up() {
+		t.Errorf("poll err %v, load %v", err, edge.Load())
+	}
+
+	atomic.StoreInt32(&code, 1)
+	if err := edge.Poll(context.Background(), time.Second); err == nil || edge.Up() {
+		t.Errorf("should down, err %v", err)
+	}
+}
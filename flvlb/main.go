@@ -0,0 +1,237 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+/*
+The flvlb is load-balance for flv streaming, use 302 or proxy to serve lots of
+connections, by picking a SRS edge for each stream.
+*/
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	oh "github.com/ossrs/go-oryx-lib/http"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The mode to serve the player.
+const (
+	// Redirect the player to edge by 302.
+	ModeRedirect = "302"
+	// Proxy the stream from edge.
+	ModeProxy = "proxy"
+)
+
+type Strings []string
+
+func (v *Strings) String() string {
+	return fmt.Sprintf("strings [%v]", strings.Join(*v, ","))
+}
+
+func (v *Strings) Set(value string) error {
+	*v = append(*v, value)
+	return nil
+}
+
+// Parse the stream of url /{app}/{stream}.flv, return empty if not flv.
+func parseStream(path string) string {
+	if !strings.HasSuffix(path, ".flv") {
+		return ""
+	}
+
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			return ""
+		}
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// The handler of flv streams, which picks edge for each stream.
+type FlvLB struct {
+	Mode  string
+	Edges *Edges
+}
+
+func (v *FlvLB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := ol.WithContext(r.Context())
+
+	stream := parseStream(r.URL.Path)
+	if stream == "" {
+		http.Error(w, "invalid stream, should be /{app}/{stream}.flv", http.StatusNotFound)
+		return
+	}
+
+	edge := v.Edges.Pick(stream)
+	if edge == nil {
+		ol.Wf(ctx, "No edge for %v", stream)
+		http.Error(w, "no edge", http.StatusServiceUnavailable)
+		return
+	}
+
+	if v.Mode == ModeRedirect {
+		location := fmt.Sprintf("%v://%v%v", edge.URL.Scheme, edge.URL.Host, r.URL.RequestURI())
+		ol.Tf(ctx, "Redirect %v to %v, load=%v", stream, location, edge.Load())
+		http.Redirect(w, r, location, http.StatusFound)
+		return
+	}
+
+	ol.Tf(ctx, "Proxy %v to %v, load=%v", stream, edge.URL, edge.Load())
+	proxy := &httputil.ReverseProxy{
+		// Flush immediately for live stream.
+		FlushInterval: -1,
+		Director: func(r *http.Request) {
+			r.URL.Scheme, r.URL.Host, r.Host = edge.URL.Scheme, edge.URL.Host, edge.URL.Host
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			ol.Ef(ctx, "Proxy %v to %v err %+v", stream, edge.URL, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+func run(ctx context.Context) error {
+	oh.Server = fmt.Sprintf("%v/%v", Signature(), Version())
+	fmt.Println(oh.Server, "load-balance for flv streaming.")
+
+	var listen, lb, mode, poll string
+	var edges Strings
+
+	flag.StringVar(&listen, "listen", ":8936", "listen at, for example, :8936")
+	flag.Var(&edges, "edge", "the SRS edge, for example, http://10.0.0.1:8080?api=http://10.0.0.1:1985")
+	flag.StringVar(&lb, "lb", LoadBalanceHash, "the load balance strategy, hash or load")
+	flag.StringVar(&mode, "mode", ModeRedirect, "the mode to serve player, 302 or proxy")
+	flag.StringVar(&poll, "poll", "5s", "the interval to poll the summaries of edges")
+
+	flag.Usage = func() {
+		fmt.Println(fmt.Sprintf("Usage: %v -listen :8936 -edge url [-edge url]... [-lb hash|load] [-mode 302|proxy]", os.Args[0]))
+		fmt.Println(fmt.Sprintf("	"))
+		fmt.Println(fmt.Sprintf("Options:"))
+		fmt.Println(fmt.Sprintf("	-listen string"))
+		fmt.Println(fmt.Sprintf("			Listen at for HTTP-FLV players. Default: :8936"))
+		fmt.Println(fmt.Sprintf("	-edge string"))
+		fmt.Println(fmt.Sprintf("			The SRS edge, with HTTP API by api option, default to port 1985 of the same host."))
+		fmt.Println(fmt.Sprintf("			For example: http://10.0.0.1:8080?api=http://10.0.0.1:1985"))
+		fmt.Println(fmt.Sprintf("	-lb string"))
+		fmt.Println(fmt.Sprintf("			The strategy to pick edge, hash for consistent hash of stream, or load for least connections. Default: hash"))
+		fmt.Println(fmt.Sprintf("	-mode string"))
+		fmt.Println(fmt.Sprintf("			Redirect player to edge by 302, or proxy the stream from edge. Default: 302"))
+		fmt.Println(fmt.Sprintf("	-poll duration"))
+		fmt.Println(fmt.Sprintf("			The interval to poll the /api/v1/summaries of edges, for load and status. Default: 5s"))
+		fmt.Println(fmt.Sprintf("For example:"))
+		fmt.Println(fmt.Sprintf("	%v -listen :8936 -edge http://10.0.0.1:8080 -edge http://10.0.0.2:8080 -lb load", os.Args[0]))
+	}
+	flag.Parse()
+
+	if mode != ModeRedirect && mode != ModeProxy {
+		return oe.Errorf("invalid mode %v", mode)
+	}
+
+	interval, err := time.ParseDuration(poll)
+	if err != nil || interval <= 0 {
+		return oe.Errorf("invalid poll %v", poll)
+	}
+
+	var pool []*Edge
+	for _, s := range edges {
+		edge, err := NewEdge(s)
+		if err != nil {
+			return oe.Wrapf(err, "parse edge %v", s)
+		}
+		pool = append(pool, edge)
+		ol.Tf(ctx, "Edge %v", edge)
+	}
+
+	lbEdges, err := NewEdges(lb, pool)
+	if err != nil {
+		flag.Usage()
+		return oe.Wrapf(err, "create edges")
+	}
+	ol.Tf(ctx, "Listen at %v, lb=%v, mode=%v, poll=%v", listen, lb, mode, interval)
+
+	wg := sync.WaitGroup{}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lbEdges.Start(ctx, interval, &wg)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/flvlb/v1/versions", func(w http.ResponseWriter, r *http.Request) {
+		oh.WriteVersion(w, r, Version())
+	})
+	mux.HandleFunc("/flvlb/v1/edges", func(w http.ResponseWriter, r *http.Request) {
+		oh.WriteData(ctx, w, r, lbEdges.State())
+	})
+	mux.Handle("/", &FlvLB{Mode: mode, Edges: lbEdges})
+
+	server := &http.Server{Addr: listen, Handler: mux}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer cancel()
+
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			ol.Ef(ctx, "serve err %+v", err)
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigs)
+
+	select {
+	case <-ctx.Done():
+	case sig := <-sigs:
+		ol.Tf(ctx, "Got %v, quit", sig)
+	}
+
+	server.Close()
+	cancel()
+	wg.Wait()
+	return nil
+}
+
+func main() {
+	ctx := ol.WithContext(context.Background())
+	if err := run(ctx); err != nil {
+		ol.Ef(ctx, "run err %+v", err)
+		os.Exit(-1)
+	}
+}
@@ -0,0 +1,166 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The format of access log.
+const (
+	// The Apache combined log format, with extra fields of duration, upstream and sni.
+	AccessLogCombined = "combined"
+	// The JSON lines, one object per request.
+	AccessLogJSON = "json"
+)
+
+// The access log, one line per request, write to file or stdout, reopen the file for
+// logrotate.
+type AccessLog struct {
+	filename string
+	format   string
+	lock     sync.Mutex
+	w        io.Writer
+	f        *os.File
+}
+
+// Create the access log for filename, which is stdout or file path.
+func NewAccessLog(filename, format string) (*AccessLog, error) {
+	if format == "" {
+		format = AccessLogCombined
+	}
+	if format != AccessLogCombined && format != AccessLogJSON {
+		return nil, oe.Errorf("invalid format %v", format)
+	}
+
+	v := &AccessLog{filename: filename, format: format}
+	if err := v.Reopen(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Reopen the file, for logrotate.
+func (v *AccessLog) Reopen() error {
+	if v.filename == "stdout" || v.filename == "console" {
+		v.w = os.Stdout
+		return nil
+	}
+
+	f, err := os.OpenFile(v.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return oe.Wrapf(err, "open %v", v.filename)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.f != nil {
+		v.f.Close()
+	}
+	v.w, v.f = f, f
+
+	return nil
+}
+
+func (v *AccessLog) Close() error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.f != nil {
+		return v.f.Close()
+	}
+	return nil
+}
+
+// Write access log when request done.
+func (v *AccessLog) Observe(r *http.Request, record *requestRecord) {
+	sw, start, duration, upstream := record.writer, record.start, record.Duration(), record.Upstream()
+
+	var sni string
+	if r.TLS != nil {
+		sni = r.TLS.ServerName
+	}
+
+	var line string
+	if v.format == AccessLogJSON {
+		b, err := json.Marshal(map[string]interface{}{
+			"time": start.Format(time.RFC3339Nano), "ip": realIP(r), "host": r.Host,
+			"method": r.Method, "uri": r.RequestURI, "proto": r.Proto,
+			"status": sw.Status(), "bytes": sw.bytes, "duration": duration.Seconds(),
+			"referer": r.Referer(), "ua": r.UserAgent(), "upstream": upstream, "sni": sni,
+		})
+		if err != nil {
+			return
+		}
+		line = string(b) + "\n"
+	} else {
+		// Use - for empty field, like Apache.
+		dash := func(v string) string {
+			if v == "" {
+				return "-"
+			}
+			return v
+		}
+		// Escape the request line from client, like the %q without the outer quotes.
+		escape := func(v string) string {
+			v = strconv.Quote(v)
+			return v[1 : len(v)-1]
+		}
+
+		line = fmt.Sprintf("%v - - [%v] \"%v %v %v\" %v %v %q %q %.3f %q %q\n",
+			realIP(r), start.Format("02/Jan/2006:15:04:05 -0700"), escape(r.Method), escape(r.RequestURI), escape(r.Proto),
+			sw.Status(), sw.bytes, dash(r.Referer()), dash(r.UserAgent()), duration.Seconds(),
+			dash(upstream), dash(sni),
+		)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	io.WriteString(v.w, line)
+}
+
+// Open the server log file, and switch the logger to it.
+func switchLogFile(filename string) error {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return oe.Wrapf(err, "open %v", filename)
+	}
+
+	// The logger never closes the previous io, so we close it.
+	if c, ok := ol.Switch(f).(io.Closer); ok && c != os.Stdout {
+		c.Close()
+	}
+	return nil
+}
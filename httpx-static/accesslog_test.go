@@ -0,0 +1,58 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogCombined(t *testing.T) {
+	filename := path.Join(t.TempDir(), "access.log")
+	v, err := NewAccessLog(filename, "")
+	if err != nil {
+		t.Fatalf("create err %+v", err)
+	}
+	defer v.Close()
+
+	// The quote in uri never breaks the fields of line.
+	r := &http.Request{
+		Method: "GET", RequestURI: `/a"b c\d`, Proto: "HTTP/1.1",
+		RemoteAddr: "1.2.3.4:1234", Header: http.Header{"User-Agent": {"curl"}},
+	}
+	v.Observe(r, &requestRecord{start: time.Now(), writer: &statusWriter{}})
+
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := string(b); !strings.Contains(line, `"GET /a\"b c\\d HTTP/1.1" 200 0 "-" "curl"`) {
+		t.Errorf("invalid line %v", line)
+	}
+}
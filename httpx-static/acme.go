@@ -0,0 +1,652 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The directory of Let's Encrypt ACME v2.
+const LetsEncryptDirectory = "https://acme-v02.api.letsencrypt.org/directory"
+
+// The ACME problem document, see https://datatracker.ietf.org/doc/html/rfc8555#section-6.7
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (v *acmeProblem) Error() string {
+	return fmt.Sprintf("acme %v %v, %v", v.Status, v.Type, v.Detail)
+}
+
+// The ACME directory, see https://datatracker.ietf.org/doc/html/rfc8555#section-7.1.1
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+	Meta       struct {
+		TermsOfService          string `json:"termsOfService"`
+		ExternalAccountRequired bool   `json:"externalAccountRequired"`
+	} `json:"meta"`
+}
+
+type acmeIdentifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type acmeOrder struct {
+	// The url of order, from the Location header.
+	URL string `json:"-"`
+
+	Status         string           `json:"status"`
+	Identifiers    []acmeIdentifier `json:"identifiers"`
+	Authorizations []string         `json:"authorizations"`
+	Finalize       string           `json:"finalize"`
+	Certificate    string           `json:"certificate"`
+	Error          *acmeProblem     `json:"error"`
+}
+
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error"`
+}
+
+type acmeAuthorization struct {
+	Status     string          `json:"status"`
+	Identifier acmeIdentifier  `json:"identifier"`
+	Wildcard   bool            `json:"wildcard"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+// The client of ACME v2, see https://datatracker.ietf.org/doc/html/rfc8555
+type acmeClient struct {
+	// The directory url, for example, LetsEncryptDirectory.
+	DirectoryURL string
+	// The account key, ECDSA P-256 or RSA.
+	Key crypto.Signer
+	// The external account binding, the key id and base64url HMAC key, optional.
+	EABKeyID string
+	EABHMAC  string
+	// The http client, for example, trust the CA of Pebble.
+	HTTPClient *http.Client
+
+	lock   sync.Mutex
+	dir    *acmeDirectory
+	nonces []string
+	// The account url, as kid of JWS.
+	account string
+}
+
+// Get the directory, cached after fetched.
+func (v *acmeClient) Directory(ctx context.Context) (*acmeDirectory, error) {
+	v.lock.Lock()
+	dir := v.dir
+	v.lock.Unlock()
+	if dir != nil {
+		return dir, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, v.DirectoryURL, nil)
+	if err != nil {
+		return nil, oe.Wrapf(err, "create request %v", v.DirectoryURL)
+	}
+
+	res, err := v.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, oe.Wrapf(err, "get directory %v", v.DirectoryURL)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, acmeResponseError(res)
+	}
+
+	dir = &acmeDirectory{}
+	if err := json.NewDecoder(res.Body).Decode(dir); err != nil {
+		return nil, oe.Wrapf(err, "decode directory %v", v.DirectoryURL)
+	}
+
+	v.lock.Lock()
+	v.dir = dir
+	v.lock.Unlock()
+	return dir, nil
+}
+
+// Register the account, or get the existing account of key, with the optional contact
+// email. The terms of service is agreed.
+func (v *acmeClient) Register(ctx context.Context, email string) error {
+	dir, err := v.Directory(ctx)
+	if err != nil {
+		return oe.Wrapf(err, "directory")
+	}
+
+	payload := map[string]interface{}{
+		"termsOfServiceAgreed": true,
+	}
+	if email != "" {
+		payload["contact"] = []string{"mailto:" + email}
+	}
+
+	if v.EABKeyID != "" {
+		eab, err := v.externalAccountBinding(dir.NewAccount)
+		if err != nil {
+			return oe.Wrapf(err, "eab")
+		}
+		payload["externalAccountBinding"] = eab
+	} else if dir.Meta.ExternalAccountRequired {
+		return oe.Errorf("external account binding required by %v", v.DirectoryURL)
+	}
+
+	res, err := v.post(ctx, dir.NewAccount, payload, true)
+	if err != nil {
+		return oe.Wrapf(err, "new account")
+	}
+	res.Body.Close()
+
+	location := res.Header.Get("Location")
+	if location == "" {
+		return oe.New("no account location")
+	}
+
+	v.lock.Lock()
+	v.account = location
+	v.lock.Unlock()
+	return nil
+}
+
+// Create an order for the DNS names.
+func (v *acmeClient) NewOrder(ctx context.Context, names []string) (*acmeOrder, error) {
+	dir, err := v.Directory(ctx)
+	if err != nil {
+		return nil, oe.Wrapf(err, "directory")
+	}
+
+	var ids []acmeIdentifier
+	for _, name := range names {
+		ids = append(ids, acmeIdentifier{Type: "dns", Value: name})
+	}
+
+	res, err := v.post(ctx, dir.NewOrder, map[string]interface{}{"identifiers": ids}, false)
+	if err != nil {
+		return nil, oe.Wrapf(err, "new order %v", names)
+	}
+	defer res.Body.Close()
+
+	order := &acmeOrder{URL: res.Header.Get("Location")}
+	if err := json.NewDecoder(res.Body).Decode(order); err != nil {
+		return nil, oe.Wrapf(err, "decode order")
+	}
+	return order, nil
+}
+
+// Get the order by POST-as-GET.
+func (v *acmeClient) GetOrder(ctx context.Context, url string) (*acmeOrder, error) {
+	order := &acmeOrder{URL: url}
+	if err := v.getJSON(ctx, url, order); err != nil {
+		return nil, oe.Wrapf(err, "get order")
+	}
+	return order, nil
+}
+
+// Get the authorization by POST-as-GET.
+func (v *acmeClient) GetAuthorization(ctx context.Context, url string) (*acmeAuthorization, error) {
+	authz := &acmeAuthorization{}
+	if err := v.getJSON(ctx, url, authz); err != nil {
+		return nil, oe.Wrapf(err, "get authorization")
+	}
+	return authz, nil
+}
+
+// Tell the server the challenge is ready to validate.
+func (v *acmeClient) Accept(ctx context.Context, chal *acmeChallenge) error {
+	res, err := v.post(ctx, chal.URL, struct{}{}, false)
+	if err != nil {
+		return oe.Wrapf(err, "accept challenge %v", chal.Type)
+	}
+	res.Body.Close()
+	return nil
+}
+
+// Wait for the authorization to be valid, or fail if invalid.
+func (v *acmeClient) WaitAuthorization(ctx context.Context, url string) error {
+	for {
+		authz, err := v.GetAuthorization(ctx, url)
+		if err != nil {
+			return err
+		}
+
+		switch authz.Status {
+		case "valid":
+			return nil
+		case "pending", "processing":
+		default:
+			for _, chal := range authz.Challenges {
+				if chal.Error != nil {
+					return oe.Wrapf(chal.Error, "authorization %v %v", authz.Identifier.Value, authz.Status)
+				}
+			}
+			return oe.Errorf("authorization %v %v", authz.Identifier.Value, authz.Status)
+		}
+
+		if err := acmeSleep(ctx, time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+// Finalize the order with the CSR, wait for the cert and download the chain in PEM.
+func (v *acmeClient) Finalize(ctx context.Context, order *acmeOrder, csr []byte) ([]byte, error) {
+	res, err := v.post(ctx, order.Finalize, map[string]string{"csr": acmeEncode(csr)}, false)
+	if err != nil {
+		return nil, oe.Wrapf(err, "finalize")
+	}
+	res.Body.Close()
+
+	for {
+		if order, err = v.GetOrder(ctx, order.URL); err != nil {
+			return nil, err
+		}
+
+		if order.Status == "valid" {
+			break
+		}
+		if order.Status != "pending" && order.Status != "ready" && order.Status != "processing" {
+			if order.Error != nil {
+				return nil, oe.Wrapf(order.Error, "order %v", order.Status)
+			}
+			return nil, oe.Errorf("order %v", order.Status)
+		}
+
+		if err := acmeSleep(ctx, time.Second); err != nil {
+			return nil, err
+		}
+	}
+
+	if res, err = v.post(ctx, order.Certificate, nil, false); err != nil {
+		return nil, oe.Wrapf(err, "download cert")
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, oe.Wrapf(err, "read cert")
+	}
+	return b, nil
+}
+
+// The thumbprint of account key, see https://datatracker.ietf.org/doc/html/rfc7638
+func (v *acmeClient) Thumbprint() (string, error) {
+	jwk, err := acmeJWK(v.Key.Public())
+	if err != nil {
+		return "", err
+	}
+
+	// The members are in lexicographic order, without whitespace.
+	var b []byte
+	if jwk["kty"] == "EC" {
+		b = []byte(fmt.Sprintf(`{"crv":"%v","kty":"EC","x":"%v","y":"%v"}`, jwk["crv"], jwk["x"], jwk["y"]))
+	} else {
+		b = []byte(fmt.Sprintf(`{"e":"%v","kty":"RSA","n":"%v"}`, jwk["e"], jwk["n"]))
+	}
+
+	sum := sha256.Sum256(b)
+	return acmeEncode(sum[:]), nil
+}
+
+// The key authorization of token, see https://datatracker.ietf.org/doc/html/rfc8555#section-8.1
+func (v *acmeClient) KeyAuthorization(token string) (string, error) {
+	thumbprint, err := v.Thumbprint()
+	if err != nil {
+		return "", err
+	}
+	return token + "." + thumbprint, nil
+}
+
+// The external account binding, the account key signed by HMAC, see
+// https://datatracker.ietf.org/doc/html/rfc8555#section-7.3.4
+func (v *acmeClient) externalAccountBinding(url string) (interface{}, error) {
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(v.EABHMAC, "="))
+	if err != nil {
+		return nil, oe.Wrapf(err, "decode hmac")
+	}
+
+	jwk, err := acmeJWK(v.Key.Public())
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(jwk)
+	if err != nil {
+		return nil, oe.Wrapf(err, "marshal jwk")
+	}
+	protected, err := json.Marshal(map[string]string{"alg": "HS256", "kid": v.EABKeyID, "url": url})
+	if err != nil {
+		return nil, oe.Wrapf(err, "marshal protected")
+	}
+
+	input := acmeEncode(protected) + "." + acmeEncode(payload)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(input))
+
+	return map[string]string{
+		"protected": acmeEncode(protected),
+		"payload":   acmeEncode(payload),
+		"signature": acmeEncode(mac.Sum(nil)),
+	}, nil
+}
+
+// POST-as-GET the url, decode the response in JSON.
+func (v *acmeClient) getJSON(ctx context.Context, url string, o interface{}) error {
+	res, err := v.post(ctx, url, nil, false)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if err := json.NewDecoder(res.Body).Decode(o); err != nil {
+		return oe.Wrapf(err, "decode %v", url)
+	}
+	return nil
+}
+
+// POST the payload in JWS, signed with jwk or kid of account. The nil payload is for
+// POST-as-GET. Retry once for the bad nonce.
+func (v *acmeClient) post(ctx context.Context, url string, payload interface{}, useJWK bool) (*http.Response, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return nil, oe.Wrapf(err, "marshal payload")
+		}
+	}
+
+	for i := 0; ; i++ {
+		res, err := v.postOnce(ctx, url, body, useJWK)
+		if err != nil {
+			return nil, err
+		}
+
+		if res.StatusCode < 400 {
+			return res, nil
+		}
+
+		err = acmeResponseError(res)
+		res.Body.Close()
+		if p, ok := err.(*acmeProblem); ok && p.Type == "urn:ietf:params:acme:error:badNonce" && i == 0 {
+			continue
+		}
+		return nil, err
+	}
+}
+
+func (v *acmeClient) postOnce(ctx context.Context, url string, payload []byte, useJWK bool) (*http.Response, error) {
+	nonce, err := v.nonce(ctx)
+	if err != nil {
+		return nil, oe.Wrapf(err, "nonce")
+	}
+
+	alg, err := acmeAlg(v.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	protected := map[string]interface{}{"alg": alg, "nonce": nonce, "url": url}
+	if useJWK {
+		if protected["jwk"], err = acmeJWK(v.Key.Public()); err != nil {
+			return nil, err
+		}
+	} else {
+		v.lock.Lock()
+		protected["kid"] = v.account
+		v.lock.Unlock()
+		if protected["kid"] == "" {
+			return nil, oe.New("no account")
+		}
+	}
+
+	b, err := json.Marshal(protected)
+	if err != nil {
+		return nil, oe.Wrapf(err, "marshal protected")
+	}
+
+	input := acmeEncode(b) + "." + acmeEncode(payload)
+	signature, err := acmeSign(v.Key, []byte(input))
+	if err != nil {
+		return nil, oe.Wrapf(err, "sign")
+	}
+
+	jws, err := json.Marshal(map[string]string{
+		"protected": acmeEncode(b),
+		"payload":   acmeEncode(payload),
+		"signature": acmeEncode(signature),
+	})
+	if err != nil {
+		return nil, oe.Wrapf(err, "marshal jws")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(jws))
+	if err != nil {
+		return nil, oe.Wrapf(err, "create request %v", url)
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+
+	res, err := v.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, oe.Wrapf(err, "post %v", url)
+	}
+	v.saveNonce(res)
+	return res, nil
+}
+
+// Get a nonce from the pool, or from the new nonce url.
+func (v *acmeClient) nonce(ctx context.Context) (string, error) {
+	v.lock.Lock()
+	if n := len(v.nonces); n > 0 {
+		nonce := v.nonces[n-1]
+		v.nonces = v.nonces[:n-1]
+		v.lock.Unlock()
+		return nonce, nil
+	}
+	v.lock.Unlock()
+
+	dir, err := v.Directory(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodHead, dir.NewNonce, nil)
+	if err != nil {
+		return "", oe.Wrapf(err, "create request %v", dir.NewNonce)
+	}
+
+	res, err := v.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", oe.Wrapf(err, "head %v", dir.NewNonce)
+	}
+	res.Body.Close()
+
+	nonce := res.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", oe.Errorf("no nonce from %v, status %v", dir.NewNonce, res.StatusCode)
+	}
+	return nonce, nil
+}
+
+func (v *acmeClient) saveNonce(res *http.Response) {
+	if nonce := res.Header.Get("Replay-Nonce"); nonce != "" {
+		v.lock.Lock()
+		v.nonces = append(v.nonces, nonce)
+		v.lock.Unlock()
+	}
+}
+
+// Parse the problem document of response, or an error with the status.
+func acmeResponseError(res *http.Response) error {
+	b, _ := ioutil.ReadAll(res.Body)
+
+	p := &acmeProblem{}
+	if err := json.Unmarshal(b, p); err != nil || p.Type == "" {
+		return oe.Errorf("acme status %v, %v", res.StatusCode, string(b))
+	}
+	if p.Status == 0 {
+		p.Status = res.StatusCode
+	}
+	return p
+}
+
+func acmeSleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+func acmeEncode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func acmeAlg(key crypto.Signer) (string, error) {
+	switch pub := key.Public().(type) {
+	case *ecdsa.PublicKey:
+		if pub.Curve == elliptic.P256() {
+			return "ES256", nil
+		}
+		return "", oe.Errorf("unsupported curve %v", pub.Curve.Params().Name)
+	case *rsa.PublicKey:
+		return "RS256", nil
+	}
+	return "", oe.Errorf("unsupported key %T", key)
+}
+
+// The JWK of public key, see https://datatracker.ietf.org/doc/html/rfc7517
+func acmeJWK(pub crypto.PublicKey) (map[string]string, error) {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		return map[string]string{
+			"kty": "EC", "crv": pub.Curve.Params().Name,
+			"x": acmeEncode(acmePad(pub.X, size)), "y": acmeEncode(acmePad(pub.Y, size)),
+		}, nil
+	case *rsa.PublicKey:
+		return map[string]string{
+			"kty": "RSA", "e": acmeEncode(big.NewInt(int64(pub.E)).Bytes()), "n": acmeEncode(pub.N.Bytes()),
+		}, nil
+	}
+	return nil, oe.Errorf("unsupported key %T", pub)
+}
+
+// Sign the input by SHA256, the ECDSA signature is r and s in fixed size, see
+// https://datatracker.ietf.org/doc/html/rfc7518#section-3.4
+func acmeSign(key crypto.Signer, input []byte) ([]byte, error) {
+	sum := sha256.Sum256(input)
+
+	if k, ok := key.(*ecdsa.PrivateKey); ok {
+		r, s, err := ecdsa.Sign(rand.Reader, k, sum[:])
+		if err != nil {
+			return nil, err
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		return append(acmePad(r, size), acmePad(s, size)...), nil
+	}
+
+	return key.Sign(rand.Reader, sum[:], crypto.SHA256)
+}
+
+func acmePad(n *big.Int, size int) []byte {
+	b := n.Bytes()
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// Load the ECDSA or RSA key in PEM, in PKCS8, SEC1 or PKCS1.
+func acmeLoadKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, oe.New("no pem")
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+		return nil, oe.Errorf("unsupported key %T", key)
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, oe.Errorf("unsupported key %v", block.Type)
+}
+
+func acmeMarshalKey(key crypto.Signer) ([]byte, error) {
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, oe.Wrapf(err, "marshal key")
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}), nil
+}
+
+// Parse the cert chain and key in PEM, with the leaf.
+func acmeParseCert(chain, key []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(chain, key)
+	if err != nil {
+		return nil, oe.Wrapf(err, "parse key pair")
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, oe.Wrapf(err, "parse leaf")
+	}
+	return &cert, nil
+}
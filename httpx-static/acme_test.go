@@ -0,0 +1,640 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The stand-in ACME CA for test, which verifies the JWS, validates the challenges from
+// the manager by HTTP-01 or TLS-ALPN-01, and signs the CSR.
+type fakeACME struct {
+	t      *testing.T
+	server *httptest.Server
+	// The address of HTTP, TLS and DNS server to validate challenges.
+	httpAddr, tlsAddr, dnsAddr string
+	// The external account binding required.
+	eabKeyID string
+	eabKey   []byte
+
+	caKey  *ecdsa.PrivateKey
+	caCert *x509.Certificate
+
+	lock     sync.Mutex
+	nonces   map[string]bool
+	accounts map[string]map[string]string
+	orders   map[string]*fakeOrder
+	nextID   int
+}
+
+type fakeOrder struct {
+	id                         int
+	name, token, kid, chalType string
+	status                     string
+	cert                       []byte
+}
+
+func newFakeACME(t *testing.T) *fakeACME {
+	v := &fakeACME{
+		t: t, nonces: make(map[string]bool), accounts: make(map[string]map[string]string),
+		orders: make(map[string]*fakeOrder),
+	}
+
+	v.caKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "fake acme ca"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(24 * time.Hour),
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, v.caKey.Public(), v.caKey)
+	v.caCert, _ = x509.ParseCertificate(der)
+
+	v.server = httptest.NewTLSServer(http.HandlerFunc(v.serve))
+	t.Cleanup(v.server.Close)
+	return v
+}
+
+// The last order of domain.
+func (v *fakeACME) Order(name string) *fakeOrder {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var last *fakeOrder
+	for _, order := range v.orders {
+		if order.name == name && (last == nil || order.id > last.id) {
+			last = order
+		}
+	}
+	return last
+}
+
+// The number of orders.
+func (v *fakeACME) Orders() int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return len(v.orders)
+}
+
+func (v *fakeACME) newNonce(w http.ResponseWriter) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.nextID++
+	nonce := fmt.Sprintf("nonce-%v", v.nextID)
+	v.nonces[nonce] = true
+	w.Header().Set("Replay-Nonce", nonce)
+}
+
+func (v *fakeACME) problem(w http.ResponseWriter, status int, typ, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type": "urn:ietf:params:acme:error:" + typ, "detail": detail, "status": status,
+	})
+}
+
+// Verify the JWS, return the payload, and the kid of account.
+func (v *fakeACME) verify(r *http.Request) (payload []byte, kid string, jwk map[string]string, err error) {
+	var jws struct{ Protected, Payload, Signature string }
+	if err = json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return
+	}
+
+	b, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	var protected struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  map[string]string
+	}
+	if err = json.Unmarshal(b, &protected); err != nil {
+		return
+	}
+
+	v.lock.Lock()
+	ok := v.nonces[protected.Nonce]
+	delete(v.nonces, protected.Nonce)
+	if protected.Kid != "" {
+		jwk = v.accounts[protected.Kid]
+	} else {
+		jwk = protected.JWK
+	}
+	v.lock.Unlock()
+
+	if !ok {
+		return nil, "", nil, fmt.Errorf("badNonce")
+	}
+	if protected.URL != v.server.URL+r.URL.Path {
+		return nil, "", nil, fmt.Errorf("url %v not match %v", protected.URL, r.URL.Path)
+	}
+	if protected.Alg != "ES256" || jwk == nil {
+		return nil, "", nil, fmt.Errorf("invalid alg %v or no jwk", protected.Alg)
+	}
+
+	x, _ := base64.RawURLEncoding.DecodeString(jwk["x"])
+	y, _ := base64.RawURLEncoding.DecodeString(jwk["y"])
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	sig, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	sum := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if len(sig) != 64 || !ecdsa.Verify(pub, sum[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return nil, "", nil, fmt.Errorf("invalid signature")
+	}
+
+	payload, _ = base64.RawURLEncoding.DecodeString(jws.Payload)
+	return payload, protected.Kid, jwk, nil
+}
+
+// The key authorization of token, by the thumbprint of account jwk.
+func (v *fakeACME) keyAuth(kid, token string) string {
+	v.lock.Lock()
+	jwk := v.accounts[kid]
+	v.lock.Unlock()
+
+	// The json of map is in sorted keys, without whitespace.
+	b, _ := json.Marshal(map[string]string{"crv": jwk["crv"], "kty": jwk["kty"], "x": jwk["x"], "y": jwk["y"]})
+	sum := sha256.Sum256(b)
+	return token + "." + base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (v *fakeACME) serve(w http.ResponseWriter, r *http.Request) {
+	base := v.server.URL
+	if r.URL.Path == "/dir" {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"newNonce": base + "/nonce", "newAccount": base + "/account", "newOrder": base + "/order",
+			"meta": map[string]interface{}{"externalAccountRequired": v.eabKeyID != ""},
+		})
+		return
+	}
+
+	v.newNonce(w)
+	if r.URL.Path == "/nonce" {
+		return
+	}
+
+	payload, kid, jwk, err := v.verify(r)
+	if err != nil {
+		v.problem(w, http.StatusBadRequest, "malformed", err.Error())
+		return
+	}
+
+	parts := strings.Split(r.URL.Path, "/")
+	id := parts[len(parts)-1]
+
+	switch {
+	case r.URL.Path == "/account":
+		var req struct {
+			TermsOfServiceAgreed   bool
+			ExternalAccountBinding struct{ Protected, Payload, Signature string }
+		}
+		json.Unmarshal(payload, &req)
+		if !req.TermsOfServiceAgreed {
+			v.problem(w, http.StatusForbidden, "unauthorized", "terms of service")
+			return
+		}
+
+		if v.eabKeyID != "" {
+			eab := req.ExternalAccountBinding
+			mac := hmac.New(sha256.New, v.eabKey)
+			mac.Write([]byte(eab.Protected + "." + eab.Payload))
+			protected, _ := base64.RawURLEncoding.DecodeString(eab.Protected)
+			if base64.RawURLEncoding.EncodeToString(mac.Sum(nil)) != eab.Signature ||
+				!strings.Contains(string(protected), v.eabKeyID) {
+				v.problem(w, http.StatusUnauthorized, "unauthorized", "invalid eab")
+				return
+			}
+		}
+
+		kid = base + "/acct/" + jwk["x"]
+		v.lock.Lock()
+		v.accounts[kid] = jwk
+		v.lock.Unlock()
+		w.Header().Set("Location", kid)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"status":"valid"}`))
+	case r.URL.Path == "/order":
+		var req struct{ Identifiers []acmeIdentifier }
+		json.Unmarshal(payload, &req)
+
+		v.lock.Lock()
+		v.nextID++
+		id = fmt.Sprint(v.nextID)
+		v.orders[id] = &fakeOrder{id: v.nextID, name: req.Identifiers[0].Value, token: "token-" + id, kid: kid, status: "pending"}
+		v.lock.Unlock()
+
+		w.Header().Set("Location", base+"/orders/"+id)
+		w.WriteHeader(http.StatusCreated)
+		v.writeOrder(w, id)
+	case strings.HasPrefix(r.URL.Path, "/orders/"):
+		v.writeOrder(w, id)
+	case strings.HasPrefix(r.URL.Path, "/authz/"):
+		v.lock.Lock()
+		order := v.orders[id]
+		v.lock.Unlock()
+
+		status := "pending"
+		if order.status != "pending" {
+			status = "valid"
+		}
+
+		// The wildcard is only validated by DNS-01.
+		var challenges []map[string]string
+		for _, typ := range []string{ChallengeHTTP01, ChallengeTLSALPN01, ChallengeDNS01} {
+			if typ == ChallengeDNS01 || !strings.HasPrefix(order.name, "*.") {
+				challenges = append(challenges, map[string]string{
+					"type": typ, "url": base + "/chal/" + typ + "/" + id, "token": order.token, "status": status,
+				})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": status, "identifier": acmeIdentifier{Type: "dns", Value: strings.TrimPrefix(order.name, "*.")},
+			"wildcard": strings.HasPrefix(order.name, "*."), "challenges": challenges,
+		})
+	case strings.HasPrefix(r.URL.Path, "/chal/"):
+		v.lock.Lock()
+		order := v.orders[id]
+		v.lock.Unlock()
+
+		if err := v.validate(order, parts[2]); err != nil {
+			v.problem(w, http.StatusForbidden, "unauthorized", err.Error())
+			return
+		}
+
+		v.lock.Lock()
+		order.status, order.chalType = "ready", parts[2]
+		v.lock.Unlock()
+		w.Write([]byte(`{"status":"valid"}`))
+	case strings.HasPrefix(r.URL.Path, "/finalize/"):
+		var req struct{ CSR string }
+		json.Unmarshal(payload, &req)
+		b, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(b)
+		if err != nil || csr.CheckSignature() != nil {
+			v.problem(w, http.StatusBadRequest, "badCSR", fmt.Sprint(err))
+			return
+		}
+
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()), Subject: csr.Subject, DNSNames: csr.DNSNames,
+			NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(90 * 24 * time.Hour),
+		}
+		der, _ := x509.CreateCertificate(rand.Reader, template, v.caCert, csr.PublicKey, v.caKey)
+
+		v.lock.Lock()
+		order := v.orders[id]
+		order.status = "valid"
+		order.cert = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: v.caCert.Raw})...)
+		v.lock.Unlock()
+		v.writeOrder(w, id)
+	case strings.HasPrefix(r.URL.Path, "/cert/"):
+		v.lock.Lock()
+		order := v.orders[id]
+		v.lock.Unlock()
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(order.cert)
+	default:
+		v.problem(w, http.StatusNotFound, "malformed", r.URL.Path)
+	}
+}
+
+func (v *fakeACME) writeOrder(w http.ResponseWriter, id string) {
+	v.lock.Lock()
+	order := v.orders[id]
+	o := map[string]interface{}{
+		"status": order.status, "identifiers": []acmeIdentifier{{Type: "dns", Value: order.name}},
+		"authorizations": []string{v.server.URL + "/authz/" + id}, "finalize": v.server.URL + "/finalize/" + id,
+	}
+	if order.status == "valid" {
+		o["certificate"] = v.server.URL + "/cert/" + id
+	}
+	v.lock.Unlock()
+	json.NewEncoder(w).Encode(o)
+}
+
+// Validate the challenge of order, by HTTP-01 or TLS-ALPN-01.
+func (v *fakeACME) validate(order *fakeOrder, typ string) error {
+	keyAuth := v.keyAuth(order.kid, order.token)
+
+	if typ == ChallengeHTTP01 {
+		res, err := http.Get(fmt.Sprintf("http://%v%v%v", v.httpAddr, acmeHTTP01Prefix, order.token))
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if b, _ := ioutil.ReadAll(res.Body); string(b) != keyAuth {
+			return fmt.Errorf("http-01 expect %v, got %v", keyAuth, string(b))
+		}
+		return nil
+	}
+
+	if typ == ChallengeDNS01 {
+		sum := sha256.Sum256([]byte(keyAuth))
+		fqdn := "_acme-challenge." + strings.TrimPrefix(order.name, "*.")
+		values, err := dnsLookupTXT(context.Background(), v.dnsAddr, fqdn)
+		if err != nil {
+			return err
+		}
+		if !stringsContains(values, base64.RawURLEncoding.EncodeToString(sum[:])) {
+			return fmt.Errorf("dns-01 no value of %v in %v", fqdn, values)
+		}
+		return nil
+	}
+
+	conn, err := tls.Dial("tcp", v.tlsAddr, &tls.Config{
+		ServerName: order.name, NextProtos: []string{acmeALPNProto}, InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != acmeALPNProto {
+		return fmt.Errorf("alpn %v", state.NegotiatedProtocol)
+	}
+
+	sum := sha256.Sum256([]byte(keyAuth))
+	expect, _ := asn1.Marshal(sum[:])
+	for _, ext := range state.PeerCertificates[0].Extensions {
+		if ext.Id.Equal(idPeACMEIdentifier) && ext.Critical && bytes.Equal(ext.Value, expect) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no acmeIdentifier for %v", order.name)
+}
+
+func TestACMEManager(t *testing.T) {
+	ca := newFakeACME(t)
+	ca.eabKeyID, ca.eabKey = "kid-1", []byte("eab hmac key")
+
+	dir := t.TempDir()
+	caFile := path.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.server.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &Config{
+		Cache: path.Join(dir, "cache"), Domains: "ossrs.net,www.ossrs.net",
+		ACMEDirectory: ca.server.URL + "/dir", ACMEChallenges: "http-01,tls-alpn-01", ACMECA: caFile,
+		ACMEEABKeyID: ca.eabKeyID, ACMEEABHMAC: base64.RawURLEncoding.EncodeToString(ca.eabKey),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, err := NewACMEManager(ctx, conf)
+	if err != nil {
+		t.Fatalf("create err %+v", err)
+	}
+	m.Start(ctx)
+	defer m.Close()
+
+	// The HTTP-01 is served by the HTTP server, falls back to routes if not token.
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.ServeHTTP01(w, r) {
+			http.NotFound(w, r)
+		}
+	}))
+	defer hs.Close()
+	ca.httpAddr = hs.Listener.Addr().String()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		GetCertificate: m.GetCertificate, NextProtos: []string{"http/1.1", acmeALPNProto},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+	ca.tlsAddr = ln.Addr().String()
+
+	expect := func(m *acmeManager, sni, name string) {
+		t.Helper()
+		cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: sni})
+		if err != nil {
+			t.Fatalf("get %v err %+v", sni, err)
+		}
+		if cert.Leaf == nil || len(cert.Leaf.DNSNames) != 1 || cert.Leaf.DNSNames[0] != name {
+			t.Fatalf("expect %v, got %v", name, cert.Leaf)
+		}
+		if err := cert.Leaf.CheckSignatureFrom(ca.caCert); err != nil {
+			t.Errorf("verify %v err %v", name, err)
+		}
+	}
+
+	expect(m, "ossrs.net", "ossrs.net")
+	if order := ca.Order("ossrs.net"); order == nil || order.chalType != ChallengeHTTP01 {
+		t.Errorf("expect http-01, got %v", order)
+	}
+
+	m.Challenges = []string{ChallengeTLSALPN01}
+	expect(m, "WWW.ossrs.net.", "www.ossrs.net")
+	if order := ca.Order("www.ossrs.net"); order == nil || order.chalType != ChallengeTLSALPN01 {
+		t.Errorf("expect tls-alpn-01, got %v", order)
+	}
+	if ca.Orders() != 2 {
+		t.Errorf("expect 2 orders, got %v", ca.Orders())
+	}
+
+	if _, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.net"}); err == nil {
+		t.Errorf("should not allow other.net")
+	}
+	if _, err := os.Stat(path.Join(conf.Cache, "ossrs.net.crt")); err != nil {
+		t.Errorf("no cert file, err %v", err)
+	}
+
+	// Load the certs and account key from cache dir, without issuing.
+	m2, err := NewACMEManager(ctx, conf)
+	if err != nil {
+		t.Fatalf("create err %+v", err)
+	}
+	expect(m2, "ossrs.net", "ossrs.net")
+	if ca.Orders() != 2 {
+		t.Errorf("expect 2 orders, got %v", ca.Orders())
+	}
+
+	// Renew the certs expire in RenewBefore.
+	m.RenewBefore = 365 * 24 * time.Hour
+	m.renew(ctx)
+	if ca.Orders() != 4 {
+		t.Errorf("expect 4 orders, got %v", ca.Orders())
+	}
+}
+
+func TestACMEWithoutEAB(t *testing.T) {
+	ca := newFakeACME(t)
+	ca.eabKeyID, ca.eabKey = "kid-1", []byte("eab hmac key")
+
+	dir := t.TempDir()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c := &acmeClient{DirectoryURL: ca.server.URL + "/dir", Key: key, HTTPClient: ca.server.Client()}
+	if err := c.Register(context.Background(), ""); err == nil {
+		t.Errorf("should fail without eab")
+	}
+
+	c.EABKeyID, c.EABHMAC = "kid-1", base64.RawURLEncoding.EncodeToString([]byte("invalid"))
+	if err := c.Register(context.Background(), ""); err == nil {
+		t.Errorf("should fail for invalid eab")
+	}
+
+	// Generate the account key, and load it again.
+	m := &acmeManager{Dir: dir}
+	k1, err := m.accountKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k2, err := m.accountKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !k1.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(k2.Public()) {
+		t.Errorf("account key changed")
+	}
+}
+
+// Test against Pebble, see https://github.com/letsencrypt/pebble, for example:
+//
+//	pebble -config test/config/pebble-config.json -dnsserver 127.0.0.1:8053
+//	pebble-challtestsrv -defaultIPv4 127.0.0.1
+//	HTTPX_PEBBLE_DIRECTORY=https://127.0.0.1:14000/dir HTTPX_PEBBLE_CA=test/certs/pebble.minica.pem \
+//		go test -run TestACMEPebble
+//
+// The Pebble validates the HTTP-01 at port 5002, and TLS-ALPN-01 at port 5001.
+func TestACMELegacyCache(t *testing.T) {
+	// The cache of ACME v1 is a file.
+	dir := t.TempDir()
+	cache := path.Join(dir, "letsencrypt.cache")
+	if err := os.WriteFile(cache, []byte(`{"registration":{}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &Config{Cache: cache, ACMEDirectory: "https://127.0.0.1/dir", ACMEChallenges: "http-01"}
+	if _, err := NewACMEManager(context.Background(), conf); err != nil {
+		t.Fatalf("create err %+v", err)
+	}
+
+	if info, err := os.Stat(cache); err != nil || !info.IsDir() {
+		t.Errorf("cache should be dir, err %v", err)
+	}
+	if b, err := os.ReadFile(cache + ".v1"); err != nil || string(b) != `{"registration":{}}` {
+		t.Errorf("legacy cache should be kept, err %v", err)
+	}
+	if _, err := os.Stat(path.Join(cache, "account.key")); err != nil {
+		t.Errorf("account key err %v", err)
+	}
+}
+
+func TestACMEPebble(t *testing.T) {
+	directory := os.Getenv("HTTPX_PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("no HTTPX_PEBBLE_DIRECTORY")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, challenge := range []string{ChallengeHTTP01, ChallengeTLSALPN01} {
+		conf := &Config{
+			Cache: t.TempDir(), ACMEDirectory: directory, ACMEChallenges: challenge,
+			ACMECA: os.Getenv("HTTPX_PEBBLE_CA"), ACMEEmail: "httpx@example.com",
+			ACMEEABKeyID: os.Getenv("HTTPX_PEBBLE_EAB_KID"), ACMEEABHMAC: os.Getenv("HTTPX_PEBBLE_EAB_HMAC"),
+		}
+		m, err := NewACMEManager(ctx, conf)
+		if err != nil {
+			t.Fatalf("create err %+v", err)
+		}
+		m.Start(ctx)
+		defer m.Close()
+
+		hs := &http.Server{Addr: ":5002", Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !m.ServeHTTP01(w, r) {
+				http.NotFound(w, r)
+			}
+		})}
+		go hs.ListenAndServe()
+		defer hs.Close()
+
+		ln, err := tls.Listen("tcp", ":5001", &tls.Config{GetCertificate: m.GetCertificate, NextProtos: []string{acmeALPNProto}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func(conn net.Conn) {
+					defer conn.Close()
+					conn.(*tls.Conn).Handshake()
+				}(conn)
+			}
+		}()
+
+		name := fmt.Sprintf("%v.httpx.test", strings.Replace(challenge, "-", "", -1))
+		cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		ln.Close()
+		if err != nil {
+			t.Fatalf("%v err %+v", challenge, err)
+		}
+		if cert.Leaf.DNSNames[0] != name {
+			t.Errorf("expect %v, got %v", name, cert.Leaf.DNSNames)
+		}
+	}
+}
@@ -0,0 +1,590 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The ACME challenge types.
+const (
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+	ChallengeDNS01     = "dns-01"
+)
+
+// The ALPN protocol of TLS-ALPN-01, see https://datatracker.ietf.org/doc/html/rfc8737
+const acmeALPNProto = "acme-tls/1"
+
+// The id-pe-acmeIdentifier extension of TLS-ALPN-01 cert.
+var idPeACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// The path prefix of HTTP-01, see https://datatracker.ietf.org/doc/html/rfc8555#section-8.3
+const acmeHTTP01Prefix = "/.well-known/acme-challenge/"
+
+// The https manager by ACME v2, which issues the cert for the allowed domains when the
+// first client comes, and renews before the cert expires. The account key and certs are
+// cached in the dir, so the certs are reused after restart. The wildcard domain like
+// *.ossrs.net is issued by DNS-01, and shared by all its subdomains.
+type acmeManager struct {
+	// The cache dir for account key and certs.
+	Dir string
+	// The contact email of account, optional.
+	Email string
+	// The allowed domains, empty to allow all.
+	Domains []string
+	// The challenges in preferred order, http-01, tls-alpn-01 or dns-01.
+	Challenges []string
+	// The solver of DNS-01, nil if no DNS provider.
+	DNS *dns01Solver
+	// Renew the cert when it expires in this duration.
+	RenewBefore time.Duration
+	// The timeout to issue a cert, the client waits for it in handshake.
+	IssueTimeout time.Duration
+
+	client *acmeClient
+	flight flightGroup
+
+	lock sync.Mutex
+	// Whether the account is registered.
+	registered bool
+	// The issued certs, key is the domain.
+	certs map[string]*tls.Certificate
+	// The last failure of domain, to avoid issuing again and again.
+	failed map[string]time.Time
+	// The key authorization of HTTP-01, key is the token.
+	tokens map[string]string
+	// The cert of TLS-ALPN-01, key is the domain.
+	alpnCerts map[string]*tls.Certificate
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Create the ACME manager, load or generate the account key in dir.
+func NewACMEManager(ctx context.Context, conf *Config) (*acmeManager, error) {
+	v := &acmeManager{
+		Dir: conf.Cache, Email: conf.ACMEEmail, RenewBefore: 30 * 24 * time.Hour, IssueTimeout: 3 * time.Minute,
+		certs: make(map[string]*tls.Certificate), failed: make(map[string]time.Time),
+		tokens: make(map[string]string), alpnCerts: make(map[string]*tls.Certificate),
+		ctx: ctx, cancel: func() {},
+	}
+
+	if conf.Domains != "" {
+		for _, domain := range strings.Split(conf.Domains, ",") {
+			v.Domains = append(v.Domains, strings.ToLower(strings.TrimSpace(domain)))
+		}
+	}
+	if conf.ACMEDNS != "" {
+		provider, err := NewDNSProvider(conf.ACMEDNS)
+		if err != nil {
+			return nil, oe.Wrapf(err, "create dns provider")
+		}
+
+		v.DNS = &dns01Solver{Provider: provider, Timeout: 2 * time.Minute, Interval: 2 * time.Second}
+		if conf.ACMEDNSResolvers != "" {
+			for _, resolver := range strings.Split(conf.ACMEDNSResolvers, ",") {
+				if resolver = strings.TrimSpace(resolver); !strings.Contains(resolver, ":") {
+					resolver += ":53"
+				}
+				v.DNS.Resolvers = append(v.DNS.Resolvers, resolver)
+			}
+		}
+		if conf.ACMEDNSTimeout != "" {
+			if v.DNS.Timeout, err = time.ParseDuration(conf.ACMEDNSTimeout); err != nil || v.DNS.Timeout <= 0 {
+				return nil, oe.Errorf("invalid acme-dns-timeout %v, err %v", conf.ACMEDNSTimeout, err)
+			}
+		}
+		v.IssueTimeout += v.DNS.Timeout
+	}
+
+	for _, challenge := range strings.Split(conf.ACMEChallenges, ",") {
+		switch challenge = strings.TrimSpace(challenge); challenge {
+		case ChallengeHTTP01, ChallengeTLSALPN01:
+		case ChallengeDNS01:
+			if v.DNS == nil {
+				return nil, oe.Errorf("no dns provider for %v", challenge)
+			}
+		default:
+			return nil, oe.Errorf("invalid challenge %v", challenge)
+		}
+		v.Challenges = append(v.Challenges, challenge)
+	}
+	// The DNS-01 is the only challenge for wildcard domains.
+	if v.DNS != nil && !stringsContains(v.Challenges, ChallengeDNS01) {
+		v.Challenges = append(v.Challenges, ChallengeDNS01)
+	}
+
+	// The cache of ACME v1 is a file at the same default path, move it aside for upgrade.
+	if info, err := os.Stat(v.Dir); err == nil && !info.IsDir() {
+		legacy := v.Dir + ".v1"
+		if err := os.Rename(v.Dir, legacy); err != nil {
+			return nil, oe.Wrapf(err, "move legacy cache %v to %v", v.Dir, legacy)
+		}
+		ol.Wf(ctx, "acme cache %v is a file of ACME v1, moved to %v, certs will be issued again", v.Dir, legacy)
+	}
+
+	if err := os.MkdirAll(v.Dir, 0700); err != nil {
+		return nil, oe.Wrapf(err, "create cache dir %v", v.Dir)
+	}
+
+	key, err := v.accountKey()
+	if err != nil {
+		return nil, oe.Wrapf(err, "account key")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if conf.ACMECA != "" {
+		b, err := ioutil.ReadFile(conf.ACMECA)
+		if err != nil {
+			return nil, oe.Wrapf(err, "read ca %v", conf.ACMECA)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, oe.Errorf("no cert in ca %v", conf.ACMECA)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	v.client = &acmeClient{
+		DirectoryURL: conf.ACMEDirectory, Key: key,
+		EABKeyID: conf.ACMEEABKeyID, EABHMAC: conf.ACMEEABHMAC,
+		HTTPClient: &http.Client{Transport: transport, Timeout: 30 * time.Second},
+	}
+
+	ol.Tf(ctx, "acme directory %v, domains %v, challenges %v, eab %v, cache %v",
+		conf.ACMEDirectory, conf.Domains, strings.Join(v.Challenges, ","), conf.ACMEEABKeyID, v.Dir)
+	return v, nil
+}
+
+// Load the account key from dir, or generate and save one.
+func (v *acmeManager) accountKey() (crypto.Signer, error) {
+	file := path.Join(v.Dir, "account.key")
+	if b, err := ioutil.ReadFile(file); err == nil {
+		return acmeLoadKey(b)
+	} else if !os.IsNotExist(err) {
+		return nil, oe.Wrapf(err, "read %v", file)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, oe.Wrapf(err, "generate key")
+	}
+
+	b, err := acmeMarshalKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(file, b, 0600); err != nil {
+		return nil, oe.Wrapf(err, "save %v", file)
+	}
+	return key, nil
+}
+
+// Start to renew the certs before expiry, until closed.
+func (v *acmeManager) Start(ctx context.Context) {
+	v.ctx, v.cancel = context.WithCancel(ctx)
+	ctx = v.ctx
+
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				v.renew(ctx)
+			}
+		}
+	}()
+}
+
+func (v *acmeManager) Close() {
+	v.cancel()
+}
+
+// Renew the certs which expire in RenewBefore, the old cert is served until renewed.
+func (v *acmeManager) renew(ctx context.Context) {
+	var names []string
+	v.lock.Lock()
+	for name, cert := range v.certs {
+		if time.Until(cert.Leaf.NotAfter) < v.RenewBefore {
+			names = append(names, name)
+		}
+	}
+	v.lock.Unlock()
+
+	for _, name := range names {
+		if _, err, _ := v.flight.Do(name, func() (interface{}, error) {
+			ctx, cancel := context.WithTimeout(ctx, v.IssueTimeout)
+			defer cancel()
+			return v.issue(ctx, name)
+		}); err != nil {
+			ol.Wf(ctx, "acme renew %v err %+v", name, err)
+		}
+	}
+}
+
+// Match the allowed domain of server name, the exact one or the wildcard, which is the
+// name of cert to issue. Return false if not allowed.
+func (v *acmeManager) match(name string) (string, bool) {
+	if name == "" || net.ParseIP(name) != nil || !strings.Contains(name, ".") {
+		return "", false
+	}
+	if len(v.Domains) == 0 || stringsContains(v.Domains, name) {
+		return name, true
+	}
+
+	if i := strings.Index(name, "."); i > 0 && stringsContains(v.Domains, "*"+name[i:]) {
+		return "*" + name[i:], true
+	}
+	return "", false
+}
+
+func (v *acmeManager) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.TrimSuffix(strings.ToLower(clientHello.ServerName), ".")
+
+	// The validation of TLS-ALPN-01 from CA.
+	if len(clientHello.SupportedProtos) == 1 && clientHello.SupportedProtos[0] == acmeALPNProto {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		if cert, ok := v.alpnCerts[name]; ok {
+			return cert, nil
+		}
+		return nil, fmt.Errorf("no %v cert for %v", ChallengeTLSALPN01, name)
+	}
+
+	name, ok := v.match(name)
+	if !ok {
+		return nil, fmt.Errorf("acme not allow %v", clientHello.ServerName)
+	}
+
+	v.lock.Lock()
+	cert, ok := v.certs[name]
+	v.lock.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	val, err, _ := v.flight.Do(name, func() (interface{}, error) {
+		return v.obtain(name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return val.(*tls.Certificate), nil
+}
+
+// Load the cert of domain from cache dir, or issue a new one.
+func (v *acmeManager) obtain(name string) (*tls.Certificate, error) {
+	ctx := ol.WithContext(v.ctx)
+
+	if cert, err := v.load(name); err == nil {
+		v.lock.Lock()
+		v.certs[name] = cert
+		v.lock.Unlock()
+		ol.Tf(ctx, "acme load %v ok, expire %v", name, cert.Leaf.NotAfter.Format(time.RFC3339))
+		return cert, nil
+	}
+
+	v.lock.Lock()
+	failed := v.failed[name]
+	v.lock.Unlock()
+	if time.Since(failed) < time.Minute {
+		return nil, fmt.Errorf("acme %v failed at %v, retry later", name, failed.Format(time.RFC3339))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, v.IssueTimeout)
+	defer cancel()
+
+	cert, err := v.issue(ctx, name)
+	if err != nil {
+		v.lock.Lock()
+		v.failed[name] = time.Now()
+		v.lock.Unlock()
+		ol.Wf(ctx, "acme issue %v err %+v", name, err)
+		return nil, err
+	}
+	return cert, nil
+}
+
+// The cert and key file of domain in cache dir.
+func (v *acmeManager) files(name string) (string, string) {
+	name = strings.Replace(name, "*", "_", -1)
+	return path.Join(v.Dir, name+".crt"), path.Join(v.Dir, name+".key")
+}
+
+// Load the cert from cache dir, which should not expire.
+func (v *acmeManager) load(name string) (*tls.Certificate, error) {
+	certFile, keyFile := v.files(name)
+
+	chain, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := acmeParseCert(chain, key)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return nil, oe.Errorf("cert %v expired at %v", certFile, cert.Leaf.NotAfter)
+	}
+	return cert, nil
+}
+
+// Issue the cert of domain by ACME, save to cache dir.
+func (v *acmeManager) issue(ctx context.Context, name string) (*tls.Certificate, error) {
+	v.lock.Lock()
+	registered := v.registered
+	v.lock.Unlock()
+
+	if !registered {
+		if err := v.client.Register(ctx, v.Email); err != nil {
+			return nil, oe.Wrapf(err, "register")
+		}
+
+		v.lock.Lock()
+		v.registered = true
+		v.lock.Unlock()
+	}
+
+	order, err := v.client.NewOrder(ctx, []string{name})
+	if err != nil {
+		return nil, oe.Wrapf(err, "new order")
+	}
+
+	for _, url := range order.Authorizations {
+		if err := v.authorize(ctx, url); err != nil {
+			return nil, oe.Wrapf(err, "authorize %v", name)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, oe.Wrapf(err, "generate key")
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: name}, DNSNames: []string{name},
+	}, key)
+	if err != nil {
+		return nil, oe.Wrapf(err, "create csr")
+	}
+
+	chain, err := v.client.Finalize(ctx, order, csr)
+	if err != nil {
+		return nil, oe.Wrapf(err, "finalize")
+	}
+
+	keyPEM, err := acmeMarshalKey(key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := acmeParseCert(chain, keyPEM)
+	if err != nil {
+		return nil, oe.Wrapf(err, "parse cert")
+	}
+
+	certFile, keyFile := v.files(name)
+	if err := writeFileAtomic(keyFile, keyPEM, 0600); err != nil {
+		return nil, oe.Wrapf(err, "save %v", keyFile)
+	}
+	if err := writeFileAtomic(certFile, chain, 0644); err != nil {
+		return nil, oe.Wrapf(err, "save %v", certFile)
+	}
+
+	v.lock.Lock()
+	v.certs[name] = cert
+	delete(v.failed, name)
+	v.lock.Unlock()
+
+	ol.Tf(ctx, "acme issue %v ok, expire %v, cert %v", name, cert.Leaf.NotAfter.Format(time.RFC3339), certFile)
+	return cert, nil
+}
+
+// Solve the authorization by the preferred challenge, wait for it to be valid.
+func (v *acmeManager) authorize(ctx context.Context, url string) error {
+	authz, err := v.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+
+	var chal *acmeChallenge
+	for _, challenge := range v.Challenges {
+		for i := range authz.Challenges {
+			if authz.Challenges[i].Type == challenge && chal == nil {
+				chal = &authz.Challenges[i]
+			}
+		}
+	}
+	if chal == nil {
+		return oe.Errorf("no challenge of %v", strings.Join(v.Challenges, ","))
+	}
+
+	keyAuth, err := v.client.KeyAuthorization(chal.Token)
+	if err != nil {
+		return oe.Wrapf(err, "key authorization")
+	}
+
+	cleanup, err := v.prepare(ctx, authz.Identifier.Value, chal, keyAuth)
+	if err != nil {
+		return oe.Wrapf(err, "prepare %v", chal.Type)
+	}
+	defer cleanup()
+
+	if err := v.client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	return v.client.WaitAuthorization(ctx, url)
+}
+
+// Prepare the response of challenge, return the cleanup function. The name is the domain
+// without *. for wildcard.
+func (v *acmeManager) prepare(ctx context.Context, name string, chal *acmeChallenge, keyAuth string) (func(), error) {
+	switch chal.Type {
+	case ChallengeDNS01:
+		return v.DNS.Present(ctx, name, keyAuth)
+	case ChallengeHTTP01:
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		v.tokens[chal.Token] = keyAuth
+		return func() {
+			v.lock.Lock()
+			defer v.lock.Unlock()
+			delete(v.tokens, chal.Token)
+		}, nil
+	case ChallengeTLSALPN01:
+		cert, err := acmeALPNCert(name, keyAuth)
+		if err != nil {
+			return nil, err
+		}
+
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		v.alpnCerts[name] = cert
+		return func() {
+			v.lock.Lock()
+			defer v.lock.Unlock()
+			delete(v.alpnCerts, name)
+		}, nil
+	}
+	return nil, oe.Errorf("unsupported challenge %v", chal.Type)
+}
+
+// Serve the HTTP-01 challenge, return false if not a pending token, for the routes to
+// serve it.
+func (v *acmeManager) ServeHTTP01(w http.ResponseWriter, r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, acmeHTTP01Prefix) {
+		return false
+	}
+
+	v.lock.Lock()
+	keyAuth, ok := v.tokens[strings.TrimPrefix(r.URL.Path, acmeHTTP01Prefix)]
+	v.lock.Unlock()
+	if !ok {
+		return false
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(keyAuth))
+	return true
+}
+
+// Create the self-signed cert of TLS-ALPN-01, with the digest of key authorization in
+// the critical acmeIdentifier extension.
+func acmeALPNCert(name, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, oe.Wrapf(err, "generate key")
+	}
+
+	sum := sha256.Sum256([]byte(keyAuth))
+	ext, err := asn1.Marshal(sum[:])
+	if err != nil {
+		return nil, oe.Wrapf(err, "marshal extension")
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		DNSNames:     []string{name},
+		ExtraExtensions: []pkix.Extension{
+			{Id: idPeACMEIdentifier, Critical: true, Value: ext},
+		},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, oe.Wrapf(err, "create cert")
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// Write the file by a temporary file and rename, so the reader never sees a partial file.
+func writeFileAtomic(file string, b []byte, perm os.FileMode) error {
+	tmp := fmt.Sprintf("%v.%v.tmp", file, os.Getpid())
+	if err := ioutil.WriteFile(tmp, b, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
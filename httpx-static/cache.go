@@ -0,0 +1,303 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The cached response, in memory or on disk.
+type cacheEntry struct {
+	Key    string
+	Status int
+	Header http.Header
+	// The time when cached, and expired, zero for never expire.
+	CachedAt time.Time
+	ExpireAt time.Time
+
+	// The body in memory, or the file on disk.
+	body []byte
+	file string
+	size int64
+
+	element *list.Element
+}
+
+// Whether the entry is fresh at now.
+func (v *cacheEntry) Fresh(now time.Time) bool {
+	return v.ExpireAt.IsZero() || now.Before(v.ExpireAt)
+}
+
+// Open the body to read.
+func (v *cacheEntry) Open() (io.ReadSeeker, io.Closer, error) {
+	if v.file == "" {
+		return bytes.NewReader(v.body), ioutil.NopCloser(nil), nil
+	}
+
+	f, err := os.Open(v.file)
+	if err != nil {
+		return nil, nil, oe.Wrapf(err, "open %v", v.file)
+	}
+	return f, f, nil
+}
+
+// Read the whole body.
+func (v *cacheEntry) Bytes() ([]byte, error) {
+	if v.file == "" {
+		return v.body, nil
+	}
+	return ioutil.ReadFile(v.file)
+}
+
+// The id of cache store on disk, to avoid conflict when reload.
+var cacheStoreID uint64
+
+// The LRU store of responses, which evicts the least recently used entries when the
+// bytes exceed the capacity. The bodies are stored in memory, or in a directory on disk.
+type CacheStore struct {
+	capacity int64
+	// The directory on disk, empty for memory.
+	dir string
+	// Called with the key when entry is removed, evicted or purged, in the lock of store.
+	OnRemove func(key string)
+
+	lock    sync.Mutex
+	size    int64
+	ll      *list.List
+	entries map[string]*cacheEntry
+}
+
+// Create the store in capacity bytes, in memory if dir is empty, or in a directory
+// under dir, which is removed when closed.
+func NewCacheStore(capacity int64, dir string) (*CacheStore, error) {
+	v := &CacheStore{capacity: capacity, ll: list.New(), entries: make(map[string]*cacheEntry)}
+
+	if dir != "" {
+		v.dir = path.Join(dir, fmt.Sprintf("httpx-cache-%v-%v", os.Getpid(), atomic.AddUint64(&cacheStoreID, 1)))
+		if err := os.MkdirAll(v.dir, 0755); err != nil {
+			return nil, oe.Wrapf(err, "create %v", v.dir)
+		}
+	}
+
+	return v, nil
+}
+
+func (v *CacheStore) String() string {
+	if v.dir != "" {
+		return fmt.Sprintf("%vB(dir=%v)", v.capacity, v.dir)
+	}
+	return fmt.Sprintf("%vB(memory)", v.capacity)
+}
+
+// The bytes and number of entries.
+func (v *CacheStore) Size() (int64, int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.size, len(v.entries)
+}
+
+// Get the entry by key, nil if not found. The expired entry is also returned, for the
+// caller to revalidate or serve stale.
+func (v *CacheStore) Get(key string) *cacheEntry {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if entry, ok := v.entries[key]; ok {
+		v.ll.MoveToFront(entry.element)
+		return entry
+	}
+	return nil
+}
+
+// Store the response, evict the least recently used entries if exceed the capacity.
+func (v *CacheStore) Set(key string, status int, header http.Header, body []byte, expireAt time.Time) (*cacheEntry, error) {
+	entry := &cacheEntry{
+		Key: key, Status: status, Header: header, CachedAt: time.Now(), ExpireAt: expireAt, size: int64(len(body)),
+	}
+	if entry.size > v.capacity {
+		return nil, oe.Errorf("size %v exceed capacity %v", entry.size, v.capacity)
+	}
+
+	if v.dir == "" {
+		entry.body = body
+	} else {
+		h := sha1.Sum([]byte(key))
+		entry.file = path.Join(v.dir, fmt.Sprintf("%v-%v", hex.EncodeToString(h[:]), time.Now().UnixNano()))
+		if err := ioutil.WriteFile(entry.file, body, 0644); err != nil {
+			return nil, oe.Wrapf(err, "write %v", entry.file)
+		}
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if old, ok := v.entries[key]; ok {
+		v.remove(old)
+	}
+	for v.size+entry.size > v.capacity && v.ll.Len() > 0 {
+		v.remove(v.ll.Back().Value.(*cacheEntry))
+	}
+
+	entry.element = v.ll.PushFront(entry)
+	v.entries[key] = entry
+	v.size += entry.size
+	return entry, nil
+}
+
+// Remove the entry, and the file on disk. The opened file is still readable.
+func (v *CacheStore) remove(entry *cacheEntry) {
+	v.ll.Remove(entry.element)
+	delete(v.entries, entry.Key)
+	v.size -= entry.size
+
+	if entry.file != "" {
+		os.Remove(entry.file)
+	}
+	if v.OnRemove != nil {
+		v.OnRemove(entry.Key)
+	}
+}
+
+// Delete the entries with key prefix, return the number of deleted.
+func (v *CacheStore) Purge(prefix string) (n int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for key, entry := range v.entries {
+		if strings.HasPrefix(key, prefix) {
+			v.remove(entry)
+			n++
+		}
+	}
+	return
+}
+
+// Remove all entries, and the directory on disk.
+func (v *CacheStore) Close() {
+	v.Purge("")
+	if v.dir != "" {
+		os.RemoveAll(v.dir)
+	}
+}
+
+// The response writer to buffer the response in memory, at most max bytes.
+type bufferWriter struct {
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	max      int64
+	overflow bool
+}
+
+func newBufferWriter(max int64) *bufferWriter {
+	return &bufferWriter{header: make(http.Header), max: max}
+}
+
+func (v *bufferWriter) Header() http.Header {
+	return v.header
+}
+
+func (v *bufferWriter) WriteHeader(status int) {
+	if v.status == 0 {
+		v.status = status
+	}
+}
+
+func (v *bufferWriter) Write(b []byte) (int, error) {
+	if v.status == 0 {
+		v.status = http.StatusOK
+	}
+	if int64(v.body.Len()+len(b)) > v.max {
+		v.overflow = true
+		return 0, oe.Errorf("exceed max %v", v.max)
+	}
+	return v.body.Write(b)
+}
+
+// Never flush, because it's buffered.
+func (v *bufferWriter) Flush() {
+}
+
+// The hop-by-hop headers which are not cached, see https://www.rfc-editor.org/rfc/rfc9111#section-3.1
+var cacheHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+	"Content-Length", "Set-Cookie",
+}
+
+// Serve the cached entry, which supports Range and conditional requests.
+func serveCacheEntry(w http.ResponseWriter, r *http.Request, entry *cacheEntry, xcache string) {
+	// Keep the Vary of this request, for example, Vary: Origin for CORS.
+	for k, values := range entry.Header {
+		if k == "Vary" {
+			w.Header()[k] = append(w.Header()[k], values...)
+		} else {
+			w.Header()[k] = values
+		}
+	}
+	for _, k := range cacheHopHeaders {
+		w.Header().Del(k)
+	}
+	w.Header().Set("X-Cache", xcache)
+	w.Header().Set("Age", fmt.Sprint(int64(time.Now().Sub(entry.CachedAt).Seconds())))
+
+	if entry.Status != http.StatusOK {
+		w.WriteHeader(entry.Status)
+		if r.Method != http.MethodHead {
+			if body, closer, err := entry.Open(); err == nil {
+				defer closer.Close()
+				io.Copy(w, body)
+			}
+		}
+		return
+	}
+
+	body, closer, err := entry.Open()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer closer.Close()
+
+	// Never sniff the content type.
+	if _, ok := w.Header()["Content-Type"]; !ok {
+		w.Header()["Content-Type"] = nil
+	}
+	modtime, _ := http.ParseTime(entry.Header.Get("Last-Modified"))
+	http.ServeContent(w, r, "", modtime, body)
+}
@@ -0,0 +1,164 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The shared response is too large to buffer.
+var errCollapseOverflow = oe.New("collapse overflow")
+
+// Collapse the identical GET or HEAD requests in flight into one upstream request, and
+// fan out the response, by collapse=true. The identity is the method and collapseKey,
+// for example, uri,header:Accept-Encoding
+type Collapser struct {
+	Path string
+	// The key of request, see parseRequestKey.
+	Key []string
+	// The max body to buffer and share, larger one is proxied for each request.
+	MaxBody int64
+	// The timeout of the shared request, which is not canceled by any client.
+	Timeout time.Duration
+
+	flight flightGroup
+}
+
+// Create the collapser if collapse=true, or nil.
+func NewCollapser(proxyUrl *url.URL) (*Collapser, error) {
+	q := proxyUrl.Query()
+	if q.Get("collapse") != "true" {
+		return nil, nil
+	}
+
+	v := &Collapser{
+		Path: proxyUrl.Path, Key: []string{"uri", "header:Accept-Encoding"},
+		MaxBody: 8 * 1024 * 1024, Timeout: 30 * time.Second,
+	}
+
+	if s := q.Get("collapseKey"); s != "" {
+		var err error
+		if v.Key, err = parseRequestKey(s); err != nil {
+			return nil, oe.Wrapf(err, "parse collapseKey")
+		}
+	}
+
+	if s := q.Get("collapseMaxBody"); s != "" {
+		var err error
+		if v.MaxBody, err = parseSize(s); err != nil || v.MaxBody <= 0 {
+			return nil, oe.Errorf("invalid collapseMaxBody=%v", s)
+		}
+	}
+
+	if s := q.Get("collapseTimeout"); s != "" {
+		var err error
+		if v.Timeout, err = time.ParseDuration(s); err != nil || v.Timeout <= 0 {
+			return nil, oe.Errorf("invalid collapseTimeout=%v", s)
+		}
+	}
+
+	return v, nil
+}
+
+func (v *Collapser) String() string {
+	return fmt.Sprintf("key=%v, maxBody=%v, timeout=%v", strings.Join(v.Key, ","), v.MaxBody, v.Timeout)
+}
+
+// Wrap the proxy, to collapse the identical requests.
+func (v *Collapser) Wrap(ctx context.Context, proxy http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v.Serve(ctx, w, r, proxy)
+	})
+}
+
+// Serve the request by the shared upstream request. Never share the private response of
+// request with credentials, like the cache.
+func (v *Collapser) Serve(ctx context.Context, w http.ResponseWriter, r *http.Request, proxy http.Handler) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || r.Header.Get("Range") != "" || isWebSocket(r) ||
+		r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" {
+		proxy.ServeHTTP(w, r)
+		return
+	}
+
+	key := r.Method + "\n" + requestKey(r, v.Key)
+	val, err, shared := v.flight.Do(key, func() (interface{}, error) {
+		return v.fetch(r, proxy)
+	})
+
+	// Proxy it directly, if the shared response is too large.
+	if err == errCollapseOverflow {
+		proxy.ServeHTTP(w, r)
+		return
+	}
+	if err != nil {
+		ol.Wf(ctx, "Collapse %v err %+v", r.URL, err)
+		http.Error(w, "upstream failed", http.StatusBadGateway)
+		return
+	}
+
+	if shared {
+		httpxMetrics.CollapsedRequests.Add(1, v.Path)
+	}
+
+	// Keep the headers of this request, for example, the CORS and Vary: Origin.
+	bw := val.(*bufferWriter)
+	for k, values := range bw.header {
+		if k == "Vary" {
+			w.Header()[k] = append(w.Header()[k], values...)
+		} else if _, ok := w.Header()[k]; !ok {
+			w.Header()[k] = values
+		}
+	}
+	for _, k := range cacheHopHeaders {
+		if k != "Set-Cookie" || shared {
+			w.Header().Del(k)
+		}
+	}
+	w.WriteHeader(bw.status)
+	if r.Method != http.MethodHead {
+		w.Write(bw.body.Bytes())
+	}
+}
+
+// Request the upstream and buffer the whole response.
+func (v *Collapser) fetch(r *http.Request, proxy http.Handler) (*bufferWriter, error) {
+	// Never cancel the request when the client is gone, because it's shared by others.
+	ctx, cancel := context.WithTimeout(context.Background(), v.Timeout)
+	defer cancel()
+
+	bw := newBufferWriter(v.MaxBody)
+	proxy.ServeHTTP(bw, r.Clone(ctx))
+	if bw.overflow {
+		return nil, errCollapseOverflow
+	}
+	return bw, nil
+}
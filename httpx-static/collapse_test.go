@@ -0,0 +1,175 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCollapser(t *testing.T) {
+	var requests int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("Set-Cookie", "session=leader")
+		w.Write([]byte("stats of " + r.URL.Query().Get("id")))
+	}))
+	defer backend.Close()
+
+	if _, err := NewCollapser(&url.URL{RawQuery: "collapse=true&collapseKey=uri,body"}); err == nil {
+		t.Errorf("should fail for invalid collapseKey")
+	}
+
+	u, _ := url.Parse(backend.URL + "/api/v1?collapse=true&collapseKey=path,query")
+	pool, err := NewUpstreamPool(u)
+	if err != nil || pool.Collapse == nil {
+		t.Fatalf("pool err %+v", err)
+	}
+	defer pool.Close()
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewComplexProxy(context.Background(), pool, nil, nil, r).ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	// The identical requests share one upstream request, and only the leader got the cookie.
+	var wg sync.WaitGroup
+	var cookies int32
+	for i := 0; i < 20; i++ {
+		id := "1"
+		if i%2 == 1 {
+			id = "2"
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := http.Get(proxy.URL + "/api/v1/stats?id=" + id)
+			if err != nil {
+				t.Errorf("get err %+v", err)
+				return
+			}
+			defer res.Body.Close()
+
+			if b, _ := ioutil.ReadAll(res.Body); string(b) != "stats of "+id {
+				t.Errorf("id=%v, body=%v", id, string(b))
+			}
+			if res.Header.Get("Set-Cookie") != "" {
+				atomic.AddInt32(&cookies, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("requests=%v", n)
+	}
+	if n := atomic.LoadInt32(&cookies); n != 2 {
+		t.Errorf("cookies=%v", n)
+	}
+}
+
+func TestCollapserPrivate(t *testing.T) {
+	var requests int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Write([]byte("user " + r.Header.Get("Authorization") + r.Header.Get("Cookie")))
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL + "/api/v1?collapse=true")
+	pool, err := NewUpstreamPool(u)
+	if err != nil || pool.Collapse == nil {
+		t.Fatalf("pool err %+v", err)
+	}
+	defer pool.Close()
+
+	routes := &Routes{cors: "https://a.ossrs.net,https://b.ossrs.net"}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.setCORS(w, r)
+		NewComplexProxy(context.Background(), pool, nil, nil, r).ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	get := func(key, value string) *http.Response {
+		req, _ := http.NewRequest("GET", proxy.URL+"/api/v1/user", nil)
+		req.Header.Set(key, value)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("get err %+v", err)
+			return nil
+		}
+		return res
+	}
+
+	// The private requests are never collapsed, and the CORS is for each request.
+	var wg sync.WaitGroup
+	for i, vv := range []struct {
+		key, value, expect string
+	}{
+		{"Authorization", "a", "user a"}, {"Authorization", "b", "user b"},
+		{"Cookie", "c=1", "user c=1"}, {"Cookie", "c=2", "user c=2"},
+		{"Origin", "https://a.ossrs.net", "user "}, {"Origin", "https://b.ossrs.net", "user "},
+	} {
+		wg.Add(1)
+		go func(i int, key, value, expect string) {
+			defer wg.Done()
+			if i >= 4 {
+				time.Sleep(30 * time.Millisecond)
+			}
+
+			res := get(key, value)
+			if res == nil {
+				return
+			}
+			defer res.Body.Close()
+
+			if b, _ := ioutil.ReadAll(res.Body); string(b) != expect {
+				t.Errorf("expect %v, got %v", expect, string(b))
+			}
+			if key == "Origin" && (res.Header.Get("Access-Control-Allow-Origin") != value ||
+				!strings.Contains(strings.Join(res.Header["Vary"], ","), "Origin")) {
+				t.Errorf("expect CORS %v, got %v", value, res.Header)
+			}
+		}(i, vv.key, vv.value, vv.expect)
+	}
+	wg.Wait()
+
+	// The 4 private requests, and the 2 shared ones.
+	if n := atomic.LoadInt32(&requests); n != 5 {
+		t.Errorf("requests=%v", n)
+	}
+}
@@ -0,0 +1,724 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+type Strings []string
+
+func (v *Strings) String() string {
+	return fmt.Sprintf("strings [%v]", strings.Join(*v, ","))
+}
+
+func (v *Strings) Set(value string) error {
+	*v = append(*v, value)
+	return nil
+}
+
+// Reset the list, when flags override the config file.
+func (v *Strings) Reset() {
+	*v = nil
+}
+
+// Unmarshal from string or number, or array of them, for example, the http port
+// could be 80, "80" or [80, "8080"].
+func (v *Strings) UnmarshalJSON(b []byte) error {
+	var values []interface{}
+	if err := json.Unmarshal(b, &values); err != nil {
+		var value interface{}
+		if err := json.Unmarshal(b, &value); err != nil {
+			return err
+		}
+		values = []interface{}{value}
+	}
+
+	*v = nil
+	for _, value := range values {
+		switch value := value.(type) {
+		case string:
+			*v = append(*v, value)
+		case float64:
+			*v = append(*v, fmt.Sprint(value))
+		default:
+			return fmt.Errorf("invalid value %v", value)
+		}
+	}
+	return nil
+}
+
+// The URL with options, for proxy and pre-hook. In config file, it could be a string,
+// or an object with url and options, which are merged to the query of url, for example:
+//
+//	"http://127.0.0.1:8888/api/webrtc?trimPrefix=/ffmpeg"
+//	{"url": "http://127.0.0.1:8888/api/webrtc", "options": {"trimPrefix": "/ffmpeg"}}
+type URLConfig struct {
+	URL     string            `json:"url"`
+	Options map[string]string `json:"options"`
+}
+
+func (v *URLConfig) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &v.URL); err == nil {
+		return nil
+	}
+
+	type urlConfig URLConfig
+	return json.Unmarshal(b, (*urlConfig)(v))
+}
+
+// Parse the url, with options merged to query.
+func (v *URLConfig) Parse() (*url.URL, error) {
+	if v.URL == "" {
+		return nil, oe.New("empty url")
+	}
+
+	u, err := url.Parse(v.URL)
+	if err != nil {
+		return nil, oe.Wrapf(err, "parse %v", v.URL)
+	}
+
+	if len(v.Options) > 0 {
+		q := u.Query()
+		for k, v := range v.Options {
+			q.Set(k, v)
+		}
+		u.RawQuery = q.Encode()
+	}
+
+	return u, nil
+}
+
+func (v *URLConfig) String() string {
+	if u, err := v.Parse(); err == nil {
+		return u.String()
+	}
+	return v.URL
+}
+
+type URLConfigs []*URLConfig
+
+func (v *URLConfigs) String() string {
+	var s []string
+	for _, u := range *v {
+		s = append(s, u.String())
+	}
+	return fmt.Sprintf("urls [%v]", strings.Join(s, ","))
+}
+
+func (v *URLConfigs) Set(value string) error {
+	*v = append(*v, &URLConfig{URL: value})
+	return nil
+}
+
+func (v *URLConfigs) Reset() {
+	*v = nil
+}
+
+// The HTTPS site, with file-based cert. The cert is selected by the names in its SANs,
+// and the domain is only a label, or the name if no SANs. The default sites serve the
+// unknown names and clients without SNI.
+type SiteConfig struct {
+	Domain  string `json:"domain"`
+	Key     string `json:"key"`
+	Cert    string `json:"cert"`
+	Default bool   `json:"default"`
+}
+
+// The virtual host, to serve the requests by Host with its own root and routes. The
+// hosts are exact like ossrs.net, or wildcard like *.ossrs.net for any subdomain. The
+// default one serves the unknown hosts, or the global root and routes if no default.
+type VHostConfig struct {
+	Hosts   Strings `json:"hosts"`
+	Default bool    `json:"default"`
+
+	// The www web root, default to the global root.
+	Root            string `json:"root"`
+	NoRedirectIndex bool   `json:"no-redirect-index"`
+	TrimLastSlash   bool   `json:"trim-last-slash"`
+	TrimSlashLimit  int    `json:"trim-slash-limit"`
+	// The CORS policy, see Config.CORS, default to the global one.
+	CORS string `json:"cors"`
+
+	Proxies   URLConfigs `json:"proxies"`
+	PreHooks  URLConfigs `json:"pre-hooks"`
+	PostHooks URLConfigs `json:"post-hooks"`
+
+	// The cert and key for the hosts, which are merged to sites.
+	Key  string `json:"key"`
+	Cert string `json:"cert"`
+}
+
+func (v *VHostConfig) String() string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// The config of httpx-static, load from the config file by -conf, and the flags
+// override the values in config file.
+type Config struct {
+	// The listen ports, 0 to disable.
+	HTTPPorts  Strings `json:"http"`
+	HTTPSPorts Strings `json:"https"`
+
+	// The admin api listen, for example, 1990 or 127.0.0.1:1990, empty to disable.
+	Admin string `json:"admin"`
+	// The drain timeout for graceful shutdown, for example, 30s.
+	Drain string `json:"drain"`
+	// The write timeout of HTTP and HTTPS server, for example, 60s, empty for no timeout.
+	// The stream routes are never timeout.
+	WriteTimeout string `json:"write-timeout"`
+
+	// Whether parse the PROXY protocol v1 or v2 header, for HTTP and HTTPS listeners.
+	ProxyProtocol bool `json:"proxy-protocol"`
+	// The trusted proxies in CIDR, whose X-Real-IP and X-Forwarded-For are honored.
+	TrustedProxies Strings `json:"trusted-proxies"`
+
+	// The server log file, empty for console.
+	Log string `json:"log"`
+	// The access log, stdout or file path, empty to disable. The format is combined or json.
+	AccessLog       string `json:"access-log"`
+	AccessLogFormat string `json:"access-log-format"`
+
+	// The www web root. Support relative dir to argv[0].
+	Root            string `json:"root"`
+	NoRedirectIndex bool   `json:"no-redirect-index"`
+	TrimLastSlash   bool   `json:"trim-last-slash"`
+	TrimSlashLimit  int    `json:"trim-slash-limit"`
+	// The CORS policy, * to allow all origins, off to disable and keep the headers of
+	// upstream, or the allowed origins, for example, https://ossrs.net,https://*.ossrs.net
+	CORS string `json:"cors"`
+
+	// The virtual hosts, matched by Host of request.
+	VHosts []*VHostConfig `json:"vhosts"`
+
+	// The request rate limit for each client, requests per second, 0 to disable.
+	RateLimit float64 `json:"rate-limit"`
+	RateBurst int     `json:"rate-burst"`
+
+	// The bandwidth throttle for static files, global and for each connection, for
+	// example, 100Mbps in bits or 10MB in bytes per second. Empty to disable.
+	ThrottleGlobal string     `json:"throttle-global"`
+	ThrottleConn   string     `json:"throttle-conn"`
+	Throttles      URLConfigs `json:"throttles"`
+
+	// The proxy to backend, and the pre-hook before proxy, and post-hook after proxy.
+	Proxies   URLConfigs `json:"proxies"`
+	PreHooks  URLConfigs `json:"pre-hooks"`
+	PostHooks URLConfigs `json:"post-hooks"`
+
+	// For letsencrypt, the allow domains and cache dir.
+	UseLetsEncrypt bool   `json:"lets"`
+	Domains        string `json:"domains"`
+	Cache          string `json:"cache"`
+	// For letsencrypt, the ACME v2 directory, the contact email, the challenges in
+	// preferred order, the external account binding, and the CA to trust for directory.
+	ACMEDirectory  string `json:"acme-directory"`
+	ACMEEmail      string `json:"acme-email"`
+	ACMEChallenges string `json:"acme-challenges"`
+	ACMEEABKeyID   string `json:"acme-eab-kid"`
+	ACMEEABHMAC    string `json:"acme-eab-hmac"`
+	ACMECA         string `json:"acme-ca"`
+	// For letsencrypt, the DNS provider of DNS-01, and the resolvers and timeout to check
+	// the propagation of TXT record.
+	ACMEDNS          string `json:"acme-dns"`
+	ACMEDNSResolvers string `json:"acme-dns-resolvers"`
+	ACMEDNSTimeout   string `json:"acme-dns-timeout"`
+
+	// For self-sign or file-based cert.
+	SSKey  string `json:"ssk"`
+	SSCert string `json:"ssc"`
+	// For file-based cert, the interval to poll the cert files to reload, and warn when
+	// the cert expires in days.
+	CertPoll       string `json:"cert-poll"`
+	CertExpiryDays int    `json:"cert-expiry-days"`
+
+	// For multiple HTTPS sites. The flags -sdomain, -skey and -scert are merged
+	// to the sites, and override the site with the same domain.
+	Sites    []*SiteConfig `json:"sites"`
+	sdomains Strings
+	skeys    Strings
+	scerts   Strings
+	sdefault string
+}
+
+// Get the changes from v to o, for reload.
+func (v *Config) Diff(o *Config) (changes []string) {
+	// The listeners could not be reloaded.
+	if v.HTTPPorts.String() != o.HTTPPorts.String() {
+		changes = append(changes, fmt.Sprintf("http %v to %v, requires restart", v.HTTPPorts, o.HTTPPorts))
+	}
+	if v.HTTPSPorts.String() != o.HTTPSPorts.String() {
+		changes = append(changes, fmt.Sprintf("https %v to %v, requires restart", v.HTTPSPorts, o.HTTPSPorts))
+	}
+	if v.Admin != o.Admin {
+		changes = append(changes, fmt.Sprintf("admin %v to %v, requires restart", v.Admin, o.Admin))
+	}
+	if v.Drain != o.Drain {
+		changes = append(changes, fmt.Sprintf("drain %v to %v, requires restart", v.Drain, o.Drain))
+	}
+	if v.WriteTimeout != o.WriteTimeout {
+		changes = append(changes, fmt.Sprintf("write-timeout %v to %v, requires restart", v.WriteTimeout, o.WriteTimeout))
+	}
+	if v.ProxyProtocol != o.ProxyProtocol {
+		changes = append(changes, fmt.Sprintf("proxy-protocol %v to %v, requires restart", v.ProxyProtocol, o.ProxyProtocol))
+	}
+	if v.Log != o.Log || v.AccessLog != o.AccessLog || v.AccessLogFormat != o.AccessLogFormat {
+		changes = append(changes, fmt.Sprintf("log %v, access-log %v(%v) to %v, %v(%v), requires restart",
+			v.Log, v.AccessLog, v.AccessLogFormat, o.Log, o.AccessLog, o.AccessLogFormat))
+	}
+
+	values := []struct {
+		name     string
+		from, to interface{}
+	}{
+		{"root", v.Root, o.Root},
+		{"no-redirect-index", v.NoRedirectIndex, o.NoRedirectIndex},
+		{"trim-last-slash", v.TrimLastSlash, o.TrimLastSlash},
+		{"trim-slash-limit", v.TrimSlashLimit, o.TrimSlashLimit},
+		{"cors", v.CORS, o.CORS},
+		{"rate-limit", v.RateLimit, o.RateLimit},
+		{"rate-burst", v.RateBurst, o.RateBurst},
+		{"throttle-global", v.ThrottleGlobal, o.ThrottleGlobal},
+		{"throttle-conn", v.ThrottleConn, o.ThrottleConn},
+		{"lets", v.UseLetsEncrypt, o.UseLetsEncrypt},
+		{"domains", v.Domains, o.Domains},
+		{"cache", v.Cache, o.Cache},
+		{"acme-directory", v.ACMEDirectory, o.ACMEDirectory},
+		{"acme-email", v.ACMEEmail, o.ACMEEmail},
+		{"acme-challenges", v.ACMEChallenges, o.ACMEChallenges},
+		{"acme-eab-kid", v.ACMEEABKeyID, o.ACMEEABKeyID},
+		{"acme-ca", v.ACMECA, o.ACMECA},
+		{"acme-dns-resolvers", v.ACMEDNSResolvers, o.ACMEDNSResolvers},
+		{"acme-dns-timeout", v.ACMEDNSTimeout, o.ACMEDNSTimeout},
+		{"ssk", v.SSKey, o.SSKey},
+		{"ssc", v.SSCert, o.SSCert},
+		{"cert-poll", v.CertPoll, o.CertPoll},
+		{"cert-expiry-days", v.CertExpiryDays, o.CertExpiryDays},
+	}
+	for _, value := range values {
+		if value.from != value.to {
+			changes = append(changes, fmt.Sprintf("%v %v to %v", value.name, value.from, value.to))
+		}
+	}
+
+	diff := func(name string, from, to []string) {
+		for _, f := range from {
+			if !stringsContains(to, f) {
+				changes = append(changes, fmt.Sprintf("%v remove %v", name, f))
+			}
+		}
+		for _, t := range to {
+			if !stringsContains(from, t) {
+				changes = append(changes, fmt.Sprintf("%v add %v", name, t))
+			}
+		}
+	}
+
+	urls := func(v URLConfigs) (s []string) {
+		for _, u := range v {
+			s = append(s, u.String())
+		}
+		return
+	}
+	diff("trusted-proxies", v.TrustedProxies, o.TrustedProxies)
+	diff("proxy", urls(v.Proxies), urls(o.Proxies))
+	diff("pre-hook", urls(v.PreHooks), urls(o.PreHooks))
+	diff("post-hook", urls(v.PostHooks), urls(o.PostHooks))
+	diff("throttle", urls(v.Throttles), urls(o.Throttles))
+
+	vhosts := func(v []*VHostConfig) (s []string) {
+		for _, vhost := range v {
+			s = append(s, vhost.String())
+		}
+		return
+	}
+	diff("vhost", vhosts(v.VHosts), vhosts(o.VHosts))
+
+	sites := func(v []*SiteConfig) (s []string) {
+		for _, site := range v {
+			s = append(s, fmt.Sprintf("%v(%v,%v,default=%v)", site.Domain, site.Key, site.Cert, site.Default))
+		}
+		return
+	}
+	diff("site", sites(v.Sites), sites(o.Sites))
+
+	return
+}
+
+func stringsContains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Load the config file, overwrite the fields in it.
+func (v *Config) Load(filename string) error {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return oe.Wrapf(err, "read %v", filename)
+	}
+
+	if err := json.Unmarshal(b, v); err != nil {
+		return oe.Wrapf(err, "parse %v", filename)
+	}
+
+	return nil
+}
+
+// The list flag, which is reset when flags override the config file.
+type listFlag interface {
+	Reset()
+}
+
+// Parse the config from args, which does not include the argv[0], and load the
+// config file if -conf specified. Return the parsed config and config file.
+func ParseConfig(args []string) (conf *Config, confFile string, err error) {
+	conf = &Config{}
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+
+	fs.StringVar(&confFile, "conf", "", "the config file in json, flags override it")
+
+	fs.Var(&conf.HTTPPorts, "t", "http listen")
+	fs.Var(&conf.HTTPPorts, "http", "http listen at. 0 to disable http.")
+
+	fs.Var(&conf.HTTPSPorts, "s", "https listen")
+	fs.Var(&conf.HTTPSPorts, "https", "https listen at. 0 to disable https. 443 to serve. ")
+
+	fs.StringVar(&conf.Admin, "admin", "", "the admin api listen, for example, 127.0.0.1:1990")
+	fs.StringVar(&conf.Drain, "drain", "30s", "the drain timeout for graceful shutdown")
+	fs.StringVar(&conf.WriteTimeout, "write-timeout", "", "the write timeout of http and https server, empty for no timeout")
+	fs.BoolVar(&conf.ProxyProtocol, "proxy-protocol", false, "whether parse the PROXY protocol header of http and https listeners")
+	fs.Var(&conf.TrustedProxies, "trusted-proxies", "the trusted proxies in CIDR, for example, 10.0.0.0/8,127.0.0.1")
+
+	fs.StringVar(&conf.Log, "log", "", "the server log file, empty for console")
+	fs.StringVar(&conf.AccessLog, "access-log", "", "the access log, stdout or file path, empty to disable")
+	fs.StringVar(&conf.AccessLogFormat, "access-log-format", AccessLogCombined, "the access log format, combined or json")
+
+	fs.StringVar(&conf.Domains, "d", "", "https the allow domains")
+	fs.StringVar(&conf.Domains, "domains", "", "https the allow domains, empty to allow all. for example: ossrs.net,www.ossrs.net")
+
+	fs.StringVar(&conf.Root, "r", "./html", "the www web root")
+	fs.StringVar(&conf.Root, "root", "./html", "the www web root. support relative dir to argv[0].")
+
+	fs.StringVar(&conf.Cache, "e", "./letsencrypt.cache", "https the cache dir for letsencrypt")
+	fs.StringVar(&conf.Cache, "cache", "./letsencrypt.cache", "https the cache dir for letsencrypt. support relative dir to argv[0].")
+
+	fs.BoolVar(&conf.UseLetsEncrypt, "l", false, "whether use letsencrypt CA")
+	fs.BoolVar(&conf.UseLetsEncrypt, "lets", false, "whether use letsencrypt CA. self sign if not.")
+
+	fs.StringVar(&conf.ACMEDirectory, "acme-directory", LetsEncryptDirectory, "the ACME v2 directory of CA")
+	fs.StringVar(&conf.ACMEEmail, "acme-email", "", "the contact email of ACME account")
+	fs.StringVar(&conf.ACMEChallenges, "acme-challenges", "http-01,tls-alpn-01", "the ACME challenges in preferred order")
+	fs.StringVar(&conf.ACMEEABKeyID, "acme-eab-kid", "", "the key id of ACME external account binding")
+	fs.StringVar(&conf.ACMEEABHMAC, "acme-eab-hmac", "", "the base64url HMAC key of ACME external account binding")
+	fs.StringVar(&conf.ACMECA, "acme-ca", "", "the CA file to trust for ACME directory, for example, Pebble")
+	fs.StringVar(&conf.ACMEDNS, "acme-dns", "", "the DNS provider for dns-01, rfc2136://server:53?tsigKey=name&tsigSecret=base64 or exec:///path/to/script")
+	fs.StringVar(&conf.ACMEDNSResolvers, "acme-dns-resolvers", "8.8.8.8:53,1.1.1.1:53", "the resolvers to check propagation of dns-01, empty to not check")
+	fs.StringVar(&conf.ACMEDNSTimeout, "acme-dns-timeout", "2m", "the timeout to wait for propagation of dns-01")
+
+	fs.StringVar(&conf.SSKey, "k", "", "https self-sign key")
+	fs.StringVar(&conf.SSKey, "ssk", "", "https self-sign key")
+
+	fs.StringVar(&conf.SSCert, "c", "", `https self-sign cert`)
+	fs.StringVar(&conf.SSCert, "ssc", "", `https self-sign cert`)
+
+	fs.StringVar(&conf.CertPoll, "cert-poll", "10s", "the interval to poll the cert files to reload, 0 to disable")
+	fs.IntVar(&conf.CertExpiryDays, "cert-expiry-days", 30, "warn when the cert expires in days, 0 to disable")
+
+	fs.Float64Var(&conf.RateLimit, "rate-limit", 0, "the request rate limit for each client, requests per second")
+	fs.IntVar(&conf.RateBurst, "rate-burst", 0, "the burst requests for rate limit, default to rate-limit")
+
+	fs.StringVar(&conf.ThrottleGlobal, "throttle-global", "", "the global bandwidth for static files, for example, 100Mbps")
+	fs.StringVar(&conf.ThrottleConn, "throttle-conn", "", "the bandwidth of each connection for static files, for example, 8Mbps")
+	fs.Var(&conf.Throttles, "throttle", "the bandwidth rule for static files, for example, /vod?ext=.mp4&rate=4Mbps&burst=10MB")
+
+	fs.Var(&conf.Proxies, "p", "proxy ruler")
+	fs.Var(&conf.Proxies, "proxy", "one or more proxy the matched path to backend, for example, -proxy http://127.0.0.1:8888/api/webrtc")
+
+	fs.Var(&conf.PreHooks, "pre-hook", "the pre-hook ruler, with request")
+	fs.Var(&conf.PostHooks, "post-hook", "the post-hook ruler, with response")
+
+	fs.Var(&conf.sdomains, "sdomain", "the SSL hostname")
+	fs.Var(&conf.skeys, "skey", "the SSL key for domain")
+	fs.Var(&conf.scerts, "scert", "the SSL cert for domain")
+	fs.StringVar(&conf.sdefault, "sdefault", "", "the SSL domain as default for unknown names and clients without SNI")
+
+	fs.BoolVar(&conf.NoRedirectIndex, "no-redirect-index", false, "Whether serve with index.html without redirect.")
+	fs.BoolVar(&conf.TrimLastSlash, "trim-last-slash", false, "Whether trim last slash by HTTP redirect(302).")
+	fs.IntVar(&conf.TrimSlashLimit, "trim-slash-limit", 0, "Only trim last slash when got enough directories.")
+	fs.StringVar(&conf.CORS, "cors", "*", "the CORS policy, * to allow all, off to disable, or the allowed origins")
+
+	fs.Usage = func() {
+		fmt.Println(fmt.Sprintf("Usage: %v -t http -s https -d domains -r root -e cache -l lets -k ssk -c ssc -p proxy", os.Args[0]))
+		fmt.Println(fmt.Sprintf("	"))
+		fmt.Println(fmt.Sprintf("Options:"))
+		fmt.Println(fmt.Sprintf("	-conf string"))
+		fmt.Println(fmt.Sprintf("			The config file in json, and the flags override the values in it."))
+		fmt.Println(fmt.Sprintf("	-t, -http string"))
+		fmt.Println(fmt.Sprintf("			Listen at port for HTTP server. Default: 0, disable HTTP."))
+		fmt.Println(fmt.Sprintf("	-s, -https string"))
+		fmt.Println(fmt.Sprintf("			Listen at port for HTTPS server. Default: 0, disable HTTPS."))
+		fmt.Println(fmt.Sprintf("	-admin string"))
+		fmt.Println(fmt.Sprintf("			Listen at for admin api, such as reload and /metrics. For example: 127.0.0.1:1990. Default: disabled."))
+		fmt.Println(fmt.Sprintf("	-drain duration"))
+		fmt.Println(fmt.Sprintf("			The drain timeout to wait for in-flight requests when SIGTERM or SIGINT. Default: 30s"))
+		fmt.Println(fmt.Sprintf("	-write-timeout duration"))
+		fmt.Println(fmt.Sprintf("			The write timeout of HTTP and HTTPS response, except the stream=true proxy. Default: no timeout"))
+		fmt.Println(fmt.Sprintf("	-trusted-proxies string"))
+		fmt.Println(fmt.Sprintf("			The trusted proxies in CIDR, only honor their X-Real-IP and X-Forwarded-For. For example: 10.0.0.0/8,127.0.0.1"))
+		fmt.Println(fmt.Sprintf("			The forwarding headers from other clients are stripped. Default: empty, trust none."))
+		fmt.Println(fmt.Sprintf("	-proxy-protocol=bool"))
+		fmt.Println(fmt.Sprintf("			Whether parse the PROXY protocol v1/v2 header of HTTP and HTTPS connections, when behind L4 load balancer."))
+		fmt.Println(fmt.Sprintf("			Only accept the header from -trusted-proxies, which is required. Default: false"))
+		fmt.Println(fmt.Sprintf("	-log string"))
+		fmt.Println(fmt.Sprintf("			The server log file, reopen by SIGUSR1. Default: console"))
+		fmt.Println(fmt.Sprintf("	-access-log string"))
+		fmt.Println(fmt.Sprintf("			The access log, stdout or file path, reopen by SIGUSR1. Default: disabled"))
+		fmt.Println(fmt.Sprintf("	-access-log-format string"))
+		fmt.Println(fmt.Sprintf("			The access log format, combined for Apache combined, or json for JSON lines. Default: combined"))
+		fmt.Println(fmt.Sprintf("	-r, -root string"))
+		fmt.Println(fmt.Sprintf("			The www root path. Supports relative to argv[0]=%v. Default: ./html", path.Dir(os.Args[0])))
+		fmt.Println(fmt.Sprintf("	-no-redirect-index=bool"))
+		fmt.Println(fmt.Sprintf("			Whether serve with index.html without redirect. Default: false"))
+		fmt.Println(fmt.Sprintf("	-cors string"))
+		fmt.Println(fmt.Sprintf("			The CORS policy, * to allow all, off to keep the headers of backend, or the allowed origins, for"))
+		fmt.Println(fmt.Sprintf("			example, https://ossrs.net,https://*.ossrs.net. The vhosts in config file have their own. Default: *"))
+		fmt.Println(fmt.Sprintf("	-rate-limit float"))
+		fmt.Println(fmt.Sprintf("			The request rate limit for each client ip, requests per second, 429 if exceed. Default: 0, disabled."))
+		fmt.Println(fmt.Sprintf("	-rate-burst int"))
+		fmt.Println(fmt.Sprintf("			The burst requests for rate limit. Default: same to -rate-limit"))
+		fmt.Println(fmt.Sprintf("	-throttle-global string"))
+		fmt.Println(fmt.Sprintf("			The total bandwidth of static files, in bits like 100Mbps or bytes like 10MB per second. Default: disabled"))
+		fmt.Println(fmt.Sprintf("	-throttle-conn string"))
+		fmt.Println(fmt.Sprintf("			The bandwidth of static files for each connection, for example, 8Mbps. Default: disabled"))
+		fmt.Println(fmt.Sprintf("	-throttle string"))
+		fmt.Println(fmt.Sprintf("			The bandwidth rule of static files for path, the first matched is used, throttle after the burst bytes of connection."))
+		fmt.Println(fmt.Sprintf("			For example: -throttle \"/vod?ext=.mp4&rate=4Mbps&burst=10MB\""))
+		fmt.Println(fmt.Sprintf("	-p, -proxy string"))
+		fmt.Println(fmt.Sprintf("			Proxy path to backend. For example: http://127.0.0.1:8888/api/webrtc"))
+		fmt.Println(fmt.Sprintf("			Proxy path to backend. For example: http://127.0.0.1:8888/api/webrtc?modifyRequestHost=false"))
+		fmt.Println(fmt.Sprintf("			Proxy path to backend. For example: http://127.0.0.1:8888/api/webrtc?keepUpsreamServer=true"))
+		fmt.Println(fmt.Sprintf("			Proxy path to backend. For example: http://127.0.0.1:8888/api/webrtc?trimPrefix=/ffmpeg"))
+		fmt.Println(fmt.Sprintf("			Proxy path to backend. For example: http://127.0.0.1:8888/api/webrtc?addPrefix=/release"))
+		fmt.Println(fmt.Sprintf("			Proxy the same path to multiple backends, load balance by lb=rr|lc|hash of the first one. Default: rr"))
+		fmt.Println(fmt.Sprintf("			For example: -p http://127.0.0.1:1985/api/v1?lb=lc -p http://127.0.0.1:1986/api/v1"))
+		fmt.Println(fmt.Sprintf("			Health check the backends, by options of the first one: healthCheck=/api/v1/versions, healthInterval=5s,"))
+		fmt.Println(fmt.Sprintf("			healthTimeout=3s, healthStatus=200, and eject after maxFails=3 failures, retry after failTimeout=10s."))
+		fmt.Println(fmt.Sprintf("			Limit the request rate of each client for the path, by rateLimit=10 requests per second, rateBurst=20."))
+		fmt.Println(fmt.Sprintf("			For live stream like HTTP-FLV or SSE, stream=true to flush immediately without compression and timeout."))
+		fmt.Println(fmt.Sprintf("			For WebSocket, limit the upgraded connections by wsMaxConns=1000, close if idle for wsIdleTimeout=5m,"))
+		fmt.Println(fmt.Sprintf("			or no response in wsPingTimeout=10s for the ping every wsPingInterval=30s. Default: no limit"))
+		fmt.Println(fmt.Sprintf("			For HLS edge, hls=true to cache the segments by URL, and the live m3u8 for hlsPlaylistRatio=0.5 of"))
+		fmt.Println(fmt.Sprintf("			target duration, evict in LRU if exceed hlsCacheSize=64MB, on disk if hlsCacheDir, hlsFetchTimeout=30s."))
+		fmt.Println(fmt.Sprintf("			For API, cache=true to cache the GET responses by Cache-Control, Expires and Vary of backend, and"))
+		fmt.Println(fmt.Sprintf("			revalidate by ETag, evict in LRU if exceed cacheSize=64MB, on disk if cacheDir. Default: false"))
+		fmt.Println(fmt.Sprintf("			The collapse=true shares one request for the identical GET in flight, by collapseKey=uri,header:Accept-Encoding,"))
+		fmt.Println(fmt.Sprintf("			for response at most collapseMaxBody=8MB, in collapseTimeout=30s, except with Authorization or Cookie. Default: false"))
+		fmt.Println(fmt.Sprintf("			Retry the idempotent requests to next backend by retries=0, in retryTimeout=0s for each try and"))
+		fmt.Println(fmt.Sprintf("			retryDeadline=0s for all, on retryOn=502,503,504, body at most retryMaxBody=64KB, and limit the"))
+		fmt.Println(fmt.Sprintf("			retries to retryBudget=0.2 of requests, at least retryMin=10 in 10s. Default: no retry"))
+		fmt.Println(fmt.Sprintf("	-pre-hook string"))
+		fmt.Println(fmt.Sprintf("			Pre-hook to backend, with request. For example: http://127.0.0.1:8888/api/stat"))
+		fmt.Println(fmt.Sprintf("			Forward the headers and body of request, at most maxBody=64KB, 0 to not forward body."))
+		fmt.Println(fmt.Sprintf("			Allow by status 200, or JSON to allow, deny or redirect, and add or remove headers to upstream."))
+		fmt.Println(fmt.Sprintf("			Request in timeout=5s, retries=0 with retryBackoff=100ms doubled, and onError=deny|allow if fails."))
+		fmt.Println(fmt.Sprintf("			Cache and share the allow decisions in cacheTTL=0s, by cacheKey=ip,method,uri,header:Authorization,header:Cookie"))
+		fmt.Println(fmt.Sprintf("			The cacheKey could be ip, method, host, path, uri, query, header:Name or cookie:name."))
+		fmt.Println(fmt.Sprintf("	-post-hook string"))
+		fmt.Println(fmt.Sprintf("			Post-hook after proxy, with the method, path, status, bytes, duration and ip of response in JSON."))
+		fmt.Println(fmt.Sprintf("			For example: http://127.0.0.1:8888/api/billing?mode=async&queue=1024&workers=1&timeout=3s"))
+		fmt.Println(fmt.Sprintf("			The mode=sync requests before response, and could veto or rewrite the headers, onError=allow|deny."))
+		fmt.Println(fmt.Sprintf("Options for HTTPS(letsencrypt cert):"))
+		fmt.Println(fmt.Sprintf("	-l, -lets=bool"))
+		fmt.Println(fmt.Sprintf("			Whether use letsencrypt CA. Default: false"))
+		fmt.Println(fmt.Sprintf("	-e, -cache string"))
+		fmt.Println(fmt.Sprintf("			The letsencrypt cache dir, for the account key and certs. Default: ./letsencrypt.cache"))
+		fmt.Println(fmt.Sprintf("	-d, -domains string"))
+		fmt.Println(fmt.Sprintf("			Set the validate HTTPS domain. For example: ossrs.net,www.ossrs.net"))
+		fmt.Println(fmt.Sprintf("	-acme-directory string"))
+		fmt.Println(fmt.Sprintf("			The ACME v2 directory of CA. Default: %v", LetsEncryptDirectory))
+		fmt.Println(fmt.Sprintf("	-acme-email string"))
+		fmt.Println(fmt.Sprintf("			The contact email of ACME account. Default: none"))
+		fmt.Println(fmt.Sprintf("	-acme-challenges string"))
+		fmt.Println(fmt.Sprintf("			The challenges in preferred order, http-01 served by HTTP port 80, tls-alpn-01 by HTTPS port 443,"))
+		fmt.Println(fmt.Sprintf("			and dns-01 by -acme-dns, which is the only one for wildcard domains like *.ossrs.net."))
+		fmt.Println(fmt.Sprintf("			Default: http-01,tls-alpn-01, and dns-01 if -acme-dns"))
+		fmt.Println(fmt.Sprintf("	-acme-dns string"))
+		fmt.Println(fmt.Sprintf("			The DNS provider for dns-01, RFC 2136 dynamic update with optional TSIG, for example:"))
+		fmt.Println(fmt.Sprintf("			rfc2136://127.0.0.1:53?zone=ossrs.net&tsigKey=acme&tsigSecret=base64&tsigAlgorithm=hmac-sha256&ttl=60"))
+		fmt.Println(fmt.Sprintf("			Or a script executed with args present|cleanup, the fqdn and value, for example:"))
+		fmt.Println(fmt.Sprintf("			exec:///usr/local/bin/dns-hook.sh"))
+		fmt.Println(fmt.Sprintf("	-acme-dns-resolvers string"))
+		fmt.Println(fmt.Sprintf("			The resolvers to check propagation of TXT record, empty to not check. Default: 8.8.8.8:53,1.1.1.1:53"))
+		fmt.Println(fmt.Sprintf("	-acme-dns-timeout duration"))
+		fmt.Println(fmt.Sprintf("			The timeout to wait for propagation of TXT record. Default: 2m"))
+		fmt.Println(fmt.Sprintf("	-acme-eab-kid string, -acme-eab-hmac string"))
+		fmt.Println(fmt.Sprintf("			The key id and base64url HMAC key of external account binding, required by some CA."))
+		fmt.Println(fmt.Sprintf("	-acme-ca string"))
+		fmt.Println(fmt.Sprintf("			The CA file to trust for ACME directory, for example, pebble.minica.pem of Pebble."))
+		fmt.Println(fmt.Sprintf("Options for HTTPS(file-based cert):"))
+		fmt.Println(fmt.Sprintf("	-k, -ssk string"))
+		fmt.Println(fmt.Sprintf("			The self-sign or validate file-based key file."))
+		fmt.Println(fmt.Sprintf("	-c, -ssc string"))
+		fmt.Println(fmt.Sprintf("			The self-sign or validate file-based cert file."))
+		fmt.Println(fmt.Sprintf("	-cert-poll duration"))
+		fmt.Println(fmt.Sprintf("			The interval to poll the mtime of cert and key files, reload when changed and valid. 0 to disable. Default: 10s"))
+		fmt.Println(fmt.Sprintf("	-cert-expiry-days int"))
+		fmt.Println(fmt.Sprintf("			Warn in logs and metric httpx_cert_expiring when the cert expires in days. 0 to disable. Default: 30"))
+		fmt.Println(fmt.Sprintf("	-sdomain string"))
+		fmt.Println(fmt.Sprintf("			For multiple HTTPS site, the domain name. For example: ossrs.net"))
+		fmt.Println(fmt.Sprintf("			The cert is selected by the names in SANs, exact or wildcard, and ECDSA is preferred to RSA."))
+		fmt.Println(fmt.Sprintf("	-skey string"))
+		fmt.Println(fmt.Sprintf("			For multiple HTTPS site, the key file."))
+		fmt.Println(fmt.Sprintf("	-scert string"))
+		fmt.Println(fmt.Sprintf("			For multiple HTTPS site, the cert file."))
+		fmt.Println(fmt.Sprintf("	-sdefault string"))
+		fmt.Println(fmt.Sprintf("			For multiple HTTPS site, the default domain for unknown names and clients without SNI."))
+		fmt.Println(fmt.Sprintf("For example:"))
+		fmt.Println(fmt.Sprintf("	%v -t 8080 -s 9443 -r ./html", os.Args[0]))
+		fmt.Println(fmt.Sprintf("	%v -t 8080 -s 9443 -r ./html -p http://ossrs.net:1985/api/v1/versions", os.Args[0]))
+		fmt.Println(fmt.Sprintf("	%v -conf httpx.json -t 8080", os.Args[0]))
+		fmt.Println(fmt.Sprintf("Generate cert for self-sign HTTPS:"))
+		fmt.Println(fmt.Sprintf("	openssl genrsa -out server.key 2048"))
+		fmt.Println(fmt.Sprintf(`	openssl req -new -x509 -key server.key -out server.crt -days 365 -subj "/C=CN/ST=Beijing/L=Beijing/O=Me/OU=Me/CN=me.org"`))
+		fmt.Println(fmt.Sprintf("For example:"))
+		fmt.Println(fmt.Sprintf("	%v -s 9443 -r ./html -sdomain ossrs.net -skey ossrs.net.key -scert ossrs.net.pem", os.Args[0]))
+	}
+	flag.Usage = fs.Usage
+
+	if err = fs.Parse(args); err != nil {
+		return nil, "", oe.Wrapf(err, "parse %v", args)
+	}
+
+	if confFile != "" {
+		if err = conf.Load(confFile); err != nil {
+			return nil, "", oe.Wrapf(err, "load %v", confFile)
+		}
+
+		// Parse the flags again, to override the values in config file. For list,
+		// the values from flags replace the whole list from config file.
+		fs.Visit(func(f *flag.Flag) {
+			if v, ok := f.Value.(listFlag); ok {
+				v.Reset()
+			}
+		})
+		if err = fs.Parse(args); err != nil {
+			return nil, "", oe.Wrapf(err, "parse %v", args)
+		}
+	}
+
+	// Merge the sites from flags, which overrides the config file.
+	if len(conf.sdomains) != len(conf.skeys) || len(conf.sdomains) != len(conf.scerts) {
+		return nil, "", oe.Errorf("sdomain=%v, skey=%v, scert=%v not match", conf.sdomains, conf.skeys, conf.scerts)
+	}
+	for i := 0; i < len(conf.sdomains); i++ {
+		site := &SiteConfig{Domain: conf.sdomains[i], Key: conf.skeys[i], Cert: conf.scerts[i]}
+
+		var replaced bool
+		for j, s := range conf.Sites {
+			if s.Domain == site.Domain {
+				conf.Sites[j], replaced = site, true
+			}
+		}
+		if !replaced {
+			conf.Sites = append(conf.Sites, site)
+		}
+	}
+
+	if conf.sdefault != "" {
+		var found bool
+		for _, site := range conf.Sites {
+			if site.Domain == conf.sdefault {
+				site.Default, found = true, true
+			}
+		}
+		if !found {
+			return nil, "", oe.Errorf("sdefault=%v not in sites", conf.sdefault)
+		}
+	}
+
+	// Merge the certs of vhosts to sites, if not specified by sites.
+	for _, vhost := range conf.VHosts {
+		if vhost.Key == "" && vhost.Cert == "" {
+			continue
+		}
+		for _, host := range vhost.Hosts {
+			var exists bool
+			for _, s := range conf.Sites {
+				exists = exists || s.Domain == host
+			}
+			if !exists {
+				conf.Sites = append(conf.Sites, &SiteConfig{Domain: host, Key: vhost.Key, Cert: vhost.Cert})
+			}
+		}
+	}
+
+	// The PROXY header overrides the client address, so only accept it from trusted proxies.
+	if conf.ProxyProtocol && len(conf.TrustedProxies) == 0 {
+		return nil, "", oe.New("proxy-protocol requires trusted-proxies")
+	}
+
+	// If trim last slash, we should enable no redirect index, to avoid infinitely redirect.
+	if conf.TrimLastSlash {
+		conf.NoRedirectIndex = true
+	}
+	for _, vhost := range conf.VHosts {
+		if vhost.TrimLastSlash {
+			vhost.NoRedirectIndex = true
+		}
+	}
+
+	if !path.IsAbs(conf.Cache) && path.IsAbs(os.Args[0]) {
+		conf.Cache = path.Join(path.Dir(os.Args[0]), conf.Cache)
+	}
+	if !path.IsAbs(conf.Root) && path.IsAbs(os.Args[0]) {
+		conf.Root = path.Join(path.Dir(os.Args[0]), conf.Root)
+	}
+	for _, vhost := range conf.VHosts {
+		if vhost.Root == "" {
+			vhost.Root = conf.Root
+		} else if !path.IsAbs(vhost.Root) && path.IsAbs(os.Args[0]) {
+			vhost.Root = path.Join(path.Dir(os.Args[0]), vhost.Root)
+		}
+		if vhost.CORS == "" {
+			vhost.CORS = conf.CORS
+		}
+	}
+
+	return conf, confFile, nil
+}
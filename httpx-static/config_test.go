@@ -0,0 +1,114 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httpx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	confFile := path.Join(dir, "httpx.json")
+	if err := ioutil.WriteFile(confFile, []byte(`{
+		"http": [80, "8080"], "https": 443, "root": "/data/html",
+		"proxies": [
+			"http://127.0.0.1:1985/api/v1",
+			{"url": "http://127.0.0.1:8888/api/webrtc", "options": {"trimPrefix": "/ffmpeg"}}
+		],
+		"sites": [{"domain": "ossrs.net", "key": "ossrs.key", "cert": "ossrs.crt"}],
+		"vhosts": [
+			{"hosts": ["ossrs.net", "www.ossrs.net"], "key": "vhost.key", "cert": "vhost.crt", "trim-last-slash": true},
+			{"default": true, "root": "/data/default", "cors": "off"}
+		]
+	}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, _, err := ParseConfig([]string{"-conf", confFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.HTTPPorts) != 2 || conf.HTTPPorts[0] != "80" || conf.HTTPPorts[1] != "8080" {
+		t.Errorf("http=%v", conf.HTTPPorts)
+	}
+	if len(conf.HTTPSPorts) != 1 || conf.HTTPSPorts[0] != "443" {
+		t.Errorf("https=%v", conf.HTTPSPorts)
+	}
+	if conf.Root != "/data/html" {
+		t.Errorf("root=%v", conf.Root)
+	}
+	if len(conf.Proxies) != 2 || conf.Proxies[1].String() != "http://127.0.0.1:8888/api/webrtc?trimPrefix=%2Fffmpeg" {
+		t.Errorf("proxies=%v", conf.Proxies.String())
+	}
+
+	// The vhost inherits the root and cors, and merges the cert to sites if not exists.
+	if len(conf.VHosts) != 2 || conf.VHosts[0].Root != "/data/html" || conf.VHosts[0].CORS != "*" || !conf.VHosts[0].NoRedirectIndex {
+		t.Errorf("vhosts=%v", conf.VHosts)
+	}
+	if vhost := conf.VHosts[1]; vhost.Root != "/data/default" || vhost.CORS != "off" {
+		t.Errorf("vhost=%v", vhost)
+	}
+	if len(conf.Sites) != 2 || conf.Sites[0].Key != "ossrs.key" || conf.Sites[1].Domain != "www.ossrs.net" || conf.Sites[1].Key != "vhost.key" {
+		t.Errorf("sites=%v", conf.Sites)
+	}
+
+	// The flags override the config file, and replace the whole list.
+	conf, _, err = ParseConfig([]string{"-conf", confFile, "-t", "8081", "-r", "/tmp/html",
+		"-sdomain", "ossrs.net", "-skey", "new.key", "-scert", "new.crt",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conf.HTTPPorts) != 1 || conf.HTTPPorts[0] != "8081" {
+		t.Errorf("http=%v", conf.HTTPPorts)
+	}
+	if len(conf.HTTPSPorts) != 1 || conf.HTTPSPorts[0] != "443" {
+		t.Errorf("https=%v", conf.HTTPSPorts)
+	}
+	if conf.Root != "/tmp/html" {
+		t.Errorf("root=%v", conf.Root)
+	}
+	if len(conf.Proxies) != 2 {
+		t.Errorf("proxies=%v", conf.Proxies.String())
+	}
+	if len(conf.Sites) != 2 || conf.Sites[0].Key != "new.key" {
+		t.Errorf("sites=%v", conf.Sites)
+	}
+	// The PROXY protocol requires the trusted proxies.
+	if _, _, err = ParseConfig([]string{"-t", "8081", "-proxy-protocol"}); err == nil {
+		t.Errorf("should fail for no trusted proxies")
+	}
+	if _, _, err = ParseConfig([]string{"-t", "8081", "-proxy-protocol", "-trusted-proxies", "10.0.0.0/8"}); err != nil {
+		t.Errorf("parse err %+v", err)
+	}
+}
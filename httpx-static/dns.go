@@ -0,0 +1,628 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	"hash"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// The DNS types and classes, see https://datatracker.ietf.org/doc/html/rfc1035#section-3.2
+const (
+	dnsTypeSOA  = 6
+	dnsTypeTXT  = 16
+	dnsTypeTSIG = 250
+
+	dnsClassIN   = 1
+	dnsClassNONE = 254
+	dnsClassANY  = 255
+
+	dnsOpcodeQuery  = 0
+	dnsOpcodeUpdate = 5
+
+	dnsRcodeSuccess  = 0
+	dnsRcodeNXDomain = 3
+	dnsRcodeNotAuth  = 9
+)
+
+// The question of DNS message, or the zone of UPDATE.
+type dnsQuestion struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// The resource record, the data is in wire format.
+type dnsRR struct {
+	Name  string
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	Data  []byte
+}
+
+// The DNS message, for UPDATE the sections are zone, prerequisite, update and additional,
+// see https://datatracker.ietf.org/doc/html/rfc2136#section-2
+type dnsMessage struct {
+	ID                 uint16
+	Response           bool
+	Opcode             int
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	Rcode              int
+
+	Questions   []dnsQuestion
+	Answers     []dnsRR
+	Authorities []dnsRR
+	Additionals []dnsRR
+
+	// The offset of the last RR when unpack, which is the TSIG to verify.
+	last int
+}
+
+// Pack the message in wire format, the names are not compressed.
+func (v *dnsMessage) Pack() ([]byte, error) {
+	var flags uint16
+	if v.Response {
+		flags |= 1 << 15
+	}
+	flags |= uint16(v.Opcode&0xf) << 11
+	if v.Authoritative {
+		flags |= 1 << 10
+	}
+	if v.Truncated {
+		flags |= 1 << 9
+	}
+	if v.RecursionDesired {
+		flags |= 1 << 8
+	}
+	if v.RecursionAvailable {
+		flags |= 1 << 7
+	}
+	flags |= uint16(v.Rcode & 0xf)
+
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint16(b[0:], v.ID)
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(v.Questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(v.Answers)))
+	binary.BigEndian.PutUint16(b[8:], uint16(len(v.Authorities)))
+	binary.BigEndian.PutUint16(b[10:], uint16(len(v.Additionals)))
+
+	var err error
+	for _, q := range v.Questions {
+		if b, err = dnsPackName(b, q.Name); err != nil {
+			return nil, err
+		}
+		b = append(b, byte(q.Type>>8), byte(q.Type), byte(q.Class>>8), byte(q.Class))
+	}
+
+	for _, section := range [][]dnsRR{v.Answers, v.Authorities, v.Additionals} {
+		for _, rr := range section {
+			if b, err = rr.pack(b); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return b, nil
+}
+
+func (v *dnsRR) pack(b []byte) ([]byte, error) {
+	b, err := dnsPackName(b, v.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(v.Data) > 0xffff {
+		return nil, oe.Errorf("rdata %v too long", len(v.Data))
+	}
+
+	var fixed [10]byte
+	binary.BigEndian.PutUint16(fixed[0:], v.Type)
+	binary.BigEndian.PutUint16(fixed[2:], v.Class)
+	binary.BigEndian.PutUint32(fixed[4:], v.TTL)
+	binary.BigEndian.PutUint16(fixed[8:], uint16(len(v.Data)))
+	return append(append(b, fixed[:]...), v.Data...), nil
+}
+
+// Unpack the message in wire format, with the compressed names.
+func (v *dnsMessage) Unpack(b []byte) error {
+	if len(b) < 12 {
+		return oe.Errorf("message %v too short", len(b))
+	}
+
+	v.ID = binary.BigEndian.Uint16(b[0:])
+	flags := binary.BigEndian.Uint16(b[2:])
+	v.Response = flags&(1<<15) != 0
+	v.Opcode = int(flags>>11) & 0xf
+	v.Authoritative = flags&(1<<10) != 0
+	v.Truncated = flags&(1<<9) != 0
+	v.RecursionDesired = flags&(1<<8) != 0
+	v.RecursionAvailable = flags&(1<<7) != 0
+	v.Rcode = int(flags & 0xf)
+
+	counts := []int{
+		int(binary.BigEndian.Uint16(b[4:])), int(binary.BigEndian.Uint16(b[6:])),
+		int(binary.BigEndian.Uint16(b[8:])), int(binary.BigEndian.Uint16(b[10:])),
+	}
+
+	off := 12
+	v.Questions = nil
+	for i := 0; i < counts[0]; i++ {
+		name, n, err := dnsUnpackName(b, off)
+		if err != nil {
+			return oe.Wrapf(err, "question %v", i)
+		}
+		if off = n; off+4 > len(b) {
+			return oe.Errorf("question %v overflow", i)
+		}
+		v.Questions = append(v.Questions, dnsQuestion{
+			Name: name, Type: binary.BigEndian.Uint16(b[off:]), Class: binary.BigEndian.Uint16(b[off+2:]),
+		})
+		off += 4
+	}
+
+	sections := []*[]dnsRR{&v.Answers, &v.Authorities, &v.Additionals}
+	for i, section := range sections {
+		*section = nil
+		for j := 0; j < counts[i+1]; j++ {
+			v.last = off
+			name, n, err := dnsUnpackName(b, off)
+			if err != nil {
+				return oe.Wrapf(err, "rr %v of section %v", j, i)
+			}
+			if off = n; off+10 > len(b) {
+				return oe.Errorf("rr %v of section %v overflow", j, i)
+			}
+
+			rr := dnsRR{
+				Name: name, Type: binary.BigEndian.Uint16(b[off:]), Class: binary.BigEndian.Uint16(b[off+2:]),
+				TTL: binary.BigEndian.Uint32(b[off+4:]),
+			}
+			size := int(binary.BigEndian.Uint16(b[off+8:]))
+			if off += 10; off+size > len(b) {
+				return oe.Errorf("rdata of rr %v of section %v overflow", j, i)
+			}
+			rr.Data = append([]byte(nil), b[off:off+size]...)
+			off += size
+
+			*section = append(*section, rr)
+		}
+	}
+	return nil
+}
+
+// Pack the name in labels, the name is fully qualified with or without the last dot.
+func dnsPackName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) == 0 || len(label) > 63 {
+				return nil, oe.Errorf("invalid label of %v", name)
+			}
+			b = append(append(b, byte(len(label))), label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+// Unpack the name at off, follow the compression pointers. Return the name with the
+// last dot, and the offset after name.
+func dnsUnpackName(b []byte, off int) (string, int, error) {
+	var labels []string
+	end, jumps := -1, 0
+	for {
+		if off >= len(b) {
+			return "", 0, oe.New("name overflow")
+		}
+
+		size := int(b[off])
+		if size == 0 {
+			off++
+			break
+		}
+
+		// The compression pointer, see https://datatracker.ietf.org/doc/html/rfc1035#section-4.1.4
+		if size&0xc0 == 0xc0 {
+			if off+1 >= len(b) {
+				return "", 0, oe.New("pointer overflow")
+			}
+			if jumps++; jumps > 16 {
+				return "", 0, oe.New("too many pointers")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+			continue
+		}
+
+		if off+1+size > len(b) {
+			return "", 0, oe.New("label overflow")
+		}
+		labels = append(labels, string(b[off+1:off+1+size]))
+		off += 1 + size
+	}
+
+	if end < 0 {
+		end = off
+	}
+	return strings.Join(labels, ".") + ".", end, nil
+}
+
+// The rdata of TXT, the value is split to strings of 255 bytes.
+func dnsTXTData(value string) []byte {
+	var b []byte
+	for len(value) > 255 {
+		b = append(append(b, 255), value[:255]...)
+		value = value[255:]
+	}
+	return append(append(b, byte(len(value))), value...)
+}
+
+// Parse the rdata of TXT, the strings are joined as a value.
+func dnsParseTXT(b []byte) (string, error) {
+	var value []byte
+	for len(b) > 0 {
+		size := int(b[0])
+		if 1+size > len(b) {
+			return "", oe.New("txt overflow")
+		}
+		value = append(value, b[1:1+size]...)
+		b = b[1+size:]
+	}
+	return string(value), nil
+}
+
+// The TSIG key to sign the message, see https://datatracker.ietf.org/doc/html/rfc8945
+type dnsTSIG struct {
+	// The key name, for example, acme.ossrs.net.
+	Name string
+	// The algorithm, for example, hmac-sha256.
+	Algorithm string
+	Secret    []byte
+}
+
+// The hash of TSIG algorithm.
+func dnsTSIGHash(algorithm string) (func() hash.Hash, error) {
+	switch strings.TrimSuffix(strings.ToLower(algorithm), ".") {
+	case "hmac-md5.sig-alg.reg.int", "hmac-md5":
+		return md5.New, nil
+	case "hmac-sha1":
+		return sha1.New, nil
+	case "hmac-sha256":
+		return sha256.New, nil
+	case "hmac-sha512":
+		return sha512.New, nil
+	}
+	return nil, oe.Errorf("unsupported tsig algorithm %v", algorithm)
+}
+
+// The canonical name of TSIG algorithm.
+func dnsTSIGAlgorithm(algorithm string) string {
+	algorithm = strings.TrimSuffix(strings.ToLower(algorithm), ".")
+	if algorithm == "hmac-md5" {
+		algorithm = "hmac-md5.sig-alg.reg.int"
+	}
+	return algorithm + "."
+}
+
+// The rdata of TSIG record, see https://datatracker.ietf.org/doc/html/rfc8945#section-4.2
+type dnsTSIGRecord struct {
+	Algorithm string
+	Signed    time.Time
+	Fudge     uint16
+	MAC       []byte
+	OrigID    uint16
+	Error     uint16
+	Other     []byte
+}
+
+func (v *dnsTSIGRecord) pack() ([]byte, error) {
+	b, err := dnsPackName(nil, v.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, dnsTSIGTime(v.Signed)...)
+	b = append(b, byte(v.Fudge>>8), byte(v.Fudge), byte(len(v.MAC)>>8), byte(len(v.MAC)))
+	b = append(b, v.MAC...)
+	b = append(b, byte(v.OrigID>>8), byte(v.OrigID), byte(v.Error>>8), byte(v.Error))
+	b = append(b, byte(len(v.Other)>>8), byte(len(v.Other)))
+	return append(b, v.Other...), nil
+}
+
+func (v *dnsTSIGRecord) unpack(b []byte) error {
+	algorithm, off, err := dnsUnpackName(b, 0)
+	if err != nil {
+		return oe.Wrapf(err, "algorithm")
+	}
+	if off+10 > len(b) {
+		return oe.New("tsig overflow")
+	}
+	v.Algorithm = algorithm
+	v.Signed = time.Unix(int64(binary.BigEndian.Uint64(append([]byte{0, 0}, b[off:off+6]...))), 0)
+	v.Fudge = binary.BigEndian.Uint16(b[off+6:])
+
+	size := int(binary.BigEndian.Uint16(b[off+8:]))
+	if off += 10; off+size+6 > len(b) {
+		return oe.New("tsig mac overflow")
+	}
+	v.MAC = append([]byte(nil), b[off:off+size]...)
+	off += size
+
+	v.OrigID = binary.BigEndian.Uint16(b[off:])
+	v.Error = binary.BigEndian.Uint16(b[off+2:])
+	size = int(binary.BigEndian.Uint16(b[off+4:]))
+	if off += 6; off+size > len(b) {
+		return oe.New("tsig other overflow")
+	}
+	v.Other = append([]byte(nil), b[off:off+size]...)
+	return nil
+}
+
+// Compute the MAC of the prior MAC, the message without TSIG, and the TSIG variables. The
+// prior MAC is the MAC of request when sign or verify the response, nil for request.
+func (v *dnsTSIG) MAC(prior, msg []byte, r *dnsTSIGRecord) ([]byte, error) {
+	h, err := dnsTSIGHash(v.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	vars, err := dnsPackName(nil, strings.ToLower(v.Name))
+	if err != nil {
+		return nil, err
+	}
+	vars = append(vars, 0, dnsClassANY, 0, 0, 0, 0)
+	if vars, err = dnsPackName(vars, dnsTSIGAlgorithm(v.Algorithm)); err != nil {
+		return nil, err
+	}
+	vars = append(vars, dnsTSIGTime(r.Signed)...)
+	vars = append(vars, byte(r.Fudge>>8), byte(r.Fudge), byte(r.Error>>8), byte(r.Error))
+	vars = append(vars, byte(len(r.Other)>>8), byte(len(r.Other)))
+	vars = append(vars, r.Other...)
+
+	mac := hmac.New(h, v.Secret)
+	if len(prior) > 0 {
+		mac.Write([]byte{byte(len(prior) >> 8), byte(len(prior))})
+		mac.Write(prior)
+	}
+	mac.Write(msg)
+	mac.Write(vars)
+	return mac.Sum(nil), nil
+}
+
+// Sign and pack the message, with the TSIG record in additional section. Return the
+// message and its MAC, which is the prior MAC to verify the response.
+func (v *dnsTSIG) Sign(m *dnsMessage, prior []byte, signed time.Time) ([]byte, []byte, error) {
+	msg, err := m.Pack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r := &dnsTSIGRecord{Algorithm: dnsTSIGAlgorithm(v.Algorithm), Signed: signed, Fudge: 300, OrigID: m.ID}
+	if r.MAC, err = v.MAC(prior, msg, r); err != nil {
+		return nil, nil, err
+	}
+
+	data, err := r.pack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rr := dnsRR{Name: strings.ToLower(v.Name), Type: dnsTypeTSIG, Class: dnsClassANY, Data: data}
+	if msg, err = rr.pack(msg); err != nil {
+		return nil, nil, err
+	}
+
+	// Increase the ARCOUNT for TSIG.
+	binary.BigEndian.PutUint16(msg[10:], binary.BigEndian.Uint16(msg[10:])+1)
+	return msg, r.MAC, nil
+}
+
+// Verify the message signed by TSIG, with the prior MAC of request for response. Return
+// the MAC of message, which is the prior MAC to sign the response.
+func (v *dnsTSIG) Verify(b, prior []byte) ([]byte, error) {
+	m := &dnsMessage{}
+	if err := m.Unpack(b); err != nil {
+		return nil, oe.Wrapf(err, "unpack")
+	}
+
+	n := len(m.Additionals)
+	if n == 0 || m.Additionals[n-1].Type != dnsTypeTSIG {
+		return nil, oe.New("no tsig")
+	}
+	if rr := m.Additionals[n-1]; !strings.EqualFold(dnsFQDN(rr.Name), dnsFQDN(v.Name)) {
+		return nil, oe.Errorf("tsig key %v not match %v", rr.Name, v.Name)
+	}
+
+	r := &dnsTSIGRecord{}
+	if err := r.unpack(m.Additionals[n-1].Data); err != nil {
+		return nil, oe.Wrapf(err, "unpack tsig")
+	}
+	if !strings.EqualFold(dnsFQDN(r.Algorithm), dnsTSIGAlgorithm(v.Algorithm)) {
+		return nil, oe.Errorf("tsig algorithm %v not match %v", r.Algorithm, v.Algorithm)
+	}
+	if r.Error != 0 {
+		return nil, oe.Errorf("tsig error %v", r.Error)
+	}
+
+	// The message without TSIG, with the original id and ARCOUNT.
+	msg := append([]byte(nil), b[:m.last]...)
+	binary.BigEndian.PutUint16(msg[0:], r.OrigID)
+	binary.BigEndian.PutUint16(msg[10:], uint16(n-1))
+
+	mac, err := v.MAC(prior, msg, r)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, r.MAC) {
+		return nil, oe.New("tsig mac not match")
+	}
+
+	fudge := time.Duration(r.Fudge) * time.Second
+	if d := time.Since(r.Signed); d > fudge || -d > fudge {
+		return nil, oe.Errorf("tsig time %v out of fudge %v", r.Signed.Format(time.RFC3339), fudge)
+	}
+	return mac, nil
+}
+
+// The time signed in 48 bits.
+func dnsTSIGTime(t time.Time) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(t.Unix()))
+	return b[2:]
+}
+
+// Exchange the message with server over UDP, retry over TCP if truncated. If tsig, the
+// response must be signed, and verified with the MAC of request.
+func dnsExchange(ctx context.Context, server string, msg []byte, tsig *dnsTSIG, mac []byte) (*dnsMessage, error) {
+	res, err := dnsExchangeBy(ctx, "udp", server, msg, tsig, mac)
+	if err == nil && res.Truncated {
+		res, err = dnsExchangeBy(ctx, "tcp", server, msg, tsig, mac)
+	}
+	return res, err
+}
+
+func dnsExchangeBy(ctx context.Context, network, server string, msg []byte, tsig *dnsTSIG, mac []byte) (*dnsMessage, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, oe.Wrapf(err, "dial %v %v", network, server)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	id := binary.BigEndian.Uint16(msg)
+	if network == "tcp" {
+		msg = append([]byte{byte(len(msg) >> 8), byte(len(msg))}, msg...)
+	}
+	if _, err = conn.Write(msg); err != nil {
+		return nil, oe.Wrapf(err, "write")
+	}
+
+	b := make([]byte, 65535)
+	for {
+		var n int
+		if network == "tcp" {
+			if _, err = io.ReadFull(conn, b[:2]); err != nil {
+				return nil, oe.Wrapf(err, "read size")
+			}
+			n = int(binary.BigEndian.Uint16(b))
+			if _, err = io.ReadFull(conn, b[:n]); err != nil {
+				return nil, oe.Wrapf(err, "read")
+			}
+		} else if n, err = conn.Read(b); err != nil {
+			return nil, oe.Wrapf(err, "read")
+		}
+
+		res := &dnsMessage{}
+		if err := res.Unpack(b[:n]); err != nil {
+			return nil, oe.Wrapf(err, "unpack")
+		}
+		// Ignore the response of other request, for UDP, and read again.
+		if res.ID == id && res.Response {
+			if tsig != nil {
+				if _, err := tsig.Verify(b[:n], mac); err != nil {
+					return nil, oe.Wrapf(err, "verify response")
+				}
+			}
+			return res, nil
+		}
+		if network == "tcp" {
+			return nil, oe.Errorf("id %v not match %v", res.ID, id)
+		}
+	}
+}
+
+// A random id of DNS message.
+func dnsID() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// Query the records of name by server, for example, TXT or SOA.
+func dnsQuery(ctx context.Context, server, name string, typ uint16) (*dnsMessage, error) {
+	m := &dnsMessage{
+		ID: dnsID(), Opcode: dnsOpcodeQuery, RecursionDesired: true,
+		Questions: []dnsQuestion{{Name: name, Type: typ, Class: dnsClassIN}},
+	}
+
+	msg, err := m.Pack()
+	if err != nil {
+		return nil, oe.Wrapf(err, "pack")
+	}
+	return dnsExchange(ctx, server, msg, nil, nil)
+}
+
+// Lookup the TXT values of name by server.
+func dnsLookupTXT(ctx context.Context, server, name string) ([]string, error) {
+	res, err := dnsQuery(ctx, server, name, dnsTypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	if res.Rcode != dnsRcodeSuccess && res.Rcode != dnsRcodeNXDomain {
+		return nil, oe.Errorf("query %v rcode %v", name, res.Rcode)
+	}
+
+	var values []string
+	for _, rr := range res.Answers {
+		if rr.Type != dnsTypeTXT || !strings.EqualFold(rr.Name, dnsFQDN(name)) {
+			continue
+		}
+		value, err := dnsParseTXT(rr.Data)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// The fully qualified name, with the last dot.
+func dnsFQDN(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
@@ -0,0 +1,269 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The DNS provider for DNS-01, to present and cleanup the TXT record of challenge.
+type DNSProvider interface {
+	// Add the TXT record with value to the fqdn, for example, _acme-challenge.ossrs.net.
+	Present(ctx context.Context, fqdn, value string) error
+	// Remove the TXT record with value from the fqdn.
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// Create the DNS provider by url, for example:
+//
+//	rfc2136://127.0.0.1:53?zone=ossrs.net&tsigKey=acme&tsigSecret=base64&tsigAlgorithm=hmac-sha256&ttl=60
+//	exec:///usr/local/bin/dns-hook.sh
+func NewDNSProvider(s string) (DNSProvider, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, oe.Wrapf(err, "parse %v", s)
+	}
+
+	q := u.Query()
+	switch u.Scheme {
+	case "rfc2136":
+		v := &rfc2136Provider{Server: u.Host, Zone: q.Get("zone"), TTL: 60}
+		if !strings.Contains(v.Server, ":") {
+			v.Server += ":53"
+		}
+		if v.Zone != "" {
+			v.Zone = dnsFQDN(v.Zone)
+		}
+
+		if s := q.Get("ttl"); s != "" {
+			ttl, err := strconv.ParseUint(s, 10, 32)
+			if err != nil {
+				return nil, oe.Wrapf(err, "parse ttl %v", s)
+			}
+			v.TTL = uint32(ttl)
+		}
+
+		if key := q.Get("tsigKey"); key != "" {
+			secret, err := base64.StdEncoding.DecodeString(q.Get("tsigSecret"))
+			if err != nil {
+				return nil, oe.Wrapf(err, "decode tsig secret")
+			}
+
+			v.TSIG = &dnsTSIG{Name: dnsFQDN(key), Algorithm: q.Get("tsigAlgorithm"), Secret: secret}
+			if v.TSIG.Algorithm == "" {
+				v.TSIG.Algorithm = "hmac-sha256"
+			}
+			if _, err := dnsTSIGHash(v.TSIG.Algorithm); err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	case "exec":
+		if u.Path == "" {
+			return nil, oe.Errorf("no script of %v", s)
+		}
+		return &execProvider{Script: u.Path}, nil
+	}
+	return nil, oe.Errorf("unsupported dns provider %v", s)
+}
+
+// The provider by RFC 2136 dynamic update, signed by TSIG, for BIND, Knot or PowerDNS,
+// see https://datatracker.ietf.org/doc/html/rfc2136
+type rfc2136Provider struct {
+	// The primary server, for example, 127.0.0.1:53
+	Server string
+	// The zone to update, found by SOA if empty.
+	Zone string
+	TTL  uint32
+	// The TSIG key, optional.
+	TSIG *dnsTSIG
+}
+
+func (v *rfc2136Provider) Present(ctx context.Context, fqdn, value string) error {
+	return v.update(ctx, dnsRR{
+		Name: fqdn, Type: dnsTypeTXT, Class: dnsClassIN, TTL: v.TTL, Data: dnsTXTData(value),
+	})
+}
+
+// Delete the RR by class NONE, see https://datatracker.ietf.org/doc/html/rfc2136#section-2.5.4
+func (v *rfc2136Provider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return v.update(ctx, dnsRR{
+		Name: fqdn, Type: dnsTypeTXT, Class: dnsClassNONE, Data: dnsTXTData(value),
+	})
+}
+
+func (v *rfc2136Provider) update(ctx context.Context, rr dnsRR) error {
+	zone := v.Zone
+	if zone == "" {
+		var err error
+		if zone, err = v.findZone(ctx, rr.Name); err != nil {
+			return oe.Wrapf(err, "find zone of %v", rr.Name)
+		}
+	}
+
+	m := &dnsMessage{
+		ID: dnsID(), Opcode: dnsOpcodeUpdate,
+		Questions:   []dnsQuestion{{Name: zone, Type: dnsTypeSOA, Class: dnsClassIN}},
+		Authorities: []dnsRR{rr},
+	}
+
+	var msg, mac []byte
+	var err error
+	if v.TSIG != nil {
+		msg, mac, err = v.TSIG.Sign(m, nil, time.Now())
+	} else {
+		msg, err = m.Pack()
+	}
+	if err != nil {
+		return oe.Wrapf(err, "pack update")
+	}
+
+	res, err := dnsExchange(ctx, v.Server, msg, v.TSIG, mac)
+	if err != nil {
+		return oe.Wrapf(err, "update %v", v.Server)
+	}
+	if res.Rcode != dnsRcodeSuccess {
+		return oe.Errorf("update %v of zone %v rcode %v", rr.Name, zone, res.Rcode)
+	}
+	return nil
+}
+
+// Find the zone of name by SOA, in the answer or the authority of response.
+func (v *rfc2136Provider) findZone(ctx context.Context, name string) (string, error) {
+	for name = dnsFQDN(name); name != "."; name = name[strings.Index(name, ".")+1:] {
+		res, err := dnsQuery(ctx, v.Server, name, dnsTypeSOA)
+		if err != nil {
+			return "", err
+		}
+
+		for _, rrs := range [][]dnsRR{res.Answers, res.Authorities} {
+			for _, rr := range rrs {
+				if rr.Type == dnsTypeSOA {
+					return rr.Name, nil
+				}
+			}
+		}
+	}
+	return "", oe.New("no soa")
+}
+
+// The provider to exec a script, with args present or cleanup, the fqdn and value, for
+// example:
+//
+//	dns-hook.sh present _acme-challenge.ossrs.net. value
+type execProvider struct {
+	Script string
+}
+
+func (v *execProvider) Present(ctx context.Context, fqdn, value string) error {
+	return v.run(ctx, "present", fqdn, value)
+}
+
+func (v *execProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return v.run(ctx, "cleanup", fqdn, value)
+}
+
+func (v *execProvider) run(ctx context.Context, args ...string) error {
+	if b, err := exec.CommandContext(ctx, v.Script, args...).CombinedOutput(); err != nil {
+		return oe.Wrapf(err, "exec %v %v, output %v", v.Script, strings.Join(args, " "), string(b))
+	}
+	return nil
+}
+
+// The solver of DNS-01, which presents the TXT record by provider, and waits for it to
+// propagate to the resolvers, see https://datatracker.ietf.org/doc/html/rfc8555#section-8.4
+type dns01Solver struct {
+	Provider DNSProvider
+	// The resolvers to check propagation, for example, 8.8.8.8:53, empty to not check.
+	Resolvers []string
+	// The timeout and interval to check propagation.
+	Timeout  time.Duration
+	Interval time.Duration
+}
+
+// Present the TXT record of domain, wait for propagation, return the cleanup function.
+func (v *dns01Solver) Present(ctx context.Context, domain, keyAuth string) (func(), error) {
+	fqdn := fmt.Sprintf("_acme-challenge.%v", dnsFQDN(domain))
+	sum := sha256.Sum256([]byte(keyAuth))
+	value := acmeEncode(sum[:])
+
+	if err := v.Provider.Present(ctx, fqdn, value); err != nil {
+		return nil, oe.Wrapf(err, "present %v", fqdn)
+	}
+
+	cleanup := func() {
+		// The ctx of issue may be done, cleanup in a new one.
+		cctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := v.Provider.CleanUp(cctx, fqdn, value); err != nil {
+			ol.Wf(ctx, "dns-01 cleanup %v err %+v", fqdn, err)
+		}
+	}
+
+	if err := v.wait(ctx, fqdn, value); err != nil {
+		cleanup()
+		return nil, err
+	}
+	return cleanup, nil
+}
+
+// Wait for the TXT value of fqdn in all resolvers.
+func (v *dns01Solver) wait(ctx context.Context, fqdn, value string) error {
+	ctx, cancel := context.WithTimeout(ctx, v.Timeout)
+	defer cancel()
+
+	pending := append([]string(nil), v.Resolvers...)
+	for len(pending) > 0 {
+		var next []string
+		var lastErr error
+		for _, resolver := range pending {
+			values, err := dnsLookupTXT(ctx, resolver, fqdn)
+			if err != nil || !stringsContains(values, value) {
+				next, lastErr = append(next, resolver), err
+			}
+		}
+
+		if pending = next; len(pending) == 0 {
+			break
+		}
+
+		if err := acmeSleep(ctx, v.Interval); err != nil {
+			return oe.Wrapf(err, "propagate %v to %v, last err %v", fqdn, strings.Join(pending, ","), lastErr)
+		}
+	}
+
+	ol.Tf(ctx, "dns-01 %v propagated to %v", fqdn, strings.Join(v.Resolvers, ","))
+	return nil
+}
@@ -0,0 +1,227 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRFC2136Provider(t *testing.T) {
+	secret := []byte("tsig secret")
+	server := newFakeDNS(t, "ossrs.net.", &dnsTSIG{Name: "acme.", Algorithm: "hmac-sha256", Secret: secret})
+
+	ctx := context.Background()
+	fqdn := "_acme-challenge.www.ossrs.net."
+
+	// The zone is found by SOA.
+	p, err := NewDNSProvider(fmt.Sprintf("rfc2136://%v?tsigKey=acme&tsigSecret=%v",
+		server.Addr(), url.QueryEscape(base64.StdEncoding.EncodeToString(secret))))
+	if err != nil {
+		t.Fatalf("create err %+v", err)
+	}
+	if err := p.Present(ctx, fqdn, "v1"); err != nil {
+		t.Fatalf("present err %+v", err)
+	}
+	if err := p.Present(ctx, fqdn, "v2"); err != nil {
+		t.Fatalf("present err %+v", err)
+	}
+	if values := server.TXT(fqdn); strings.Join(values, ",") != "v1,v2" {
+		t.Errorf("expect v1,v2, got %v", values)
+	}
+
+	if err := p.CleanUp(ctx, fqdn, "v1"); err != nil {
+		t.Fatalf("cleanup err %+v", err)
+	}
+	if values := server.TXT(fqdn); strings.Join(values, ",") != "v2" {
+		t.Errorf("expect v2, got %v", values)
+	}
+
+	for _, s := range []string{
+		fmt.Sprintf("rfc2136://%v?zone=ossrs.net&tsigKey=acme&tsigSecret=%v", server.Addr(), base64.StdEncoding.EncodeToString([]byte("invalid"))),
+		fmt.Sprintf("rfc2136://%v?zone=ossrs.net", server.Addr()),
+		fmt.Sprintf("rfc2136://%v?zone=ossrs.io&tsigKey=acme&tsigSecret=%v", server.Addr(), base64.StdEncoding.EncodeToString(secret)),
+	} {
+		p, err := NewDNSProvider(s)
+		if err != nil {
+			t.Fatalf("create err %+v", err)
+		}
+		if err := p.Present(ctx, fqdn, "v3"); err == nil {
+			t.Errorf("should fail for %v", s)
+		}
+	}
+
+	for _, s := range []string{"dns://127.0.0.1", "exec://", "rfc2136://127.0.0.1?tsigKey=acme&tsigAlgorithm=hmac-sha3", "rfc2136://127.0.0.1?ttl=x"} {
+		if _, err := NewDNSProvider(s); err == nil {
+			t.Errorf("should fail for %v", s)
+		}
+	}
+}
+
+func TestExecProvider(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no shell")
+	}
+
+	dir := t.TempDir()
+	script, output := path.Join(dir, "hook.sh"), path.Join(dir, "output")
+	if err := os.WriteFile(script, []byte(fmt.Sprintf("#!/bin/sh\necho \"$@\" >> %v\n[ \"$3\" != fail ] || { echo failed; exit 1; }\n", output)), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := NewDNSProvider("exec://" + script)
+	if err != nil {
+		t.Fatalf("create err %+v", err)
+	}
+
+	ctx := context.Background()
+	if err := p.Present(ctx, "_acme-challenge.ossrs.net.", "v1"); err != nil {
+		t.Errorf("present err %+v", err)
+	}
+	if err := p.CleanUp(ctx, "_acme-challenge.ossrs.net.", "v1"); err != nil {
+		t.Errorf("cleanup err %+v", err)
+	}
+	if err := p.Present(ctx, "_acme-challenge.ossrs.net.", "fail"); err == nil || !strings.Contains(err.Error(), "failed") {
+		t.Errorf("should fail with output, err %v", err)
+	}
+
+	b, _ := ioutil.ReadFile(output)
+	if expect := "present _acme-challenge.ossrs.net. v1\ncleanup _acme-challenge.ossrs.net. v1\npresent _acme-challenge.ossrs.net. fail\n"; string(b) != expect {
+		t.Errorf("expect %v, got %v", expect, string(b))
+	}
+}
+
+func TestDNS01Solver(t *testing.T) {
+	primary := newFakeDNS(t, "ossrs.net.", nil)
+	secondary := newFakeDNS(t, "ossrs.net.", nil)
+
+	s := &dns01Solver{
+		Provider:  &rfc2136Provider{Server: primary.Addr(), Zone: "ossrs.net.", TTL: 60},
+		Resolvers: []string{primary.Addr()}, Timeout: 300 * time.Millisecond, Interval: 50 * time.Millisecond,
+	}
+
+	ctx := context.Background()
+	fqdn := "_acme-challenge.ossrs.net."
+	sum := sha256.Sum256([]byte("token.thumbprint"))
+	value := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	cleanup, err := s.Present(ctx, "ossrs.net", "token.thumbprint")
+	if err != nil {
+		t.Fatalf("present err %+v", err)
+	}
+	if values := primary.TXT(fqdn); len(values) != 1 || values[0] != value {
+		t.Errorf("expect %v, got %v", value, values)
+	}
+	cleanup()
+	if values := primary.TXT(fqdn); len(values) != 0 {
+		t.Errorf("expect cleanup, got %v", values)
+	}
+
+	// Never propagate to the secondary, cleanup when timeout.
+	s.Resolvers = append(s.Resolvers, secondary.Addr())
+	if _, err := s.Present(ctx, "ossrs.net", "token.thumbprint"); err == nil || !strings.Contains(err.Error(), secondary.Addr()) {
+		t.Errorf("should timeout for %v, err %v", secondary.Addr(), err)
+	}
+	if values := primary.TXT(fqdn); len(values) != 0 {
+		t.Errorf("expect cleanup, got %v", values)
+	}
+}
+
+func TestACMEManagerDNS01(t *testing.T) {
+	server := newFakeDNS(t, "ossrs.net.", nil)
+	ca := newFakeACME(t)
+	ca.dnsAddr = server.Addr()
+
+	dir := t.TempDir()
+	caFile := path.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.server.Certificate().Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &Config{
+		Cache: path.Join(dir, "cache"), Domains: "*.ossrs.net",
+		ACMEDirectory: ca.server.URL + "/dir", ACMEChallenges: "http-01", ACMECA: caFile,
+		ACMEDNS: "rfc2136://" + server.Addr(), ACMEDNSResolvers: server.Addr(), ACMEDNSTimeout: "3s",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, err := NewACMEManager(ctx, conf)
+	if err != nil {
+		t.Fatalf("create err %+v", err)
+	}
+	m.Start(ctx)
+	defer m.Close()
+
+	if strings.Join(m.Challenges, ",") != "http-01,dns-01" {
+		t.Errorf("expect dns-01 appended, got %v", m.Challenges)
+	}
+
+	for _, name := range []string{"a.ossrs.net", "b.ossrs.net"} {
+		cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Fatalf("get %v err %+v", name, err)
+		}
+		if len(cert.Leaf.DNSNames) != 1 || cert.Leaf.DNSNames[0] != "*.ossrs.net" {
+			t.Errorf("expect *.ossrs.net, got %v", cert.Leaf.DNSNames)
+		}
+	}
+	if ca.Orders() != 1 {
+		t.Errorf("expect 1 order, got %v", ca.Orders())
+	}
+	if order := ca.Order("*.ossrs.net"); order == nil || order.chalType != ChallengeDNS01 {
+		t.Errorf("expect dns-01, got %v", order)
+	}
+	if values := server.TXT("_acme-challenge.ossrs.net."); len(values) != 0 {
+		t.Errorf("expect cleanup, got %v", values)
+	}
+	if _, err := os.Stat(path.Join(conf.Cache, "_.ossrs.net.crt")); err != nil {
+		t.Errorf("no cert file, err %v", err)
+	}
+
+	for _, name := range []string{"ossrs.net", "a.b.ossrs.net"} {
+		if _, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: name}); err == nil {
+			t.Errorf("should not allow %v", name)
+		}
+	}
+
+	conf.ACMEDNS, conf.ACMEChallenges = "", "dns-01"
+	if _, err := NewACMEManager(ctx, conf); err == nil {
+		t.Errorf("should fail for dns-01 without provider")
+	}
+}
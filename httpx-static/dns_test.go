@@ -0,0 +1,301 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The authoritative DNS server of zone for test, which answers SOA and TXT, and accepts
+// the UPDATE signed by TSIG.
+type fakeDNS struct {
+	conn net.PacketConn
+	zone string
+	// The TSIG key required by UPDATE, nil to not require.
+	tsig *dnsTSIG
+
+	lock    sync.Mutex
+	records map[string][]string
+}
+
+func newFakeDNS(t *testing.T, zone string, tsig *dnsTSIG) *fakeDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	v := &fakeDNS{conn: conn, zone: zone, tsig: tsig, records: make(map[string][]string)}
+	go func() {
+		b := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			if res := v.serve(b[:n]); res != nil {
+				conn.WriteTo(res, addr)
+			}
+		}
+	}()
+	return v
+}
+
+func (v *fakeDNS) Addr() string {
+	return v.conn.LocalAddr().String()
+}
+
+// The TXT values of name.
+func (v *fakeDNS) TXT(name string) []string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.records[strings.ToLower(dnsFQDN(name))]
+}
+
+func (v *fakeDNS) serve(b []byte) []byte {
+	m := &dnsMessage{}
+	if err := m.Unpack(b); err != nil || len(m.Questions) != 1 {
+		return nil
+	}
+
+	res := &dnsMessage{ID: m.ID, Response: true, Opcode: m.Opcode, Authoritative: true, Questions: m.Questions}
+	q := m.Questions[0]
+	name := strings.ToLower(q.Name)
+
+	var mac []byte
+	if m.Opcode == dnsOpcodeUpdate {
+		res.Rcode, mac = v.update(m, b)
+	} else if !strings.HasSuffix(name, v.zone) {
+		res.Rcode = 5 // REFUSED
+	} else if q.Type == dnsTypeSOA && name == v.zone {
+		res.Answers = append(res.Answers, v.soa())
+	} else if q.Type == dnsTypeTXT && len(v.TXT(name)) > 0 {
+		for _, value := range v.TXT(name) {
+			res.Answers = append(res.Answers, dnsRR{Name: q.Name, Type: dnsTypeTXT, Class: dnsClassIN, TTL: 60, Data: dnsTXTData(value)})
+		}
+	} else {
+		res.Rcode = dnsRcodeNXDomain
+		res.Authorities = append(res.Authorities, v.soa())
+	}
+
+	// Sign the response of the signed request.
+	if mac != nil {
+		b, _, _ = v.tsig.Sign(res, mac, time.Now())
+	} else {
+		b, _ = res.Pack()
+	}
+	return b
+}
+
+func (v *fakeDNS) soa() dnsRR {
+	data, _ := dnsPackName(nil, "ns."+v.zone)
+	data, _ = dnsPackName(data, "admin."+v.zone)
+	return dnsRR{Name: v.zone, Type: dnsTypeSOA, Class: dnsClassIN, TTL: 60, Data: append(data, make([]byte, 20)...)}
+}
+
+// Verify the TSIG and update the TXT records, return the rcode, and the MAC of request
+// to sign the response.
+func (v *fakeDNS) update(m *dnsMessage, b []byte) (int, []byte) {
+	if !strings.EqualFold(m.Questions[0].Name, v.zone) {
+		return 10, nil // NOTZONE
+	}
+
+	var mac []byte
+	if v.tsig != nil {
+		var err error
+		if mac, err = v.tsig.Verify(b, nil); err != nil {
+			return dnsRcodeNotAuth, nil
+		}
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for _, rr := range m.Authorities {
+		name := strings.ToLower(rr.Name)
+		value, _ := dnsParseTXT(rr.Data)
+		if rr.Type != dnsTypeTXT {
+			continue
+		}
+
+		if rr.Class == dnsClassIN && !stringsContains(v.records[name], value) {
+			v.records[name] = append(v.records[name], value)
+		} else if rr.Class == dnsClassNONE {
+			var values []string
+			for _, s := range v.records[name] {
+				if s != value {
+					values = append(values, s)
+				}
+			}
+			v.records[name] = values
+		}
+	}
+	return dnsRcodeSuccess, mac
+}
+
+func TestDNSMessage(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	m := &dnsMessage{
+		ID: 0x1234, Response: true, Opcode: dnsOpcodeUpdate, Authoritative: true, RecursionDesired: true, Rcode: dnsRcodeNotAuth,
+		Questions:   []dnsQuestion{{Name: "ossrs.net.", Type: dnsTypeSOA, Class: dnsClassIN}},
+		Answers:     []dnsRR{{Name: "_acme-challenge.ossrs.net", Type: dnsTypeTXT, Class: dnsClassIN, TTL: 60, Data: dnsTXTData(long)}},
+		Authorities: []dnsRR{{Name: "ossrs.net.", Type: dnsTypeTXT, Class: dnsClassNONE, Data: dnsTXTData("v")}},
+	}
+
+	b, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := &dnsMessage{}
+	if err := o.Unpack(b); err != nil {
+		t.Fatalf("unpack err %+v", err)
+	}
+	if o.ID != m.ID || !o.Response || o.Opcode != m.Opcode || !o.Authoritative || !o.RecursionDesired ||
+		o.RecursionAvailable || o.Truncated || o.Rcode != m.Rcode {
+		t.Errorf("invalid header %+v", o)
+	}
+	if len(o.Questions) != 1 || o.Questions[0] != m.Questions[0] {
+		t.Errorf("invalid questions %+v", o.Questions)
+	}
+	if len(o.Answers) != 1 || o.Answers[0].Name != "_acme-challenge.ossrs.net." || o.Answers[0].TTL != 60 {
+		t.Errorf("invalid answers %+v", o.Answers)
+	} else if value, err := dnsParseTXT(o.Answers[0].Data); err != nil || value != long {
+		t.Errorf("invalid txt %v, err %v", value, err)
+	}
+	if len(o.Authorities) != 1 || o.Authorities[0].Class != dnsClassNONE {
+		t.Errorf("invalid authorities %+v", o.Authorities)
+	}
+
+	// The answer name is compressed, pointer to the question name at 12.
+	b, _ = (&dnsMessage{ID: 1, Response: true, Questions: []dnsQuestion{{Name: "ossrs.net", Type: dnsTypeTXT, Class: dnsClassIN}}}).Pack()
+	b[7] = 1
+	b = append(b, 0xc0, 12, 0, dnsTypeTXT, 0, dnsClassIN, 0, 0, 0, 60, 0, 2, 1, 'v')
+	if err := o.Unpack(b); err != nil {
+		t.Fatalf("unpack err %+v", err)
+	}
+	if len(o.Answers) != 1 || o.Answers[0].Name != "ossrs.net." || !bytes.Equal(o.Answers[0].Data, []byte{1, 'v'}) {
+		t.Errorf("invalid answers %+v", o.Answers)
+	}
+
+	// The pointer loop should fail.
+	b = append(b[:12], 0xc0, 12)
+	b[5], b[7] = 1, 0
+	if err := o.Unpack(b); err == nil {
+		t.Errorf("should fail for pointer loop")
+	}
+
+	for _, name := range []string{"a..b", strings.Repeat("a", 64) + ".net"} {
+		if _, err := dnsPackName(nil, name); err == nil {
+			t.Errorf("should fail for %v", name)
+		}
+	}
+}
+
+func TestDNSLookup(t *testing.T) {
+	server := newFakeDNS(t, "ossrs.net.", nil)
+	server.lock.Lock()
+	server.records["_acme-challenge.ossrs.net."] = []string{"v1", "v2"}
+	server.lock.Unlock()
+
+	ctx := context.Background()
+	if values, err := dnsLookupTXT(ctx, server.Addr(), "_acme-challenge.OSSRS.net"); err != nil {
+		t.Errorf("lookup err %+v", err)
+	} else if strings.Join(values, ",") != "v1,v2" {
+		t.Errorf("expect v1,v2, got %v", values)
+	}
+
+	if values, err := dnsLookupTXT(ctx, server.Addr(), "none.ossrs.net"); err != nil || len(values) != 0 {
+		t.Errorf("expect none, got %v, err %v", values, err)
+	}
+	if _, err := dnsLookupTXT(ctx, server.Addr(), "ossrs.io"); err == nil {
+		t.Errorf("should fail for refused")
+	}
+}
+
+func TestDNSExchange(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Respond a message of other id before the response, and sign the response by the key.
+	key := &dnsTSIG{Name: "acme.", Algorithm: "hmac-sha256", Secret: []byte("server secret")}
+	var requests int32
+	go func() {
+		b := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&requests, 1)
+
+			m := &dnsMessage{}
+			m.Unpack(b[:n])
+			other, _ := (&dnsMessage{ID: m.ID + 1, Response: true}).Pack()
+			conn.WriteTo(other, addr)
+
+			res := &dnsMessage{ID: m.ID, Response: true, Opcode: m.Opcode, Questions: m.Questions}
+			mac, _ := key.Verify(b[:n], nil)
+			res.Rcode = dnsRcodeNotAuth
+			if mac != nil {
+				res.Rcode = dnsRcodeSuccess
+			}
+			msg, _, _ := key.Sign(res, mac, time.Now())
+			conn.WriteTo(msg, addr)
+		}
+	}()
+
+	ctx := context.Background()
+	exchange := func(tsig *dnsTSIG) (*dnsMessage, error) {
+		m := &dnsMessage{ID: dnsID(), Opcode: dnsOpcodeUpdate, Questions: []dnsQuestion{{Name: "ossrs.net.", Type: dnsTypeSOA, Class: dnsClassIN}}}
+		msg, mac, _ := tsig.Sign(m, nil, time.Now())
+		return dnsExchange(ctx, conn.LocalAddr().String(), msg, tsig, mac)
+	}
+
+	// Read again for the other id, never write the request again.
+	if res, err := exchange(key); err != nil || res.Rcode != dnsRcodeSuccess {
+		t.Errorf("exchange err %+v, res %v", err, res)
+	}
+	if v := atomic.LoadInt32(&requests); v != 1 {
+		t.Errorf("expect 1 request, got %v", v)
+	}
+
+	// The response signed by other key is not trusted.
+	if _, err := exchange(&dnsTSIG{Name: "acme.", Algorithm: "hmac-sha256", Secret: []byte("client secret")}); err == nil {
+		t.Errorf("should fail for response not verified")
+	}
+	if _, err := exchange(&dnsTSIG{Name: "other.", Algorithm: "hmac-sha256", Secret: []byte("server secret")}); err == nil {
+		t.Errorf("should fail for response of other key")
+	}
+}
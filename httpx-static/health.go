@@ -0,0 +1,242 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// The health check for upstream pool, by the options of the first proxy url, for example:
+//
+//	-proxy http://127.0.0.1:1985/api/v1?healthCheck=/api/v1/versions&healthInterval=5s&maxFails=3
+//
+// The active check probes the healthCheck path of each upstream every healthInterval, and
+// expects the healthStatus. The passive check ejects the upstream after maxFails consecutive
+// failures, and retries it after failTimeout if no active check.
+type HealthCheck struct {
+	// For active check, empty path to disable.
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+	Status   int
+	// For passive check, 0 to disable.
+	MaxFails    int
+	FailTimeout time.Duration
+}
+
+func NewHealthCheck(q url.Values) (*HealthCheck, error) {
+	v := &HealthCheck{
+		Path: q.Get("healthCheck"), Interval: 5 * time.Second, Timeout: 3 * time.Second,
+		Status: http.StatusOK, FailTimeout: 10 * time.Second,
+	}
+
+	durations := []struct {
+		key   string
+		value *time.Duration
+	}{
+		{"healthInterval", &v.Interval}, {"healthTimeout", &v.Timeout}, {"failTimeout", &v.FailTimeout},
+	}
+	for _, d := range durations {
+		if s := q.Get(d.key); s != "" {
+			if iv, err := time.ParseDuration(s); err != nil {
+				return nil, oe.Wrapf(err, "parse %v=%v", d.key, s)
+			} else if iv <= 0 {
+				return nil, oe.Errorf("invalid %v=%v", d.key, s)
+			} else {
+				*d.value = iv
+			}
+		}
+	}
+
+	ints := []struct {
+		key   string
+		value *int
+	}{
+		{"healthStatus", &v.Status}, {"maxFails", &v.MaxFails},
+	}
+	for _, i := range ints {
+		if s := q.Get(i.key); s != "" {
+			if iv, err := strconv.Atoi(s); err != nil {
+				return nil, oe.Wrapf(err, "parse %v=%v", i.key, s)
+			} else {
+				*i.value = iv
+			}
+		}
+	}
+
+	return v, nil
+}
+
+// Whether upstream is available for request.
+func (v *UpstreamPool) available(upstream *Upstream) bool {
+	if atomic.LoadInt32(&upstream.down) == 0 {
+		return true
+	}
+
+	// Without active check, retry the upstream after fail timeout.
+	if v.Health.Path == "" {
+		downAt := time.Unix(0, atomic.LoadInt64(&upstream.downAt))
+		return time.Now().Sub(downAt) > v.Health.FailTimeout
+	}
+
+	return false
+}
+
+// Mark the upstream failed, for example, dial failed or 502 from upstream.
+func (v *UpstreamPool) Fail(ctx context.Context, upstream *Upstream, err error) {
+	httpxMetrics.UpstreamErrors.Add(1, v.Path, upstream.URL.Host)
+
+	fails := atomic.AddInt32(&upstream.fails, 1)
+	if v.Health.MaxFails <= 0 || int(fails) < v.Health.MaxFails {
+		return
+	}
+
+	// Reset the down time, to retry it again after fail timeout.
+	atomic.StoreInt64(&upstream.downAt, time.Now().UnixNano())
+	if atomic.CompareAndSwapInt32(&upstream.down, 0, 1) {
+		ol.Wf(ctx, "Upstream %v of %v down, fails=%v, err %v", upstream.URL.Host, v.Path, fails, err)
+	}
+}
+
+// Mark the upstream succeeded.
+func (v *UpstreamPool) Succeed(ctx context.Context, upstream *Upstream) {
+	atomic.StoreInt32(&upstream.fails, 0)
+	if atomic.CompareAndSwapInt32(&upstream.down, 1, 0) {
+		ol.Tf(ctx, "Upstream %v of %v up", upstream.URL.Host, v.Path)
+	}
+}
+
+// Start the active health check and rate limiter, until Close.
+func (v *UpstreamPool) Start(ctx context.Context) {
+	if v.limiter != nil {
+		v.limiter.Start(ctx)
+	}
+
+	if v.Health.Path == "" || v.cancel != nil {
+		return
+	}
+
+	ctx, v.cancel = context.WithCancel(ctx)
+	for _, upstream := range v.Upstreams {
+		go func(ctx context.Context, upstream *Upstream) {
+			ticker := time.NewTicker(v.Health.Interval)
+			defer ticker.Stop()
+
+			for {
+				if err := v.probe(ctx, upstream); err != nil {
+					// Eject by active check directly, ignore the maxFails.
+					atomic.StoreInt64(&upstream.downAt, time.Now().UnixNano())
+					if atomic.CompareAndSwapInt32(&upstream.down, 0, 1) {
+						ol.Wf(ctx, "Upstream %v of %v down, err %+v", upstream.URL.Host, v.Path, err)
+					}
+				} else {
+					v.Succeed(ctx, upstream)
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(ol.WithContext(ctx), upstream)
+	}
+}
+
+// Stop the active health check and rate limiter, and remove the cache.
+func (v *UpstreamPool) Close() {
+	if v.HLS != nil {
+		v.HLS.Close()
+	}
+	if v.Cache != nil {
+		v.Cache.Close()
+	}
+	if v.limiter != nil {
+		v.limiter.Close()
+	}
+	if v.cancel != nil {
+		v.cancel()
+	}
+}
+
+func (v *UpstreamPool) probe(ctx context.Context, upstream *Upstream) error {
+	ctx, cancel := context.WithTimeout(ctx, v.Health.Timeout)
+	defer cancel()
+
+	api := fmt.Sprintf("%v://%v%v", upstream.URL.Scheme, upstream.URL.Host, v.Health.Path)
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, api, nil)
+	if err != nil {
+		return oe.Wrapf(err, "new request %v", api)
+	}
+
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return oe.Wrapf(err, "probe %v", api)
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	if res.StatusCode != v.Health.Status {
+		return oe.Errorf("probe %v status %v, expect %v", api, res.StatusCode, v.Health.Status)
+	}
+	return nil
+}
+
+// The state of upstream, for admin api.
+type UpstreamState struct {
+	URL     string `json:"url"`
+	Healthy bool   `json:"healthy"`
+	Fails   int32  `json:"fails"`
+	Active  int64  `json:"active"`
+}
+
+// The state of upstream pool, for admin api.
+type UpstreamPoolState struct {
+	Host      string           `json:"host,omitempty"`
+	Path      string           `json:"path"`
+	Strategy  string           `json:"lb"`
+	Upstreams []*UpstreamState `json:"upstreams"`
+}
+
+func (v *UpstreamPool) State() *UpstreamPoolState {
+	state := &UpstreamPoolState{Path: v.Path, Strategy: v.Strategy}
+	for _, upstream := range v.Upstreams {
+		state.Upstreams = append(state.Upstreams, &UpstreamState{
+			URL: upstream.URL.String(), Healthy: atomic.LoadInt32(&upstream.down) == 0,
+			Fails: atomic.LoadInt32(&upstream.fails), Active: upstream.Active(),
+		})
+	}
+	return state
+}
@@ -0,0 +1,234 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The extensions of HLS segments, which are immutable and cached by URL.
+var hlsSegmentExts = []string{".ts", ".m4s", ".mp4", ".aac", ".m4a", ".vtt"}
+
+// The response is too large to cache.
+var errHLSOverflow = oe.New("hls overflow")
+
+// The HLS edge cache, to pull the m3u8 and segments from origin. The segments are
+// cached immutable by URL, while the live playlist is cached for hlsPlaylistRatio of
+// the target duration. The concurrent misses are coalesced to one origin fetch, and
+// the entries are evicted in LRU order when exceed hlsCacheSize.
+type HLSCache struct {
+	Path string
+	// The ratio of target duration to cache the live playlist.
+	PlaylistRatio float64
+	// The timeout to fetch from origin.
+	FetchTimeout time.Duration
+
+	store  *CacheStore
+	flight flightGroup
+}
+
+// Create the HLS cache if hls=true, or nil.
+func NewHLSCache(proxyUrl *url.URL) (*HLSCache, error) {
+	q := proxyUrl.Query()
+	if q.Get("hls") != "true" {
+		return nil, nil
+	}
+
+	v := &HLSCache{Path: proxyUrl.Path, PlaylistRatio: 0.5, FetchTimeout: 30 * time.Second}
+
+	capacity := int64(64 * 1024 * 1024)
+	if s := q.Get("hlsCacheSize"); s != "" {
+		var err error
+		if capacity, err = parseSize(s); err != nil || capacity <= 0 {
+			return nil, oe.Errorf("invalid hlsCacheSize=%v", s)
+		}
+	}
+
+	if s := q.Get("hlsPlaylistRatio"); s != "" {
+		var err error
+		if v.PlaylistRatio, err = strconv.ParseFloat(s, 64); err != nil || v.PlaylistRatio < 0 {
+			return nil, oe.Errorf("invalid hlsPlaylistRatio=%v", s)
+		}
+	}
+
+	if s := q.Get("hlsFetchTimeout"); s != "" {
+		var err error
+		if v.FetchTimeout, err = time.ParseDuration(s); err != nil || v.FetchTimeout <= 0 {
+			return nil, oe.Errorf("invalid hlsFetchTimeout=%v", s)
+		}
+	}
+
+	var err error
+	if v.store, err = NewCacheStore(capacity, q.Get("hlsCacheDir")); err != nil {
+		return nil, oe.Wrapf(err, "cache store")
+	}
+
+	return v, nil
+}
+
+func (v *HLSCache) String() string {
+	return fmt.Sprintf("store=%v, playlist=%v, timeout=%v", v.store, v.PlaylistRatio, v.FetchTimeout)
+}
+
+// Remove the cached entries.
+func (v *HLSCache) Close() {
+	v.store.Close()
+	httpxMetrics.CacheBytes.Set(0, v.Path)
+}
+
+// Remove the entries whose URI starts with prefix.
+func (v *HLSCache) Purge(prefix string) int {
+	n := v.store.Purge(prefix)
+	size, _ := v.store.Size()
+	httpxMetrics.CacheBytes.Set(float64(size), v.Path)
+	return n
+}
+
+// Whether the request is for HLS playlist or segment.
+func (v *HLSCache) Match(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	ext := path.Ext(r.URL.Path)
+	if ext == ".m3u8" {
+		return true
+	}
+	for _, e := range hlsSegmentExts {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// Serve the request from cache, or fetch from origin by proxy when missed.
+func (v *HLSCache) Serve(ctx context.Context, w http.ResponseWriter, r *http.Request, proxy http.Handler) {
+	key := r.URL.RequestURI()
+	if entry := v.store.Get(key); entry != nil && entry.Fresh(time.Now()) {
+		httpxMetrics.CacheRequests.Add(1, v.Path, "hit")
+		serveCacheEntry(w, r, entry, "HIT")
+		return
+	}
+
+	val, err, shared := v.flight.Do(key, func() (interface{}, error) {
+		return v.fetch(ctx, r, key, proxy)
+	})
+
+	// Proxy it directly, if the response is too large to cache, for example, the VOD mp4.
+	if err == errHLSOverflow {
+		httpxMetrics.CacheRequests.Add(1, v.Path, "bypass")
+		w.Header().Set("X-Cache", "BYPASS")
+		proxy.ServeHTTP(w, r)
+		return
+	}
+	if err != nil {
+		ol.Wf(ctx, "HLS fetch %v err %+v", key, err)
+		http.Error(w, "fetch from origin failed", http.StatusBadGateway)
+		return
+	}
+
+	if shared {
+		httpxMetrics.CacheRequests.Add(1, v.Path, "shared")
+	} else {
+		httpxMetrics.CacheRequests.Add(1, v.Path, "miss")
+	}
+	serveCacheEntry(w, r, val.(*cacheEntry), "MISS")
+}
+
+// Fetch the whole response from origin, and cache it if OK.
+func (v *HLSCache) fetch(ctx context.Context, r *http.Request, key string, proxy http.Handler) (*cacheEntry, error) {
+	// Never cancel the fetch when the client is gone, because it's shared by others.
+	fetchCtx, cancel := context.WithTimeout(context.Background(), v.FetchTimeout)
+	defer cancel()
+
+	req := r.Clone(fetchCtx)
+	req.Method = http.MethodGet
+	for _, h := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		req.Header.Del(h)
+	}
+
+	start := time.Now()
+	bw := newBufferWriter(v.store.capacity)
+	proxy.ServeHTTP(bw, req)
+	if bw.overflow {
+		return nil, errHLSOverflow
+	}
+
+	// Never cache the failed response, but share it with the waiting requests.
+	body := bw.body.Bytes()
+	if bw.status != http.StatusOK {
+		return &cacheEntry{Key: key, Status: bw.status, Header: bw.header, CachedAt: start, body: body}, nil
+	}
+
+	var expireAt time.Time
+	if path.Ext(r.URL.Path) == ".m3u8" {
+		if ttl := v.playlistTTL(body); ttl >= 0 {
+			expireAt = start.Add(ttl)
+		}
+	}
+
+	// Serve the response without cache, if failed to store it.
+	entry, err := v.store.Set(key, bw.status, bw.header, body, expireAt)
+	if err != nil {
+		ol.Wf(ctx, "HLS cache %v err %+v", key, err)
+		return &cacheEntry{Key: key, Status: bw.status, Header: bw.header, CachedAt: start, body: body}, nil
+	}
+
+	size, entries := v.store.Size()
+	httpxMetrics.CacheBytes.Set(float64(size), v.Path)
+	ol.Tf(ctx, "HLS cache %v, size=%v, expire=%v, cost=%v, cache=%v/%v",
+		key, len(body), expireAt.Format(time.RFC3339), time.Now().Sub(start), size, entries)
+	return entry, nil
+}
+
+// The TTL of playlist, which is ratio of target duration for live, or -1 for VOD which
+// never changes. The master playlist without target duration is cached for 1s.
+func (v *HLSCache) playlistTTL(body []byte) time.Duration {
+	if bytes.Contains(body, []byte("#EXT-X-ENDLIST")) {
+		return -1
+	}
+
+	for _, line := range strings.Split(string(body), "\n") {
+		if line = strings.TrimSpace(line); strings.HasPrefix(line, "#EXT-X-TARGETDURATION:") {
+			s := strings.TrimPrefix(line, "#EXT-X-TARGETDURATION:")
+			if td, err := strconv.ParseFloat(s, 64); err == nil && td > 0 {
+				return time.Duration(td * v.PlaylistRatio * float64(time.Second))
+			}
+		}
+	}
+
+	return time.Second
+}
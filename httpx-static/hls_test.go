@@ -0,0 +1,237 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheStore(t *testing.T) {
+	for _, dir := range []string{"", t.TempDir()} {
+		store, err := NewCacheStore(10, dir)
+		if err != nil {
+			t.Fatalf("store err %+v", err)
+		}
+
+		store.Set("a", 200, nil, []byte("aaaa"), time.Time{})
+		store.Set("b", 200, nil, []byte("bbbb"), time.Time{})
+		// Touch a, so b is the least recently used.
+		if store.Get("a") == nil {
+			t.Errorf("dir=%v, a should be cached", dir)
+		}
+		store.Set("c", 200, nil, []byte("cccc"), time.Time{})
+
+		if store.Get("b") != nil {
+			t.Errorf("dir=%v, b should be evicted", dir)
+		}
+		if size, n := store.Size(); size != 8 || n != 2 {
+			t.Errorf("dir=%v, size=%v, n=%v", dir, size, n)
+		}
+		if _, err := store.Set("d", 200, nil, []byte("0123456789a"), time.Time{}); err == nil {
+			t.Errorf("dir=%v, should fail for exceed capacity", dir)
+		}
+
+		entry := store.Get("c")
+		body, closer, err := entry.Open()
+		if err != nil {
+			t.Fatalf("dir=%v, open err %+v", dir, err)
+		}
+		if b, _ := ioutil.ReadAll(body); string(b) != "cccc" {
+			t.Errorf("dir=%v, body=%v", dir, string(b))
+		}
+		closer.Close()
+
+		if n := store.Purge(""); n != 2 {
+			t.Errorf("dir=%v, purged=%v", dir, n)
+		}
+		store.Close()
+	}
+}
+
+func TestHLSCache(t *testing.T) {
+	var segments, playlists int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/live/livestream.m3u8" {
+			atomic.AddInt32(&playlists, 1)
+			w.Write([]byte("#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXTINF:2.0,\nlivestream-0.ts\n"))
+			return
+		}
+
+		atomic.AddInt32(&segments, 1)
+		time.Sleep(100 * time.Millisecond)
+		w.Header().Set("Content-Type", "video/MP2T")
+		w.Write([]byte("0123456789"))
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL + "/live?hls=true&hlsPlaylistRatio=0.1")
+	pool, err := NewUpstreamPool(u)
+	if err != nil || pool.HLS == nil {
+		t.Fatalf("pool err %+v", err)
+	}
+	defer pool.Close()
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewComplexProxy(context.Background(), pool, nil, nil, r).ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	get := func(p string, header http.Header) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", proxy.URL+p, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get %v err %+v", p, err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res, string(b)
+	}
+
+	// The concurrent misses are coalesced to one fetch.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", proxy.URL+"/live/livestream-0.ts", nil)
+			if res, err := http.DefaultClient.Do(req); err == nil {
+				b, _ := ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				if string(b) != "0123456789" {
+					t.Errorf("body=%v", string(b))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&segments); n != 1 {
+		t.Errorf("segment fetched %v times", n)
+	}
+
+	res, body := get("/live/livestream-0.ts", nil)
+	if res.Header.Get("X-Cache") != "HIT" || body != "0123456789" || res.Header.Get("Content-Type") != "video/MP2T" {
+		t.Errorf("should hit, x-cache=%v, body=%v, headers=%v", res.Header.Get("X-Cache"), body, res.Header)
+	}
+
+	res, body = get("/live/livestream-0.ts", http.Header{"Range": []string{"bytes=2-4"}})
+	if res.StatusCode != http.StatusPartialContent || body != "234" {
+		t.Errorf("should serve range, status=%v, body=%v", res.StatusCode, body)
+	}
+
+	// The playlist is cached for 0.1 of the target duration, that is 200ms.
+	for i := 0; i < 3; i++ {
+		get("/live/livestream.m3u8", nil)
+	}
+	if n := atomic.LoadInt32(&playlists); n != 1 {
+		t.Errorf("playlist fetched %v times", n)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if res, _ := get("/live/livestream.m3u8", nil); res.Header.Get("X-Cache") != "MISS" {
+		t.Errorf("playlist should expire, x-cache=%v", res.Header.Get("X-Cache"))
+	}
+	if n := atomic.LoadInt32(&playlists); n != 2 {
+		t.Errorf("playlist fetched %v times", n)
+	}
+}
+
+func TestHLSPlaylistTTL(t *testing.T) {
+	v := &HLSCache{PlaylistRatio: 0.5}
+	for _, vv := range []struct {
+		playlist string
+		expect   time.Duration
+	}{
+		{"#EXTM3U\n#EXT-X-TARGETDURATION:10\n", 5 * time.Second},
+		{"#EXTM3U\r\n#EXT-X-TARGETDURATION:4\r\n", 2 * time.Second},
+		{"#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXT-X-ENDLIST\n", -1},
+		{"#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1280000\nhd.m3u8\n", time.Second},
+	} {
+		if ttl := v.playlistTTL([]byte(vv.playlist)); ttl != vv.expect {
+			t.Errorf("playlist %q, ttl=%v, expect=%v", vv.playlist, ttl, vv.expect)
+		}
+	}
+}
+
+func TestHLSCacheOverflow(t *testing.T) {
+	var segments int32
+	body := strings.Repeat("x", 4096)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&segments, 1)
+		w.Header().Set("Content-Type", "video/mp4")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL + "/vod?hls=true&hlsCacheSize=1KB")
+	pool, err := NewUpstreamPool(u)
+	if err != nil || pool.HLS == nil {
+		t.Fatalf("pool err %+v", err)
+	}
+	defer pool.Close()
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewComplexProxy(context.Background(), pool, nil, nil, r).ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	// The segment larger than the cache is proxied directly, with range.
+	for _, vv := range []struct {
+		rng    string
+		status int
+		body   string
+	}{
+		{"", http.StatusOK, body}, {"bytes=2-4", http.StatusPartialContent, "xxx"},
+	} {
+		req, _ := http.NewRequest("GET", proxy.URL+"/vod/a.mp4", nil)
+		if vv.rng != "" {
+			req.Header.Set("Range", vv.rng)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get err %+v", err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != vv.status || string(b) != vv.body || res.Header.Get("X-Cache") != "BYPASS" {
+			t.Errorf("expect %v BYPASS, got %v %v, body %v", vv.status, res.StatusCode, res.Header.Get("X-Cache"), len(b))
+		}
+	}
+	if size, n := pool.HLS.store.Size(); size != 0 || n != 0 {
+		t.Errorf("should not cache, size=%v, entries=%v", size, n)
+	}
+}
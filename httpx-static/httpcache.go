@@ -0,0 +1,450 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The status codes which are cacheable, with explicit freshness.
+var cacheableStatus = map[int]bool{
+	http.StatusOK: true, http.StatusNonAuthoritativeInfo: true, http.StatusNoContent: true,
+	http.StatusMultipleChoices: true, http.StatusMovedPermanently: true, http.StatusPermanentRedirect: true,
+	http.StatusNotFound: true, http.StatusGone: true,
+}
+
+// The response cache of proxy, as a shared cache which follows the Cache-Control,
+// Expires and Vary of upstream, and revalidates by ETag or Last-Modified. It serves the
+// stale response in stale-while-revalidate while revalidating in background, or in
+// stale-if-error when upstream fails. See https://www.rfc-editor.org/rfc/rfc9111
+type ResponseCache struct {
+	Path string
+	// The timeout to revalidate in background.
+	RevalidateTimeout time.Duration
+
+	store  *CacheStore
+	flight flightGroup
+	// The Vary header names of responses, by request URI, removed with the entries in
+	// store, so it's bounded by the store.
+	varies sync.Map
+}
+
+// Create the response cache if cache=true, or nil.
+func NewResponseCache(proxyUrl *url.URL) (*ResponseCache, error) {
+	q := proxyUrl.Query()
+	if q.Get("cache") != "true" {
+		return nil, nil
+	}
+
+	v := &ResponseCache{Path: proxyUrl.Path, RevalidateTimeout: 30 * time.Second}
+
+	capacity := int64(64 * 1024 * 1024)
+	if s := q.Get("cacheSize"); s != "" {
+		var err error
+		if capacity, err = parseSize(s); err != nil || capacity <= 0 {
+			return nil, oe.Errorf("invalid cacheSize=%v", s)
+		}
+	}
+
+	var err error
+	if v.store, err = NewCacheStore(capacity, q.Get("cacheDir")); err != nil {
+		return nil, oe.Wrapf(err, "cache store")
+	}
+	v.store.OnRemove = func(key string) {
+		v.varies.Delete(strings.SplitN(key, "\n", 2)[0])
+	}
+
+	return v, nil
+}
+
+func (v *ResponseCache) String() string {
+	return fmt.Sprintf("store=%v", v.store)
+}
+
+// Remove the cached responses.
+func (v *ResponseCache) Close() {
+	v.store.Close()
+	httpxMetrics.CacheBytes.Set(0, v.Path)
+}
+
+// Remove the responses whose request URI starts with prefix.
+func (v *ResponseCache) Purge(prefix string) int {
+	n := v.store.Purge(prefix)
+	size, _ := v.store.Size()
+	httpxMetrics.CacheBytes.Set(float64(size), v.Path)
+	return n
+}
+
+// The key of request, the URI with the headers in Vary of response.
+func (v *ResponseCache) key(r *http.Request) string {
+	var names []string
+	if value, ok := v.varies.Load(r.URL.RequestURI()); ok {
+		names = value.([]string)
+	}
+	return varyKey(r, names)
+}
+
+// The key of request by the Vary header names.
+func varyKey(r *http.Request, names []string) string {
+	key := r.URL.RequestURI()
+	for _, name := range names {
+		key += fmt.Sprintf("\n%v: %v", name, strings.Join(r.Header[name], ","))
+	}
+	return key
+}
+
+// Serve the request from cache, or proxy to upstream and cache the response.
+func (v *ResponseCache) Serve(ctx context.Context, w http.ResponseWriter, r *http.Request, proxy http.Handler) {
+	// Never cache the WebSocket, which hijacks the connection, or the partial response.
+	reqCC := parseCacheControl(r.Header.Get("Cache-Control"))
+	if _, ok := reqCC["no-store"]; ok || (r.Method != http.MethodGet && r.Method != http.MethodHead) ||
+		r.Header.Get("Authorization") != "" || r.Header.Get("Range") != "" || isWebSocket(r) {
+		httpxMetrics.CacheRequests.Add(1, v.Path, "bypass")
+		w.Header().Set("X-Cache", "BYPASS")
+		proxy.ServeHTTP(w, r)
+		return
+	}
+
+	key := v.key(r)
+	entry := v.store.Get(key)
+	if entry == nil {
+		httpxMetrics.CacheRequests.Add(1, v.Path, "miss")
+		v.miss(w, r, proxy)
+		return
+	}
+
+	// The client requires to revalidate by no-cache or max-age=0.
+	now := time.Now()
+	_, noCache := reqCC["no-cache"]
+	if maxAge, ok := cacheControlSeconds(reqCC, "max-age"); ok && now.Sub(entry.CachedAt) > maxAge {
+		noCache = true
+	}
+
+	if !noCache && entry.Fresh(now) {
+		httpxMetrics.CacheRequests.Add(1, v.Path, "hit")
+		serveCacheEntry(w, r, entry, "HIT")
+		return
+	}
+
+	// Serve the stale one, and revalidate in background.
+	cc := parseCacheControl(entry.Header.Get("Cache-Control"))
+	_, mustRevalidate := cc["must-revalidate"]
+	if _, ok := cc["proxy-revalidate"]; ok {
+		mustRevalidate = true
+	}
+	if _, ok := cc["no-cache"]; ok {
+		mustRevalidate = true
+	}
+
+	stale := now.Sub(entry.ExpireAt)
+	if swr, ok := cacheControlSeconds(cc, "stale-while-revalidate"); ok && !noCache && !mustRevalidate && stale <= swr {
+		httpxMetrics.CacheRequests.Add(1, v.Path, "stale")
+		serveCacheEntry(w, r, entry, "STALE")
+
+		// Never cancel when the client is gone, and revalidate once for the concurrent requests.
+		bgCtx, cancel := context.WithTimeout(context.Background(), v.RevalidateTimeout)
+		req := r.Clone(bgCtx)
+		go func() {
+			defer cancel()
+			v.flight.Do(key, func() (interface{}, error) {
+				_, _, err := v.revalidate(req, entry, proxy)
+				if err != nil {
+					ol.Wf(ctx, "Cache revalidate %v err %+v", key, err)
+				}
+				return nil, err
+			})
+		}()
+		return
+	}
+
+	fresh, xcache, err := v.revalidate(r.Clone(r.Context()), entry, proxy)
+	if err != nil {
+		// Serve the stale one if upstream fails.
+		if sie, ok := cacheControlSeconds(cc, "stale-if-error"); ok && !mustRevalidate && stale <= sie {
+			ol.Wf(ctx, "Cache serve stale %v for err %+v", key, err)
+			httpxMetrics.CacheRequests.Add(1, v.Path, "stale")
+			serveCacheEntry(w, r, entry, "STALE")
+			return
+		}
+		if fresh == nil {
+			ol.Wf(ctx, "Cache revalidate %v err %+v", key, err)
+			http.Error(w, "revalidate failed", http.StatusBadGateway)
+			return
+		}
+	}
+
+	httpxMetrics.CacheRequests.Add(1, v.Path, strings.ToLower(xcache))
+	serveCacheEntry(w, r, fresh, xcache)
+}
+
+// Proxy the request for cache missed, and cache the response if cacheable.
+func (v *ResponseCache) miss(w http.ResponseWriter, r *http.Request, proxy http.Handler) {
+	w.Header().Set("X-Cache", "MISS")
+
+	// Never cache the conditional response.
+	if r.Method != http.MethodGet || r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" {
+		proxy.ServeHTTP(w, r)
+		return
+	}
+
+	cw := &cacheWriter{ResponseWriter: w, pre: w.Header().Clone(), max: v.store.capacity}
+	proxy.ServeHTTP(cw, r)
+
+	if !cw.overflow && cw.header != nil {
+		v.save(r, cw.status, cw.header, cw.body.Bytes())
+	}
+}
+
+// Revalidate the stale entry by its ETag or Last-Modified, return the refreshed entry
+// and X-Cache REVALIDATED, or the new response and MISS. Return error with the response
+// if upstream fails, to serve the stale one by stale-if-error.
+func (v *ResponseCache) revalidate(r *http.Request, entry *cacheEntry, proxy http.Handler) (*cacheEntry, string, error) {
+	r.Method = http.MethodGet
+	for _, h := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		r.Header.Del(h)
+	}
+	if etag := entry.Header.Get("ETag"); etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	if lm := entry.Header.Get("Last-Modified"); lm != "" {
+		r.Header.Set("If-Modified-Since", lm)
+	}
+
+	bw := newBufferWriter(v.store.capacity)
+	proxy.ServeHTTP(bw, r)
+	if bw.overflow {
+		return nil, "", oe.Errorf("body exceed %v", v.store.capacity)
+	}
+
+	if bw.status >= http.StatusInternalServerError {
+		res := &cacheEntry{Key: entry.Key, Status: bw.status, Header: bw.header, CachedAt: time.Now(), body: bw.body.Bytes()}
+		return res, "MISS", oe.Errorf("status %v", bw.status)
+	}
+
+	// Not modified, update the headers and freshness of the cached one.
+	if bw.status == http.StatusNotModified {
+		header := entry.Header.Clone()
+		for k, values := range bw.header {
+			header[k] = values
+		}
+		header.Del("Content-Length")
+
+		body, err := entry.Bytes()
+		if err != nil {
+			return nil, "", oe.Wrapf(err, "read %v", entry.Key)
+		}
+		return v.save(r, entry.Status, header, body), "REVALIDATED", nil
+	}
+
+	return v.save(r, bw.status, bw.header, bw.body.Bytes()), "MISS", nil
+}
+
+// Store the response if cacheable, return the entry to serve.
+func (v *ResponseCache) save(r *http.Request, status int, header http.Header, body []byte) *cacheEntry {
+	now := time.Now()
+	key := r.URL.RequestURI()
+	uncached := &cacheEntry{Key: key, Status: status, Header: header, CachedAt: now, body: body}
+
+	ttl, ok := cacheLifetime(status, header, now)
+	if !ok || r.Method != http.MethodGet {
+		return uncached
+	}
+
+	var names []string
+	for _, name := range strings.Split(strings.Join(header["Vary"], ","), ",") {
+		if name = strings.TrimSpace(name); name == "*" {
+			return uncached
+		} else if name != "" {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	// Store the Vary after the entry, because the replaced entry removes it.
+	entry, err := v.store.Set(varyKey(r, names), status, header, body, now.Add(ttl))
+	if err != nil {
+		return uncached
+	}
+	if len(names) > 0 {
+		v.varies.Store(key, names)
+	} else {
+		v.varies.Delete(key)
+	}
+
+	size, _ := v.store.Size()
+	httpxMetrics.CacheBytes.Set(float64(size), v.Path)
+	return entry
+}
+
+// The freshness lifetime of response, and whether it's cacheable by shared cache.
+func cacheLifetime(status int, header http.Header, now time.Time) (time.Duration, bool) {
+	if !cacheableStatus[status] {
+		return 0, false
+	}
+
+	cc := parseCacheControl(header.Get("Cache-Control"))
+	if _, ok := cc["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := cc["private"]; ok {
+		return 0, false
+	}
+
+	var ttl time.Duration
+	if v, ok := cacheControlSeconds(cc, "s-maxage"); ok {
+		ttl = v
+	} else if v, ok := cacheControlSeconds(cc, "max-age"); ok {
+		ttl = v
+	} else if expires := header.Get("Expires"); expires != "" {
+		// The invalid Expires, like 0, means already expired.
+		if t, err := http.ParseTime(expires); err == nil {
+			date, err := http.ParseTime(header.Get("Date"))
+			if err != nil {
+				date = now
+			}
+			ttl = t.Sub(date)
+		}
+	} else if _, ok := cc["no-cache"]; !ok {
+		// Never guess the freshness, only cache with explicit one.
+		return 0, false
+	}
+
+	if _, ok := cc["no-cache"]; ok {
+		ttl = 0
+	}
+	if age, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil {
+		ttl -= time.Duration(age) * time.Second
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ttl, true
+}
+
+// Parse the Cache-Control to directives in lower case, for example, max-age=60 to
+// max-age:60, and no-cache to no-cache:"".
+func parseCacheControl(s string) map[string]string {
+	cc := make(map[string]string)
+	for _, directive := range strings.Split(s, ",") {
+		directive = strings.TrimSpace(directive)
+		if directive == "" {
+			continue
+		}
+
+		name, value := directive, ""
+		if i := strings.Index(directive, "="); i > 0 {
+			name, value = directive[:i], strings.Trim(strings.TrimSpace(directive[i+1:]), "\"")
+		}
+		cc[strings.ToLower(strings.TrimSpace(name))] = value
+	}
+	return cc
+}
+
+// The directive in seconds, for example, max-age=60.
+func cacheControlSeconds(cc map[string]string, name string) (time.Duration, bool) {
+	s, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v < 0 {
+		return 0, false
+	}
+	return time.Duration(v) * time.Second, true
+}
+
+// The response writer to write to client and buffer the response to cache, at most
+// max bytes. Only the headers of upstream are cached, not the ones for this request.
+type cacheWriter struct {
+	http.ResponseWriter
+	// The headers set before proxy, such as CORS and X-Cache, never cached.
+	pre    http.Header
+	header http.Header
+	status int
+	body   bytes.Buffer
+	max    int64
+	// Whether exceed max or failed to write, never cache it.
+	overflow bool
+}
+
+func (v *cacheWriter) WriteHeader(status int) {
+	if v.header == nil {
+		v.status, v.header = status, upstreamHeader(v.pre, v.ResponseWriter.Header())
+	}
+	v.ResponseWriter.WriteHeader(status)
+}
+
+// The headers from upstream, without the ones in pre which are set before proxy. The
+// values of upstream are appended to pre by proxy.
+func upstreamHeader(pre, header http.Header) http.Header {
+	h := header.Clone()
+	for k, values := range pre {
+		current := h[k]
+		if len(current) >= len(values) && strings.Join(current[:len(values)], "\n") == strings.Join(values, "\n") {
+			current = current[len(values):]
+		}
+
+		if len(current) == 0 {
+			delete(h, k)
+		} else {
+			h[k] = current
+		}
+	}
+	return h
+}
+
+func (v *cacheWriter) Write(b []byte) (int, error) {
+	if v.header == nil {
+		v.WriteHeader(http.StatusOK)
+	}
+
+	n, err := v.ResponseWriter.Write(b)
+	if err != nil {
+		v.overflow = true
+	} else if !v.overflow {
+		if int64(v.body.Len()+n) > v.max {
+			v.overflow = true
+			v.body.Reset()
+		} else {
+			v.body.Write(b[:n])
+		}
+	}
+	return n, err
+}
+
+func (v *cacheWriter) Flush() {
+	if f, ok := v.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
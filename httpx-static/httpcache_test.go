@@ -0,0 +1,366 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheLifetime(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	for _, vv := range []struct {
+		status    int
+		header    http.Header
+		ttl       time.Duration
+		cacheable bool
+	}{
+		{200, http.Header{"Cache-Control": {"max-age=60"}}, 60 * time.Second, true},
+		{200, http.Header{"Cache-Control": {"public, max-age=60, s-maxage=10"}}, 10 * time.Second, true},
+		{200, http.Header{"Cache-Control": {"max-age=60"}, "Age": {"20"}}, 40 * time.Second, true},
+		{200, http.Header{"Cache-Control": {"no-cache"}}, 0, true},
+		{200, http.Header{"Cache-Control": {"private, max-age=60"}}, 0, false},
+		{200, http.Header{"Cache-Control": {"no-store"}}, 0, false},
+		{200, http.Header{"Expires": {now.Add(30 * time.Second).UTC().Format(http.TimeFormat)}}, 30 * time.Second, true},
+		{200, http.Header{"Expires": {"0"}}, 0, true},
+		{200, http.Header{}, 0, false},
+		{500, http.Header{"Cache-Control": {"max-age=60"}}, 0, false},
+	} {
+		ttl, ok := cacheLifetime(vv.status, vv.header, now)
+		if ok != vv.cacheable || ttl.Round(time.Second) != vv.ttl {
+			t.Errorf("status=%v, header=%v, ttl=%v, ok=%v", vv.status, vv.header, ttl, ok)
+		}
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	var requests, revalidated int32
+	var fails atomic.Value
+	fails.Store(false)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/api/v1/versions":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Write([]byte(`{"version":"1.0"}`))
+		case "/api/v1/lang":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+			w.Write([]byte(r.Header.Get("Accept-Language")))
+		case "/api/v1/etag":
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				atomic.AddInt32(&revalidated, 1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte("etag"))
+		case "/api/v1/stale":
+			if fails.Load().(bool) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Cache-Control", "max-age=0, stale-if-error=60")
+			w.Write([]byte("stale"))
+		case "/api/v1/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+			w.Write([]byte("private"))
+		}
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL + "/api/v1?cache=true&maxFails=100")
+	pool, err := NewUpstreamPool(u)
+	if err != nil || pool.Cache == nil {
+		t.Fatalf("pool err %+v", err)
+	}
+	defer pool.Close()
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewComplexProxy(context.Background(), pool, nil, nil, r).ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	get := func(p string, header http.Header) (*http.Response, string) {
+		req, _ := http.NewRequest("GET", proxy.URL+p, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get %v err %+v", p, err)
+		}
+		defer res.Body.Close()
+		b, _ := ioutil.ReadAll(res.Body)
+		return res, string(b)
+	}
+	expect := func(p string, header http.Header, xcache, body string) {
+		t.Helper()
+		if res, b := get(p, header); res.Header.Get("X-Cache") != xcache || b != body {
+			t.Errorf("%v expect %v %v, got %v %v", p, xcache, body, res.Header.Get("X-Cache"), b)
+		}
+	}
+
+	expect("/api/v1/versions", nil, "MISS", `{"version":"1.0"}`)
+	expect("/api/v1/versions", nil, "HIT", `{"version":"1.0"}`)
+	expect("/api/v1/versions", http.Header{"Authorization": {"Basic eDp5"}}, "BYPASS", `{"version":"1.0"}`)
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("requests=%v", n)
+	}
+
+	// Cache by the Vary header.
+	expect("/api/v1/lang", http.Header{"Accept-Language": {"en"}}, "MISS", "en")
+	expect("/api/v1/lang", http.Header{"Accept-Language": {"zh"}}, "MISS", "zh")
+	expect("/api/v1/lang", http.Header{"Accept-Language": {"en"}}, "HIT", "en")
+	expect("/api/v1/lang", http.Header{"Accept-Language": {"zh"}}, "HIT", "zh")
+
+	// Revalidate by ETag.
+	expect("/api/v1/etag", nil, "MISS", "etag")
+	expect("/api/v1/etag", nil, "REVALIDATED", "etag")
+	if n := atomic.LoadInt32(&revalidated); n != 1 {
+		t.Errorf("revalidated=%v", n)
+	}
+
+	// Serve stale if upstream fails.
+	expect("/api/v1/stale", nil, "MISS", "stale")
+	fails.Store(true)
+	expect("/api/v1/stale", nil, "STALE", "stale")
+
+	// Never cache the private response.
+	expect("/api/v1/private", nil, "MISS", "private")
+	expect("/api/v1/private", nil, "MISS", "private")
+
+	// Purge by prefix.
+	if n := pool.Cache.Purge("/api/v1/lang"); n != 2 {
+		t.Errorf("purged=%v", n)
+	}
+	expect("/api/v1/lang", http.Header{"Accept-Language": {"en"}}, "MISS", "en")
+}
+
+func TestResponseCacheStaleWhileRevalidate(t *testing.T) {
+	var requests int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		w.Write([]byte{byte('0' + n)})
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL + "/api?cache=true")
+	pool, err := NewUpstreamPool(u)
+	if err != nil {
+		t.Fatalf("pool err %+v", err)
+	}
+	defer pool.Close()
+
+	serve := func() (string, string) {
+		r := httptest.NewRequest("GET", "/api/v1", nil)
+		w := httptest.NewRecorder()
+		NewComplexProxy(context.Background(), pool, nil, nil, r).ServeHTTP(w, r)
+		return w.Header().Get("X-Cache"), w.Body.String()
+	}
+
+	if xcache, body := serve(); xcache != "MISS" || body != "1" {
+		t.Errorf("got %v %v", xcache, body)
+	}
+	if xcache, body := serve(); xcache != "STALE" || body != "1" {
+		t.Errorf("got %v %v", xcache, body)
+	}
+
+	// Wait for the background revalidation.
+	for i := 0; i < 100 && atomic.LoadInt32(&requests) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, body := serve(); body != "2" {
+		t.Errorf("should revalidated, got %v", body)
+	}
+}
+
+func TestResponseCacheCORS(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Write([]byte("cors"))
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL + "/api?cache=true")
+	pool, err := NewUpstreamPool(u)
+	if err != nil || pool.Cache == nil {
+		t.Fatalf("pool err %+v", err)
+	}
+	defer pool.Close()
+
+	// The CORS headers are set by routes before proxy, for each request.
+	routes := &Routes{cors: "https://a.ossrs.net,https://b.ossrs.net"}
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes.setCORS(w, r)
+		NewComplexProxy(context.Background(), pool, nil, nil, r).ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	expect := func(origin, xcache, allow string) {
+		t.Helper()
+		req, _ := http.NewRequest("GET", proxy.URL+"/api/v1", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("get err %+v", err)
+		}
+		res.Body.Close()
+
+		if res.Header.Get("X-Cache") != xcache || res.Header.Get("Access-Control-Allow-Origin") != allow {
+			t.Errorf("%v expect %v %v, got %v %v", origin, xcache, allow,
+				res.Header.Get("X-Cache"), res.Header.Get("Access-Control-Allow-Origin"))
+		}
+		if vary := strings.Join(res.Header["Vary"], ","); !strings.Contains(vary, "Accept-Encoding") ||
+			(origin != "" && !strings.Contains(vary, "Origin")) {
+			t.Errorf("%v invalid vary %v", origin, vary)
+		}
+	}
+
+	// The allowed origin of a client never leaks to others.
+	expect("https://a.ossrs.net", "MISS", "https://a.ossrs.net")
+	expect("https://b.ossrs.net", "HIT", "https://b.ossrs.net")
+	expect("https://c.ossrs.net", "HIT", "")
+	expect("", "HIT", "")
+}
+
+func TestResponseCacheBypass(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") == "websocket" {
+			c, brw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+			brw.Flush()
+			return
+		}
+
+		w.Header().Set("Cache-Control", "max-age=60")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("0123456789"))
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL + "/api?cache=true")
+	pool, err := NewUpstreamPool(u)
+	if err != nil || pool.Cache == nil {
+		t.Fatalf("pool err %+v", err)
+	}
+	defer pool.Close()
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewComplexProxy(context.Background(), pool, nil, nil, r).ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	// The WebSocket is upgraded, not cached.
+	c, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial err %+v", err)
+	}
+	defer c.Close()
+	c.Write([]byte("GET /api/ws HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	if res, err := http.ReadResponse(bufio.NewReader(c), nil); err != nil || res.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("should upgrade, res %v, err %v", res, err)
+	}
+
+	// The Range request is proxied, not cached.
+	req, _ := http.NewRequest("GET", proxy.URL+"/api/range", nil)
+	req.Header.Set("Range", "bytes=2-4")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("get err %+v", err)
+	}
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent || string(b) != "234" || res.Header.Get("X-Cache") != "BYPASS" {
+		t.Errorf("expect 206 BYPASS 234, got %v %v %v", res.StatusCode, res.Header.Get("X-Cache"), string(b))
+	}
+	if size, _ := pool.Cache.store.Size(); size != 0 {
+		t.Errorf("should not cache, size %v", size)
+	}
+}
+
+func TestResponseCacheVaryBounded(t *testing.T) {
+	u, _ := url.Parse("http://127.0.0.1/api?cache=true&cacheSize=1KB")
+	cache, err := NewResponseCache(u)
+	if err != nil || cache == nil {
+		t.Fatalf("cache err %+v", err)
+	}
+
+	proxy := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte(strings.Repeat("x", 100)))
+	})
+
+	varies := func() (n int) {
+		cache.varies.Range(func(key, value interface{}) bool {
+			n++
+			return true
+		})
+		return
+	}
+
+	// The Vary of the evicted entries are removed, with the attacker-chosen queries.
+	for i := 0; i < 1000; i++ {
+		r := httptest.NewRequest("GET", fmt.Sprintf("/api/v1/lang?id=%v", i), nil)
+		r.Header.Set("Accept-Language", "en")
+		cache.Serve(context.Background(), httptest.NewRecorder(), r, proxy)
+	}
+	if _, entries := cache.store.Size(); entries > 10 || varies() != entries {
+		t.Errorf("expect varies %v bounded by entries %v", varies(), entries)
+	}
+
+	// The Vary is still used for the cached entry.
+	r := httptest.NewRequest("GET", "/api/v1/lang?id=999", nil)
+	r.Header.Set("Accept-Language", "en")
+	w := httptest.NewRecorder()
+	cache.Serve(context.Background(), w, r, proxy)
+	if w.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("expect HIT, got %v", w.Header().Get("X-Cache"))
+	}
+
+	if cache.Purge("/api/"); varies() != 0 {
+		t.Errorf("expect no varies after purge, got %v", varies())
+	}
+}
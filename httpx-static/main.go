@@ -23,7 +23,7 @@ SOFTWARE.
 */
 
 /*
- This the main entrance of https-proxy, proxy to api or other http server.
+This the main entrance of https-proxy, proxy to api or other http server.
 */
 package main
 
@@ -34,32 +34,21 @@ import (
 	"fmt"
 	oe "github.com/ossrs/go-oryx-lib/errors"
 	oh "github.com/ossrs/go-oryx-lib/http"
-	"github.com/ossrs/go-oryx-lib/https"
 	ol "github.com/ossrs/go-oryx-lib/logger"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"os"
-	"path"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
-type Strings []string
-
-func (v *Strings) String() string {
-	return fmt.Sprintf("strings [%v]", strings.Join(*v, ","))
-}
-
-func (v *Strings) Set(value string) error {
-	*v = append(*v, value)
-	return nil
-}
-
 func shouldProxyURL(srcPath, proxyPath string) bool {
 	if !strings.HasSuffix(srcPath, "/") {
 		// /api to /api/
@@ -83,6 +72,8 @@ func shouldProxyURL(srcPath, proxyPath string) bool {
 // https://segmentfault.com/q/1010000002409659
 // https://distinctplace.com/2014/04/23/story-behind-x-forwarded-for-and-x-real-ip-headers/
 // @remark http proxy will set the X-Forwarded-For.
+// @remark the realIP and fwd are from the request resolved by TrustedProxies, so they
+// are stripped if the client is not trusted.
 func addProxyAddToHeader(remoteAddr, realIP string, fwd []string, header http.Header, omitForward bool) {
 	rip, _, err := net.SplitHostPort(remoteAddr)
 	if err != nil {
@@ -101,60 +92,82 @@ func addProxyAddToHeader(remoteAddr, realIP string, fwd []string, header http.He
 	}
 }
 
-func filterByPreHook(ctx context.Context, preHook *url.URL, req *http.Request) error {
-	target := *preHook
-	target.RawQuery = strings.Join([]string{target.RawQuery, req.URL.RawQuery}, "&")
-
-	api := target.String()
-	r, err := http.NewRequestWithContext(ctx, req.Method, api, nil)
-	if err != nil {
-		return err
+// Get the real ip of client, the X-Real-IP or the remote address, which is the same
+// to the X-Real-IP set by addProxyAddToHeader. The X-Real-IP is resolved by the
+// TrustedProxies, so it's never spoofed by the untrusted client.
+func realIP(r *http.Request) string {
+	if rip := r.Header.Get("X-Real-IP"); rip != "" {
+		return rip
 	}
 
-	// Add real ip and forwarded for to header.
-	// We should append the forward for pass-by.
-	addProxyAddToHeader(req.RemoteAddr, req.Header.Get("X-Real-IP"), req.Header["X-Forwarded-For"], r.Header, false)
-	ol.Tf(ctx, "Pre-hook proxy addr req=%v, r=%v", req.Header, r.Header)
-
-	r2, err := http.DefaultClient.Do(r)
-	if err != nil {
-		return err
+	if rip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return rip
 	}
-	defer r2.Body.Close()
-
-	if r2.StatusCode != http.StatusOK {
-		return fmt.Errorf("Pre-hook HTTP StatusCode=%v %v", r2.StatusCode, r2.Status)
-	}
-
-	b, err := ioutil.ReadAll(r2.Body)
-	if err != nil {
-		return err
-	}
-	ol.Tf(ctx, "Pre-hook %v url=%v, res=%v, headers=%v", req.Method, api, string(b), r.Header)
-
-	return nil
+	return r.RemoteAddr
 }
 
-func NewComplexProxy(ctx context.Context, proxyUrl, preHook *url.URL, originalRequest *http.Request) http.Handler {
+func NewComplexProxy(ctx context.Context, pool *UpstreamPool, preHook *PreHook, postHook *PostHook, originalRequest *http.Request) http.Handler {
 	// Hook before proxy it.
 	if preHook != nil {
-		if err := filterByPreHook(ctx, preHook, originalRequest); err != nil {
+		res, err := preHook.Do(ctx, originalRequest)
+		if err != nil && preHook.OnError == HookAllow {
+			httpxMetrics.PreHookFailures.Add(1, preHook.URL.Host+preHook.URL.Path)
+			ol.Wf(ctx, "Pre-hook err %+v, allow by onError", err)
+			res, err = &HookResponse{Action: HookAllow}, nil
+		}
+		if err != nil {
+			setRequestRoute(originalRequest, RoutePreHook)
+			httpxMetrics.PreHookFailures.Add(1, preHook.URL.Host+preHook.URL.Path)
+
 			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				ol.Ef(ctx, "Pre-hook err %+v", err)
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 			})
 		}
+
+		// Deny or redirect the request, or mutate the headers of request.
+		if res.Action != HookAllow {
+			setRequestRoute(originalRequest, RoutePreHook)
+			httpxMetrics.PreHookDenied.Add(1, preHook.URL.Host+preHook.URL.Path, res.Action)
+
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ol.Tf(ctx, "Pre-hook %v %v", res.Action, r.URL)
+				res.Apply(w, r)
+			})
+		}
+		res.Apply(nil, originalRequest)
+	}
+
+	// Pick an upstream from pool.
+	upstream := pool.Pick(originalRequest)
+	if upstream == nil {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ol.Ef(ctx, "No upstream for %v", pool)
+			http.Error(w, "no upstream", http.StatusBadGateway)
+		})
 	}
+	setRequestUpstream(originalRequest, upstream.URL.Host)
 
 	// Start proxy it.
+	start := time.Now()
+	websocket := isWebSocket(originalRequest)
 	proxy := &httputil.ReverseProxy{}
-	proxyUrlQuery := proxyUrl.Query()
+	// Whether the CORS headers are set by routes, or by upstream if disabled.
+	var corsSet bool
 
 	// Create a proxy which attach a isolate logger.
 	elogger := log.New(os.Stderr, fmt.Sprintf("%v ", originalRequest.RemoteAddr), log.LstdFlags)
 	proxy.ErrorLog = elogger
 
+	// Flush immediately for live stream.
+	if pool.Stream {
+		proxy.FlushInterval = -1
+	}
+
 	proxy.Director = func(r *http.Request) {
+		proxyUrl := attemptOf(r).upstream.URL
+		proxyUrlQuery := proxyUrl.Query()
+
 		// about the x-real-schema, we proxy to backend to identify the client schema.
 		if rschema := r.Header.Get("X-Real-Schema"); rschema == "" {
 			if r.TLS == nil {
@@ -167,11 +180,18 @@ func NewComplexProxy(ctx context.Context, proxyUrl, preHook *url.URL, originalRe
 		// Add real ip and forwarded for to header.
 		// We should omit the forward header, because the ReverseProxy will doit.
 		addProxyAddToHeader(r.RemoteAddr, r.Header.Get("X-Real-IP"), r.Header["X-Forwarded-For"], r.Header, true)
-		ol.Tf(ctx, "Proxy addr header %v", r.Header)
+		if !websocket {
+			ol.Tf(ctx, "Proxy addr header %v", r.Header)
+		}
 
 		r.URL.Scheme = proxyUrl.Scheme
 		r.URL.Host = proxyUrl.Host
 
+		// Disable the compression of stream, which buffers the response.
+		if pool.Stream {
+			r.Header.Set("Accept-Encoding", "identity")
+		}
+
 		// Trim the prefix path.
 		if trimPrefix := proxyUrlQuery.Get("trimPrefix"); trimPrefix != "" {
 			r.URL.Path = strings.TrimPrefix(r.URL.Path, trimPrefix)
@@ -194,281 +214,250 @@ func NewComplexProxy(ctx context.Context, proxyUrl, preHook *url.URL, originalRe
 		}
 
 		ra, url, rip := r.RemoteAddr, r.URL.String(), r.Header.Get("X-Real-Ip")
-		ol.Tf(ctx, "proxy http rip=%v, addr=%v %v %v with headers %v", rip, ra, r.Method, url, r.Header)
+		if websocket {
+			ol.Tf(ctx, "proxy websocket rip=%v, addr=%v %v %v", rip, ra, r.Method, url)
+		} else {
+			ol.Tf(ctx, "proxy http rip=%v, addr=%v %v %v with headers %v", rip, ra, r.Method, url, r.Header)
+		}
 	}
 
-	proxy.ModifyResponse = func(w *http.Response) error {
-		// We have already set the server, so remove the upstream one.
-		if proxyUrlQuery.Get("keepUpsreamServer") != "true" {
-			w.Header.Del("Server")
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		// Retry by the status of upstream, the response is discarded.
+		attempt := attemptOf(r)
+		if err == errRetryStatus {
+			return
 		}
 
-		// We already added this header, it will cause chrome failed when duplicated.
-		if w.Header.Get("Access-Control-Allow-Origin") != "" {
-			w.Header.Del("Access-Control-Allow-Origin")
+		// Ignore the error when client closed the request, except the timeout of try.
+		if r.Context().Err() == nil || attempt.TimedOut() {
+			pool.Fail(ctx, attempt.upstream, err)
+
+			// Retry the next upstream, never write the response.
+			if attempt.retryable && pool.Retry.budget.Withdraw() {
+				attempt.retry, attempt.err = true, err
+				return
+			}
 		}
 
-		return nil
+		elogger.Printf("http: proxy error: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
 	}
 
-	return proxy
-}
-
-func run(ctx context.Context) error {
-	oh.Server = fmt.Sprintf("%v/%v", Signature(), Version())
-	fmt.Println(oh.Server, "HTTP/HTTPS static server with API proxy.")
-
-	var httpPorts Strings
-	flag.Var(&httpPorts, "t", "http listen")
-	flag.Var(&httpPorts, "http", "http listen at. 0 to disable http.")
-
-	var httpsPorts Strings
-	flag.Var(&httpsPorts, "s", "https listen")
-	flag.Var(&httpsPorts, "https", "https listen at. 0 to disable https. 443 to serve. ")
-
-	var httpsDomains string
-	flag.StringVar(&httpsDomains, "d", "", "https the allow domains")
-	flag.StringVar(&httpsDomains, "domains", "", "https the allow domains, empty to allow all. for example: ossrs.net,www.ossrs.net")
-
-	var html string
-	flag.StringVar(&html, "r", "./html", "the www web root")
-	flag.StringVar(&html, "root", "./html", "the www web root. support relative dir to argv[0].")
-
-	var cacheFile string
-	flag.StringVar(&cacheFile, "e", "./letsencrypt.cache", "https the cache for letsencrypt")
-	flag.StringVar(&cacheFile, "cache", "./letsencrypt.cache", "https the cache for letsencrypt. support relative dir to argv[0].")
-
-	var useLetsEncrypt bool
-	flag.BoolVar(&useLetsEncrypt, "l", false, "whether use letsencrypt CA")
-	flag.BoolVar(&useLetsEncrypt, "lets", false, "whether use letsencrypt CA. self sign if not.")
-
-	var ssKey string
-	flag.StringVar(&ssKey, "k", "", "https self-sign key")
-	flag.StringVar(&ssKey, "ssk", "", "https self-sign key")
-
-	var ssCert string
-	flag.StringVar(&ssCert, "c", "", `https self-sign cert`)
-	flag.StringVar(&ssCert, "ssc", "", `https self-sign cert`)
-
-	var oproxies Strings
-	flag.Var(&oproxies, "p", "proxy ruler")
-	flag.Var(&oproxies, "proxy", "one or more proxy the matched path to backend, for example, -proxy http://127.0.0.1:8888/api/webrtc")
-
-	var oprehooks Strings
-	flag.Var(&oprehooks, "pre-hook", "the pre-hook ruler, with request")
-
-	var sdomains, skeys, scerts Strings
-	flag.Var(&sdomains, "sdomain", "the SSL hostname")
-	flag.Var(&skeys, "skey", "the SSL key for domain")
-	flag.Var(&scerts, "scert", "the SSL cert for domain")
-
-	var trimSlashLimit int
-	var noRedirectIndex, trimLastSlash bool
-	flag.BoolVar(&noRedirectIndex, "no-redirect-index", false, "Whether serve with index.html without redirect.")
-	flag.BoolVar(&trimLastSlash, "trim-last-slash", false, "Whether trim last slash by HTTP redirect(302).")
-	flag.IntVar(&trimSlashLimit, "trim-slash-limit", 0, "Only trim last slash when got enough directories.")
-
-	flag.Usage = func() {
-		fmt.Println(fmt.Sprintf("Usage: %v -t http -s https -d domains -r root -e cache -l lets -k ssk -c ssc -p proxy", os.Args[0]))
-		fmt.Println(fmt.Sprintf("	"))
-		fmt.Println(fmt.Sprintf("Options:"))
-		fmt.Println(fmt.Sprintf("	-t, -http string"))
-		fmt.Println(fmt.Sprintf("			Listen at port for HTTP server. Default: 0, disable HTTP."))
-		fmt.Println(fmt.Sprintf("	-s, -https string"))
-		fmt.Println(fmt.Sprintf("			Listen at port for HTTPS server. Default: 0, disable HTTPS."))
-		fmt.Println(fmt.Sprintf("	-r, -root string"))
-		fmt.Println(fmt.Sprintf("			The www root path. Supports relative to argv[0]=%v. Default: ./html", path.Dir(os.Args[0])))
-		fmt.Println(fmt.Sprintf("	-no-redirect-index=bool"))
-		fmt.Println(fmt.Sprintf("			Whether serve with index.html without redirect. Default: false"))
-		fmt.Println(fmt.Sprintf("	-p, -proxy string"))
-		fmt.Println(fmt.Sprintf("			Proxy path to backend. For example: http://127.0.0.1:8888/api/webrtc"))
-		fmt.Println(fmt.Sprintf("			Proxy path to backend. For example: http://127.0.0.1:8888/api/webrtc?modifyRequestHost=false"))
-		fmt.Println(fmt.Sprintf("			Proxy path to backend. For example: http://127.0.0.1:8888/api/webrtc?keepUpsreamServer=true"))
-		fmt.Println(fmt.Sprintf("			Proxy path to backend. For example: http://127.0.0.1:8888/api/webrtc?trimPrefix=/ffmpeg"))
-		fmt.Println(fmt.Sprintf("			Proxy path to backend. For example: http://127.0.0.1:8888/api/webrtc?addPrefix=/release"))
-		fmt.Println(fmt.Sprintf("	-pre-hook string"))
-		fmt.Println(fmt.Sprintf("			Pre-hook to backend, with request. For example: http://127.0.0.1:8888/api/stat"))
-		fmt.Println(fmt.Sprintf("Options for HTTPS(letsencrypt cert):"))
-		fmt.Println(fmt.Sprintf("	-l, -lets=bool"))
-		fmt.Println(fmt.Sprintf("			Whether use letsencrypt CA. Default: false"))
-		fmt.Println(fmt.Sprintf("	-e, -cache string"))
-		fmt.Println(fmt.Sprintf("			The letsencrypt cache. Default: ./letsencrypt.cache"))
-		fmt.Println(fmt.Sprintf("	-d, -domains string"))
-		fmt.Println(fmt.Sprintf("			Set the validate HTTPS domain. For example: ossrs.net,www.ossrs.net"))
-		fmt.Println(fmt.Sprintf("Options for HTTPS(file-based cert):"))
-		fmt.Println(fmt.Sprintf("	-k, -ssk string"))
-		fmt.Println(fmt.Sprintf("			The self-sign or validate file-based key file."))
-		fmt.Println(fmt.Sprintf("	-c, -ssc string"))
-		fmt.Println(fmt.Sprintf("			The self-sign or validate file-based cert file."))
-		fmt.Println(fmt.Sprintf("	-sdomain string"))
-		fmt.Println(fmt.Sprintf("			For multiple HTTPS site, the domain name. For example: ossrs.net"))
-		fmt.Println(fmt.Sprintf("	-skey string"))
-		fmt.Println(fmt.Sprintf("			For multiple HTTPS site, the key file."))
-		fmt.Println(fmt.Sprintf("	-scert string"))
-		fmt.Println(fmt.Sprintf("			For multiple HTTPS site, the cert file."))
-		fmt.Println(fmt.Sprintf("For example:"))
-		fmt.Println(fmt.Sprintf("	%v -t 8080 -s 9443 -r ./html", os.Args[0]))
-		fmt.Println(fmt.Sprintf("	%v -t 8080 -s 9443 -r ./html -p http://ossrs.net:1985/api/v1/versions", os.Args[0]))
-		fmt.Println(fmt.Sprintf("Generate cert for self-sign HTTPS:"))
-		fmt.Println(fmt.Sprintf("	openssl genrsa -out server.key 2048"))
-		fmt.Println(fmt.Sprintf(`	openssl req -new -x509 -key server.key -out server.crt -days 365 -subj "/C=CN/ST=Beijing/L=Beijing/O=Me/OU=Me/CN=me.org"`))
-		fmt.Println(fmt.Sprintf("For example:"))
-		fmt.Println(fmt.Sprintf("	%v -s 9443 -r ./html -sdomain ossrs.net -skey ossrs.net.key -scert ossrs.net.pem", os.Args[0]))
-	}
-	flag.Parse()
+	proxy.ModifyResponse = func(w *http.Response) error {
+		attempt := attemptOf(w.Request)
+		attempt.Responded()
+
+		// Passive health check by the status of upstream.
+		upstream := attempt.upstream
+		switch w.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			pool.Fail(ctx, upstream, fmt.Errorf("status %v", w.Status))
+		default:
+			pool.Succeed(ctx, upstream)
+		}
 
-	if useLetsEncrypt && len(httpsPorts) == 0 {
-		return oe.Errorf("for letsencrypt, https=%v must be 0(disabled) or 443(enabled)", httpsPorts)
-	}
-	if len(httpPorts) == 0 && len(httpsPorts) == 0 {
-		flag.Usage()
-		os.Exit(-1)
-	}
+		// Retry the next upstream by status, if in budget.
+		if attempt.retryable && pool.Retry.Statuses[w.StatusCode] && pool.Retry.budget.Withdraw() {
+			attempt.retry, attempt.err = true, fmt.Errorf("status %v", w.Status)
+			return errRetryStatus
+		}
 
-	// If trim last slash, we should enable no redirect index, to avoid infinitely redirect.
-	if trimLastSlash {
-		noRedirectIndex = true
-	}
-	fmt.Println(fmt.Sprintf("Config trimLastSlash=%v, trimSlashLimit=%v, noRedirectIndex=%v", trimLastSlash, trimSlashLimit, noRedirectIndex))
+		if websocket && w.StatusCode != http.StatusSwitchingProtocols {
+			ol.Wf(ctx, "WebSocket upgrade %v failed, status=%v", pool.Path, w.Status)
+		}
 
-	var proxyUrls []*url.URL
-	proxies := make(map[string]*url.URL)
-	for _, oproxy := range []string(oproxies) {
-		if oproxy == "" {
-			return oe.Errorf("empty proxy in %v", oproxies)
+		// We have already set the server, so remove the upstream one.
+		if upstream.URL.Query().Get("keepUpsreamServer") != "true" {
+			w.Header.Del("Server")
 		}
 
-		proxyUrl, err := url.Parse(oproxy)
-		if err != nil {
-			return oe.Wrapf(err, "parse proxy %v", oproxy)
+		// We already added this header, it will cause chrome failed when duplicated.
+		if corsSet && w.Header.Get("Access-Control-Allow-Origin") != "" {
+			w.Header.Del("Access-Control-Allow-Origin")
 		}
 
-		if _, ok := proxies[proxyUrl.Path]; ok {
-			return oe.Errorf("proxy %v duplicated", proxyUrl.Path)
+		// Request the post-hook in sync mode, which could veto or rewrite the response.
+		if postHook != nil && postHook.Mode == PostHookSync {
+			postHook.ModifyResponse(ctx, w, upstream.URL.Host, start)
 		}
 
-		proxyUrls = append(proxyUrls, proxyUrl)
-		proxies[proxyUrl.Path] = proxyUrl
-		ol.Tf(ctx, "Proxy %v to %v", proxyUrl.Path, oproxy)
+		return nil
 	}
 
-	var preHookUrls []*url.URL
-	preHooks := make(map[string]*url.URL)
-	for _, oprehook := range []string(oprehooks) {
-		if oprehook == "" {
-			return oe.Errorf("empty pre-hook in %v", oprehooks)
-		}
+	// Proxy to the upstream, and retry the idempotent request to the next one if fails.
+	var served atomic.Value
+	served.Store(upstream.URL.Host)
+	forward := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var retryable bool
+		var deadline time.Time
+		if pool.Retry != nil {
+			pool.Retry.budget.Request()
 
-		preHookUrl, err := url.Parse(oprehook)
-		if err != nil {
-			return oe.Wrapf(err, "parse pre-hook %v", oprehook)
-		}
-
-		if _, ok := preHooks[preHookUrl.Path]; ok {
-			return oe.Errorf("pre-hook %v duplicated", preHookUrl.Path)
+			var err error
+			if retryable, err = pool.Retry.Retryable(r); err != nil {
+				ol.Wf(ctx, "Retry read body err %+v", err)
+				http.Error(w, "read body failed", http.StatusBadRequest)
+				return
+			}
+			if pool.Retry.Deadline > 0 {
+				deadline = time.Now().Add(pool.Retry.Deadline)
+			}
 		}
 
-		preHookUrls = append(preHookUrls, preHookUrl)
-		preHooks[preHookUrl.Path] = preHookUrl
-		ol.Tf(ctx, "pre-hook %v to %v", preHookUrl.Path, oprehook)
-	}
+		var tried []*Upstream
+		for target := upstream; ; {
+			var timeout time.Duration
+			if pool.Retry != nil {
+				timeout = pool.Retry.TryTimeout
+				if remain := time.Until(deadline); !deadline.IsZero() && (timeout == 0 || remain < timeout) {
+					timeout = remain
+				}
+			}
 
-	if !path.IsAbs(cacheFile) && path.IsAbs(os.Args[0]) {
-		cacheFile = path.Join(path.Dir(os.Args[0]), cacheFile)
-	}
-	if !path.IsAbs(html) && path.IsAbs(os.Args[0]) {
-		html = path.Join(path.Dir(os.Args[0]), html)
-	}
+			req, attempt, cancel := newProxyAttempt(r, target, retryable && len(tried) < pool.Retry.Retries, timeout)
+			served.Store(target.URL.Host)
+			setRequestUpstream(r, target.URL.Host)
 
-	serveFileNoRedirect := func (w http.ResponseWriter, r *http.Request, name string) {
-		upath := path.Join(html, path.Clean(r.URL.Path))
+			// Count the active requests, for least connections.
+			atomic.AddInt64(&target.active, 1)
+			proxy.ServeHTTP(w, req)
+			atomic.AddInt64(&target.active, -1)
+			cancel()
 
-		// Redirect without the last slash.
-		if trimLastSlash && r.URL.Path != "/" && strings.HasSuffix(r.URL.Path, "/") {
-			u := strings.TrimSuffix(r.URL.Path, "/")
-			if r.URL.RawQuery != "" {
-				u += "?" + r.URL.RawQuery
+			if !attempt.retry {
+				return
 			}
-			if strings.Count(u, "/") >= trimSlashLimit {
-				http.Redirect(w, r, u, http.StatusFound)
+
+			tried = append(tried, target)
+			if target = pool.Next(r, tried); target == nil || (!deadline.IsZero() && time.Now().After(deadline)) {
+				ol.Wf(ctx, "Retry %v abort after %v tries, err %+v", r.URL, len(tried), attempt.err)
+				http.Error(w, "upstream failed", http.StatusBadGateway)
 				return
 			}
+
+			httpxMetrics.Retries.Add(1, pool.Path, attempt.upstream.URL.Host)
+			ol.Wf(ctx, "Retry %v %v/%v to %v, err %v", r.URL, len(tried), pool.Retry.Retries, target.URL.Host, attempt.err)
 		}
+	})
 
-		// Append the index.html path if access a directory.
-		if noRedirectIndex && !strings.Contains(path.Base(upath), ".") {
-			if d, err := os.Stat(upath); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		corsSet = w.Header().Get("Access-Control-Allow-Origin") != ""
+
+		// Limit the upgraded connections, and track the frames of WebSocket.
+		if websocket {
+			n := atomic.AddInt64(&pool.wsConns, 1)
+			defer atomic.AddInt64(&pool.wsConns, -1)
+
+			if max := pool.WebSocket.MaxConns; max > 0 && n > int64(max) {
+				ol.Wf(ctx, "WebSocket %v exceed max %v connections", pool.Path, max)
+				http.Error(w, "too many websocket connections", http.StatusServiceUnavailable)
 				return
-			} else if d.IsDir() {
-				upath = path.Join(upath, "index.html")
 			}
+			w = &wsResponseWriter{ResponseWriter: w, ctx: ctx, path: pool.Path, conf: pool.WebSocket}
 		}
 
-		http.ServeFile(w, r, upath)
-	}
+		// Never timeout for stream, and count the bytes streamed to client.
+		if pool.Stream {
+			// TODO: FIXME: For HTTP/2, the write timeout of server is applied to stream.
+			if c := requestConn(r); c != nil && r.ProtoMajor == 1 {
+				c.SetWriteDeadline(time.Time{})
+			}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		oh.SetHeader(w)
-
-		if o := r.Header.Get("Origin"); len(o) > 0 {
-			// SRS does not need cookie or credentials, so we disable CORS credentials, and use * for CORS origin,
-			// headers, expose headers and methods.
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			// See https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Access-Control-Allow-Headers
-			w.Header().Set("Access-Control-Allow-Headers", "*")
-			// See https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Access-Control-Allow-Methods
-			w.Header().Set("Access-Control-Allow-Methods", "*")
-			// See https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Access-Control-Expose-Headers
-			w.Header().Set("Access-Control-Expose-Headers", "*")
-			// https://stackoverflow.com/a/24689738/17679565
-			// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Access-Control-Allow-Credentials
-			w.Header().Set("Access-Control-Allow-Credentials", "false")
-		}
-
-		// For matched OPTIONS, directly return without response.
-		if r.Method == "OPTIONS" {
-			return
+			httpxMetrics.Streams.Add(1, pool.Path)
+			sw := &streamWriter{ResponseWriter: w, path: pool.Path, client: realIP(r)}
+			defer func() {
+				httpxMetrics.Streams.Add(-1, pool.Path)
+				ol.Tf(ctx, "Stream %v to %v, bytes=%v, duration=%v", r.URL.Path, sw.client, sw.bytes, time.Now().Sub(start))
+			}()
+			w = sw
 		}
 
-		if proxyUrls == nil {
-			if r.URL.Path == "/httpx/v1/versions" {
-				oh.WriteVersion(w, r, Version())
-				return
-			}
+		// Notify the post-hook in async mode, with the status and bytes of response.
+		if postHook != nil && postHook.Mode == PostHookAsync {
+			sw := &statusWriter{ResponseWriter: w}
+			defer func() {
+				postHook.Notify(NewPostHookEvent(r, served.Load().(string), sw.Status(), sw.bytes, time.Now().Sub(start)))
+			}()
+			w = sw
+		}
 
-			serveFileNoRedirect(w, r, path.Join(html, path.Clean(r.URL.Path)))
-			return
+		// Collapse the identical requests in flight to one upstream request.
+		var handler http.Handler = forward
+		if pool.Collapse != nil && !pool.Stream {
+			handler = pool.Collapse.Wrap(ctx, forward)
 		}
 
-		// Find pre-hook to serve with proxy.
-		var preHook *url.URL
-		for _, preHookUrl := range preHookUrls {
-			if !shouldProxyURL(r.URL.Path, preHookUrl.Path) {
-				continue
-			}
+		// Serve HLS from cache, and coalesce the misses to one origin fetch.
+		if pool.HLS != nil && pool.HLS.Match(r) {
+			pool.HLS.Serve(ctx, w, r, handler)
+			return
+		}
 
-			if p, ok := preHooks[preHookUrl.Path]; ok {
-				preHook = p
-			}
+		// Serve from the response cache, by the Cache-Control of upstream.
+		if pool.Cache != nil {
+			pool.Cache.Serve(ctx, w, r, handler)
+			return
 		}
 
-		// Find proxy to serve it.
-		for _, proxyUrl := range proxyUrls {
-			if !shouldProxyURL(r.URL.Path, proxyUrl.Path) {
-				continue
-			}
+		handler.ServeHTTP(w, r)
+	})
+}
 
-			if proxy, ok := proxies[proxyUrl.Path]; ok {
-				p := NewComplexProxy(ctx, proxy, preHook, r)
-				p.ServeHTTP(w, r)
-				return
-			}
+func run(ctx context.Context) error {
+	oh.Server = fmt.Sprintf("%v/%v", Signature(), Version())
+	fmt.Println(oh.Server, "HTTP/HTTPS static server with API proxy.")
+
+	conf, confFile, err := ParseConfig(os.Args[1:])
+	if err != nil {
+		return oe.Wrapf(err, "parse config")
+	}
+	if conf.Log != "" {
+		if err := switchLogFile(conf.Log); err != nil {
+			return oe.Wrapf(err, "switch log")
 		}
+	}
+	if confFile != "" {
+		ol.Tf(ctx, "Load config from %v", confFile)
+	}
+
+	httpPorts, httpsPorts, httpsDomains, html, cacheFile := conf.HTTPPorts, conf.HTTPSPorts, conf.Domains, conf.Root, conf.Cache
+	useLetsEncrypt, ssKey, ssCert := conf.UseLetsEncrypt, conf.SSKey, conf.SSCert
+	noRedirectIndex, trimLastSlash, trimSlashLimit := conf.NoRedirectIndex, conf.TrimLastSlash, conf.TrimSlashLimit
 
-		serveFileNoRedirect(w, r, path.Join(html, path.Clean(r.URL.Path)))
+	if useLetsEncrypt && len(httpsPorts) == 0 {
+		return oe.Errorf("for letsencrypt, https=%v must be 0(disabled) or 443(enabled)", httpsPorts)
+	}
+	if len(httpPorts) == 0 && len(httpsPorts) == 0 {
+		flag.Usage()
+		os.Exit(-1)
+	}
+
+	fmt.Println(fmt.Sprintf("Config trimLastSlash=%v, trimSlashLimit=%v, noRedirectIndex=%v", trimLastSlash, trimSlashLimit, noRedirectIndex))
+
+	server := NewServer(os.Args[1:])
+	if err := server.Initialize(ctx, conf); err != nil {
+		return oe.Wrapf(err, "initialize server")
+	}
+
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.Serve(ctx, w, r)
 	})
 
+	observers := []requestObserver{httpxMetrics}
+
+	var accessLog *AccessLog
+	if conf.AccessLog != "" {
+		if accessLog, err = NewAccessLog(conf.AccessLog, conf.AccessLogFormat); err != nil {
+			return oe.Wrapf(err, "create access log")
+		}
+		defer accessLog.Close()
+
+		observers = append(observers, accessLog)
+		ol.Tf(ctx, "Access log to %v, format %v", conf.AccessLog, conf.AccessLogFormat)
+	}
+
+	http.Handle("/", observeRequests(handler, observers...))
+
 	var protos []string
 	if len(httpPorts) > 0 {
 		protos = append(protos, fmt.Sprintf("http(:%v)", strings.Join(httpPorts, ",")))
@@ -493,39 +482,23 @@ func run(ctx context.Context) error {
 			protos = append(protos, "letsencrypt")
 		} else if ssKey != "" {
 			protos = append(protos, fmt.Sprintf("self-sign(%v, %v)", ssKey, ssCert))
-		} else if len(sdomains) == 0 {
-			return oe.New("no ssl config")
 		}
 
-		for i := 0; i < len(sdomains); i++ {
-			sdomain, skey, scert := sdomains[i], skeys[i], scerts[i]
-			if f, err := os.Open(scert); err != nil {
-				return oe.Wrapf(err, "open cert %v for %v err %+v", scert, sdomain, err)
-			} else {
-				f.Close()
-			}
-
-			if f, err := os.Open(skey); err != nil {
-				return oe.Wrapf(err, "open key %v for %v err %+v", skey, sdomain, err)
-			} else {
-				f.Close()
-			}
-			protos = append(protos, fmt.Sprintf("ssl(%v,%v,%v)", sdomain, skey, scert))
+		for _, site := range conf.Sites {
+			protos = append(protos, fmt.Sprintf("ssl(%v,%v,%v)", site.Domain, site.Key, site.Cert))
 		}
 	}
 	ol.Tf(ctx, "%v html root at %v", strings.Join(protos, ", "), string(html))
 
-	if len(httpsPorts) > 0 && !useLetsEncrypt && ssKey != "" {
-		if f, err := os.Open(ssCert); err != nil {
-			return oe.Wrapf(err, "open cert %v err %+v", ssCert, err)
-		} else {
-			f.Close()
-		}
+	drain, err := time.ParseDuration(conf.Drain)
+	if err != nil {
+		return oe.Wrapf(err, "parse drain %v", conf.Drain)
+	}
 
-		if f, err := os.Open(ssKey); err != nil {
-			return oe.Wrapf(err, "open key %v err %+v", ssKey, err)
-		} else {
-			f.Close()
+	var writeTimeout time.Duration
+	if conf.WriteTimeout != "" {
+		if writeTimeout, err = time.ParseDuration(conf.WriteTimeout); err != nil {
+			return oe.Wrapf(err, "parse write timeout %v", conf.WriteTimeout)
 		}
 	}
 
@@ -533,7 +506,19 @@ func run(ctx context.Context) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	var httpServers []*http.Server
+	var httpServers []*trackedServer
+
+	// Listen at addr, parse the PROXY header only from the trusted proxies.
+	listen := func(addr string) (net.Listener, error) {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil || !conf.ProxyProtocol {
+			return ln, err
+		}
+
+		return NewProxyProtoListener(ln, func(ip string) bool {
+			return server.Routes().trusted.Contains(ip)
+		}), nil
+	}
 
 	for _, v := range httpPorts {
 		httpPort, err := strconv.ParseInt(v, 10, 64)
@@ -541,26 +526,37 @@ func run(ctx context.Context) error {
 			return oe.Wrapf(err, "parse %v", v)
 		}
 
+		if httpPort == 0 {
+			ol.W(ctx, "http server disabled")
+			continue
+		}
+
+		hs := &trackedServer{
+			Server:  &http.Server{Addr: fmt.Sprintf(":%v", httpPort), WriteTimeout: writeTimeout},
+			tracker: NewConnTracker(fmt.Sprintf("http(:%v)", httpPort)),
+		}
+		hs.tracker.Track(hs.Server)
+		httpServers = append(httpServers, hs)
+
+		ln, err := listen(hs.Addr)
+		if err != nil {
+			return oe.Wrapf(err, "listen %v", hs.Addr)
+		}
+
 		wg.Add(1)
 		go func(httpPort int) {
 			defer wg.Done()
 
-			ctx = ol.WithContext(ctx)
-			if httpPort == 0 {
-				ol.W(ctx, "http server disabled")
-				return
-			}
+			ctx := ol.WithContext(ctx)
 
 			defer cancel()
-			hs := &http.Server{Addr: fmt.Sprintf(":%v", httpPort), Handler: nil}
-			httpServers = append(httpServers, hs)
 			ol.Tf(ctx, "http serve at %v", httpPort)
 
-			if err := hs.ListenAndServe(); err != nil {
+			if err := hs.Serve(ln); err != nil && err != http.ErrServerClosed {
 				ol.Ef(ctx, "http serve err %+v", err)
 				return
 			}
-			ol.T("http server ok")
+			ol.T(ctx, "http server ok")
 		}(int(httpPort))
 	}
 
@@ -570,65 +566,144 @@ func run(ctx context.Context) error {
 			return oe.Wrapf(err, "parse %v", v)
 		}
 
+		if httpsPort == 0 {
+			ol.W(ctx, "https server disabled")
+			continue
+		}
+
+		hss := &trackedServer{
+			Server: &http.Server{
+				Addr:         fmt.Sprintf(":%v", httpsPort),
+				WriteTimeout: writeTimeout,
+				TLSConfig: &tls.Config{
+					GetCertificate:   server.GetCertificate,
+					VerifyConnection: server.VerifyConnection,
+					// For TLS-ALPN-01 of letsencrypt, the ALPN acme-tls/1 is only for validation.
+					NextProtos: []string{"h2", "http/1.1", acmeALPNProto},
+				},
+			},
+			tracker: NewConnTracker(fmt.Sprintf("https(:%v)", httpsPort)),
+		}
+		hss.tracker.Track(hss.Server)
+		httpServers = append(httpServers, hss)
+
+		ln, err := listen(hss.Addr)
+		if err != nil {
+			return oe.Wrapf(err, "listen %v", hss.Addr)
+		}
+
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 
-			ctx = ol.WithContext(ctx)
-			if httpsPort == 0 {
-				ol.W(ctx, "https server disabled")
+			ctx := ol.WithContext(ctx)
+
+			defer cancel()
+			ol.Tf(ctx, "https serve at %v", httpsPort)
+
+			if err := hss.ServeTLS(ln, "", ""); err != nil && err != http.ErrServerClosed {
+				ol.Ef(ctx, "https serve err %+v", err)
 				return
 			}
+			ol.T(ctx, "https serve ok")
+		}()
+	}
+
+	if conf.Admin != "" {
+		addr := conf.Admin
+		if !strings.Contains(addr, ":") {
+			addr = fmt.Sprintf(":%v", addr)
+		}
+
+		has := &trackedServer{
+			Server:  &http.Server{Addr: addr, Handler: server.Admin()},
+			tracker: NewConnTracker(fmt.Sprintf("admin(%v)", addr)),
+		}
+		has.tracker.Track(has.Server)
+		httpServers = append(httpServers, has)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx := ol.WithContext(ctx)
 
 			defer cancel()
+			ol.Tf(ctx, "admin serve at %v", addr)
 
-			var err error
-			var m https.Manager
-			if useLetsEncrypt {
-				var domains []string
-				if httpsDomains != "" {
-					domains = strings.Split(httpsDomains, ",")
-				}
+			if err := has.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				ol.Ef(ctx, "admin serve err %+v", err)
+				return
+			}
+			ol.T(ctx, "admin serve ok")
+		}()
+	}
 
-				if m, err = https.NewLetsencryptManager("", domains, cacheFile); err != nil {
-					ol.Ef(ctx, "create letsencrypt manager err %+v", err)
-					return
-				}
-			} else if ssKey != "" {
-				if m, err = https.NewSelfSignManager(ssCert, ssKey); err != nil {
-					ol.Ef(ctx, "create self-sign manager err %+v", err)
-					return
-				}
-			} else if len(sdomains) > 0 {
-				if m, err = NewCertsManager(sdomains, skeys, scerts); err != nil {
-					ol.Ef(ctx, "create ssl managers err %+v", err)
-					return
+	// Collect the active connections of listeners for metrics.
+	httpxMetrics.OnCollect(func() {
+		for _, hs := range httpServers {
+			var n int
+			for state, count := range hs.tracker.States() {
+				if state != http.StateIdle {
+					n += count
 				}
 			}
+			httpxMetrics.Connections.Set(float64(n), hs.tracker.Name)
+		}
+	})
 
-			hss := &http.Server{
-				Addr: fmt.Sprintf(":%v", httpsPort),
-				TLSConfig: &tls.Config{
-					GetCertificate: m.GetCertificate,
-				},
-			}
-			httpServers = append(httpServers, hss)
-			ol.Tf(ctx, "https serve at %v", httpsPort)
+	// Reload the config and certs by SIGHUP, reopen the logs by SIGUSR1.
+	go func() {
+		ctx := ol.WithContext(ctx)
 
-			if err = hss.ListenAndServeTLS("", ""); err != nil {
-				ol.Ef(ctx, "https serve err %+v", err)
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGHUP)
+		defer signal.Stop(sigs)
+
+		reopens := make(chan os.Signal, 1)
+		if len(reopenSignals) > 0 {
+			signal.Notify(reopens, reopenSignals...)
+			defer signal.Stop(reopens)
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
 				return
+			case <-sigs:
+				ol.Tf(ctx, "Got SIGHUP, reload config")
+				if _, err := server.Reload(ctx); err != nil {
+					ol.Ef(ctx, "reload err %+v", err)
+				}
+			case sig := <-reopens:
+				if conf.Log != "" {
+					if err := switchLogFile(conf.Log); err != nil {
+						ol.Ef(ctx, "reopen log err %+v", err)
+					}
+				}
+				if accessLog != nil {
+					if err := accessLog.Reopen(); err != nil {
+						ol.Ef(ctx, "reopen access log err %+v", err)
+					}
+				}
+				ol.Tf(ctx, "Got %v, reopen log %v, access log %v", sig, conf.Log, conf.AccessLog)
 			}
-			ol.T("https serve ok")
-		}()
-	}
+		}
+	}()
+
+	// Graceful shutdown by SIGTERM or SIGINT, or any server failed.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigs)
 
 	select {
 	case <-ctx.Done():
-		for _, server := range httpServers {
-			server.Close()
-		}
+	case sig := <-sigs:
+		ol.Tf(ctx, "Got %v, shutdown", sig)
 	}
+
+	gracefulShutdown(ol.WithContext(context.Background()), httpServers, server.Inflight, drain)
+	server.Routes().Close()
 	wg.Wait()
 
 	return nil
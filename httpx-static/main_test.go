@@ -24,7 +24,14 @@ SOFTWARE.
 
 package main
 
-import "testing"
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
 
 func TestShouldProxyURL(t *testing.T) {
 	vvs := []struct {
@@ -47,3 +54,41 @@ func TestShouldProxyURL(t *testing.T) {
 		}
 	}
 }
+
+func TestStreamProxy(t *testing.T) {
+	// The upstream writes the header and first tag, then waits for client.
+	done := make(chan bool)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Accept-Encoding", r.Header.Get("Accept-Encoding"))
+		w.Write([]byte("FLV\n"))
+		w.(http.Flusher).Flush()
+		<-done
+	}))
+	defer backend.Close()
+	defer close(done)
+
+	u, _ := url.Parse(backend.URL + "/live?stream=true")
+	pool, err := NewUpstreamPool(u)
+	if err != nil || !pool.Stream {
+		t.Fatalf("pool err %+v", err)
+	}
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewComplexProxy(context.Background(), pool, nil, nil, r).ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	res, err := http.Get(proxy.URL + "/live/livestream.flv")
+	if err != nil {
+		t.Fatalf("get err %+v", err)
+	}
+	defer res.Body.Close()
+
+	// Got the data before the upstream done, without compression.
+	if line, err := bufio.NewReader(res.Body).ReadString('\n'); err != nil || line != "FLV\n" {
+		t.Errorf("should stream, got %v, err %v", line, err)
+	}
+	if v := res.Header.Get("X-Accept-Encoding"); v != "identity" {
+		t.Errorf("should disable compression, got %v", v)
+	}
+}
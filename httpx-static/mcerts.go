@@ -25,39 +25,368 @@ SOFTWARE.
 package main
 
 import (
+	"context"
+	"crypto/rsa"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	oe "github.com/ossrs/go-oryx-lib/errors"
 	"github.com/ossrs/go-oryx-lib/https"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
-type certsManager struct {
-	// Key is hostname.
-	certs map[string]https.Manager
+// The type of https manager.
+const (
+	ManagerLetsEncrypt = "letsencrypt"
+	ManagerSelfSign    = "self-sign"
+	ManagerSSL         = "ssl"
+)
+
+// Create the https manager by config, nil if no https. The cert and key files are
+// loaded to validate, so reload never swaps in an invalid cert. The file-based and ACME
+// managers should be started to poll the cert files or renew, and closed when replaced.
+func NewHTTPSManager(ctx context.Context, conf *Config) (m https.Manager, err error) {
+	var enabled bool
+	for _, port := range conf.HTTPSPorts {
+		if port != "0" {
+			enabled = true
+		}
+	}
+	if !enabled {
+		return nil, nil
+	}
+
+	if conf.UseLetsEncrypt {
+		if m, err = NewACMEManager(ctx, conf); err != nil {
+			return nil, oe.Wrapf(err, "create letsencrypt manager")
+		}
+		return m, nil
+	}
+
+	// The self-sign cert is served for all names, like a default site.
+	manager, sites := ManagerSSL, conf.Sites
+	if conf.SSKey != "" {
+		manager = ManagerSelfSign
+		sites = []*SiteConfig{{Key: conf.SSKey, Cert: conf.SSCert, Default: true}}
+	}
+	if len(sites) == 0 {
+		return nil, oe.New("no ssl config")
+	}
+
+	var poll time.Duration
+	if conf.CertPoll != "" {
+		if poll, err = time.ParseDuration(conf.CertPoll); err != nil {
+			return nil, oe.Wrapf(err, "parse cert-poll %v", conf.CertPoll)
+		}
+	}
+
+	cm, err := NewCertsManager(ctx, manager, sites)
+	if err != nil {
+		return nil, oe.Wrapf(err, "create %v manager", manager)
+	}
+	cm.Poll, cm.ExpiryDays = poll, conf.CertExpiryDays
+	return cm, nil
+}
+
+// The cert of site, with the names from SANs of cert.
+type siteCert struct {
+	site  *SiteConfig
+	cert  *tls.Certificate
+	names []string
+	// Whether the key is RSA, the others like ECDSA are preferred.
+	rsa bool
+}
+
+// Load the cert and key of site, parse the DNS and IP names from SANs, or the common
+// name, or the domain of site if no names.
+func loadSiteCert(site *SiteConfig) (*siteCert, error) {
+	cert, err := tls.LoadX509KeyPair(site.Cert, site.Key)
+	if err != nil {
+		return nil, oe.Wrapf(err, "load cert %v, key %v", site.Cert, site.Key)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, oe.Wrapf(err, "parse cert %v", site.Cert)
+	}
+	cert.Leaf = leaf
+
+	v := &siteCert{site: site, cert: &cert}
+	_, v.rsa = leaf.PublicKey.(*rsa.PublicKey)
+
+	for _, name := range leaf.DNSNames {
+		v.names = append(v.names, strings.ToLower(name))
+	}
+	for _, ip := range leaf.IPAddresses {
+		v.names = append(v.names, ip.String())
+	}
+	if len(v.names) == 0 && leaf.Subject.CommonName != "" {
+		v.names = append(v.names, strings.ToLower(leaf.Subject.CommonName))
+	}
+	if len(v.names) == 0 && site.Domain != "" {
+		v.names = append(v.names, strings.ToLower(site.Domain))
+	}
+
+	return v, nil
 }
 
-func NewCertsManager(domains, keys, certs []string) (m https.Manager, err error) {
-	v := &certsManager{
-		certs: make(map[string]https.Manager),
+// The domain of cert, for logs and metrics.
+func (v *siteCert) Domain() string {
+	if v.site.Domain != "" {
+		return v.site.Domain
+	}
+	if len(v.names) > 0 {
+		return v.names[0]
 	}
+	return v.site.Cert
+}
 
-	for i := 0; i < len(domains); i++ {
-		domain, key, cert := domains[i], keys[i], certs[i]
+// The certs indexed by names, which is swapped as a whole when cert files changed.
+type certsIndex struct {
+	// Key is the name in SANs, the certs are ECDSA first.
+	names map[string][]*siteCert
+	// The default certs for unknown names, or clients without SNI.
+	defaults []*siteCert
+}
 
-		if m, err = https.NewSelfSignManager(cert, key); err != nil {
-			return nil, oe.Wrapf(err, "create cert for %v by %v, %v", domain, cert, key)
-		} else {
-			v.certs[domain] = m
+func newCertsIndex(certs []*siteCert) *certsIndex {
+	v := &certsIndex{names: make(map[string][]*siteCert)}
+	for _, cert := range certs {
+		for _, name := range cert.names {
+			v.names[name] = append(v.names[name], cert)
+		}
+		if cert.site.Default {
+			v.defaults = append(v.defaults, cert)
 		}
 	}
 
+	// Prefer the ECDSA certs, which is smaller and faster.
+	preferECDSA := func(certs []*siteCert) {
+		sort.SliceStable(certs, func(i, j int) bool {
+			return !certs[i].rsa && certs[j].rsa
+		})
+	}
+	for _, certs := range v.names {
+		preferECDSA(certs)
+	}
+	preferECDSA(v.defaults)
+
+	return v
+}
+
+// The stat of cert and key file, to detect the changes.
+type certStat struct {
+	cert, key os.FileInfo
+}
+
+func statCertFiles(site *SiteConfig) (*certStat, error) {
+	cert, err := os.Stat(site.Cert)
+	if err != nil {
+		return nil, err
+	}
+	key, err := os.Stat(site.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &certStat{cert: cert, key: key}, nil
+}
+
+func (v *certStat) Equals(o *certStat) bool {
+	return v.cert.ModTime().Equal(o.cert.ModTime()) && v.cert.Size() == o.cert.Size() &&
+		v.key.ModTime().Equal(o.key.ModTime()) && v.key.Size() == o.key.Size()
+}
+
+// The manager for file-based certs, which selects the cert by the SANs, exact name first,
+// then the wildcard like *.ossrs.net, then the default sites. For the certs with the
+// same name, such as ECDSA and RSA, selects the first one supported by the client.
+//
+// The cert and key files are polled by mtime, and the new pair is swapped in only when
+// it's valid, so it's safe for tools like certbot to renew the files in place.
+type certsManager struct {
+	// The type of manager, ssl or self-sign, for logs and metrics.
+	manager string
+	// The interval to poll the cert files, 0 to disable reload.
+	Poll time.Duration
+	// Warn when cert expires in these days, 0 to disable.
+	ExpiryDays int
+
+	// The *certsIndex, for GetCertificate.
+	index atomic.Value
+	// Only accessed by the poll goroutine after started.
+	certs []*siteCert
+	stats []*certStat
+	// The last time to warn the expiry of each cert.
+	warns []time.Time
+
+	cancel context.CancelFunc
+}
+
+func NewCertsManager(ctx context.Context, manager string, sites []*SiteConfig) (*certsManager, error) {
+	v := &certsManager{manager: manager, cancel: func() {}}
+
+	for _, site := range sites {
+		// Stat before load, so the change during load is detected by next poll.
+		stat, err := statCertFiles(site)
+		if err != nil {
+			return nil, oe.Wrapf(err, "stat cert for %v", site.Domain)
+		}
+
+		cert, err := loadSiteCert(site)
+		if err != nil {
+			return nil, oe.Wrapf(err, "load cert for %v", site.Domain)
+		}
+
+		v.certs = append(v.certs, cert)
+		v.stats = append(v.stats, stat)
+		v.warns = append(v.warns, time.Time{})
+
+		httpxMetrics.ObserveCertificate(manager, cert.Domain(), cert.cert)
+		ol.Tf(ctx, "%v for %v, names %v, rsa=%v, default=%v, expire %v, cert %v, key %v",
+			manager, site.Domain, strings.Join(cert.names, ","), cert.rsa, site.Default,
+			cert.cert.Leaf.NotAfter.Format(time.RFC3339), site.Cert, site.Key)
+	}
+
+	v.index.Store(newCertsIndex(v.certs))
 	return v, nil
 }
 
+// Start to poll the cert files and check the expiry, until closed.
+func (v *certsManager) Start(ctx context.Context) {
+	ctx, v.cancel = context.WithCancel(ctx)
+
+	// Check the expiry once, then hourly if reload disabled.
+	v.check(ctx, time.Now())
+
+	interval := v.Poll
+	if interval <= 0 {
+		if v.ExpiryDays <= 0 {
+			return
+		}
+		interval = time.Hour
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				v.check(ctx, time.Now())
+			}
+		}
+	}()
+}
+
+func (v *certsManager) Close() {
+	v.cancel()
+}
+
+// Reload the changed cert files, and check the expiry of certs.
+func (v *certsManager) check(ctx context.Context, now time.Time) {
+	var changed bool
+	for i := range v.certs {
+		if v.Poll > 0 && v.reload(ctx, i, now) {
+			changed = true
+		}
+		v.checkExpiry(ctx, i, now)
+	}
+
+	if changed {
+		v.index.Store(newCertsIndex(v.certs))
+	}
+}
+
+// Reload the cert i if files changed and valid, return whether reloaded.
+func (v *certsManager) reload(ctx context.Context, i int, now time.Time) bool {
+	site := v.certs[i].site
+
+	stat, err := statCertFiles(site)
+	if err != nil || stat.Equals(v.stats[i]) {
+		return false
+	}
+	// Never retry the same files, the next change of files will trigger a reload, for
+	// example, the key is written after the cert.
+	v.stats[i] = stat
+
+	cert, err := loadSiteCert(site)
+	if err != nil {
+		ol.Wf(ctx, "%v reload %v ignored, err %+v", v.manager, site.Domain, err)
+		return false
+	}
+	if leaf := cert.cert.Leaf; now.After(leaf.NotAfter) || now.Before(leaf.NotBefore) {
+		ol.Wf(ctx, "%v reload %v ignored, cert %v invalid, not before %v, not after %v",
+			v.manager, site.Domain, site.Cert, leaf.NotBefore.Format(time.RFC3339), leaf.NotAfter.Format(time.RFC3339))
+		return false
+	}
+
+	v.certs[i], v.warns[i] = cert, time.Time{}
+	httpxMetrics.ObserveCertificate(v.manager, cert.Domain(), cert.cert)
+	ol.Tf(ctx, "%v reload %v ok, names %v, expire %v, cert %v, key %v",
+		v.manager, site.Domain, strings.Join(cert.names, ","), cert.cert.Leaf.NotAfter.Format(time.RFC3339),
+		site.Cert, site.Key)
+	return true
+}
+
+// Warn hourly if cert i expires in days, and update the metric.
+func (v *certsManager) checkExpiry(ctx context.Context, i int, now time.Time) {
+	if v.ExpiryDays <= 0 {
+		return
+	}
+
+	cert := v.certs[i]
+	left := cert.cert.Leaf.NotAfter.Sub(now)
+	expiring := left < time.Duration(v.ExpiryDays)*24*time.Hour
+	httpxMetrics.ObserveCertificateExpiring(v.manager, cert.Domain(), expiring)
+
+	if !expiring || now.Sub(v.warns[i]) < time.Hour {
+		return
+	}
+	v.warns[i] = now
+
+	if left <= 0 {
+		ol.Ef(ctx, "%v cert %v expired at %v, cert %v", v.manager, cert.Domain(),
+			cert.cert.Leaf.NotAfter.Format(time.RFC3339), cert.site.Cert)
+	} else {
+		ol.Wf(ctx, "%v cert %v expires in %.1f days at %v, cert %v", v.manager, cert.Domain(),
+			left.Hours()/24, cert.cert.Leaf.NotAfter.Format(time.RFC3339), cert.site.Cert)
+	}
+}
+
 func (v *certsManager) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
-	if cert, ok := v.certs[clientHello.ServerName]; ok {
-		return cert.GetCertificate(clientHello)
+	name := strings.TrimSuffix(strings.ToLower(clientHello.ServerName), ".")
+
+	// For client without SNI, such as access by IP, use the local IP.
+	if name == "" && clientHello.Conn != nil {
+		if host, _, err := net.SplitHostPort(clientHello.Conn.LocalAddr().String()); err == nil {
+			name = host
+		}
 	}
 
-	return nil, fmt.Errorf("no cert for %v", clientHello.ServerName)
+	index := v.index.Load().(*certsIndex)
+	certs := index.names[name]
+	if i := strings.Index(name, "."); len(certs) == 0 && i > 0 {
+		certs = index.names["*"+name[i:]]
+	}
+	if len(certs) == 0 {
+		certs = index.defaults
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no cert for %v", clientHello.ServerName)
+	}
+
+	for _, cert := range certs {
+		if err := clientHello.SupportsCertificate(cert.cert); err == nil {
+			return cert.cert, nil
+		}
+	}
+	return certs[0].cert, nil
 }
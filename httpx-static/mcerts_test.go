@@ -0,0 +1,206 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Create a self-signed cert with names, write the cert and key to dir.
+func createTestCert(t *testing.T, dir, name string, key crypto.Signer, notAfter time.Time, names ...string) *SiteConfig {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	site := &SiteConfig{Domain: name, Cert: path.Join(dir, name+".crt"), Key: path.Join(dir, name+".key")}
+	if err := os.WriteFile(site.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(site.Key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return site
+}
+
+func TestCertsManager(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	notAfter := time.Now().Add(24 * time.Hour)
+
+	sites := []*SiteConfig{
+		createTestCert(t, dir, "rsa", rsaKey, notAfter, "ossrs.net", "www.ossrs.net"),
+		createTestCert(t, dir, "ecdsa", ecKey, notAfter, "ossrs.net"),
+		createTestCert(t, dir, "wildcard", ecKey, notAfter, "*.ossrs.io", "127.0.0.1"),
+		createTestCert(t, dir, "default", rsaKey, notAfter, "default.ossrs.net"),
+	}
+
+	m, err := NewCertsManager(context.Background(), ManagerSSL, sites)
+	if err != nil {
+		t.Fatalf("create err %+v", err)
+	}
+	if _, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "unknown.ossrs.net"}); err == nil {
+		t.Errorf("should fail without default")
+	}
+
+	sites[3].Default = true
+	if m, err = NewCertsManager(context.Background(), ManagerSSL, sites); err != nil {
+		t.Fatalf("create err %+v", err)
+	}
+
+	ecdsaHello := func(name string) *tls.ClientHelloInfo {
+		return &tls.ClientHelloInfo{
+			ServerName: name, SupportedVersions: []uint16{tls.VersionTLS13},
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256, tls.PSSWithSHA256},
+			SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		}
+	}
+	rsaHello := &tls.ClientHelloInfo{
+		ServerName: "ossrs.net", SupportedVersions: []uint16{tls.VersionTLS13},
+		SignatureSchemes: []tls.SignatureScheme{tls.PSSWithSHA256},
+	}
+
+	for _, vv := range []struct {
+		hello  *tls.ClientHelloInfo
+		expect *SiteConfig
+	}{
+		{ecdsaHello("ossrs.net"), sites[1]}, {rsaHello, sites[0]}, {ecdsaHello("WWW.ossrs.net."), sites[0]},
+		{ecdsaHello("a.ossrs.io"), sites[2]}, {ecdsaHello("a.b.ossrs.io"), sites[3]}, {ecdsaHello(""), sites[3]},
+	} {
+		cert, err := m.GetCertificate(vv.hello)
+		if err != nil {
+			t.Errorf("%v err %+v", vv.hello.ServerName, err)
+		} else if cert.Leaf.Subject.CommonName != vv.expect.Domain {
+			t.Errorf("%v expect %v, got %v", vv.hello.ServerName, vv.expect.Domain, cert.Leaf.Subject.CommonName)
+		}
+	}
+}
+
+func TestCertsManagerReload(t *testing.T) {
+	dir := t.TempDir()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	site := createTestCert(t, dir, "reload", key, time.Now().Add(24*time.Hour), "ossrs.net")
+	site.Default = true
+
+	m, err := NewCertsManager(context.Background(), ManagerSSL, []*SiteConfig{site})
+	if err != nil {
+		t.Fatalf("create err %+v", err)
+	}
+	m.Poll, m.ExpiryDays = time.Second, 30
+
+	expect := func(name string) {
+		t.Helper()
+		cert, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: "ossrs.net"})
+		if err != nil {
+			t.Fatalf("get err %+v", err)
+		}
+		if len(cert.Leaf.DNSNames) != 1 || cert.Leaf.DNSNames[0] != name {
+			t.Errorf("expect %v, got %v", name, cert.Leaf.DNSNames)
+		}
+	}
+	// Touch the files to a new mtime, as the poll by mtime.
+	touch := func(offset time.Duration) {
+		t.Helper()
+		mtime := time.Now().Add(offset)
+		for _, f := range []string{site.Cert, site.Key} {
+			if err := os.Chtimes(f, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	m.check(context.Background(), time.Now())
+	expect("ossrs.net")
+	var b bytes.Buffer
+	httpxMetrics.CertExpiring.Write(&b)
+	if !strings.Contains(b.String(), `httpx_cert_expiring{manager="ssl",domain="reload"} 1`) {
+		t.Errorf("expect expiring, got %v", b.String())
+	}
+
+	// The key mismatch the cert, ignored.
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	keyData, _ := os.ReadFile(site.Key)
+	createTestCert(t, dir, "reload", other, time.Now().Add(24*time.Hour), "www.ossrs.net")
+	if err := os.WriteFile(site.Key, keyData, 0644); err != nil {
+		t.Fatal(err)
+	}
+	touch(time.Second)
+	m.check(context.Background(), time.Now())
+	expect("ossrs.net")
+
+	// The expired cert, ignored.
+	createTestCert(t, dir, "reload", key, time.Now().Add(-time.Minute), "www.ossrs.net")
+	touch(2 * time.Second)
+	m.check(context.Background(), time.Now())
+	expect("ossrs.net")
+
+	// The valid cert, swapped in.
+	createTestCert(t, dir, "reload", key, time.Now().Add(90*24*time.Hour), "www.ossrs.net")
+	touch(3 * time.Second)
+	m.check(context.Background(), time.Now())
+	expect("www.ossrs.net")
+
+	b.Reset()
+	httpxMetrics.CertExpiring.Write(&b)
+	if !strings.Contains(b.String(), `httpx_cert_expiring{manager="ssl",domain="reload"} 0`) {
+		t.Errorf("expect not expiring, got %v", b.String())
+	}
+}
@@ -0,0 +1,345 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The default buckets of latency histogram, in seconds.
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// The max series of a metric, the label values from client(such as SNI) are replaced
+// by "other" when exceed it, to keep the memory bounded.
+const maxMetricSeries = 1024
+
+type metricSeries struct {
+	values []string
+	value  float64
+	// For histogram.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// The metric with labels, in type of counter, gauge or histogram, which is written in
+// the Prometheus text format.
+type metricVec struct {
+	name, help, kind string
+	labels           []string
+	buckets          []float64
+
+	lock   sync.Mutex
+	series map[string]*metricSeries
+}
+
+func newMetricVec(kind, name, help string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*metricSeries)}
+}
+
+func (v *metricVec) get(values []string) *metricSeries {
+	key := strings.Join(values, "\xff")
+	if s, ok := v.series[key]; ok {
+		return s
+	}
+
+	if len(v.series) >= maxMetricSeries {
+		values = make([]string, len(values))
+		for i := range values {
+			values[i] = "other"
+		}
+		key = strings.Join(values, "\xff")
+		if s, ok := v.series[key]; ok {
+			return s
+		}
+	}
+
+	s := &metricSeries{values: values, counts: make([]uint64, len(v.buckets))}
+	v.series[key] = s
+	return s
+}
+
+// Add delta to counter or gauge.
+func (v *metricVec) Add(delta float64, values ...string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.get(values).value += delta
+}
+
+// Set the value of gauge.
+func (v *metricVec) Set(value float64, values ...string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.get(values).value = value
+}
+
+// Observe the value of histogram.
+func (v *metricVec) Observe(value float64, values ...string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	s := v.get(values)
+	for i, bucket := range v.buckets {
+		if value <= bucket {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// Remove all series, for the gauges which are collected again.
+func (v *metricVec) Reset() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.series = make(map[string]*metricSeries)
+}
+
+func (v *metricVec) labelPairs(values []string, extra ...string) string {
+	var pairs []string
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for i, label := range v.labels {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, label, escape.Replace(values[i])))
+	}
+	for i := 0; i < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (v *metricVec) Write(w io.Writer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %v %v\n", v.name, v.help)
+	fmt.Fprintf(w, "# TYPE %v %v\n", v.name, v.kind)
+
+	var keys []string
+	for key := range v.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	format := func(v float64) string {
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+
+	for _, key := range keys {
+		s := v.series[key]
+		if v.kind != "histogram" {
+			fmt.Fprintf(w, "%v%v %v\n", v.name, v.labelPairs(s.values), format(s.value))
+			continue
+		}
+
+		for i, bucket := range v.buckets {
+			fmt.Fprintf(w, "%v_bucket%v %v\n", v.name, v.labelPairs(s.values, "le", format(bucket)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%v_bucket%v %v\n", v.name, v.labelPairs(s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", v.name, v.labelPairs(s.values), format(s.sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", v.name, v.labelPairs(s.values), s.count)
+	}
+}
+
+// The metrics of httpx, exposed at /metrics of admin listener.
+type Metrics struct {
+	Requests          *metricVec
+	RequestDuration   *metricVec
+	UpstreamErrors    *metricVec
+	PreHookFailures   *metricVec
+	PreHookDenied     *metricVec
+	PostHookEvents    *metricVec
+	WebSockets        *metricVec
+	WebSocketCloses   *metricVec
+	Streams           *metricVec
+	StreamBytes       *metricVec
+	CacheRequests     *metricVec
+	CacheBytes        *metricVec
+	CollapsedRequests *metricVec
+	Retries           *metricVec
+	Connections       *metricVec
+	TLSHandshakes     *metricVec
+	CertExpiry        *metricVec
+	CertExpiring      *metricVec
+
+	lock       sync.Mutex
+	collectors []func()
+	// The parsed leaf of the latest certificate, by manager and domain, to get the expiry.
+	// It's at most maxMetricSeries, like the series of CertExpiry.
+	leafs map[string]*metricLeaf
+}
+
+type metricLeaf struct {
+	cert *tls.Certificate
+	leaf *x509.Certificate
+}
+
+func NewMetrics() *Metrics {
+	v := &Metrics{
+		Requests: newMetricVec("counter", "httpx_requests_total",
+			"The total requests by route type and status code.", "route", "code"),
+		RequestDuration: newMetricVec("histogram", "httpx_request_duration_seconds",
+			"The latency of requests by route type.", "route"),
+		UpstreamErrors: newMetricVec("counter", "httpx_upstream_errors_total",
+			"The errors of proxy upstreams, by path and upstream.", "path", "upstream"),
+		PreHookFailures: newMetricVec("counter", "httpx_prehook_failures_total",
+			"The failures of pre-hooks, by error or timeout.", "prehook"),
+		PreHookDenied: newMetricVec("counter", "httpx_prehook_denied_total",
+			"The requests denied or redirected by pre-hooks, by action.", "prehook", "action"),
+		PostHookEvents: newMetricVec("counter", "httpx_posthook_events_total",
+			"The events of post-hooks, by result sent, failed or dropped.", "posthook", "result"),
+		WebSockets: newMetricVec("gauge", "httpx_websockets",
+			"The open WebSocket connections, by proxy path.", "path"),
+		WebSocketCloses: newMetricVec("counter", "httpx_websocket_closes_total",
+			"The closed WebSocket connections, by proxy path and close code of client and upstream, 0 for none.",
+			"path", "client", "upstream"),
+		Streams: newMetricVec("gauge", "httpx_streams",
+			"The active streams of stream=true proxy, by path.", "path"),
+		StreamBytes: newMetricVec("counter", "httpx_stream_bytes_total",
+			"The bytes streamed of stream=true proxy, by path and client ip.", "path", "client"),
+		CacheRequests: newMetricVec("counter", "httpx_cache_requests_total",
+			"The requests of cache, by proxy path and result hit, miss or shared.", "path", "result"),
+		CacheBytes: newMetricVec("gauge", "httpx_cache_bytes",
+			"The bytes of cached responses, by proxy path.", "path"),
+		CollapsedRequests: newMetricVec("counter", "httpx_collapsed_requests_total",
+			"The requests served by the shared upstream request, by proxy path.", "path"),
+		Retries: newMetricVec("counter", "httpx_retries_total",
+			"The retries of proxy, by path and the failed upstream.", "path", "upstream"),
+		Connections: newMetricVec("gauge", "httpx_connections",
+			"The active connections of listeners.", "listener"),
+		TLSHandshakes: newMetricVec("counter", "httpx_tls_handshakes_total",
+			"The TLS handshakes by SNI.", "sni"),
+		CertExpiry: newMetricVec("gauge", "httpx_cert_expiry_timestamp_seconds",
+			"The expiry unix timestamp of certificates, by https manager and domain.", "manager", "domain"),
+		CertExpiring: newMetricVec("gauge", "httpx_cert_expiring",
+			"Whether the certificate expires in the warning days, 1 for expiring, by https manager and domain.", "manager", "domain"),
+	}
+	v.RequestDuration.buckets = defaultBuckets
+	v.leafs = make(map[string]*metricLeaf)
+	return v
+}
+
+// The global metrics.
+var httpxMetrics = NewMetrics()
+
+// Register a collector, which is called before writing metrics, to update the gauges.
+func (v *Metrics) OnCollect(collector func()) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.collectors = append(v.collectors, collector)
+}
+
+// Observe the request when done.
+func (v *Metrics) Observe(r *http.Request, record *requestRecord) {
+	route := record.Route()
+	v.Requests.Add(1, route, strconv.Itoa(record.writer.Status()))
+	v.RequestDuration.Observe(record.Duration().Seconds(), route)
+}
+
+// Observe the certificate of https manager, to update the expiry.
+func (v *Metrics) ObserveCertificate(manager, domain string, cert *tls.Certificate) {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return
+	}
+
+	if domain == "" {
+		domain = "default"
+	}
+
+	leaf := cert.Leaf
+	if leaf == nil {
+		if leaf = v.leaf(manager+"/"+domain, cert); leaf == nil {
+			return
+		}
+	}
+	v.CertExpiry.Set(float64(leaf.NotAfter.Unix()), manager, domain)
+}
+
+// Get the parsed leaf of certificate, from cache if not changed, nil if invalid.
+func (v *Metrics) leaf(key string, cert *tls.Certificate) *x509.Certificate {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if cached, ok := v.leafs[key]; ok && cached.cert == cert {
+		return cached.leaf
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil
+	}
+
+	// Replace the previous cert of domain, and never cache more than the series.
+	if _, ok := v.leafs[key]; ok || len(v.leafs) < maxMetricSeries {
+		v.leafs[key] = &metricLeaf{cert: cert, leaf: leaf}
+	}
+	return leaf
+}
+
+// Observe whether the certificate of https manager is expiring.
+func (v *Metrics) ObserveCertificateExpiring(manager, domain string, expiring bool) {
+	if domain == "" {
+		domain = "default"
+	}
+
+	var value float64
+	if expiring {
+		value = 1
+	}
+	v.CertExpiring.Set(value, manager, domain)
+}
+
+func (v *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.lock.Lock()
+	collectors := append([]func(){}, v.collectors...)
+	v.lock.Unlock()
+
+	for _, collector := range collectors {
+		collector()
+	}
+
+	var b bytes.Buffer
+	for _, m := range []*metricVec{
+		v.Requests, v.RequestDuration, v.UpstreamErrors, v.PreHookFailures, v.PreHookDenied, v.PostHookEvents,
+		v.WebSockets, v.WebSocketCloses, v.Streams, v.StreamBytes, v.CacheRequests, v.CacheBytes, v.CollapsedRequests, v.Retries,
+		v.Connections, v.TLSHandshakes, v.CertExpiry, v.CertExpiring,
+	} {
+		m.Write(&b)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,116 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricVec(t *testing.T) {
+	c := newMetricVec("counter", "test_total", "The test.", "route", "code")
+	c.Add(1, "static", "200")
+	c.Add(2, "static", "200")
+	c.Add(1, "proxy", `5"02`)
+
+	var b bytes.Buffer
+	c.Write(&b)
+	if v := b.String(); !strings.Contains(v, `test_total{route="static",code="200"} 3`) ||
+		!strings.Contains(v, `test_total{route="proxy",code="5\"02"} 1`) || !strings.Contains(v, "# TYPE test_total counter") {
+		t.Errorf("invalid counter %v", v)
+	}
+
+	h := newMetricVec("histogram", "test_seconds", "The test.", "route")
+	h.buckets = []float64{0.1, 1}
+	h.Observe(0.05, "static")
+	h.Observe(0.5, "static")
+	h.Observe(5, "static")
+
+	b.Reset()
+	h.Write(&b)
+	for _, expect := range []string{
+		`test_seconds_bucket{route="static",le="0.1"} 1`,
+		`test_seconds_bucket{route="static",le="1"} 2`,
+		`test_seconds_bucket{route="static",le="+Inf"} 3`,
+		`test_seconds_sum{route="static"} 5.55`,
+		`test_seconds_count{route="static"} 3`,
+	} {
+		if v := b.String(); !strings.Contains(v, expect) {
+			t.Errorf("expect %v in %v", expect, v)
+		}
+	}
+
+	// The series is bounded.
+	g := newMetricVec("gauge", "test_sni", "The test.", "sni")
+	for i := 0; i < maxMetricSeries+10; i++ {
+		g.Add(1, strings.Repeat("x", i))
+	}
+	if len(g.series) != maxMetricSeries+1 {
+		t.Errorf("series %v exceed %v", len(g.series), maxMetricSeries)
+	}
+}
+
+func TestMetricsCertificate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	site := createTestCert(t, t.TempDir(), "ossrs.net", key, notAfter, "ossrs.net")
+
+	// The leaf is cached for the latest cert of domain, and replaced by the new one.
+	v := NewMetrics()
+	for i := 0; i < 3; i++ {
+		cert, err := tls.LoadX509KeyPair(site.Cert, site.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert.Leaf = nil
+		v.ObserveCertificate(ManagerLetsEncrypt, "ossrs.net", &cert)
+	}
+	if len(v.leafs) != 1 {
+		t.Errorf("expect 1 leaf, got %v", len(v.leafs))
+	}
+	if s := v.CertExpiry.get([]string{ManagerLetsEncrypt, "ossrs.net"}); s.value != float64(notAfter.Unix()) {
+		t.Errorf("expect expiry %v, got %v", notAfter.Unix(), s.value)
+	}
+
+	// The leafs are bounded.
+	cert, _ := tls.LoadX509KeyPair(site.Cert, site.Key)
+	cert.Leaf = nil
+	for i := 0; i < maxMetricSeries+10; i++ {
+		v.ObserveCertificate(ManagerLetsEncrypt, fmt.Sprintf("%v.ossrs.net", i), &cert)
+	}
+	if len(v.leafs) != maxMetricSeries {
+		t.Errorf("leafs %v exceed %v", len(v.leafs), maxMetricSeries)
+	}
+}
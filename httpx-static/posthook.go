@@ -0,0 +1,333 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The mode of post-hook.
+const (
+	// Request the post-hook before response, which could veto or rewrite the headers.
+	PostHookSync = "sync"
+	// Notify the post-hook after response, in a bounded queue.
+	PostHookAsync = "async"
+)
+
+// The options of post-hook in query, which are not forwarded to the post-hook.
+var postHookOptions = []string{"mode", "timeout", "onError", "queue", "workers"}
+
+// The event of response, posted to post-hook in JSON.
+type PostHookEvent struct {
+	Time     string `json:"time"`
+	IP       string `json:"ip"`
+	Method   string `json:"method"`
+	Host     string `json:"host"`
+	Path     string `json:"path"`
+	Query    string `json:"query"`
+	Upstream string `json:"upstream"`
+	Status   int    `json:"status"`
+	// The bytes of response body. For sync mode, it's the Content-Length of upstream,
+	// -1 if unknown.
+	Bytes int64 `json:"bytes"`
+	// The duration in seconds. For sync mode, it's the time to the upstream response.
+	Duration float64 `json:"duration"`
+	// The headers of upstream response, only for sync mode.
+	Headers http.Header `json:"headers,omitempty"`
+}
+
+func NewPostHookEvent(r *http.Request, upstream string, status int, bytes int64, duration time.Duration) *PostHookEvent {
+	return &PostHookEvent{
+		Time: time.Now().Format(time.RFC3339Nano), IP: realIP(r), Method: r.Method, Host: r.Host,
+		Path: r.URL.Path, Query: r.URL.RawQuery, Upstream: upstream, Status: status, Bytes: bytes,
+		Duration: duration.Seconds(),
+	}
+}
+
+// The post-hook after upstream response, for billing and auditing. For example:
+//
+//	-post-hook "http://127.0.0.1:8085/api/v1/billing?mode=async&queue=1024"
+//	-post-hook "http://127.0.0.1:8085/api/v1/audit?mode=sync&timeout=1s&onError=allow"
+type PostHook struct {
+	URL *url.URL
+	// The mode, sync or async.
+	Mode string
+	// The timeout of each request to post-hook.
+	Timeout time.Duration
+	// For sync mode, the policy when post-hook fails, allow or deny.
+	OnError string
+	// For async mode, the size of queue and the number of workers.
+	Queue   int
+	Workers int
+
+	queue   chan *PostHookEvent
+	closed  chan struct{}
+	once    sync.Once
+	dropped uint64
+}
+
+func NewPostHook(u *url.URL) (*PostHook, error) {
+	v := &PostHook{
+		URL: u, Mode: PostHookAsync, Timeout: 3 * time.Second, OnError: HookAllow, Queue: 1024, Workers: 1,
+		closed: make(chan struct{}),
+	}
+
+	q := u.Query()
+	if s := q.Get("mode"); s != "" {
+		if s != PostHookSync && s != PostHookAsync {
+			return nil, oe.Errorf("invalid mode %v", s)
+		}
+		v.Mode = s
+	}
+
+	if s := q.Get("timeout"); s != "" {
+		var err error
+		if v.Timeout, err = time.ParseDuration(s); err != nil {
+			return nil, oe.Wrapf(err, "parse timeout %v", s)
+		}
+	}
+
+	if s := q.Get("onError"); s != "" {
+		if s != HookDeny && s != HookAllow {
+			return nil, oe.Errorf("invalid onError %v", s)
+		}
+		v.OnError = s
+	}
+
+	ints := []struct {
+		key   string
+		value *int
+	}{
+		{"queue", &v.Queue}, {"workers", &v.Workers},
+	}
+	for _, e := range ints {
+		if s := q.Get(e.key); s != "" {
+			var err error
+			if *e.value, err = strconv.Atoi(s); err != nil || *e.value <= 0 {
+				return nil, oe.Errorf("invalid %v %v", e.key, s)
+			}
+		}
+	}
+	v.queue = make(chan *PostHookEvent, v.Queue)
+
+	// Strip the options from the url of post-hook.
+	for _, k := range postHookOptions {
+		q.Del(k)
+	}
+	target := *u
+	target.RawQuery = q.Encode()
+	v.URL = &target
+
+	return v, nil
+}
+
+func (v *PostHook) String() string {
+	if v.Mode == PostHookSync {
+		return fmt.Sprintf("%v(mode=%v, timeout=%v, onError=%v)", v.URL, v.Mode, v.Timeout, v.OnError)
+	}
+	return fmt.Sprintf("%v(mode=%v, timeout=%v, queue=%v, workers=%v)", v.URL, v.Mode, v.Timeout, v.Queue, v.Workers)
+}
+
+func (v *PostHook) label() string {
+	return v.URL.Host + v.URL.Path
+}
+
+// Start the workers for async mode.
+func (v *PostHook) Start(ctx context.Context) {
+	if v.Mode != PostHookAsync {
+		return
+	}
+
+	for i := 0; i < v.Workers; i++ {
+		go func(ctx context.Context) {
+			for {
+				select {
+				case e := <-v.queue:
+					v.send(ctx, e)
+				case <-v.closed:
+					// Send the left events in queue, then quit.
+					for {
+						select {
+						case e := <-v.queue:
+							v.send(ctx, e)
+						default:
+							return
+						}
+					}
+				}
+			}
+		}(ol.WithContext(ctx))
+	}
+}
+
+// Stop the workers after the events in queue are sent, and drop the new events.
+func (v *PostHook) Close() {
+	v.once.Do(func() {
+		close(v.closed)
+	})
+}
+
+// The number of dropped events.
+func (v *PostHook) Dropped() uint64 {
+	return atomic.LoadUint64(&v.dropped)
+}
+
+func (v *PostHook) drop() {
+	atomic.AddUint64(&v.dropped, 1)
+	httpxMetrics.PostHookEvents.Add(1, v.label(), "dropped")
+}
+
+// Notify the event in async mode, drop it if the queue is full or closed.
+func (v *PostHook) Notify(e *PostHookEvent) {
+	select {
+	case <-v.closed:
+		v.drop()
+		return
+	default:
+	}
+
+	select {
+	case v.queue <- e:
+	default:
+		v.drop()
+	}
+}
+
+func (v *PostHook) send(ctx context.Context, e *PostHookEvent) {
+	hookCtx, cancel := context.WithTimeout(context.Background(), v.Timeout)
+	defer cancel()
+
+	if _, err := v.Do(hookCtx, e); err != nil {
+		httpxMetrics.PostHookEvents.Add(1, v.label(), "failed")
+		ol.Wf(ctx, "Post-hook %v err %+v", v.URL, err)
+		return
+	}
+	httpxMetrics.PostHookEvents.Add(1, v.label(), "sent")
+}
+
+// Post the event to post-hook in JSON, return the decision.
+func (v *PostHook) Do(ctx context.Context, e *PostHookEvent) (*HookResponse, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, oe.Wrapf(err, "marshal %v", e)
+	}
+
+	api := v.URL.String()
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, api, bytes.NewReader(b))
+	if err != nil {
+		return nil, oe.Wrapf(err, "create request %v", api)
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	r2, err := http.DefaultClient.Do(r)
+	if err != nil {
+		return nil, oe.Wrapf(err, "request %v", api)
+	}
+	defer r2.Body.Close()
+
+	b, err = ioutil.ReadAll(io.LimitReader(r2.Body, hookMaxResponse))
+	if err != nil {
+		return nil, oe.Wrapf(err, "read response")
+	}
+
+	res, _, err := parseHookResponse(r2, b)
+	return res, err
+}
+
+// Request the post-hook in sync mode before response, to veto or rewrite the headers
+// of response.
+func (v *PostHook) ModifyResponse(ctx context.Context, resp *http.Response, upstream string, start time.Time) {
+	e := NewPostHookEvent(resp.Request, upstream, resp.StatusCode, resp.ContentLength, time.Now().Sub(start))
+	e.Headers = resp.Header
+
+	hookCtx, cancel := context.WithTimeout(resp.Request.Context(), v.Timeout)
+	defer cancel()
+
+	res, err := v.Do(hookCtx, e)
+	if err != nil {
+		httpxMetrics.PostHookEvents.Add(1, v.label(), "failed")
+		ol.Wf(ctx, "Post-hook %v err %+v, %v by onError", v.URL, err, v.OnError)
+
+		if v.OnError == HookAllow {
+			return
+		}
+		res = &HookResponse{Action: HookDeny, Status: http.StatusBadGateway}
+	} else {
+		httpxMetrics.PostHookEvents.Add(1, v.label(), "sent")
+	}
+
+	res.ApplyResponse(resp)
+}
+
+// Apply the response of hook to the upstream response, to veto or rewrite the headers.
+func (v *HookResponse) ApplyResponse(resp *http.Response) {
+	switch v.Action {
+	case HookDeny, HookRedirect:
+		status, body := v.Status, ""
+		if v.Action == HookDeny {
+			if status == 0 {
+				status = http.StatusForbidden
+			}
+			if body = v.Message; body == "" {
+				body = http.StatusText(status)
+			}
+		} else if status == 0 {
+			status = http.StatusFound
+		}
+
+		// Discard the upstream response.
+		resp.Body.Close()
+		resp.StatusCode, resp.Status = status, fmt.Sprintf("%v %v", status, http.StatusText(status))
+		resp.Header = http.Header{}
+		resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		if v.Action == HookRedirect {
+			resp.Header.Set("Location", v.Location)
+		}
+		resp.Body, resp.ContentLength = ioutil.NopCloser(strings.NewReader(body)), int64(len(body))
+		return
+	}
+
+	for _, k := range v.RemoveHeaders {
+		resp.Header.Del(k)
+	}
+	for k, value := range v.AddHeaders {
+		resp.Header.Set(k, value)
+	}
+}
@@ -0,0 +1,107 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostHook(t *testing.T) {
+	events := make(chan *PostHookEvent, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := &PostHookEvent{}
+		json.NewDecoder(r.Body).Decode(e)
+		events <- e
+
+		w.Header().Set("Content-Type", "application/json")
+		if e.Status == http.StatusNotFound {
+			w.Write([]byte(`{"action":"deny","status":451,"message":"blocked"}`))
+		} else {
+			w.Write([]byte(`{"add_headers":{"X-Audit":"ok"},"remove_headers":["X-Secret"]}`))
+		}
+	}))
+	defer hook.Close()
+
+	if _, err := NewPostHook(&url.URL{RawQuery: "mode=x"}); err == nil {
+		t.Errorf("should fail for invalid mode")
+	}
+
+	// Rewrite the headers of response in sync mode.
+	u, _ := url.Parse(hook.URL + "/api/v1/audit?mode=sync&timeout=1s")
+	v, err := NewPostHook(u)
+	if err != nil || v.Mode != PostHookSync || v.URL.RawQuery != "" {
+		t.Fatalf("invalid hook %v, err %v", v, err)
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/users?id=1", nil)
+	resp := &http.Response{
+		StatusCode: http.StatusOK, Header: http.Header{"X-Secret": {"x"}}, ContentLength: 5,
+		Body: ioutil.NopCloser(strings.NewReader("hello")), Request: r,
+	}
+	v.ModifyResponse(context.Background(), resp, "127.0.0.1:1985", time.Now())
+	if e := <-events; e.Path != "/api/v1/users" || e.Query != "id=1" || e.Bytes != 5 || e.Upstream != "127.0.0.1:1985" {
+		t.Errorf("invalid event %v", e)
+	}
+	if resp.Header.Get("X-Audit") != "ok" || resp.Header.Get("X-Secret") != "" {
+		t.Errorf("should rewrite headers %v", resp.Header)
+	}
+
+	// Veto the response in sync mode.
+	resp.StatusCode = http.StatusNotFound
+	v.ModifyResponse(context.Background(), resp, "127.0.0.1:1985", time.Now())
+	<-events
+	if b, _ := ioutil.ReadAll(resp.Body); resp.StatusCode != 451 || string(b) != "blocked" {
+		t.Errorf("should veto, status %v, body %v", resp.StatusCode, string(b))
+	}
+
+	// Drop the events when queue is full in async mode.
+	u, _ = url.Parse(hook.URL + "/api/v1/billing?queue=1")
+	if v, err = NewPostHook(u); err != nil || v.Mode != PostHookAsync {
+		t.Fatalf("invalid hook %v, err %v", v, err)
+	}
+	v.Notify(NewPostHookEvent(r, "", 200, 100, time.Second))
+	v.Notify(NewPostHookEvent(r, "", 200, 200, time.Second))
+	if v.Dropped() != 1 {
+		t.Errorf("should drop, dropped %v", v.Dropped())
+	}
+
+	// Send the left events when closed, then drop.
+	v.Start(context.Background())
+	if e := <-events; e.Bytes != 100 || e.Duration != 1 {
+		t.Errorf("invalid event %v", e)
+	}
+	v.Close()
+	if v.Notify(NewPostHookEvent(r, "", 200, 100, time.Second)); v.Dropped() != 2 {
+		t.Errorf("should drop, dropped %v", v.Dropped())
+	}
+}
@@ -0,0 +1,482 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The actions of pre-hook or post-hook response.
+const (
+	HookAllow    = "allow"
+	HookDeny     = "deny"
+	HookRedirect = "redirect"
+)
+
+// The default max body to forward to pre-hook.
+const preHookMaxBody = 64 * 1024
+
+// The max response of pre-hook or post-hook to read.
+const hookMaxResponse = 1024 * 1024
+
+// The max entries of pre-hook cache.
+const preHookMaxCache = 10000
+
+// The options of pre-hook in query, which are not forwarded to the pre-hook.
+var preHookOptions = []string{"maxBody", "timeout", "retries", "retryBackoff", "onError", "cacheTTL", "cacheKey"}
+
+// The headers which are not forwarded to the pre-hook.
+var preHookHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Te", "Trailer",
+	"Transfer-Encoding", "Upgrade", "Content-Length", "Accept-Encoding",
+}
+
+// The pre-hook before proxy, which receives the headers and body of request, and
+// decides to allow, deny or redirect it. For example:
+//
+//	-pre-hook "http://127.0.0.1:8085/api/v1/auth?maxBody=4KB&timeout=1s&retries=2&onError=deny"
+type PreHook struct {
+	URL *url.URL
+	// The max body to forward, 0 to not forward body.
+	MaxBody int64
+	// The timeout of each request to pre-hook.
+	Timeout time.Duration
+	// The retries when pre-hook fails, and the backoff which doubles for each retry.
+	Retries      int
+	RetryBackoff time.Duration
+	// The policy when pre-hook fails after retries, deny or allow.
+	OnError string
+	// The TTL to cache the allow decisions, 0 to disable. The cache key is the request
+	// attributes, for example, ip,method,uri,header:Authorization,cookie:token
+	CacheTTL time.Duration
+	CacheKey []string
+
+	lock  sync.Mutex
+	cache map[string]*preHookCacheEntry
+	// The concurrent requests with the same cache key share one pre-hook request.
+	flight flightGroup
+}
+
+type preHookCacheEntry struct {
+	res      *HookResponse
+	expireAt time.Time
+}
+
+func NewPreHook(u *url.URL) (*PreHook, error) {
+	v := &PreHook{
+		URL: u, MaxBody: preHookMaxBody, Timeout: 5 * time.Second, RetryBackoff: 100 * time.Millisecond,
+		OnError: HookDeny, CacheKey: []string{"ip", "method", "uri", "header:Authorization", "header:Cookie"},
+		cache: make(map[string]*preHookCacheEntry),
+	}
+
+	q := u.Query()
+	if s := q.Get("maxBody"); s != "" {
+		var err error
+		if v.MaxBody, err = parseSize(s); err != nil {
+			return nil, oe.Wrapf(err, "parse maxBody %v", s)
+		}
+	}
+
+	durations := []struct {
+		key   string
+		value *time.Duration
+	}{
+		{"timeout", &v.Timeout}, {"retryBackoff", &v.RetryBackoff}, {"cacheTTL", &v.CacheTTL},
+	}
+	for _, d := range durations {
+		if s := q.Get(d.key); s != "" {
+			var err error
+			if *d.value, err = time.ParseDuration(s); err != nil {
+				return nil, oe.Wrapf(err, "parse %v %v", d.key, s)
+			}
+		}
+	}
+
+	if s := q.Get("retries"); s != "" {
+		var err error
+		if v.Retries, err = strconv.Atoi(s); err != nil || v.Retries < 0 {
+			return nil, oe.Errorf("invalid retries %v", s)
+		}
+	}
+
+	if s := q.Get("onError"); s != "" {
+		if s != HookDeny && s != HookAllow {
+			return nil, oe.Errorf("invalid onError %v", s)
+		}
+		v.OnError = s
+	}
+
+	if s := q.Get("cacheKey"); s != "" {
+		var err error
+		if v.CacheKey, err = parseRequestKey(s); err != nil {
+			return nil, oe.Wrapf(err, "parse cacheKey")
+		}
+	}
+
+	// Strip the options from the url of pre-hook.
+	for _, k := range preHookOptions {
+		q.Del(k)
+	}
+	target := *u
+	target.RawQuery = q.Encode()
+	v.URL = &target
+
+	return v, nil
+}
+
+func (v *PreHook) String() string {
+	return fmt.Sprintf("%v(maxBody=%v, timeout=%v, retries=%v, onError=%v, cacheTTL=%v, cacheKey=%v)",
+		v.URL, v.MaxBody, v.Timeout, v.Retries, v.OnError, v.CacheTTL, strings.Join(v.CacheKey, ","))
+}
+
+// The response of pre-hook or post-hook in JSON. The hook responses status 200 to allow
+// the request, or JSON to mutate the request or response, for example:
+//
+//	{"action": "allow", "add_headers": {"X-User": "winlin"}, "remove_headers": ["Cookie"]}
+//	{"action": "deny", "status": 401, "message": "invalid token"}
+//	{"action": "redirect", "status": 302, "location": "https://ossrs.net/login"}
+type HookResponse struct {
+	// The action, allow, deny or redirect. Default to allow.
+	Action string `json:"action"`
+	// The status code for deny or redirect, default to 403 or 302.
+	Status int `json:"status"`
+	// The message body for deny.
+	Message string `json:"message"`
+	// The location for redirect.
+	Location string `json:"location"`
+	// The headers to add to or remove from request to upstream, or response to client.
+	AddHeaders    map[string]string `json:"add_headers"`
+	RemoveHeaders []string          `json:"remove_headers"`
+}
+
+// Apply the response to request, return false if the request is denied or redirected,
+// and the response is written.
+func (v *HookResponse) Apply(w http.ResponseWriter, r *http.Request) bool {
+	switch v.Action {
+	case HookDeny:
+		status := v.Status
+		if status == 0 {
+			status = http.StatusForbidden
+		}
+		message := v.Message
+		if message == "" {
+			message = http.StatusText(status)
+		}
+		http.Error(w, message, status)
+		return false
+	case HookRedirect:
+		status := v.Status
+		if status == 0 {
+			status = http.StatusFound
+		}
+		http.Redirect(w, r, v.Location, status)
+		return false
+	}
+
+	for _, k := range v.RemoveHeaders {
+		r.Header.Del(k)
+	}
+	for k, value := range v.AddHeaders {
+		r.Header.Set(k, value)
+	}
+	return true
+}
+
+// Read the body of request, at most max bytes, and restore the body for upstream.
+// Return whether the body is truncated.
+func (v *PreHook) readBody(req *http.Request) (body []byte, truncated bool, err error) {
+	if req.Body == nil || req.Body == http.NoBody || v.MaxBody <= 0 {
+		return nil, req.ContentLength != 0, nil
+	}
+
+	if body, err = ioutil.ReadAll(io.LimitReader(req.Body, v.MaxBody+1)); err != nil {
+		return nil, false, oe.Wrapf(err, "read body")
+	}
+
+	// Restore the body, the read bytes and the left in body.
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+
+	if int64(len(body)) > v.MaxBody {
+		return body[:v.MaxBody], true, nil
+	}
+	return body, false, nil
+}
+
+// The cache key of request, empty if not cacheable, for example, with body.
+func (v *PreHook) cacheKey(req *http.Request) string {
+	if v.CacheTTL <= 0 || (req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0) {
+		return ""
+	}
+
+	return requestKey(req, v.CacheKey)
+}
+
+// Parse the key of request, in attributes separated by comma, for example,
+// ip,method,host,path,uri,query,header:Authorization,cookie:token
+func parseRequestKey(s string) ([]string, error) {
+	keys := strings.Split(s, ",")
+	for _, k := range keys {
+		switch {
+		case k == "ip", k == "method", k == "host", k == "path", k == "uri", k == "query":
+		case strings.HasPrefix(k, "header:"), strings.HasPrefix(k, "cookie:"):
+		default:
+			return nil, oe.Errorf("invalid key %v", k)
+		}
+	}
+	return keys, nil
+}
+
+// Build the key of request by the attributes.
+func requestKey(req *http.Request, keys []string) string {
+	var key []string
+	for _, k := range keys {
+		switch {
+		case k == "ip":
+			key = append(key, realIP(req))
+		case k == "method":
+			key = append(key, req.Method)
+		case k == "host":
+			key = append(key, req.Host)
+		case k == "path":
+			key = append(key, req.URL.Path)
+		case k == "uri":
+			key = append(key, req.URL.RequestURI())
+		case k == "query":
+			key = append(key, req.URL.RawQuery)
+		case strings.HasPrefix(k, "header:"):
+			key = append(key, strings.Join(req.Header.Values(k[len("header:"):]), ","))
+		case strings.HasPrefix(k, "cookie:"):
+			if c, err := req.Cookie(k[len("cookie:"):]); err == nil {
+				key = append(key, c.Value)
+			} else {
+				key = append(key, "")
+			}
+		}
+	}
+	return strings.Join(key, "\n")
+}
+
+// Get the cached allow decision, nil if not found or expired.
+func (v *PreHook) cached(key string) *HookResponse {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if entry, ok := v.cache[key]; ok {
+		if time.Now().Before(entry.expireAt) {
+			return entry.res
+		}
+		delete(v.cache, key)
+	}
+	return nil
+}
+
+// Cache the allow decision, remove the expired entries when full.
+func (v *PreHook) store(key string, res *HookResponse) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	if len(v.cache) >= preHookMaxCache {
+		for k, entry := range v.cache {
+			if now.After(entry.expireAt) {
+				delete(v.cache, k)
+			}
+		}
+	}
+	if len(v.cache) < preHookMaxCache {
+		v.cache[key] = &preHookCacheEntry{res: res, expireAt: now.Add(v.CacheTTL)}
+	}
+}
+
+// Request the pre-hook with the headers and body of req, retry with backoff when it
+// fails, and return the decision.
+func (v *PreHook) Do(ctx context.Context, req *http.Request) (*HookResponse, error) {
+	key := v.cacheKey(req)
+	if key != "" {
+		if res := v.cached(key); res != nil {
+			ol.Tf(ctx, "Pre-hook %v cached %v", v.URL, res.Action)
+			return res, nil
+		}
+	}
+
+	// Coalesce the concurrent requests with the same cache key. Never cancel the shared
+	// request when the first client is gone, and each client waits in its own context.
+	if key != "" {
+		type result struct {
+			res    interface{}
+			err    error
+			shared bool
+		}
+		done := make(chan result, 1)
+		go func() {
+			res, err, shared := v.flight.Do(key, func() (interface{}, error) {
+				return v.do(ctx, context.Background(), req, key)
+			})
+			done <- result{res, err, shared}
+		}()
+
+		var r result
+		select {
+		case <-req.Context().Done():
+			return nil, oe.Wrapf(req.Context().Err(), "request done")
+		case r = <-done:
+		}
+
+		if r.err != nil {
+			return nil, r.err
+		}
+		if r.shared {
+			ol.Tf(ctx, "Pre-hook %v shared %v", v.URL, r.res.(*HookResponse).Action)
+		}
+		return r.res.(*HookResponse), nil
+	}
+
+	return v.do(ctx, req.Context(), req, key)
+}
+
+// Request the pre-hook with retries in the base context, and cache the allow decision if
+// key is not empty.
+func (v *PreHook) do(ctx, base context.Context, req *http.Request, key string) (*HookResponse, error) {
+	body, truncated, err := v.readBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var res *HookResponse
+	for i, backoff := 0, v.RetryBackoff; ; i, backoff = i+1, backoff*2 {
+		var retry bool
+		if res, retry, err = v.request(ctx, base, req, body, truncated); err == nil || !retry || i >= v.Retries {
+			break
+		}
+
+		ol.Wf(ctx, "Pre-hook retry %v/%v after %v, err %+v", i+1, v.Retries, backoff, err)
+		select {
+		case <-base.Done():
+			return nil, oe.Wrapf(base.Err(), "request done")
+		case <-time.After(backoff):
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if key != "" && res.Action == HookAllow {
+		v.store(key, res)
+	}
+	return res, nil
+}
+
+// Request the pre-hook once, return whether to retry if error.
+func (v *PreHook) request(ctx, base context.Context, req *http.Request, body []byte, truncated bool) (res *HookResponse, retry bool, err error) {
+	target := *v.URL
+	target.RawQuery = strings.Join([]string{target.RawQuery, req.URL.RawQuery}, "&")
+	api := target.String()
+
+	hookCtx, cancel := context.WithTimeout(base, v.Timeout)
+	defer cancel()
+
+	r, err := http.NewRequestWithContext(hookCtx, req.Method, api, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, oe.Wrapf(err, "create request %v", api)
+	}
+
+	// Forward the headers of request, except the hop-by-hop headers.
+	for k, values := range req.Header {
+		r.Header[k] = append([]string(nil), values...)
+	}
+	for _, k := range preHookHopHeaders {
+		r.Header.Del(k)
+	}
+	r.Header.Set("X-Original-Method", req.Method)
+	r.Header.Set("X-Original-URI", req.URL.RequestURI())
+	r.Header.Set("X-Forwarded-Host", req.Host)
+	if truncated {
+		r.Header.Set("X-Body-Truncated", "true")
+	}
+
+	// Add real ip and forwarded for to header.
+	// We should append the forward for pass-by.
+	addProxyAddToHeader(req.RemoteAddr, req.Header.Get("X-Real-IP"), req.Header["X-Forwarded-For"], r.Header, false)
+	ol.Tf(ctx, "Pre-hook proxy addr req=%v, r=%v", req.Header, r.Header)
+
+	r2, err := http.DefaultClient.Do(r)
+	if err != nil {
+		// Retry if not canceled by client.
+		return nil, base.Err() == nil, oe.Wrapf(err, "request %v", api)
+	}
+	defer r2.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(r2.Body, hookMaxResponse))
+	if err != nil {
+		return nil, base.Err() == nil, oe.Wrapf(err, "read response")
+	}
+	ol.Tf(ctx, "Pre-hook %v url=%v, status=%v, res=%v", req.Method, api, r2.StatusCode, string(b))
+
+	return parseHookResponse(r2, b)
+}
+
+// Parse the response of hook in JSON, or allow for status 200. Return whether to retry
+// if error, for example, the hook responses 5xx.
+func parseHookResponse(r *http.Response, b []byte) (res *HookResponse, retry bool, err error) {
+	res = &HookResponse{}
+	if len(bytes.TrimSpace(b)) > 0 && strings.Contains(r.Header.Get("Content-Type"), "json") {
+		if err := json.Unmarshal(b, res); err != nil {
+			return nil, r.StatusCode >= 500, oe.Wrapf(err, "parse %v", string(b))
+		}
+	}
+
+	switch res.Action {
+	case "", HookAllow:
+		if r.StatusCode != http.StatusOK {
+			return nil, r.StatusCode >= 500, oe.Errorf("Hook HTTP StatusCode=%v %v", r.StatusCode, r.Status)
+		}
+		res.Action = HookAllow
+	case HookDeny:
+	case HookRedirect:
+		if res.Location == "" {
+			return nil, false, oe.Errorf("no location for redirect")
+		}
+	default:
+		return nil, false, oe.Errorf("invalid action %v", res.Action)
+	}
+
+	return res, false, nil
+}
@@ -0,0 +1,214 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPreHook(t *testing.T) {
+	var body, user, query string
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body, user, query = string(b), r.Header.Get("X-Token"), r.URL.RawQuery
+
+		switch r.URL.Query().Get("token") {
+		case "":
+			w.WriteHeader(http.StatusOK)
+		case "user":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"action":"allow","add_headers":{"X-User":"winlin"},"remove_headers":["X-Token"]}`))
+		case "deny":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"action":"deny","status":401,"message":"invalid token"}`))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer hook.Close()
+
+	u, _ := url.Parse(hook.URL + "/api/v1/auth?maxBody=4&app=live")
+	v, err := NewPreHook(u)
+	if err != nil || v.MaxBody != 4 || v.URL.RawQuery != "app=live" {
+		t.Fatalf("invalid hook %v, err %v", v, err)
+	}
+
+	// Forward the capped body and headers, and restore the body.
+	r := httptest.NewRequest("POST", "/api/v1/auth?token=user", strings.NewReader("hello world"))
+	r.Header.Set("X-Token", "abc")
+	res, err := v.Do(context.Background(), r)
+	if err != nil || res.Action != HookAllow || body != "hell" || user != "abc" || query != "app=live&token=user" {
+		t.Errorf("err %v, res %v, body %v, user %v, query %v", err, res, body, user, query)
+	}
+	if res.Apply(nil, r); r.Header.Get("X-User") != "winlin" || r.Header.Get("X-Token") != "" {
+		t.Errorf("should mutate header %v", r.Header)
+	}
+	if b, _ := ioutil.ReadAll(r.Body); string(b) != "hello world" {
+		t.Errorf("should restore body %v", string(b))
+	}
+
+	// Allow by status 200.
+	if res, err = v.Do(context.Background(), httptest.NewRequest("GET", "/api/v1/auth", nil)); err != nil || res.Action != HookAllow {
+		t.Errorf("should allow, err %v", err)
+	}
+
+	// Deny by JSON.
+	res, err = v.Do(context.Background(), httptest.NewRequest("GET", "/api/v1/auth?token=deny", nil))
+	w := httptest.NewRecorder()
+	if err != nil || res.Apply(w, r) || w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "invalid token") {
+		t.Errorf("should deny, err %v, code %v, body %v", err, w.Code, w.Body.String())
+	}
+
+	// Error by status.
+	if _, err = v.Do(context.Background(), httptest.NewRequest("GET", "/api/v1/auth?token=x", nil)); err == nil {
+		t.Errorf("should fail")
+	}
+	// The deny is not a failure of pre-hook.
+	label := v.URL.Host + v.URL.Path
+	count := func(m *metricVec, values ...string) float64 {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		return m.get(values).value
+	}
+	failures, denied := count(httpxMetrics.PreHookFailures, label), count(httpxMetrics.PreHookDenied, label, HookDeny)
+	for _, token := range []string{"deny", "x"} {
+		r := httptest.NewRequest("GET", "/api/v1/auth?token="+token, nil)
+		NewComplexProxy(context.Background(), nil, v, nil, r).ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if count(httpxMetrics.PreHookFailures, label) != failures+1 || count(httpxMetrics.PreHookDenied, label, HookDeny) != denied+1 {
+		t.Errorf("expect 1 failure and 1 denied, got %v and %v", count(httpxMetrics.PreHookFailures, label)-failures,
+			count(httpxMetrics.PreHookDenied, label, HookDeny)-denied)
+	}
+}
+
+func TestPreHookRetry(t *testing.T) {
+	var requests int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first request, and hang for the slow one.
+		if n := atomic.AddInt32(&requests, 1); n == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else if r.URL.Query().Get("slow") != "" {
+			time.Sleep(200 * time.Millisecond)
+		}
+	}))
+	defer hook.Close()
+
+	if _, err := NewPreHook(&url.URL{RawQuery: "onError=ignore"}); err == nil {
+		t.Errorf("should fail for invalid onError")
+	}
+	if _, err := NewPreHook(&url.URL{RawQuery: "cacheKey=ip,body"}); err == nil {
+		t.Errorf("should fail for invalid cacheKey")
+	}
+
+	u, _ := url.Parse(hook.URL + "/api/v1/auth?timeout=50ms&retries=1&retryBackoff=1ms&cacheTTL=1m&cacheKey=ip,header:Authorization")
+	v, err := NewPreHook(u)
+	if err != nil || v.URL.RawQuery != "" {
+		t.Fatalf("invalid hook %v, err %v", v, err)
+	}
+
+	// Retry when hook fails, and cache the allow decision.
+	r := httptest.NewRequest("GET", "/api/v1/auth", nil)
+	r.Header.Set("Authorization", "Bearer abc")
+	if res, err := v.Do(context.Background(), r); err != nil || res.Action != HookAllow || atomic.LoadInt32(&requests) != 2 {
+		t.Errorf("should allow after retry, err %v, requests %v", err, atomic.LoadInt32(&requests))
+	}
+	if res, err := v.Do(context.Background(), r); err != nil || res.Action != HookAllow || atomic.LoadInt32(&requests) != 2 {
+		t.Errorf("should allow by cache, err %v, requests %v", err, atomic.LoadInt32(&requests))
+	}
+
+	// Timeout for the other key, and not cached.
+	r = httptest.NewRequest("GET", "/api/v1/auth?slow=1", nil)
+	if _, err := v.Do(context.Background(), r); err == nil || atomic.LoadInt32(&requests) != 4 {
+		t.Errorf("should timeout, err %v, requests %v", err, atomic.LoadInt32(&requests))
+	}
+}
+
+func TestPreHookCoalesce(t *testing.T) {
+	var requests int32
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer hook.Close()
+
+	u, _ := url.Parse(hook.URL + "/api/v1/auth?cacheTTL=1m&cacheKey=header:Authorization")
+	v, err := NewPreHook(u)
+	if err != nil {
+		t.Fatalf("invalid hook %v, err %v", v, err)
+	}
+
+	// The concurrent requests with the same key share one pre-hook request.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/api/v1/stats", nil)
+			r.Header.Set("Authorization", "Bearer abc")
+			if res, err := v.Do(context.Background(), r); err != nil || res.Action != HookAllow {
+				t.Errorf("should allow, err %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("requests=%v", n)
+	}
+
+	// The first client is gone, the others still get the shared decision.
+	ctx, cancel := context.WithCancel(context.Background())
+	first := httptest.NewRequest("GET", "/api/v1/stats", nil).WithContext(ctx)
+	first.Header.Set("Authorization", "Bearer xyz")
+	errs := make(chan error, 1)
+	go func() {
+		_, err := v.Do(context.Background(), first)
+		errs <- err
+	}()
+
+	time.Sleep(30 * time.Millisecond)
+	cancel()
+	if err := <-errs; err == nil {
+		t.Errorf("should fail for canceled client")
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/stats", nil)
+	r.Header.Set("Authorization", "Bearer xyz")
+	if res, err := v.Do(context.Background(), r); err != nil || res.Action != HookAllow {
+		t.Errorf("should allow, err %v", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("requests=%v", n)
+	}
+}
@@ -0,0 +1,217 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The signature of PROXY protocol v2.
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+var proxyProtoV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// The timeout to read the PROXY protocol header.
+const proxyProtoTimeout = 10 * time.Second
+
+// The listener parses the PROXY protocol v1 or v2 header of connections, when behind
+// the L4 load balancer, so the remote address is the client address.
+type proxyProtoListener struct {
+	net.Listener
+	// Whether the peer is allowed to send PROXY header, nil to allow all.
+	trusted func(ip string) bool
+}
+
+func NewProxyProtoListener(ln net.Listener, trusted func(ip string) bool) net.Listener {
+	return &proxyProtoListener{Listener: ln, trusted: trusted}
+}
+
+func (v *proxyProtoListener) Accept() (net.Conn, error) {
+	c, err := v.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: c, trusted: v.trusted, r: bufio.NewReader(c)}, nil
+}
+
+// The connection parses the PROXY header lazily in the goroutine of connection, when
+// the first Read or RemoteAddr, so it never blocks the Accept.
+type proxyProtoConn struct {
+	net.Conn
+	trusted func(ip string) bool
+	r       *bufio.Reader
+
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (v *proxyProtoConn) Read(b []byte) (int, error) {
+	if v.once.Do(v.parse); v.err != nil {
+		return 0, v.err
+	}
+	return v.r.Read(b)
+}
+
+func (v *proxyProtoConn) RemoteAddr() net.Addr {
+	if v.once.Do(v.parse); v.remoteAddr != nil {
+		return v.remoteAddr
+	}
+	return v.Conn.RemoteAddr()
+}
+
+func (v *proxyProtoConn) LocalAddr() net.Addr {
+	if v.once.Do(v.parse); v.localAddr != nil {
+		return v.localAddr
+	}
+	return v.Conn.LocalAddr()
+}
+
+func (v *proxyProtoConn) parse() {
+	if v.trusted != nil {
+		if peer, _, err := net.SplitHostPort(v.Conn.RemoteAddr().String()); err == nil && !v.trusted(peer) {
+			v.err = oe.Errorf("PROXY header from untrusted %v", v.Conn.RemoteAddr())
+			return
+		}
+	}
+
+	v.Conn.SetReadDeadline(time.Now().Add(proxyProtoTimeout))
+	defer v.Conn.SetReadDeadline(time.Time{})
+
+	if v.remoteAddr, v.localAddr, v.err = parseProxyProto(v.r); v.err != nil {
+		v.err = oe.Wrapf(v.err, "PROXY header from %v", v.Conn.RemoteAddr())
+	}
+}
+
+// Parse the PROXY protocol header, return nil address for UNKNOWN or LOCAL.
+func parseProxyProto(r *bufio.Reader) (src, dst net.Addr, err error) {
+	b, err := r.Peek(len(proxyProtoV2Signature))
+	if err != nil {
+		return nil, nil, oe.Wrapf(err, "peek")
+	}
+
+	if bytes.Equal(b, proxyProtoV2Signature) {
+		return parseProxyProtoV2(r)
+	}
+	if bytes.HasPrefix(b, []byte("PROXY ")) {
+		return parseProxyProtoV1(r)
+	}
+	return nil, nil, oe.New("no PROXY header")
+}
+
+// Parse the v1 header, for example, PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func parseProxyProtoV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	// The max length of v1 header is 107 bytes.
+	var line []byte
+	for len(line) < 107 {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, oe.Wrapf(err, "read v1")
+		}
+		if line = append(line, c); c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, oe.Errorf("invalid v1 %q", line)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, oe.Errorf("invalid v1 %q", line)
+	}
+
+	parseAddr := func(host, port string) (net.Addr, error) {
+		ip := net.ParseIP(host)
+		p, err := strconv.ParseUint(port, 10, 16)
+		if ip == nil || err != nil {
+			return nil, oe.Errorf("invalid address %v:%v", host, port)
+		}
+		return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+	}
+	if src, err = parseAddr(fields[2], fields[4]); err != nil {
+		return nil, nil, err
+	}
+	if dst, err = parseAddr(fields[3], fields[5]); err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+// Parse the v2 binary header, only TCP over IPv4 or IPv6 is supported, and the TLVs
+// are ignored.
+func parseProxyProtoV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	header := make([]byte, 16)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return nil, nil, oe.Wrapf(err, "read v2")
+	}
+
+	verCmd, family := header[12], header[13]
+	if verCmd>>4 != 2 {
+		return nil, nil, oe.Errorf("invalid v2 version %x", verCmd)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return nil, nil, oe.Wrapf(err, "read v2 payload")
+	}
+
+	// The LOCAL command, for example, health check of load balancer.
+	if verCmd&0x0f == 0x00 {
+		return nil, nil, nil
+	}
+	if verCmd&0x0f != 0x01 {
+		return nil, nil, oe.Errorf("invalid v2 command %x", verCmd)
+	}
+
+	var size int
+	switch family {
+	case 0x11: // TCP over IPv4.
+		size = net.IPv4len
+	case 0x21: // TCP over IPv6.
+		size = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(payload) < size*2+4 {
+		return nil, nil, oe.Errorf("invalid v2 payload %v", len(payload))
+	}
+
+	src = &net.TCPAddr{IP: net.IP(payload[:size]), Port: int(binary.BigEndian.Uint16(payload[size*2:]))}
+	dst = &net.TCPAddr{IP: net.IP(payload[size : size*2]), Port: int(binary.BigEndian.Uint16(payload[size*2+2:]))}
+	return
+}
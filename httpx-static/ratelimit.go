@@ -0,0 +1,201 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/https/time/rate"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The max number of clients of a limiter, to bound the memory when there are lots of
+// clients, for example, attacked by spoofed ips.
+const maxRateClients = 100000
+
+type clientLimiter struct {
+	client   string
+	limiter  *rate.Limiter
+	lastSeen time.Time
+	elem     *list.Element
+}
+
+// The request rate limiter for clients, keyed by client ip. The idle limiter is removed
+// when its bucket is full again, and the least recently seen one is evicted when exceed
+// the MaxClients, so the memory is bounded.
+type RateLimiter struct {
+	limit rate.Limit
+	burst int
+	// The max number of clients, evict the least recently seen one when exceed.
+	MaxClients int
+
+	lock    sync.Mutex
+	clients map[string]*clientLimiter
+	// The clients by seen, the front is the most recently seen.
+	lru    *list.List
+	cancel context.CancelFunc
+}
+
+// Create limiter with limit requests per second, and burst requests. The burst is
+// default to limit if 0.
+func NewRateLimiter(limit float64, burst int) *RateLimiter {
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(limit)))
+	}
+
+	return &RateLimiter{
+		limit: rate.Limit(limit), burst: burst, MaxClients: maxRateClients,
+		clients: make(map[string]*clientLimiter), lru: list.New(),
+	}
+}
+
+// Create limiter by proxy options rateLimit and rateBurst, nil if no limit.
+func NewRateLimiterByQuery(q url.Values) (*RateLimiter, error) {
+	s := q.Get("rateLimit")
+	if s == "" {
+		return nil, nil
+	}
+
+	limit, err := strconv.ParseFloat(s, 64)
+	if err != nil || limit <= 0 {
+		return nil, oe.Errorf("invalid rateLimit=%v", s)
+	}
+
+	var burst int
+	if s := q.Get("rateBurst"); s != "" {
+		if burst, err = strconv.Atoi(s); err != nil {
+			return nil, oe.Wrapf(err, "parse rateBurst=%v", s)
+		}
+	}
+
+	return NewRateLimiter(limit, burst), nil
+}
+
+// Whether allow the request from client, or the duration to retry after.
+func (v *RateLimiter) Allow(client string) (bool, time.Duration) {
+	now := time.Now()
+
+	v.lock.Lock()
+	c, ok := v.clients[client]
+	if !ok {
+		c = &clientLimiter{client: client, limiter: rate.NewLimiter(v.limit, v.burst)}
+		c.elem = v.lru.PushFront(c)
+		v.clients[client] = c
+	} else {
+		v.lru.MoveToFront(c.elem)
+	}
+	c.lastSeen = now
+
+	for v.MaxClients > 0 && v.lru.Len() > v.MaxClients {
+		v.remove(v.lru.Back().Value.(*clientLimiter))
+	}
+	v.lock.Unlock()
+
+	r := c.limiter.ReserveN(now, 1)
+	if !r.OK() {
+		return false, time.Second
+	}
+
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// Start to cleanup the idle limiters, until Close.
+func (v *RateLimiter) Start(ctx context.Context) {
+	if v.cancel != nil {
+		return
+	}
+
+	// The bucket is full after idle for this duration, so it's safe to remove.
+	idle := time.Duration(float64(v.burst) / float64(v.limit) * float64(time.Second))
+	if idle < time.Second {
+		idle = time.Second
+	}
+
+	ctx, v.cancel = context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				v.cleanup(idle)
+			}
+		}
+	}()
+}
+
+func (v *RateLimiter) cleanup(idle time.Duration) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	now := time.Now()
+	for _, c := range v.clients {
+		if now.Sub(c.lastSeen) > idle {
+			v.remove(c)
+		}
+	}
+}
+
+func (v *RateLimiter) remove(c *clientLimiter) {
+	v.lru.Remove(c.elem)
+	delete(v.clients, c.client)
+}
+
+func (v *RateLimiter) Close() {
+	if v.cancel != nil {
+		v.cancel()
+	}
+}
+
+func (v *RateLimiter) String() string {
+	return fmt.Sprintf("%v/s, burst %v", float64(v.limit), v.burst)
+}
+
+// Limit the request by client ip, write 429 with Retry-After and return false when
+// exceed the limit.
+func (v *RateLimiter) Limit(w http.ResponseWriter, r *http.Request) bool {
+	ok, retryAfter := v.Allow(realIP(r))
+	if ok {
+		return true
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+	return false
+}
@@ -0,0 +1,94 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	v := NewRateLimiter(1, 2)
+
+	// Allow the burst, then deny with retry after.
+	for i := 0; i < 2; i++ {
+		if ok, _ := v.Allow("10.0.0.1"); !ok {
+			t.Errorf("should allow %v", i)
+		}
+	}
+	if ok, retryAfter := v.Allow("10.0.0.1"); ok || retryAfter <= 0 || retryAfter > time.Second {
+		t.Errorf("should deny, ok=%v, retry=%v", ok, retryAfter)
+	}
+
+	// The other client is not limited.
+	if ok, _ := v.Allow("10.0.0.2"); !ok {
+		t.Errorf("should allow other client")
+	}
+
+	// Response 429 with Retry-After.
+	w := httptest.NewRecorder()
+	r := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: http.Header{}}
+	if v.Limit(w, r) || w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("should limit, code=%v, header=%v", w.Code, w.Header())
+	}
+
+	// Cleanup the idle clients.
+	v.clients["10.0.0.2"].lastSeen = time.Now().Add(-time.Hour)
+	v.cleanup(2 * time.Second)
+	if _, ok := v.clients["10.0.0.2"]; ok || len(v.clients) != 1 {
+		t.Errorf("should cleanup, clients=%v", len(v.clients))
+	}
+}
+
+func TestRateLimiterMaxClients(t *testing.T) {
+	v := NewRateLimiter(1, 1)
+	v.MaxClients = 2
+
+	v.Allow("10.0.0.1")
+	v.Allow("10.0.0.2")
+	if ok, _ := v.Allow("10.0.0.1"); ok {
+		t.Errorf("should deny 10.0.0.1")
+	}
+
+	// Evict the least recently seen client, which is 10.0.0.2.
+	v.Allow("10.0.0.3")
+	if _, ok := v.clients["10.0.0.2"]; ok || len(v.clients) != 2 || v.lru.Len() != 2 {
+		t.Errorf("should evict 10.0.0.2, clients=%v", len(v.clients))
+	}
+	if ok, _ := v.Allow("10.0.0.1"); ok {
+		t.Errorf("should keep limiting 10.0.0.1")
+	}
+
+	// Lots of clients never exceed the max.
+	for i := 0; i < 1000; i++ {
+		v.Allow(fmt.Sprintf("10.0.1.%v", i))
+	}
+	if len(v.clients) != 2 || v.lru.Len() != 2 {
+		t.Errorf("should bound clients, got %v", len(v.clients))
+	}
+}
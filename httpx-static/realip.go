@@ -0,0 +1,132 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The forwarding headers, which are only trusted from the trusted proxies.
+var forwardingHeaders = []string{
+	"X-Real-IP", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-Schema", "Forwarded",
+}
+
+// The trusted proxies in CIDR, for example, 10.0.0.0/8 or 127.0.0.1, whose forwarding
+// headers such as X-Real-IP and X-Forwarded-For are honored.
+type TrustedProxies struct {
+	nets []*net.IPNet
+}
+
+// Create the trusted proxies by CIDR or ip, separated by comma.
+func NewTrustedProxies(cidrs []string) (*TrustedProxies, error) {
+	v := &TrustedProxies{}
+	for _, cidr := range cidrs {
+		for _, cidr := range strings.Split(cidr, ",") {
+			if cidr = strings.TrimSpace(cidr); cidr == "" {
+				continue
+			}
+
+			if !strings.Contains(cidr, "/") {
+				if ip := net.ParseIP(cidr); ip == nil {
+					return nil, oe.Errorf("invalid ip %v", cidr)
+				} else if ip.To4() != nil {
+					cidr += "/32"
+				} else {
+					cidr += "/128"
+				}
+			}
+
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, oe.Wrapf(err, "parse %v", cidr)
+			}
+			v.nets = append(v.nets, ipnet)
+		}
+	}
+	return v, nil
+}
+
+// Whether the ip is trusted.
+func (v *TrustedProxies) Contains(ip string) bool {
+	addr := net.ParseIP(strings.TrimSpace(ip))
+	if addr == nil {
+		return false
+	}
+
+	for _, ipnet := range v.nets {
+		if ipnet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *TrustedProxies) String() string {
+	var s []string
+	for _, ipnet := range v.nets {
+		s = append(s, ipnet.String())
+	}
+	return strings.Join(s, ",")
+}
+
+// Resolve the client ip of request, and set to X-Real-IP. The forwarding headers are
+// stripped if the peer is not trusted, so the client ip is the socket address. For the
+// trusted peer, the client ip is the X-Real-IP, or the right-most untrusted address in
+// X-Forwarded-For.
+func (v *TrustedProxies) Resolve(r *http.Request) {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+
+	if !v.Contains(peer) {
+		for _, h := range forwardingHeaders {
+			r.Header.Del(h)
+		}
+		return
+	}
+
+	if r.Header.Get("X-Real-IP") != "" {
+		return
+	}
+
+	var fwd []string
+	for _, values := range r.Header["X-Forwarded-For"] {
+		fwd = append(fwd, strings.Split(values, ",")...)
+	}
+	for i := len(fwd) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(fwd[i])
+		if net.ParseIP(ip) == nil {
+			return
+		}
+		if i == 0 || !v.Contains(ip) {
+			r.Header.Set("X-Real-IP", ip)
+			return
+		}
+	}
+}
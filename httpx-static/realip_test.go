@@ -0,0 +1,116 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	if _, err := NewTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("should fail for invalid cidr")
+	}
+
+	v, err := NewTrustedProxies([]string{"10.0.0.0/8,127.0.0.1", "::1"})
+	if err != nil {
+		t.Fatalf("err %+v", err)
+	}
+
+	resolve := func(remoteAddr string, header http.Header) *http.Request {
+		r := &http.Request{RemoteAddr: remoteAddr, Header: header}
+		v.Resolve(r)
+		return r
+	}
+
+	// Strip the headers from untrusted client.
+	r := resolve("1.2.3.4:1234", http.Header{"X-Real-Ip": {"5.6.7.8"}, "X-Forwarded-For": {"5.6.7.8"}})
+	if len(r.Header) != 0 || realIP(r) != "1.2.3.4" {
+		t.Errorf("should strip, header=%v, ip=%v", r.Header, realIP(r))
+	}
+
+	// Honor the X-Real-IP from trusted proxy.
+	if r = resolve("127.0.0.1:1234", http.Header{"X-Real-Ip": {"5.6.7.8"}}); realIP(r) != "5.6.7.8" {
+		t.Errorf("should honor, ip=%v", realIP(r))
+	}
+
+	// The right-most untrusted address in X-Forwarded-For.
+	r = resolve("[::1]:1234", http.Header{"X-Forwarded-For": {"9.9.9.9, 5.6.7.8", "10.0.0.2"}})
+	if realIP(r) != "5.6.7.8" {
+		t.Errorf("should resolve, ip=%v", realIP(r))
+	}
+	if r = resolve("10.0.0.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.3"}}); realIP(r) != "10.0.0.3" {
+		t.Errorf("should resolve, ip=%v", realIP(r))
+	}
+
+	// Trust none if no trusted proxies.
+	v, _ = NewTrustedProxies(nil)
+	r = resolve("1.2.3.4:1234", http.Header{"X-Real-Ip": {"5.6.7.8"}, "X-Forwarded-For": {"5.6.7.8"}})
+	if len(r.Header) != 0 || realIP(r) != "1.2.3.4" {
+		t.Errorf("should strip, header=%v, ip=%v", r.Header, realIP(r))
+	}
+}
+
+func TestProxyProto(t *testing.T) {
+	headers := []struct {
+		header string
+		src    string
+		dst    string
+	}{
+		{"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n", "192.168.0.1:56324", "192.168.0.11:443"},
+		{"PROXY TCP6 ::1 ::2 56324 443\r\n", "[::1]:56324", "[::2]:443"},
+		{"PROXY UNKNOWN\r\n", "", ""},
+		{string(proxyProtoV2Signature) + "\x21\x11\x00\x0c\xc0\xa8\x00\x01\xc0\xa8\x00\x0b\xdc\x04\x01\xbb", "192.168.0.1:56324", "192.168.0.11:443"},
+		{string(proxyProtoV2Signature) + "\x20\x00\x00\x00", "", ""},
+	}
+	for _, h := range headers {
+		r := bufio.NewReader(strings.NewReader(h.header + "GET / HTTP/1.1\r\n"))
+		src, dst, err := parseProxyProto(r)
+		if err != nil {
+			t.Errorf("parse %q err %+v", h.header, err)
+			continue
+		}
+
+		if h.src == "" && (src != nil || dst != nil) {
+			t.Errorf("parse %q should be nil, src=%v, dst=%v", h.header, src, dst)
+		} else if h.src != "" && (src == nil || src.String() != h.src || dst.String() != h.dst) {
+			t.Errorf("parse %q expect %v %v, got %v %v", h.header, h.src, h.dst, src, dst)
+		}
+
+		// The data after header is not consumed.
+		if b, _ := r.ReadBytes('\n'); !bytes.Equal(b, []byte("GET / HTTP/1.1\r\n")) {
+			t.Errorf("parse %q left %q", h.header, b)
+		}
+	}
+
+	for _, h := range []string{"GET / HTTP/1.1\r\n", "PROXY TCP4 1.2.3.4\r\n", "PROXY TCP4 a b 1 2\r\n"} {
+		if _, _, err := parseProxyProto(bufio.NewReader(strings.NewReader(h))); err == nil {
+			t.Errorf("parse %q should fail", h)
+		}
+	}
+}
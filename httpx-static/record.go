@@ -0,0 +1,229 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The response writer to get the status and bytes of response, which supports the
+// flusher and hijacker for proxy.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (v *statusWriter) WriteHeader(status int) {
+	if v.status == 0 {
+		v.status = status
+	}
+	v.ResponseWriter.WriteHeader(status)
+}
+
+func (v *statusWriter) Write(b []byte) (int, error) {
+	if v.status == 0 {
+		v.status = http.StatusOK
+	}
+	n, err := v.ResponseWriter.Write(b)
+	v.bytes += int64(n)
+	return n, err
+}
+
+// Keep the sendfile for http.ServeFile.
+func (v *statusWriter) ReadFrom(r io.Reader) (int64, error) {
+	if v.status == 0 {
+		v.status = http.StatusOK
+	}
+
+	var n int64
+	var err error
+	if rf, ok := v.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(v.ResponseWriter, r)
+	}
+	v.bytes += n
+	return n, err
+}
+
+// Flush and hijack by the inner writers, unwrap the ones such as the streamWriter, which
+// is not a hijacker.
+func (v *statusWriter) Flush() {
+	for w := v.ResponseWriter; w != nil; w = unwrapWriter(w) {
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+			return
+		}
+	}
+}
+
+func (v *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	for w := v.ResponseWriter; w != nil; w = unwrapWriter(w) {
+		if h, ok := w.(http.Hijacker); ok {
+			if v.status == 0 {
+				v.status = http.StatusSwitchingProtocols
+			}
+			return h.Hijack()
+		}
+	}
+	return nil, nil, fmt.Errorf("not hijacker")
+}
+
+// Get the inner writer of the wrapped one, nil if not wrapped.
+func unwrapWriter(w http.ResponseWriter) http.ResponseWriter {
+	if u, ok := w.(interface{ Unwrap() http.ResponseWriter }); ok {
+		return u.Unwrap()
+	}
+	return nil
+}
+
+func (v *statusWriter) Unwrap() http.ResponseWriter {
+	return v.ResponseWriter
+}
+
+// The status of response, 200 if nothing written.
+func (v *statusWriter) Status() int {
+	if v.status == 0 {
+		return http.StatusOK
+	}
+	return v.status
+}
+
+// The response writer for stream, which counts the bytes streamed to client in metrics
+// when writing, because the stream is long-lived.
+type streamWriter struct {
+	http.ResponseWriter
+	path, client string
+	bytes        int64
+}
+
+func (v *streamWriter) Write(b []byte) (int, error) {
+	n, err := v.ResponseWriter.Write(b)
+	if n > 0 {
+		v.bytes += int64(n)
+		httpxMetrics.StreamBytes.Add(float64(n), v.path, v.client)
+	}
+	return n, err
+}
+
+func (v *streamWriter) Flush() {
+	if f, ok := v.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (v *streamWriter) Unwrap() http.ResponseWriter {
+	return v.ResponseWriter
+}
+
+// The route type of request, for access log and metrics.
+const (
+	RouteStatic  = "static"
+	RouteProxy   = "proxy"
+	RoutePreHook = "pre-hook"
+)
+
+type recordContextKey string
+
+var recordKey recordContextKey = "record.httpx.ossrs.org"
+
+// The record of request, which the handlers fill the extra fields, such as the
+// upstream and route type.
+type requestRecord struct {
+	start  time.Time
+	writer *statusWriter
+
+	lock     sync.Mutex
+	upstream string
+	route    string
+}
+
+func (v *requestRecord) Duration() time.Duration {
+	return time.Now().Sub(v.start)
+}
+
+func (v *requestRecord) Upstream() string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.upstream
+}
+
+// The route type, default to static.
+func (v *requestRecord) Route() string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.route == "" {
+		return RouteStatic
+	}
+	return v.route
+}
+
+// Set the upstream of request.
+func setRequestUpstream(r *http.Request, upstream string) {
+	if v, ok := r.Context().Value(recordKey).(*requestRecord); ok {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		v.upstream = upstream
+	}
+}
+
+// Set the route type of request.
+func setRequestRoute(r *http.Request, route string) {
+	if v, ok := r.Context().Value(recordKey).(*requestRecord); ok {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		v.route = route
+	}
+}
+
+// The observer of request, when request done.
+type requestObserver interface {
+	Observe(r *http.Request, record *requestRecord)
+}
+
+// Wrap the handler, to record the request and notify the observers when done.
+func observeRequests(next http.Handler, observers ...requestObserver) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		record := &requestRecord{start: time.Now(), writer: &statusWriter{ResponseWriter: w}}
+		r = r.WithContext(context.WithValue(r.Context(), recordKey, record))
+
+		defer func() {
+			for _, observer := range observers {
+				observer.Observe(r, record)
+			}
+		}()
+
+		next.ServeHTTP(record.writer, r)
+	})
+}
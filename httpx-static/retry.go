@@ -0,0 +1,278 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The status of upstream to retry.
+var errRetryStatus = oe.New("retry status")
+
+// The methods which are idempotent, see https://www.rfc-editor.org/rfc/rfc9110#section-9.2.2
+var idempotentMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodOptions: true, http.MethodTrace: true,
+	http.MethodPut: true, http.MethodDelete: true,
+}
+
+// The retry policy of proxy, to retry the idempotent requests to the next upstream when
+// failed to connect, timeout or the status in retryOn, before the response is written.
+// The retries are limited by the retryBudget, to never amplify an outage.
+type RetryPolicy struct {
+	// The max retries, 0 to disable.
+	Retries int
+	// The timeout of each try, and the overall deadline of all tries, to wait for the
+	// response header of upstream, 0 for no timeout.
+	TryTimeout time.Duration
+	Deadline   time.Duration
+	// The status of upstream to retry.
+	Statuses map[int]bool
+	// The max body of request to buffer for retry, larger one is never retried.
+	MaxBody int64
+
+	budget *RetryBudget
+}
+
+// Create the retry policy if retries is not zero, or nil.
+func NewRetryPolicy(q url.Values) (*RetryPolicy, error) {
+	s := q.Get("retries")
+	if s == "" || s == "0" {
+		return nil, nil
+	}
+
+	v := &RetryPolicy{
+		Statuses: map[int]bool{
+			http.StatusBadGateway: true, http.StatusServiceUnavailable: true, http.StatusGatewayTimeout: true,
+		},
+		MaxBody: 64 * 1024,
+		budget:  &RetryBudget{Ratio: 0.2, Min: 10, Window: 10 * time.Second},
+	}
+
+	var err error
+	if v.Retries, err = strconv.Atoi(s); err != nil || v.Retries < 0 {
+		return nil, oe.Errorf("invalid retries=%v", s)
+	}
+
+	durations := []struct {
+		key   string
+		value *time.Duration
+	}{
+		{"retryTimeout", &v.TryTimeout}, {"retryDeadline", &v.Deadline},
+	}
+	for _, d := range durations {
+		if s := q.Get(d.key); s != "" {
+			if *d.value, err = time.ParseDuration(s); err != nil || *d.value < 0 {
+				return nil, oe.Errorf("invalid %v=%v", d.key, s)
+			}
+		}
+	}
+
+	if s := q.Get("retryOn"); s != "" {
+		v.Statuses = make(map[int]bool)
+		for _, status := range strings.Split(s, ",") {
+			if code, err := strconv.Atoi(status); err != nil || code < 100 || code > 599 {
+				return nil, oe.Errorf("invalid retryOn=%v", s)
+			} else {
+				v.Statuses[code] = true
+			}
+		}
+	}
+
+	if s := q.Get("retryMaxBody"); s != "" {
+		if v.MaxBody, err = parseSize(s); err != nil {
+			return nil, oe.Wrapf(err, "parse retryMaxBody=%v", s)
+		}
+	}
+
+	if s := q.Get("retryBudget"); s != "" {
+		if v.budget.Ratio, err = strconv.ParseFloat(s, 64); err != nil || v.budget.Ratio < 0 {
+			return nil, oe.Errorf("invalid retryBudget=%v", s)
+		}
+	}
+	if s := q.Get("retryMin"); s != "" {
+		if v.budget.Min, err = strconv.Atoi(s); err != nil || v.budget.Min < 0 {
+			return nil, oe.Errorf("invalid retryMin=%v", s)
+		}
+	}
+
+	return v, nil
+}
+
+func (v *RetryPolicy) String() string {
+	var statuses []string
+	for status := range v.Statuses {
+		statuses = append(statuses, strconv.Itoa(status))
+	}
+	sort.Strings(statuses)
+
+	return fmt.Sprintf("retries=%v, timeout=%v, deadline=%v, on=%v, budget=%v",
+		v.Retries, v.TryTimeout, v.Deadline, strings.Join(statuses, ","), v.budget)
+}
+
+// Whether the request could be retried, and buffer the body to replay.
+func (v *RetryPolicy) Retryable(r *http.Request) (bool, error) {
+	if !idempotentMethods[r.Method] || isWebSocket(r) {
+		return false, nil
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		return true, nil
+	}
+	if r.ContentLength > v.MaxBody {
+		return false, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, v.MaxBody+1))
+	if err != nil {
+		return false, oe.Wrapf(err, "read body")
+	}
+
+	// Restore the body, the truncated one is never retried.
+	if int64(len(body)) > v.MaxBody {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return false, nil
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	return true, nil
+}
+
+// The budget of retries, at most ratio of the requests in window, but at least min
+// retries. For example, 0.2 means the retries are at most 20% extra load.
+type RetryBudget struct {
+	Ratio  float64
+	Min    int
+	Window time.Duration
+
+	lock     sync.Mutex
+	start    time.Time
+	requests int
+	retries  int
+}
+
+func (v *RetryBudget) String() string {
+	return fmt.Sprintf("%v/%v(min=%v)", v.Ratio, v.Window, v.Min)
+}
+
+// Reset the counters in new window.
+func (v *RetryBudget) refresh(now time.Time) {
+	if now.Sub(v.start) > v.Window {
+		v.start, v.requests, v.retries = now, 0, 0
+	}
+}
+
+// Count a request.
+func (v *RetryBudget) Request() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.refresh(time.Now())
+	v.requests++
+}
+
+// Withdraw a retry from budget, return false if exhausted.
+func (v *RetryBudget) Withdraw() bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.refresh(time.Now())
+	if v.retries >= v.Min && float64(v.retries) >= v.Ratio*float64(v.requests) {
+		return false
+	}
+	v.retries++
+	return true
+}
+
+type proxyContextKey string
+
+var attemptKey proxyContextKey = "attempt.httpx.ossrs.org"
+
+// The attempt to proxy request to an upstream.
+type proxyAttempt struct {
+	upstream *Upstream
+	// Whether the attempt fails and could be retried, and the error.
+	retryable bool
+	retry     bool
+	err       error
+	// To cancel the try if no response header in timeout. The timedOut is set by the timer
+	// goroutine, so it's accessed by atomic.
+	timer    *time.Timer
+	timedOut int32
+}
+
+// Get the attempt of the outgoing request.
+func attemptOf(r *http.Request) *proxyAttempt {
+	return r.Context().Value(attemptKey).(*proxyAttempt)
+}
+
+// Start an attempt of request to the upstream, in timeout for response header, 0 for
+// no timeout.
+func newProxyAttempt(r *http.Request, upstream *Upstream, retryable bool, timeout time.Duration) (*http.Request, *proxyAttempt, context.CancelFunc) {
+	attempt := &proxyAttempt{upstream: upstream, retryable: retryable}
+
+	ctx, cancel := context.WithCancel(context.WithValue(r.Context(), attemptKey, attempt))
+	if timeout > 0 {
+		attempt.timer = time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&attempt.timedOut, 1)
+			cancel()
+		})
+	}
+
+	req := r.Clone(ctx)
+	if r.GetBody != nil {
+		req.Body, _ = r.GetBody()
+	}
+	return req, attempt, cancel
+}
+
+// Whether the attempt is canceled by the timeout for response header.
+func (v *proxyAttempt) TimedOut() bool {
+	return atomic.LoadInt32(&v.timedOut) == 1
+}
+
+// Got the response header, stop the timer.
+func (v *proxyAttempt) Responded() {
+	if v.timer != nil {
+		v.timer.Stop()
+	}
+}
@@ -0,0 +1,163 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	if v, err := NewRetryPolicy(url.Values{}); err != nil || v != nil {
+		t.Errorf("should disable, v=%v, err %v", v, err)
+	}
+	for _, q := range []string{"retries=-1", "retries=1&retryOn=50x", "retries=1&retryTimeout=x", "retries=1&retryBudget=-1"} {
+		values, _ := url.ParseQuery(q)
+		if _, err := NewRetryPolicy(values); err == nil {
+			t.Errorf("should fail for %v", q)
+		}
+	}
+
+	values, _ := url.ParseQuery("retries=2&retryOn=500,503&retryMaxBody=4B")
+	v, err := NewRetryPolicy(values)
+	if err != nil || v.Retries != 2 || !v.Statuses[500] || v.Statuses[502] {
+		t.Fatalf("invalid policy %v, err %v", v, err)
+	}
+
+	for _, vv := range []struct {
+		method, body string
+		expect       bool
+	}{
+		{"GET", "", true}, {"PUT", "abcd", true}, {"PUT", "abcde", false}, {"POST", "", false},
+	} {
+		r := httptest.NewRequest(vv.method, "/api/v1", strings.NewReader(vv.body))
+		if ok, err := v.Retryable(r); err != nil || ok != vv.expect {
+			t.Errorf("%v %v, retryable=%v, err %v", vv.method, vv.body, ok, err)
+		}
+		if b, _ := ioutil.ReadAll(r.Body); string(b) != vv.body {
+			t.Errorf("%v %v, body should be restored, got %v", vv.method, vv.body, string(b))
+		}
+	}
+
+	// The budget allows at least min retries, then ratio of requests.
+	budget := &RetryBudget{Ratio: 0.5, Min: 1, Window: time.Minute}
+	if !budget.Withdraw() || budget.Withdraw() {
+		t.Errorf("should allow min retries")
+	}
+	for i := 0; i < 4; i++ {
+		budget.Request()
+	}
+	if !budget.Withdraw() || budget.Withdraw() {
+		t.Errorf("should allow ratio retries")
+	}
+}
+
+func TestRetryProxy(t *testing.T) {
+	var bad, good int32
+	backend1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&bad, 1)
+		if r.URL.Query().Get("slow") != "" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend1.Close()
+
+	backend2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&good, 1)
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte("ok" + string(b)))
+	}))
+	defer backend2.Close()
+
+	// A closed backend, to fail to connect.
+	backend0 := httptest.NewServer(http.NotFoundHandler())
+	backend0.Close()
+
+	newPool := func(query string, backends ...string) *UpstreamPool {
+		var pool *UpstreamPool
+		for i, backend := range backends {
+			u, _ := url.Parse(backend + "/api/v1")
+			if i == 0 {
+				u.RawQuery = query
+				pool, _ = NewUpstreamPool(u)
+			} else {
+				pool.Add(u)
+			}
+		}
+		return pool
+	}
+	serve := func(pool *UpstreamPool, method, uri, body string) (int, string) {
+		r := httptest.NewRequest(method, uri, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		NewComplexProxy(context.Background(), pool, nil, nil, r).ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	// Retry the next upstream by status, with body, or for connection refused.
+	pool := newPool("retries=2&maxFails=100", backend1.URL, backend2.URL)
+	if code, body := serve(pool, "PUT", "/api/v1/config", "-put"); code != 200 || body != "ok-put" {
+		t.Errorf("should retry, code=%v, body=%v", code, body)
+	}
+	pool = newPool("retries=1&maxFails=100", backend0.URL, backend2.URL)
+	if code, body := serve(pool, "GET", "/api/v1/versions", ""); code != 200 || body != "ok" {
+		t.Errorf("should retry, code=%v, body=%v", code, body)
+	}
+
+	// Never retry the non-idempotent request.
+	pool = newPool("retries=2&maxFails=100", backend1.URL, backend2.URL)
+	if code, _ := serve(pool, "POST", "/api/v1/config", "-post"); code != http.StatusServiceUnavailable {
+		t.Errorf("should not retry, code=%v", code)
+	}
+
+	// Retry the next upstream when try timeout.
+	pool = newPool("retries=1&retryTimeout=50ms&maxFails=100", backend1.URL, backend2.URL)
+	start := time.Now()
+	if code, body := serve(pool, "GET", "/api/v1/versions?slow=1", ""); code != 200 || body != "ok" {
+		t.Errorf("should retry, code=%v, body=%v", code, body)
+	}
+	if d := time.Now().Sub(start); d > 150*time.Millisecond {
+		t.Errorf("should timeout, cost %v", d)
+	}
+
+	// No retry when budget exhausted, retry the same upstream if no other.
+	pool = newPool("retries=1&retryBudget=0&retryMin=1&maxFails=100", backend1.URL)
+	atomic.StoreInt32(&bad, 0)
+	serve(pool, "GET", "/api/v1/versions", "")
+	if n := atomic.LoadInt32(&bad); n != 2 {
+		t.Errorf("should retry, requests=%v", n)
+	}
+	serve(pool, "GET", "/api/v1/versions", "")
+	if n := atomic.LoadInt32(&bad); n != 3 {
+		t.Errorf("should not retry, requests=%v", n)
+	}
+}
@@ -0,0 +1,499 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	oh "github.com/ossrs/go-oryx-lib/http"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+)
+
+// The routing table for static files, proxies and pre-hooks, which is built from
+// config, and swapped atomically when reload.
+type Routes struct {
+	html                           string
+	noRedirectIndex, trimLastSlash bool
+	trimSlashLimit                 int
+	// The CORS policy, see Config.CORS.
+	cors string
+
+	// The first url of each proxy path, in order.
+	proxyUrls []*url.URL
+	proxies   map[string]*UpstreamPool
+
+	preHookUrls []*url.URL
+	preHooks    map[string]*PreHook
+
+	postHookUrls []*url.URL
+	postHooks    map[string]*PostHook
+
+	// The trusted proxies, to resolve the client ip.
+	trusted *TrustedProxies
+
+	// The request rate limiter by client ip, nil if no limit.
+	limiter *RateLimiter
+	// The bandwidth throttle for static files, nil if no limit.
+	throttle *Throttle
+
+	// The virtual hosts, which share the trusted proxies, rate limiter and throttle.
+	vhosts []*VHost
+	// The references by the server and each serving request, closed when all released.
+	refs int64
+}
+
+// The virtual host, with its own routes.
+type VHost struct {
+	Hosts   []string
+	Default bool
+	routes  *Routes
+}
+
+func NewRoutes(ctx context.Context, conf *Config) (*Routes, error) {
+	v := &Routes{
+		refs:            1,
+		html:            conf.Root,
+		noRedirectIndex: conf.NoRedirectIndex,
+		trimLastSlash:   conf.TrimLastSlash,
+		trimSlashLimit:  conf.TrimSlashLimit,
+		cors:            conf.CORS,
+		proxies:         make(map[string]*UpstreamPool),
+		preHooks:        make(map[string]*PreHook),
+		postHooks:       make(map[string]*PostHook),
+	}
+
+	trusted, err := NewTrustedProxies(conf.TrustedProxies)
+	if err != nil {
+		return nil, oe.Wrapf(err, "parse trusted proxies %v", conf.TrustedProxies)
+	}
+	if v.trusted = trusted; len(trusted.nets) > 0 {
+		ol.Tf(ctx, "Trusted proxies %v", trusted)
+	}
+
+	if conf.RateLimit > 0 {
+		v.limiter = NewRateLimiter(conf.RateLimit, conf.RateBurst)
+		ol.Tf(ctx, "Rate limit %v for each client", v.limiter)
+	}
+
+	throttle, err := NewThrottle(conf)
+	if err != nil {
+		return nil, oe.Wrapf(err, "create throttle")
+	}
+	if v.throttle = throttle; throttle != nil {
+		ol.Tf(ctx, "Throttle static files, global=%v, conn=%v, rules=%v", conf.ThrottleGlobal, conf.ThrottleConn, throttle.rules)
+	}
+
+	if err := v.addRoutes(ctx, conf.Proxies, conf.PreHooks, conf.PostHooks); err != nil {
+		return nil, oe.Wrapf(err, "add routes")
+	}
+
+	var hasDefault bool
+	for _, vconf := range conf.VHosts {
+		if len(vconf.Hosts) == 0 && !vconf.Default {
+			return nil, oe.Errorf("no hosts for vhost %v", vconf)
+		}
+		if vconf.Default && hasDefault {
+			return nil, oe.Errorf("default vhost duplicated %v", conf)
+		}
+		hasDefault = hasDefault || vconf.Default
+
+		host := &VHost{Default: vconf.Default, routes: &Routes{
+			html:            vconf.Root,
+			noRedirectIndex: vconf.NoRedirectIndex,
+			trimLastSlash:   vconf.TrimLastSlash,
+			trimSlashLimit:  vconf.TrimSlashLimit,
+			cors:            vconf.CORS,
+			proxies:         make(map[string]*UpstreamPool),
+			preHooks:        make(map[string]*PreHook),
+			postHooks:       make(map[string]*PostHook),
+			throttle:        v.throttle,
+		}}
+		for _, name := range vconf.Hosts {
+			host.Hosts = append(host.Hosts, strings.ToLower(name))
+		}
+
+		ol.Tf(ctx, "VHost %v, default=%v, root=%v, cors=%v", strings.Join(vconf.Hosts, ","), vconf.Default, vconf.Root, vconf.CORS)
+		if err := host.routes.addRoutes(ctx, vconf.Proxies, vconf.PreHooks, vconf.PostHooks); err != nil {
+			return nil, oe.Wrapf(err, "add routes for vhost %v", vconf)
+		}
+		v.vhosts = append(v.vhosts, host)
+	}
+
+	return v, nil
+}
+
+// Add the proxies, pre-hooks and post-hooks.
+func (v *Routes) addRoutes(ctx context.Context, proxies, preHooks, postHooks URLConfigs) error {
+	for _, oproxy := range proxies {
+		proxyUrl, err := oproxy.Parse()
+		if err != nil {
+			return oe.Wrapf(err, "parse proxy %v", oproxy)
+		}
+
+		// The proxies with the same path, are load balanced in a pool.
+		if pool, ok := v.proxies[proxyUrl.Path]; ok {
+			if err := pool.Add(proxyUrl); err != nil {
+				return oe.Wrapf(err, "add %v to pool", proxyUrl)
+			}
+		} else {
+			pool, err := NewUpstreamPool(proxyUrl)
+			if err != nil {
+				return oe.Wrapf(err, "create pool for %v", proxyUrl)
+			}
+
+			v.proxyUrls = append(v.proxyUrls, proxyUrl)
+			v.proxies[proxyUrl.Path] = pool
+		}
+		ol.Tf(ctx, "Proxy %v to %v", proxyUrl.Path, oproxy)
+	}
+
+	for _, oprehook := range preHooks {
+		preHookUrl, err := oprehook.Parse()
+		if err != nil {
+			return oe.Wrapf(err, "parse pre-hook %v", oprehook)
+		}
+
+		if _, ok := v.preHooks[preHookUrl.Path]; ok {
+			return oe.Errorf("pre-hook %v duplicated", preHookUrl.Path)
+		}
+
+		preHook, err := NewPreHook(preHookUrl)
+		if err != nil {
+			return oe.Wrapf(err, "create pre-hook %v", oprehook)
+		}
+
+		v.preHookUrls = append(v.preHookUrls, preHookUrl)
+		v.preHooks[preHookUrl.Path] = preHook
+		ol.Tf(ctx, "pre-hook %v to %v", preHookUrl.Path, preHook)
+	}
+
+	for _, oposthook := range postHooks {
+		postHookUrl, err := oposthook.Parse()
+		if err != nil {
+			return oe.Wrapf(err, "parse post-hook %v", oposthook)
+		}
+
+		if _, ok := v.postHooks[postHookUrl.Path]; ok {
+			return oe.Errorf("post-hook %v duplicated", postHookUrl.Path)
+		}
+
+		postHook, err := NewPostHook(postHookUrl)
+		if err != nil {
+			return oe.Wrapf(err, "create post-hook %v", oposthook)
+		}
+
+		v.postHookUrls = append(v.postHookUrls, postHookUrl)
+		v.postHooks[postHookUrl.Path] = postHook
+		ol.Tf(ctx, "post-hook %v to %v", postHookUrl.Path, postHook)
+	}
+
+	return nil
+}
+
+// Start the health check of proxies, the cleanup of rate limiters, and the workers of
+// post-hooks.
+func (v *Routes) Start(ctx context.Context) {
+	if v.limiter != nil {
+		v.limiter.Start(ctx)
+	}
+	for _, pool := range v.proxies {
+		pool.Start(ctx)
+	}
+	for _, postHook := range v.postHooks {
+		postHook.Start(ctx)
+	}
+	for _, vhost := range v.vhosts {
+		vhost.routes.Start(ctx)
+	}
+}
+
+// Stop the health check of proxies, the cleanup of rate limiters, and the post-hooks.
+func (v *Routes) Close() {
+	if v.limiter != nil {
+		v.limiter.Close()
+	}
+	for _, pool := range v.proxies {
+		pool.Close()
+	}
+	for _, postHook := range v.postHooks {
+		postHook.Close()
+	}
+	for _, vhost := range v.vhosts {
+		vhost.routes.Close()
+	}
+}
+
+// Acquire the routes to serve a request, false if already released by all.
+func (v *Routes) Acquire() bool {
+	for {
+		refs := atomic.LoadInt64(&v.refs)
+		if refs <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&v.refs, refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// Release the routes, and close it when released by the server and all requests.
+func (v *Routes) Release() {
+	if atomic.AddInt64(&v.refs, -1) == 0 {
+		v.Close()
+	}
+}
+
+// The state of proxies, in order, then the proxies of vhosts.
+func (v *Routes) Upstreams() (states []*UpstreamPoolState) {
+	for _, proxyUrl := range v.proxyUrls {
+		if pool, ok := v.proxies[proxyUrl.Path]; ok {
+			states = append(states, pool.State())
+		}
+	}
+	for _, vhost := range v.vhosts {
+		for _, state := range vhost.routes.Upstreams() {
+			state.Host = strings.Join(vhost.Hosts, ",")
+			states = append(states, state)
+		}
+	}
+	return
+}
+
+// Purge the cached responses of proxies, by prefix of request URI.
+func (v *Routes) Purge(prefix string) (n int) {
+	for _, pool := range v.proxies {
+		if pool.HLS != nil {
+			n += pool.HLS.Purge(prefix)
+		}
+		if pool.Cache != nil {
+			n += pool.Cache.Purge(prefix)
+		}
+	}
+	for _, vhost := range v.vhosts {
+		n += vhost.routes.Purge(prefix)
+	}
+	return
+}
+
+// Match the vhost by host, the exact one first, then the wildcard with the longest
+// suffix, then the default one, or the global routes if no vhost matched.
+func (v *Routes) Match(host string) *Routes {
+	if len(v.vhosts) == 0 {
+		return v
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	var matched, defaults *Routes
+	var suffix string
+	for _, vhost := range v.vhosts {
+		if vhost.Default {
+			defaults = vhost.routes
+		}
+
+		for _, name := range vhost.Hosts {
+			if name == host {
+				return vhost.routes
+			}
+			if strings.HasPrefix(name, "*.") && strings.HasSuffix(host, name[1:]) && len(name) > len(suffix) {
+				matched, suffix = vhost.routes, name
+			}
+		}
+	}
+
+	if matched != nil {
+		return matched
+	}
+	if defaults != nil {
+		return defaults
+	}
+	return v
+}
+
+// Set the CORS headers by policy, * to allow all origins, off to disable, or the
+// allowed origins.
+func (v *Routes) setCORS(w http.ResponseWriter, r *http.Request) {
+	o := r.Header.Get("Origin")
+	if len(o) == 0 || v.cors == "off" {
+		return
+	}
+
+	allow := "*"
+	if v.cors != "" && v.cors != "*" {
+		var matched bool
+		for _, origin := range strings.Split(v.cors, ",") {
+			if origin = strings.TrimSpace(origin); origin == o {
+				matched = true
+			} else if i := strings.Index(origin, "://*."); i > 0 {
+				// For wildcard, https://*.ossrs.net matches https://www.ossrs.net
+				scheme, domain := origin[:i+3], origin[i+4:]
+				matched = matched || (strings.HasPrefix(o, scheme) && strings.HasSuffix(o, domain))
+			}
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if !matched {
+			return
+		}
+		allow = o
+	}
+
+	// SRS does not need cookie or credentials, so we disable CORS credentials, and use * for CORS origin,
+	// headers, expose headers and methods.
+	w.Header().Set("Access-Control-Allow-Origin", allow)
+	// See https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Access-Control-Allow-Headers
+	w.Header().Set("Access-Control-Allow-Headers", "*")
+	// See https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Access-Control-Allow-Methods
+	w.Header().Set("Access-Control-Allow-Methods", "*")
+	// See https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Access-Control-Expose-Headers
+	w.Header().Set("Access-Control-Expose-Headers", "*")
+	// https://stackoverflow.com/a/24689738/17679565
+	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Access-Control-Allow-Credentials
+	w.Header().Set("Access-Control-Allow-Credentials", "false")
+}
+
+func (v *Routes) serveFileNoRedirect(w http.ResponseWriter, r *http.Request, name string) {
+	upath := path.Join(v.html, path.Clean(r.URL.Path))
+
+	// Redirect without the last slash.
+	if v.trimLastSlash && r.URL.Path != "/" && strings.HasSuffix(r.URL.Path, "/") {
+		u := strings.TrimSuffix(r.URL.Path, "/")
+		if r.URL.RawQuery != "" {
+			u += "?" + r.URL.RawQuery
+		}
+		if strings.Count(u, "/") >= v.trimSlashLimit {
+			http.Redirect(w, r, u, http.StatusFound)
+			return
+		}
+	}
+
+	// Append the index.html path if access a directory.
+	if v.noRedirectIndex && !strings.Contains(path.Base(upath), ".") {
+		if d, err := os.Stat(upath); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if d.IsDir() {
+			upath = path.Join(upath, "index.html")
+		}
+	}
+
+	if v.throttle != nil {
+		w = v.throttle.Wrap(w, r)
+	}
+	http.ServeFile(w, r, upath)
+}
+
+func (v *Routes) Serve(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	// Resolve the client ip, and strip the forwarding headers from untrusted peer.
+	v.trusted.Resolve(r)
+
+	oh.SetHeader(w)
+
+	// Serve by the vhost of request, or the global routes.
+	host := v.Match(r.Host)
+	host.setCORS(w, r)
+
+	// Limit the request rate of client.
+	if v.limiter != nil && !v.limiter.Limit(w, r) {
+		return
+	}
+
+	// For matched OPTIONS, directly return without response.
+	if r.Method == "OPTIONS" {
+		return
+	}
+
+	host.serve(ctx, w, r)
+}
+
+// Serve the request by proxies or static files.
+func (v *Routes) serve(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+
+	if v.proxyUrls == nil {
+		if r.URL.Path == "/httpx/v1/versions" {
+			oh.WriteVersion(w, r, Version())
+			return
+		}
+
+		v.serveFileNoRedirect(w, r, path.Join(v.html, path.Clean(r.URL.Path)))
+		return
+	}
+
+	// Find pre-hook to serve with proxy.
+	var preHook *PreHook
+	for _, preHookUrl := range v.preHookUrls {
+		if !shouldProxyURL(r.URL.Path, preHookUrl.Path) {
+			continue
+		}
+
+		if p, ok := v.preHooks[preHookUrl.Path]; ok {
+			preHook = p
+		}
+	}
+
+	// Find post-hook to serve with proxy.
+	var postHook *PostHook
+	for _, postHookUrl := range v.postHookUrls {
+		if !shouldProxyURL(r.URL.Path, postHookUrl.Path) {
+			continue
+		}
+
+		if p, ok := v.postHooks[postHookUrl.Path]; ok {
+			postHook = p
+		}
+	}
+
+	// Find proxy to serve it.
+	for _, proxyUrl := range v.proxyUrls {
+		if !shouldProxyURL(r.URL.Path, proxyUrl.Path) {
+			continue
+		}
+
+		if pool, ok := v.proxies[proxyUrl.Path]; ok {
+			setRequestRoute(r, RouteProxy)
+
+			// Limit the request rate of client for this route.
+			if pool.limiter != nil && !pool.limiter.Limit(w, r) {
+				return
+			}
+
+			p := NewComplexProxy(ctx, pool, preHook, postHook, r)
+			p.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	v.serveFileNoRedirect(w, r, path.Join(v.html, path.Clean(r.URL.Path)))
+}
@@ -0,0 +1,142 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"path"
+	"testing"
+)
+
+func TestRoutesVHost(t *testing.T) {
+	dir := t.TempDir()
+	for _, site := range []string{"global", "a", "b", "default"} {
+		if err := ioutil.WriteFile(path.Join(dir, site+".txt"), []byte(site), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf := &Config{Root: dir, CORS: "*", VHosts: []*VHostConfig{
+		{Hosts: Strings{"A.com"}, Root: dir, CORS: "https://a.com,https://*.a.com"},
+		{Hosts: Strings{"*.b.com"}, Root: dir, CORS: "off"},
+		{Hosts: Strings{"*.x.b.com"}, Root: dir},
+	}}
+	routes, err := NewRoutes(context.Background(), conf)
+	if err != nil {
+		t.Fatalf("routes err %+v", err)
+	}
+
+	for _, vv := range []struct {
+		host   string
+		expect *Routes
+	}{
+		{"a.com", routes.vhosts[0].routes}, {"a.com:8080", routes.vhosts[0].routes}, {"A.com.", routes.vhosts[0].routes},
+		{"www.b.com", routes.vhosts[1].routes}, {"y.x.b.com", routes.vhosts[2].routes},
+		{"b.com", routes}, {"www.a.com", routes}, {"127.0.0.1:8080", routes},
+	} {
+		if v := routes.Match(vv.host); v != vv.expect {
+			t.Errorf("host %v not match", vv.host)
+		}
+	}
+
+	serve := func(host, origin string) string {
+		r := httptest.NewRequest("GET", "http://"+host+"/a.txt", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		routes.Serve(context.Background(), w, r)
+		return w.Header().Get("Access-Control-Allow-Origin")
+	}
+
+	// The CORS policy of each vhost.
+	for _, vv := range []struct {
+		host, origin, expect string
+	}{
+		{"a.com", "https://a.com", "https://a.com"}, {"a.com", "https://www.a.com", "https://www.a.com"},
+		{"a.com", "https://evil.com", ""}, {"a.com", "http://www.a.com", ""},
+		{"www.b.com", "https://b.com", ""}, {"b.com", "https://b.com", "*"},
+	} {
+		if v := serve(vv.host, vv.origin); v != vv.expect {
+			t.Errorf("host %v, origin %v, expect %v, got %v", vv.host, vv.origin, vv.expect, v)
+		}
+	}
+
+	// The default vhost for unknown hosts, and the root of each vhost.
+	conf.VHosts = []*VHostConfig{
+		{Hosts: Strings{"a.com"}, Root: path.Join(dir, "a")},
+		{Default: true, Root: path.Join(dir, "default")},
+	}
+	if routes, err = NewRoutes(context.Background(), conf); err != nil {
+		t.Fatalf("routes err %+v", err)
+	}
+	if v := routes.Match("b.com"); v != routes.vhosts[1].routes || v.html != path.Join(dir, "default") {
+		t.Errorf("should match default, got %v", v.html)
+	}
+
+	conf.VHosts = append(conf.VHosts, &VHostConfig{Default: true})
+	if _, err = NewRoutes(context.Background(), conf); err == nil {
+		t.Errorf("should fail for duplicated default")
+	}
+	conf.VHosts = []*VHostConfig{{Root: dir}}
+	if _, err = NewRoutes(context.Background(), conf); err == nil {
+		t.Errorf("should fail for no hosts")
+	}
+}
+
+func TestRoutesRelease(t *testing.T) {
+	conf := &Config{Root: t.TempDir(), PostHooks: URLConfigs{{URL: "http://127.0.0.1:8081/api/v1/logs"}}}
+	routes, err := NewRoutes(context.Background(), conf)
+	if err != nil {
+		t.Fatalf("routes err %+v", err)
+	}
+	postHook := routes.postHooks["/api/v1/logs"]
+	closed := func() bool {
+		select {
+		case <-postHook.closed:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// The request holds the routes, which is closed after the request done.
+	if !routes.Acquire() {
+		t.Fatalf("should acquire")
+	}
+	routes.Release()
+	if closed() {
+		t.Errorf("should not close for in-flight request")
+	}
+	routes.Release()
+	if !closed() {
+		t.Errorf("should close when released by all")
+	}
+	if routes.Acquire() {
+		t.Errorf("should not acquire the closed routes")
+	}
+}
@@ -0,0 +1,258 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	oh "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/https"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// The holder for https manager, because atomic.Value requires the same concrete type.
+type managerHolder struct {
+	m https.Manager
+	// Whether manager is letsencrypt.
+	lets bool
+}
+
+// The manager runs in background, to reload the cert files or renew the certs.
+type backgroundManager interface {
+	Start(ctx context.Context)
+	Close()
+}
+
+// Start the manager if runs in background.
+func (v *managerHolder) Start(ctx context.Context) {
+	if m, ok := v.m.(backgroundManager); ok {
+		m.Start(ctx)
+	}
+}
+
+// Close the manager when replaced by reload.
+func (v *managerHolder) Close() {
+	if m, ok := v.m.(backgroundManager); ok {
+		m.Close()
+	}
+}
+
+// Serve the HTTP-01 challenge if ACME, return whether served.
+func (v *managerHolder) ServeHTTP01(w http.ResponseWriter, r *http.Request) bool {
+	if m, ok := v.m.(*acmeManager); ok {
+		return m.ServeHTTP01(w, r)
+	}
+	return false
+}
+
+// The server holds the routes and https manager, which are reloaded from config file
+// and flags, and swapped atomically, so the existing connections are not affected.
+type Server struct {
+	// The args to parse config, without argv[0].
+	args []string
+	// The server context, for the health check of routes.
+	ctx context.Context
+	// The current config, protected by lock.
+	conf *Config
+	lock sync.Mutex
+	// The routing table, the *Routes.
+	routes atomic.Value
+	// The https manager, the *managerHolder.
+	manager atomic.Value
+	// The handlers for admin api, serve at the admin listener.
+	admin *http.ServeMux
+	// The in-flight requests, for graceful shutdown.
+	inflight int64
+}
+
+func NewServer(args []string) *Server {
+	v := &Server{args: args, admin: http.NewServeMux()}
+
+	v.admin.HandleFunc("/httpx/v1/versions", func(w http.ResponseWriter, r *http.Request) {
+		oh.WriteVersion(w, r, Version())
+	})
+	v.admin.Handle("/metrics", httpxMetrics)
+
+	return v
+}
+
+// Initialize the server by the config.
+func (v *Server) Initialize(ctx context.Context, conf *Config) error {
+	routes, err := NewRoutes(ctx, conf)
+	if err != nil {
+		return oe.Wrapf(err, "create routes")
+	}
+
+	m, err := NewHTTPSManager(ctx, conf)
+	if err != nil {
+		return oe.Wrapf(err, "create https manager")
+	}
+
+	v.ctx = ctx
+	v.conf = conf
+	v.routes.Store(routes)
+	// Start the manager before serving, so the ACME manager issues in server context.
+	manager := &managerHolder{m: m, lets: conf.UseLetsEncrypt}
+	manager.Start(ctx)
+	v.manager.Store(manager)
+	routes.Start(ctx)
+
+	v.admin.HandleFunc("/httpx/v1/upstreams", func(w http.ResponseWriter, r *http.Request) {
+		oh.WriteData(ctx, w, r, v.Routes().Upstreams())
+	})
+
+	v.admin.HandleFunc("/httpx/v1/cache/purge", func(w http.ResponseWriter, r *http.Request) {
+		prefix := r.URL.Query().Get("prefix")
+		n := v.Routes().Purge(prefix)
+		ol.Tf(ctx, "Purge cache prefix=%v, purged=%v", prefix, n)
+		oh.WriteData(ctx, w, r, map[string]interface{}{"prefix": prefix, "purged": n})
+	})
+
+	v.admin.HandleFunc("/httpx/v1/reload", func(w http.ResponseWriter, r *http.Request) {
+		ctx := ol.WithContext(ctx)
+		if changes, err := v.Reload(ctx); err != nil {
+			oh.WriteError(ctx, w, r, err)
+		} else {
+			oh.WriteData(ctx, w, r, changes)
+		}
+	})
+
+	return nil
+}
+
+// Reload the config file and flags, the cert and key files, then swap the routes and
+// https manager. Return the changes of config.
+func (v *Server) Reload(ctx context.Context) ([]string, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	conf, confFile, err := ParseConfig(v.args)
+	if err != nil {
+		return nil, oe.Wrapf(err, "parse config")
+	}
+
+	routes, err := NewRoutes(ctx, conf)
+	if err != nil {
+		return nil, oe.Wrapf(err, "create routes")
+	}
+
+	m, err := NewHTTPSManager(ctx, conf)
+	if err != nil {
+		return nil, oe.Wrapf(err, "create https manager")
+	}
+
+	changes := v.conf.Diff(conf)
+	v.conf = conf
+	old := v.Routes()
+	v.routes.Store(routes)
+	oldManager := v.manager.Load().(*managerHolder)
+	manager := &managerHolder{m: m, lets: conf.UseLetsEncrypt}
+	manager.Start(v.ctx)
+	v.manager.Store(manager)
+	oldManager.Close()
+
+	// Start the health check of new routes, in the server context, not the request's. The old
+	// routes is closed after the in-flight requests on it are done.
+	old.Release()
+	routes.Start(v.ctx)
+
+	ol.Tf(ctx, "Reload config %v ok, %v changes", confFile, len(changes))
+	for _, change := range changes {
+		ol.Tf(ctx, "Reload %v", change)
+	}
+
+	return changes, nil
+}
+
+// Serve the request by current routes, and count the in-flight requests.
+func (v *Server) Serve(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&v.inflight, 1)
+	defer atomic.AddInt64(&v.inflight, -1)
+
+	if tracker := requestTracker(r); tracker != nil {
+		defer tracker.Done(r)
+	}
+
+	if v.manager.Load().(*managerHolder).ServeHTTP01(w, r) {
+		return
+	}
+
+	// Retry if the routes is released by reload, the new one is already stored.
+	routes := v.Routes()
+	for !routes.Acquire() {
+		routes = v.Routes()
+	}
+	defer routes.Release()
+
+	routes.Serve(ctx, w, r)
+}
+
+// The number of in-flight requests.
+func (v *Server) Inflight() int64 {
+	return atomic.LoadInt64(&v.inflight)
+}
+
+// The current routing table.
+func (v *Server) Routes() *Routes {
+	return v.routes.Load().(*Routes)
+}
+
+// The current https manager, nil if no https.
+func (v *Server) Manager() https.Manager {
+	return v.manager.Load().(*managerHolder).m
+}
+
+// Get certificate from current https manager, for tls.Config.
+func (v *Server) GetCertificate(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	holder := v.manager.Load().(*managerHolder)
+	if holder.m == nil {
+		return nil, fmt.Errorf("no https manager for %v", clientHello.ServerName)
+	}
+
+	cert, err := holder.m.GetCertificate(clientHello)
+
+	// The file-based certs are observed when loaded, and letsencrypt is observed here.
+	if err == nil && holder.lets {
+		httpxMetrics.ObserveCertificate(ManagerLetsEncrypt, clientHello.ServerName, cert)
+	}
+
+	return cert, err
+}
+
+// Count the TLS handshakes, for tls.Config.
+func (v *Server) VerifyConnection(cs tls.ConnectionState) error {
+	httpxMetrics.TLSHandshakes.Add(1, cs.ServerName)
+	return nil
+}
+
+// The handler for admin api.
+func (v *Server) Admin() http.Handler {
+	return v.admin
+}
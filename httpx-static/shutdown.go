@@ -0,0 +1,216 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type connContextKey string
+
+// The key of net.Conn and *ConnTracker in request context, set by ConnTracker.
+var connKey connContextKey = "conn.httpx.ossrs.org"
+var trackerKey connContextKey = "tracker.httpx.ossrs.org"
+var connValuesKey connContextKey = "values.httpx.ossrs.org"
+
+// The values bound to a connection, shared by the requests on it.
+type connValues struct {
+	lock   sync.Mutex
+	values map[interface{}]interface{}
+}
+
+// Get the value of key bound to the connection of request, create it if not exists.
+// Return a new value which is not bound, if request is not tracked.
+func connValue(r *http.Request, key interface{}, create func() interface{}) interface{} {
+	cv, ok := r.Context().Value(connValuesKey).(*connValues)
+	if !ok {
+		return create()
+	}
+
+	cv.lock.Lock()
+	defer cv.lock.Unlock()
+
+	if v, ok := cv.values[key]; ok {
+		return v
+	}
+
+	v := create()
+	cv.values[key] = v
+	return v
+}
+
+// Get the underlayer connection of request, nil if not tracked.
+func requestConn(r *http.Request) net.Conn {
+	if c, ok := r.Context().Value(connKey).(net.Conn); ok {
+		return c
+	}
+	return nil
+}
+
+// The connections of a listener, tracked by the http.Server.ConnState. Because the
+// http.Server never tracks the hijacked connections, for example, WebSocket, we keep
+// them until the request done, so we are able to close them when shutdown.
+type ConnTracker struct {
+	// The name of listener, for example, http(:80).
+	Name  string
+	lock  sync.Mutex
+	conns map[net.Conn]http.ConnState
+}
+
+func NewConnTracker(name string) *ConnTracker {
+	return &ConnTracker{Name: name, conns: make(map[net.Conn]http.ConnState)}
+}
+
+// Track the connections of server.
+func (v *ConnTracker) Track(hs *http.Server) {
+	hs.ConnState = func(c net.Conn, state http.ConnState) {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		if state == http.StateClosed {
+			delete(v.conns, c)
+		} else {
+			v.conns[c] = state
+		}
+	}
+
+	hs.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		ctx = context.WithValue(context.WithValue(ctx, connKey, c), trackerKey, v)
+		return context.WithValue(ctx, connValuesKey, &connValues{values: make(map[interface{}]interface{})})
+	}
+}
+
+// Get the tracker of request, nil if not tracked.
+func requestTracker(r *http.Request) *ConnTracker {
+	if v, ok := r.Context().Value(trackerKey).(*ConnTracker); ok {
+		return v
+	}
+	return nil
+}
+
+// Untrack the hijacked connection of request, when request done.
+func (v *ConnTracker) Done(r *http.Request) {
+	c := requestConn(r)
+	if c == nil {
+		return
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if state, ok := v.conns[c]; ok && state == http.StateHijacked {
+		delete(v.conns, c)
+	}
+}
+
+// The number of connections by state.
+func (v *ConnTracker) States() map[http.ConnState]int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	states := make(map[http.ConnState]int)
+	for _, state := range v.conns {
+		states[state]++
+	}
+	return states
+}
+
+// Close the hijacked connections, return the number of closed.
+func (v *ConnTracker) CloseHijacked() (n int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for c, state := range v.conns {
+		if state == http.StateHijacked {
+			c.Close()
+			delete(v.conns, c)
+			n++
+		}
+	}
+	return
+}
+
+// The http server with connections tracked.
+type trackedServer struct {
+	*http.Server
+	tracker *ConnTracker
+}
+
+// Shutdown the servers gracefully, stop accepting and wait for the in-flight requests
+// until drain timeout, then force to close all connections.
+func gracefulShutdown(ctx context.Context, servers []*trackedServer, inflight func() int64, drain time.Duration) {
+	ol.Tf(ctx, "Shutdown %v servers, drain %v, in-flight %v requests", len(servers), drain, inflight())
+
+	drainCtx, cancel := context.WithTimeout(ctx, drain)
+	defer cancel()
+
+	// Stop accepting, close the idle connections, and wait for the active ones.
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *trackedServer) {
+			defer wg.Done()
+			if err := server.Shutdown(drainCtx); err != nil {
+				ol.Wf(ctx, "Shutdown %v err %v", server.tracker.Name, err)
+			}
+		}(server)
+	}
+	wg.Wait()
+
+	// Wait for the requests, for example, the hijacked WebSocket, which is not tracked
+	// by the server.
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for inflight() > 0 && drainCtx.Err() == nil {
+		select {
+		case <-drainCtx.Done():
+		case <-ticker.C:
+		}
+	}
+
+	if drainCtx.Err() == nil {
+		ol.Tf(ctx, "Shutdown ok, all requests drained")
+		return
+	}
+
+	// Force to close the connections after drain timeout.
+	requests := inflight()
+	for _, server := range servers {
+		states := server.tracker.States()
+		server.Close()
+		hijacked := server.tracker.CloseHijacked()
+
+		if n := states[http.StateActive] + states[http.StateNew] + hijacked; n > 0 {
+			ol.Wf(ctx, "Shutdown %v force closed %v connections, active=%v, new=%v, hijacked=%v",
+				server.tracker.Name, n, states[http.StateActive], states[http.StateNew], hijacked)
+		}
+	}
+	ol.Wf(ctx, "Shutdown timeout %v, force closed %v in-flight requests", drain, requests)
+}
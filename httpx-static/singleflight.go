@@ -0,0 +1,70 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import "sync"
+
+// The call of flight group, which is done by the first caller, and shared by the others.
+type flightCall struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+// The group to coalesce the concurrent calls with the same key into one, for example,
+// the requests of the same HLS segment when cache missed.
+type flightGroup struct {
+	lock  sync.Mutex
+	calls map[string]*flightCall
+}
+
+// Call fn once for the concurrent calls with the same key, return whether the result is
+// shared from other caller.
+func (v *flightGroup) Do(key string, fn func() (interface{}, error)) (val interface{}, err error, shared bool) {
+	v.lock.Lock()
+	if v.calls == nil {
+		v.calls = make(map[string]*flightCall)
+	}
+	if c, ok := v.calls[key]; ok {
+		v.lock.Unlock()
+		c.wg.Wait()
+		return c.val, c.err, true
+	}
+
+	c := &flightCall{}
+	c.wg.Add(1)
+	v.calls[key] = c
+	v.lock.Unlock()
+
+	defer func() {
+		v.lock.Lock()
+		delete(v.calls, key)
+		v.lock.Unlock()
+		c.wg.Done()
+	}()
+
+	c.val, c.err = fn()
+	return c.val, c.err, false
+}
@@ -0,0 +1,301 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/https/time/rate"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Parse the number with unit, return the value and the unit in lower case.
+func parseUnit(s string) (float64, string, error) {
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+
+	v, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, "", oe.Wrapf(err, "parse %v", s)
+	}
+	return v, strings.ToLower(strings.TrimSpace(s[i:])), nil
+}
+
+// Parse the size in bytes, for example, 1024, 512KB or 10MB.
+func parseSize(s string) (int64, error) {
+	v, unit, err := parseUnit(s)
+	if err != nil {
+		return 0, err
+	}
+
+	scales := map[string]float64{"": 1, "b": 1, "kb": 1 << 10, "mb": 1 << 20, "gb": 1 << 30}
+	if scale, ok := scales[unit]; ok {
+		return int64(v * scale), nil
+	}
+	return 0, oe.Errorf("invalid size %v", s)
+}
+
+// Parse the rate in bytes per second, for example, 4Mbps in bits per second, or 512KB
+// in bytes per second.
+func parseRate(s string) (float64, error) {
+	v, unit, err := parseUnit(s)
+	if err != nil {
+		return 0, err
+	}
+
+	scales := map[string]float64{"bps": 1.0 / 8, "kbps": 1000.0 / 8, "mbps": 1000 * 1000.0 / 8, "gbps": 1000 * 1000 * 1000.0 / 8}
+	if scale, ok := scales[unit]; ok {
+		return v * scale, nil
+	}
+
+	size, err := parseSize(s)
+	if err != nil {
+		return 0, oe.Errorf("invalid rate %v", s)
+	}
+	return float64(size), nil
+}
+
+// Create the limiter for bytes rate, the burst is one second and at least 4KB.
+func newBytesLimiter(bytesPerSecond float64) *rate.Limiter {
+	burst := int(bytesPerSecond)
+	if burst < 4096 {
+		burst = 4096
+	}
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+}
+
+// The throttle rule for static files, for example, mp4 under /vod at 4Mbps after the
+// first 10MB burst:
+//
+//	-throttle "/vod?ext=.mp4&rate=4Mbps&burst=10MB"
+type ThrottleRule struct {
+	Path string
+	// The extension of file, empty for all.
+	Ext string
+	// The rate in bytes per second.
+	Rate float64
+	// The bytes to send without throttle, at the beginning of response.
+	Burst int64
+}
+
+func NewThrottleRule(oc *URLConfig) (*ThrottleRule, error) {
+	u, err := oc.Parse()
+	if err != nil {
+		return nil, err
+	}
+
+	q := u.Query()
+	v := &ThrottleRule{Path: u.Path, Ext: q.Get("ext")}
+	if v.Ext != "" && !strings.HasPrefix(v.Ext, ".") {
+		v.Ext = "." + v.Ext
+	}
+
+	if v.Rate, err = parseRate(q.Get("rate")); err != nil || v.Rate <= 0 {
+		return nil, oe.Errorf("invalid rate of %v", oc)
+	}
+
+	if s := q.Get("burst"); s != "" {
+		if v.Burst, err = parseSize(s); err != nil {
+			return nil, oe.Wrapf(err, "parse burst of %v", oc)
+		}
+	}
+
+	return v, nil
+}
+
+func (v *ThrottleRule) Match(r *http.Request) bool {
+	if !shouldProxyURL(r.URL.Path, v.Path) {
+		return false
+	}
+	return v.Ext == "" || strings.EqualFold(path.Ext(r.URL.Path), v.Ext)
+}
+
+func (v *ThrottleRule) String() string {
+	return fmt.Sprintf("%v(ext=%v, rate=%vB/s, burst=%vB)", v.Path, v.Ext, int64(v.Rate), v.Burst)
+}
+
+// The bandwidth throttle for static files, in global, per connection and per path.
+type Throttle struct {
+	// The global limiter, nil for no limit.
+	global *rate.Limiter
+	// The rate for each connection, 0 for no limit.
+	connRate float64
+	rules    []*ThrottleRule
+}
+
+// Create the throttle by config, nil if no throttle.
+func NewThrottle(conf *Config) (*Throttle, error) {
+	v := &Throttle{}
+
+	if conf.ThrottleGlobal != "" {
+		if r, err := parseRate(conf.ThrottleGlobal); err != nil {
+			return nil, oe.Wrapf(err, "parse global %v", conf.ThrottleGlobal)
+		} else {
+			v.global = newBytesLimiter(r)
+		}
+	}
+
+	if conf.ThrottleConn != "" {
+		var err error
+		if v.connRate, err = parseRate(conf.ThrottleConn); err != nil {
+			return nil, oe.Wrapf(err, "parse conn %v", conf.ThrottleConn)
+		}
+	}
+
+	for _, oc := range conf.Throttles {
+		rule, err := NewThrottleRule(oc)
+		if err != nil {
+			return nil, oe.Wrapf(err, "parse throttle %v", oc)
+		}
+		v.rules = append(v.rules, rule)
+	}
+
+	if v.global == nil && v.connRate <= 0 && len(v.rules) == 0 {
+		return nil, nil
+	}
+	return v, nil
+}
+
+// The key of limiter bound to the connection, by the rate, so the connection keeps its
+// allowance when reload, unless the rate is changed.
+type throttleConnKey struct {
+	rate float64
+}
+
+// The key of rule state bound to the connection, by the rule.
+type throttleRuleKey struct {
+	rule string
+}
+
+// The state of rule for a connection, shared by the requests on it, so the burst is never
+// reset by requests, for example, a download split to many Range requests.
+type throttleRuleState struct {
+	// The limiter which starts after the burst bytes.
+	limiter *rate.Limiter
+	// The left burst bytes, accessed by atomic.
+	burst int64
+}
+
+// Wrap the response writer for request, to throttle the bytes.
+func (v *Throttle) Wrap(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	tw := &throttledWriter{ResponseWriter: w, ctx: r.Context()}
+
+	if v.global != nil {
+		tw.limiters = append(tw.limiters, v.global)
+	}
+
+	// The limiter for connection, shared by the requests on it, so the burst is only for
+	// the first request of connection.
+	if v.connRate > 0 {
+		if limiter, ok := connValue(r, throttleConnKey{v.connRate}, func() interface{} {
+			return newBytesLimiter(v.connRate)
+		}).(*rate.Limiter); ok {
+			tw.limiters = append(tw.limiters, limiter)
+		}
+	}
+
+	// The first matched rule, which starts to throttle after burst of connection.
+	for _, rule := range v.rules {
+		if rule.Match(r) {
+			tw.rule = connValue(r, throttleRuleKey{rule.String()}, func() interface{} {
+				return &throttleRuleState{limiter: newBytesLimiter(rule.Rate), burst: rule.Burst}
+			}).(*throttleRuleState)
+			break
+		}
+	}
+
+	if len(tw.limiters) == 0 && tw.rule == nil {
+		return w
+	}
+	return tw
+}
+
+// The response writer which waits for the limiters before writing.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []*rate.Limiter
+	// The state of rule, which starts to throttle after the burst bytes.
+	rule *throttleRuleState
+}
+
+func (v *throttledWriter) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		limiters := v.limiters
+		if v.rule != nil {
+			limiters = append(limiters, v.rule.limiter)
+		}
+
+		chunk := len(b)
+		for _, limiter := range limiters {
+			if chunk > limiter.Burst() {
+				chunk = limiter.Burst()
+			}
+		}
+
+		// The rule is not applied to the burst bytes.
+		var burst int64
+		if v.rule != nil {
+			if burst = atomic.LoadInt64(&v.rule.burst); burst > 0 && int64(chunk) > burst {
+				chunk = int(burst)
+			}
+		}
+
+		for _, limiter := range v.limiters {
+			if err = limiter.WaitN(v.ctx, chunk); err != nil {
+				return
+			}
+		}
+		if v.rule != nil {
+			if burst > 0 {
+				atomic.AddInt64(&v.rule.burst, -int64(chunk))
+			} else if err = v.rule.limiter.WaitN(v.ctx, chunk); err != nil {
+				return
+			}
+		}
+
+		var nn int
+		nn, err = v.ResponseWriter.Write(b[:chunk])
+		n += nn
+		if err != nil {
+			return
+		}
+		b = b[chunk:]
+	}
+	return
+}
+
+func (v *throttledWriter) Unwrap() http.ResponseWriter {
+	return v.ResponseWriter
+}
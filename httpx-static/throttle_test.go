@@ -0,0 +1,139 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"github.com/ossrs/go-oryx-lib/https/time/rate"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestThrottle(t *testing.T) {
+	rates := []struct {
+		s string
+		v float64
+	}{
+		{"8bps", 1}, {"4Mbps", 500000}, {"1Gbps", 125000000}, {"1024", 1024}, {"10KB", 10240}, {"1.5MB", 1572864},
+	}
+	for _, e := range rates {
+		if v, err := parseRate(e.s); err != nil || v != e.v {
+			t.Errorf("rate %v expect %v, got %v, err %v", e.s, e.v, v, err)
+		}
+	}
+	for _, s := range []string{"", "Mbps", "10Xbps", "1.2.3MB"} {
+		if _, err := parseRate(s); err == nil {
+			t.Errorf("rate %v should fail", s)
+		}
+	}
+
+	conf := &Config{}
+	if v, err := NewThrottle(conf); err != nil || v != nil {
+		t.Errorf("no throttle, got %v, err %v", v, err)
+	}
+
+	conf.Throttles.Set("/vod?ext=mp4&rate=4Mbps&burst=10MB")
+	v, err := NewThrottle(conf)
+	if err != nil || len(v.rules) != 1 {
+		t.Fatalf("throttle err %v", err)
+	}
+	if rule := v.rules[0]; rule.Ext != ".mp4" || rule.Rate != 500000 || rule.Burst != 10<<20 {
+		t.Errorf("invalid rule %v", rule)
+	}
+
+	// Only wrap the matched files.
+	w := httptest.NewRecorder()
+	if tw, ok := v.Wrap(w, httptest.NewRequest("GET", "/vod/a.mp4", nil)).(*throttledWriter); !ok || tw.rule.burst != 10<<20 {
+		t.Errorf("should throttle mp4")
+	}
+	if v.Wrap(w, httptest.NewRequest("GET", "/vod/a.m3u8", nil)) != w {
+		t.Errorf("should not throttle m3u8")
+	}
+	if v.Wrap(w, httptest.NewRequest("GET", "/live/a.mp4", nil)) != w {
+		t.Errorf("should not throttle live")
+	}
+
+	// Write in chunks, and the burst bytes are not throttled.
+	tw := v.Wrap(w, httptest.NewRequest("GET", "/vod/a.mp4", nil))
+	if n, err := tw.Write(make([]byte, 1<<20)); err != nil || n != 1<<20 || w.Body.Len() != 1<<20 {
+		t.Errorf("write n=%v, err=%v, body=%v", n, err, w.Body.Len())
+	}
+}
+
+func TestThrottleConn(t *testing.T) {
+	conf := &Config{ThrottleConn: "8Mbps"}
+	conf.Throttles.Set("/vod?rate=8Mbps&burst=10KB")
+	v, err := NewThrottle(conf)
+	if err != nil || v == nil {
+		t.Fatalf("throttle err %v", err)
+	}
+
+	var lock sync.Mutex
+	var limiters []*rate.Limiter
+	var rules []*throttleRuleState
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tw, ok := v.Wrap(w, r).(*throttledWriter)
+		if ok && len(tw.limiters) == 1 && tw.rule != nil {
+			lock.Lock()
+			limiters, rules = append(limiters, tw.limiters[0]), append(rules, tw.rule)
+			lock.Unlock()
+		}
+		tw.Write(make([]byte, 4096))
+	}))
+	NewConnTracker("test").Track(server.Config)
+	server.Start()
+	defer server.Close()
+
+	get := func(client *http.Client) {
+		res, err := client.Get(server.URL + "/vod/a.mp4")
+		if err != nil {
+			t.Fatalf("get err %+v", err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+	}
+
+	// The requests on the same connection share the limiter, and the burst.
+	client := &http.Client{Transport: &http.Transport{}}
+	get(client)
+	get(client)
+	get(&http.Client{Transport: &http.Transport{}})
+
+	lock.Lock()
+	defer lock.Unlock()
+	if len(limiters) != 3 || limiters[0] != limiters[1] || limiters[0] == limiters[2] {
+		t.Errorf("should share limiter by connection, got %v", limiters)
+	}
+
+	// The burst of rule is shared by the requests on the same connection.
+	if len(rules) != 3 || rules[0] != rules[1] || rules[0] == rules[2] {
+		t.Fatalf("should share rule by connection, got %v", rules)
+	}
+	if rules[0].burst != 10240-2*4096 || rules[2].burst != 10240-4096 {
+		t.Errorf("invalid burst %v and %v", rules[0].burst, rules[2].burst)
+	}
+}
@@ -0,0 +1,256 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync/atomic"
+)
+
+// The load balance strategy of upstream pool, by the proxy option lb.
+const (
+	// Round robin, the default strategy.
+	LoadBalanceRoundRobin = "rr"
+	// Least connections, pick the upstream with least active requests.
+	LoadBalanceLeastConn = "lc"
+	// Consistent hash by client ip, the same client always goes to the same upstream.
+	LoadBalanceHash = "hash"
+)
+
+// The virtual nodes for each upstream in consistent hash ring.
+const hashVirtualNodes = 160
+
+// The upstream server of proxy.
+type Upstream struct {
+	URL *url.URL
+	// The active requests, for least connections.
+	active int64
+	// Whether upstream is down, 1 for down, and the time when marked down.
+	down   int32
+	downAt int64
+	// The consecutive failures, for passive health check.
+	fails int32
+}
+
+// The active requests of upstream.
+func (v *Upstream) Active() int64 {
+	return atomic.LoadInt64(&v.active)
+}
+
+type hashNode struct {
+	hash     uint32
+	upstream *Upstream
+}
+
+// The pool of upstreams for a proxy path, which picks upstream by the strategy
+// of the first proxy url, for example:
+//
+//	-proxy http://127.0.0.1:1985/api/v1?lb=lc -proxy http://127.0.0.1:1986/api/v1
+type UpstreamPool struct {
+	Path      string
+	Strategy  string
+	Upstreams []*Upstream
+	Health    *HealthCheck
+	// The request rate limiter by client ip, nil if no limit.
+	limiter *RateLimiter
+	// Whether stream the response, for live stream like HTTP-FLV and SSE.
+	Stream bool
+	// The WebSocket options, and the upgraded connections.
+	WebSocket *WebSocketConfig
+	wsConns   int64
+	// The HLS edge cache, nil if disabled.
+	HLS *HLSCache
+	// The response cache, nil if disabled.
+	Cache *ResponseCache
+	// The collapser of identical requests, nil if disabled.
+	Collapse *Collapser
+	// The retry policy, nil if disabled.
+	Retry *RetryPolicy
+	// To stop the active health check.
+	cancel context.CancelFunc
+	// The next upstream for round robin.
+	next uint64
+	// The consistent hash ring, sorted by hash.
+	ring []hashNode
+}
+
+func NewUpstreamPool(proxyUrl *url.URL) (*UpstreamPool, error) {
+	v := &UpstreamPool{
+		Path: proxyUrl.Path, Strategy: proxyUrl.Query().Get("lb"), Stream: proxyUrl.Query().Get("stream") == "true",
+	}
+
+	if v.Strategy == "" {
+		v.Strategy = LoadBalanceRoundRobin
+	}
+	if v.Strategy != LoadBalanceRoundRobin && v.Strategy != LoadBalanceLeastConn && v.Strategy != LoadBalanceHash {
+		return nil, oe.Errorf("invalid lb %v of %v", v.Strategy, proxyUrl)
+	}
+
+	var err error
+	if v.Health, err = NewHealthCheck(proxyUrl.Query()); err != nil {
+		return nil, oe.Wrapf(err, "health check of %v", proxyUrl)
+	}
+
+	if v.limiter, err = NewRateLimiterByQuery(proxyUrl.Query()); err != nil {
+		return nil, oe.Wrapf(err, "rate limit of %v", proxyUrl)
+	}
+
+	if v.WebSocket, err = NewWebSocketConfig(proxyUrl.Query()); err != nil {
+		return nil, oe.Wrapf(err, "websocket of %v", proxyUrl)
+	}
+
+	if v.HLS, err = NewHLSCache(proxyUrl); err != nil {
+		return nil, oe.Wrapf(err, "hls of %v", proxyUrl)
+	}
+
+	if v.Cache, err = NewResponseCache(proxyUrl); err != nil {
+		return nil, oe.Wrapf(err, "cache of %v", proxyUrl)
+	}
+
+	if v.Collapse, err = NewCollapser(proxyUrl); err != nil {
+		return nil, oe.Wrapf(err, "collapse of %v", proxyUrl)
+	}
+
+	if v.Retry, err = NewRetryPolicy(proxyUrl.Query()); err != nil {
+		return nil, oe.Wrapf(err, "retry of %v", proxyUrl)
+	}
+
+	return v, v.Add(proxyUrl)
+}
+
+// Add upstream to pool, which must have the same path.
+func (v *UpstreamPool) Add(proxyUrl *url.URL) error {
+	if proxyUrl.Path != v.Path {
+		return oe.Errorf("path %v not match %v", proxyUrl.Path, v.Path)
+	}
+
+	for _, upstream := range v.Upstreams {
+		if upstream.URL.String() == proxyUrl.String() {
+			return oe.Errorf("proxy %v duplicated", proxyUrl)
+		}
+	}
+
+	upstream := &Upstream{URL: proxyUrl}
+	v.Upstreams = append(v.Upstreams, upstream)
+
+	for i := 0; i < hashVirtualNodes; i++ {
+		h := fnv.New32a()
+		h.Write([]byte(fmt.Sprintf("%v#%v", proxyUrl.Host, i)))
+		v.ring = append(v.ring, hashNode{hash: h.Sum32(), upstream: upstream})
+	}
+	sort.Slice(v.ring, func(i, j int) bool {
+		return v.ring[i].hash < v.ring[j].hash
+	})
+
+	return nil
+}
+
+// Pick the next available upstream to retry, which is not tried, or the tried one if
+// no other, nil if no upstream.
+func (v *UpstreamPool) Next(r *http.Request, tried []*Upstream) *Upstream {
+	isTried := func(upstream *Upstream) bool {
+		for _, t := range tried {
+			if t == upstream {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, upstream := range v.Upstreams {
+		if v.available(upstream) && !isTried(upstream) {
+			return upstream
+		}
+	}
+	return v.Pick(r)
+}
+
+// Pick an available upstream for request, nil if no upstream.
+func (v *UpstreamPool) Pick(r *http.Request) *Upstream {
+	if len(v.Upstreams) == 0 {
+		return nil
+	}
+	if len(v.Upstreams) == 1 {
+		if upstream := v.Upstreams[0]; v.available(upstream) {
+			return upstream
+		}
+		return nil
+	}
+
+	switch v.Strategy {
+	case LoadBalanceLeastConn:
+		// Start from the next one, so we pick in turn when the active requests are equal.
+		start := int(atomic.AddUint64(&v.next, 1) % uint64(len(v.Upstreams)))
+
+		var picked *Upstream
+		for i := 0; i < len(v.Upstreams); i++ {
+			upstream := v.Upstreams[(start+i)%len(v.Upstreams)]
+			if !v.available(upstream) {
+				continue
+			}
+			if picked == nil || upstream.Active() < picked.Active() {
+				picked = upstream
+			}
+		}
+		return picked
+	case LoadBalanceHash:
+		h := fnv.New32a()
+		h.Write([]byte(realIP(r)))
+		hash := h.Sum32()
+
+		i := sort.Search(len(v.ring), func(i int) bool {
+			return v.ring[i].hash >= hash
+		})
+		// Walk the ring to the next available upstream.
+		for j := 0; j < len(v.ring); j++ {
+			if upstream := v.ring[(i+j)%len(v.ring)].upstream; v.available(upstream) {
+				return upstream
+			}
+		}
+		return nil
+	default:
+		n := atomic.AddUint64(&v.next, 1) - 1
+		for i := 0; i < len(v.Upstreams); i++ {
+			if upstream := v.Upstreams[(n+uint64(i))%uint64(len(v.Upstreams))]; v.available(upstream) {
+				return upstream
+			}
+		}
+		return nil
+	}
+}
+
+func (v *UpstreamPool) String() string {
+	var hosts []string
+	for _, upstream := range v.Upstreams {
+		hosts = append(hosts, upstream.URL.Host)
+	}
+	return fmt.Sprintf("%v(%v)%v", v.Path, v.Strategy, hosts)
+}
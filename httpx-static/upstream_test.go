@@ -0,0 +1,167 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestUpstreamPool(t *testing.T) {
+	newPool := func(lb string, hosts ...string) *UpstreamPool {
+		var pool *UpstreamPool
+		for _, host := range hosts {
+			u, err := url.Parse("http://" + host + "/api/v1?lb=" + lb)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if pool == nil {
+				if pool, err = NewUpstreamPool(u); err != nil {
+					t.Fatal(err)
+				}
+			} else if err = pool.Add(u); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return pool
+	}
+
+	r := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: http.Header{}}
+
+	// Round robin in turn.
+	pool := newPool("rr", "a", "b", "c")
+	for i, expect := range []string{"a", "b", "c", "a"} {
+		if v := pool.Pick(r).URL.Host; v != expect {
+			t.Errorf("rr %v expect %v, actual %v", i, expect, v)
+		}
+	}
+
+	// Least connections.
+	pool = newPool("lc", "a", "b", "c")
+	pool.Upstreams[0].active, pool.Upstreams[1].active, pool.Upstreams[2].active = 3, 1, 2
+	if v := pool.Pick(r).URL.Host; v != "b" {
+		t.Errorf("lc expect b, actual %v", v)
+	}
+
+	// Consistent hash, the same client to the same upstream.
+	pool = newPool("hash", "a", "b", "c")
+	picked := pool.Pick(r)
+	for i := 0; i < 10; i++ {
+		if v := pool.Pick(r); v != picked {
+			t.Errorf("hash expect %v, actual %v", picked.URL.Host, v.URL.Host)
+		}
+	}
+
+	// The X-Real-IP identify the client.
+	r2 := &http.Request{RemoteAddr: "10.0.0.2:1234", Header: http.Header{"X-Real-Ip": []string{"10.0.0.1"}}}
+	if v := pool.Pick(r2); v != picked {
+		t.Errorf("hash expect %v, actual %v", picked.URL.Host, v.URL.Host)
+	}
+
+	// Duplicated and invalid.
+	u, _ := url.Parse("http://a/api/v1?lb=hash")
+	if err := pool.Add(u); err == nil {
+		t.Errorf("should fail for duplicated")
+	}
+	u, _ = url.Parse("http://a/api/v1?lb=xxx")
+	if _, err := NewUpstreamPool(u); err == nil {
+		t.Errorf("should fail for invalid lb")
+	}
+}
+
+func TestUpstreamHealthCheck(t *testing.T) {
+	ctx := context.Background()
+	r := &http.Request{RemoteAddr: "10.0.0.1:1234", Header: http.Header{}}
+
+	// Passive check, eject after maxFails, and retry after failTimeout.
+	u, _ := url.Parse("http://a/api/v1?maxFails=2&failTimeout=100ms")
+	pool, err := NewUpstreamPool(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ = url.Parse("http://b/api/v1")
+	if err := pool.Add(u); err != nil {
+		t.Fatal(err)
+	}
+
+	a := pool.Upstreams[0]
+	pool.Fail(ctx, a, fmt.Errorf("mock"))
+	if s := pool.State().Upstreams[0]; !s.Healthy || s.Fails != 1 {
+		t.Errorf("should be healthy, %v", s)
+	}
+	pool.Fail(ctx, a, fmt.Errorf("mock"))
+	if s := pool.State().Upstreams[0]; s.Healthy {
+		t.Errorf("should be down, %v", s)
+	}
+	for i := 0; i < 3; i++ {
+		if v := pool.Pick(r); v == a {
+			t.Errorf("should skip %v", a.URL)
+		}
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if !pool.available(a) {
+		t.Errorf("should retry %v after fail timeout", a.URL)
+	}
+	pool.Succeed(ctx, a)
+	if s := pool.State().Upstreams[0]; !s.Healthy || s.Fails != 0 {
+		t.Errorf("should be healthy, %v", s)
+	}
+
+	// Active check, eject the upstream which response unexpected status.
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer healthy.Close()
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unhealthy.Close()
+
+	u, _ = url.Parse(unhealthy.URL + "/api/v1?healthCheck=/health&healthInterval=10ms")
+	if pool, err = NewUpstreamPool(u); err != nil {
+		t.Fatal(err)
+	}
+	u, _ = url.Parse(healthy.URL + "/api/v1")
+	if err := pool.Add(u); err != nil {
+		t.Fatal(err)
+	}
+
+	pool.Start(ctx)
+	defer pool.Close()
+
+	for i := 0; i < 100 && pool.State().Upstreams[0].Healthy; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 3; i++ {
+		if v := pool.Pick(r); v != pool.Upstreams[1] {
+			t.Errorf("should pick %v", pool.Upstreams[1].URL)
+		}
+	}
+}
@@ -0,0 +1,450 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	oe "github.com/ossrs/go-oryx-lib/errors"
+	ol "github.com/ossrs/go-oryx-lib/logger"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The opcodes of WebSocket frame, see https://www.rfc-editor.org/rfc/rfc6455#section-5.2
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+// The close code when no status, see https://www.rfc-editor.org/rfc/rfc6455#section-7.4.1
+const wsCloseNoStatus = 1005
+
+// The WebSocket options of proxy, by the options of the first proxy url, for example:
+//
+//	-proxy http://127.0.0.1:8080/sig?wsMaxConns=1000&wsIdleTimeout=5m&wsPingInterval=30s&wsPingTimeout=10s
+//
+// The upgraded connections more than wsMaxConns are rejected with 503. The connection is
+// closed if no data frames in wsIdleTimeout, or no response in wsPingTimeout after the
+// ping which is sent to client every wsPingInterval.
+type WebSocketConfig struct {
+	// The max upgraded connections, 0 for no limit.
+	MaxConns int
+	// The idle timeout, 0 to disable.
+	IdleTimeout time.Duration
+	// The interval to ping the client, and the timeout to wait for response, 0 to disable.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+}
+
+func NewWebSocketConfig(q url.Values) (*WebSocketConfig, error) {
+	v := &WebSocketConfig{PingTimeout: 10 * time.Second}
+
+	if s := q.Get("wsMaxConns"); s != "" {
+		var err error
+		if v.MaxConns, err = strconv.Atoi(s); err != nil || v.MaxConns < 0 {
+			return nil, oe.Errorf("invalid wsMaxConns=%v", s)
+		}
+	}
+
+	durations := []struct {
+		key   string
+		value *time.Duration
+	}{
+		{"wsIdleTimeout", &v.IdleTimeout}, {"wsPingInterval", &v.PingInterval}, {"wsPingTimeout", &v.PingTimeout},
+	}
+	for _, d := range durations {
+		if s := q.Get(d.key); s != "" {
+			if iv, err := time.ParseDuration(s); err != nil {
+				return nil, oe.Wrapf(err, "parse %v=%v", d.key, s)
+			} else if iv < 0 {
+				return nil, oe.Errorf("invalid %v=%v", d.key, s)
+			} else {
+				*d.value = iv
+			}
+		}
+	}
+
+	return v, nil
+}
+
+func (v *WebSocketConfig) String() string {
+	return fmt.Sprintf("maxConns=%v, idle=%v, ping=%v/%v", v.MaxConns, v.IdleTimeout, v.PingInterval, v.PingTimeout)
+}
+
+// Whether the request is WebSocket upgrade.
+func isWebSocket(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The parser of WebSocket frames in stream, to track the frame boundary and the close
+// code, while the bytes are forwarded as is.
+type wsFrameParser struct {
+	// The header of frame in parsing.
+	header []byte
+	// The left payload of frame, and the opcode and mask of it.
+	remaining uint64
+	opcode    byte
+	mask      []byte
+	// The received payload of close frame, at most the 2 bytes code.
+	closePayload []byte
+}
+
+// Whether at the boundary of frames, so we're able to insert a frame.
+func (v *wsFrameParser) AtBoundary() bool {
+	return len(v.header) == 0 && v.remaining == 0
+}
+
+// Feed the bytes, callback the opcode when got the header of frame, and the close code
+// when got the close frame.
+func (v *wsFrameParser) Feed(b []byte, onHeader func(opcode byte), onClose func(code int)) {
+	for len(b) > 0 {
+		// Parse the payload.
+		if len(v.header) == 0 && v.remaining > 0 {
+			n := uint64(len(b))
+			if n > v.remaining {
+				n = v.remaining
+			}
+
+			if v.opcode == wsOpClose {
+				for _, c := range b[:n] {
+					if len(v.closePayload) >= 2 {
+						break
+					}
+					if v.mask != nil {
+						c ^= v.mask[len(v.closePayload)%4]
+					}
+					v.closePayload = append(v.closePayload, c)
+				}
+			}
+
+			b, v.remaining = b[n:], v.remaining-n
+			if v.remaining == 0 {
+				v.frameDone(onClose)
+			}
+			continue
+		}
+
+		// Parse the header, 2 bytes, extended length 0, 2 or 8 bytes, and mask 0 or 4 bytes.
+		v.header = append(v.header, b[0])
+		b = b[1:]
+		if len(v.header) < 2 {
+			continue
+		}
+
+		size := 2
+		if v.header[1]&0x80 != 0 {
+			size += 4
+		}
+		switch v.header[1] & 0x7f {
+		case 126:
+			size += 2
+		case 127:
+			size += 8
+		}
+		if len(v.header) < size {
+			continue
+		}
+
+		v.opcode, v.mask, v.closePayload = v.header[0]&0x0f, nil, nil
+		switch length := v.header[1] & 0x7f; length {
+		case 126:
+			v.remaining = uint64(binary.BigEndian.Uint16(v.header[2:]))
+		case 127:
+			v.remaining = binary.BigEndian.Uint64(v.header[2:])
+		default:
+			v.remaining = uint64(length)
+		}
+		if v.header[1]&0x80 != 0 {
+			v.mask = append([]byte(nil), v.header[size-4:size]...)
+		}
+		v.header = v.header[:0]
+
+		if onHeader != nil {
+			onHeader(v.opcode)
+		}
+		if v.remaining == 0 {
+			v.frameDone(onClose)
+		}
+	}
+}
+
+func (v *wsFrameParser) frameDone(onClose func(code int)) {
+	if v.opcode != wsOpClose || onClose == nil {
+		return
+	}
+
+	if len(v.closePayload) < 2 {
+		onClose(wsCloseNoStatus)
+	} else {
+		onClose(int(binary.BigEndian.Uint16(v.closePayload)))
+	}
+}
+
+// The response writer for WebSocket route, which wraps the hijacked connection to
+// track the frames, and apply the timeouts.
+type wsResponseWriter struct {
+	http.ResponseWriter
+	ctx  context.Context
+	path string
+	conf *WebSocketConfig
+}
+
+func (v *wsResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := v.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, oe.Errorf("not hijacker")
+	}
+
+	c, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return newWSConn(v.ctx, c, v.path, v.conf), brw, nil
+}
+
+func (v *wsResponseWriter) Flush() {
+	if f, ok := v.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (v *wsResponseWriter) Unwrap() http.ResponseWriter {
+	return v.ResponseWriter
+}
+
+// The upgraded WebSocket connection to client. The ReverseProxy reads the frames from
+// client, and writes the frames from upstream, so we parse both to get the close code,
+// and insert ping frame at the boundary of frames.
+type wsConn struct {
+	net.Conn
+	ctx   context.Context
+	path  string
+	conf  *WebSocketConfig
+	start time.Time
+
+	// The frames from client, only read by ReverseProxy.
+	client wsFrameParser
+	// The frames to client, by upstream or ping, protected by lock.
+	lock        sync.Mutex
+	upstream    wsFrameParser
+	pingPending bool
+
+	// The time in nanoseconds of the last data frame, the last frame from client, and
+	// the unanswered ping.
+	activeAt int64
+	readAt   int64
+	pingAt   int64
+	// The close code from client and upstream, 0 if not closed.
+	clientCode   int32
+	upstreamCode int32
+
+	closeOnce sync.Once
+	done      chan struct{}
+	// The reason to close, for timeout.
+	reason atomic.Value
+}
+
+func newWSConn(ctx context.Context, c net.Conn, path string, conf *WebSocketConfig) *wsConn {
+	now := time.Now()
+	v := &wsConn{
+		Conn: c, ctx: ctx, path: path, conf: conf, start: now, done: make(chan struct{}),
+		activeAt: now.UnixNano(), readAt: now.UnixNano(),
+	}
+
+	httpxMetrics.WebSockets.Add(1, path)
+	ol.Tf(ctx, "WebSocket upgraded %v for %v", path, c.RemoteAddr())
+
+	if conf.IdleTimeout > 0 || conf.PingInterval > 0 {
+		go v.monitor()
+	}
+	return v
+}
+
+func (v *wsConn) Read(b []byte) (int, error) {
+	n, err := v.Conn.Read(b)
+	if n > 0 {
+		now := time.Now().UnixNano()
+		atomic.StoreInt64(&v.readAt, now)
+		atomic.StoreInt64(&v.pingAt, 0)
+
+		v.client.Feed(b[:n], func(opcode byte) {
+			if opcode <= wsOpBinary {
+				atomic.StoreInt64(&v.activeAt, now)
+			}
+		}, func(code int) {
+			atomic.StoreInt32(&v.clientCode, int32(code))
+		})
+	}
+	return n, err
+}
+
+func (v *wsConn) Write(b []byte) (int, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	n, err := v.Conn.Write(b)
+	if n > 0 {
+		now := time.Now().UnixNano()
+		v.upstream.Feed(b[:n], func(opcode byte) {
+			if opcode <= wsOpBinary {
+				atomic.StoreInt64(&v.activeAt, now)
+			}
+		}, func(code int) {
+			atomic.StoreInt32(&v.upstreamCode, int32(code))
+		})
+	}
+
+	if err == nil && v.pingPending && v.upstream.AtBoundary() {
+		v.pingPending = false
+		v.writeFrame(wsOpPing, nil)
+	}
+	return n, err
+}
+
+// Propagate the close write, when upstream closed.
+func (v *wsConn) CloseWrite() error {
+	if c, ok := v.Conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return nil
+}
+
+// Write the control frame to client, which is unmasked and must be at the boundary.
+func (v *wsConn) writeFrame(opcode byte, payload []byte) error {
+	_, err := v.Conn.Write(append([]byte{0x80 | opcode, byte(len(payload))}, payload...))
+	return err
+}
+
+// Send ping to client at the boundary of frames.
+func (v *wsConn) ping() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.upstream.AtBoundary() {
+		v.writeFrame(wsOpPing, nil)
+	} else {
+		v.pingPending = true
+	}
+}
+
+// Close the connection for timeout, send the close frame with going away if possible.
+func (v *wsConn) timeout(reason string) {
+	v.reason.Store(reason)
+
+	// Unblock the writing to client, which holds the lock.
+	v.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+
+	v.lock.Lock()
+	if v.upstream.AtBoundary() {
+		v.writeFrame(wsOpClose, []byte{0x03, 0xe9})
+	}
+	v.lock.Unlock()
+
+	v.Close()
+}
+
+func (v *wsConn) monitor() {
+	interval := time.Second
+	for _, d := range []time.Duration{v.conf.IdleTimeout, v.conf.PingInterval, v.conf.PingTimeout} {
+		if d > 0 && d/4 < interval {
+			interval = d / 4
+		}
+	}
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-v.done:
+			return
+		case t := <-ticker.C:
+			now := t.UnixNano()
+
+			if d := v.conf.IdleTimeout; d > 0 && now-atomic.LoadInt64(&v.activeAt) > int64(d) {
+				v.timeout("idle timeout")
+				return
+			}
+
+			if v.conf.PingInterval <= 0 {
+				continue
+			}
+			if pingAt := atomic.LoadInt64(&v.pingAt); pingAt > 0 {
+				if now-pingAt > int64(v.conf.PingTimeout) {
+					v.timeout("ping timeout")
+					return
+				}
+			} else if now-atomic.LoadInt64(&v.readAt) >= int64(v.conf.PingInterval) {
+				// Never block the monitor, if the writing to client is blocked.
+				atomic.StoreInt64(&v.pingAt, now)
+				go v.ping()
+			}
+		}
+	}
+}
+
+func (v *wsConn) Close() error {
+	var err error
+	v.closeOnce.Do(func() {
+		close(v.done)
+		err = v.Conn.Close()
+
+		clientCode, upstreamCode := atomic.LoadInt32(&v.clientCode), atomic.LoadInt32(&v.upstreamCode)
+		httpxMetrics.WebSockets.Add(-1, v.path)
+		httpxMetrics.WebSocketCloses.Add(1, v.path, fmt.Sprint(clientCode), fmt.Sprint(upstreamCode))
+
+		reason, _ := v.reason.Load().(string)
+		ol.Tf(v.ctx, "WebSocket closed %v for %v, client=%v, upstream=%v, duration=%v, reason=%v",
+			v.path, v.Conn.RemoteAddr(), clientCode, upstreamCode, time.Now().Sub(v.start), reason)
+	})
+	return err
+}
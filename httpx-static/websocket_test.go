@@ -0,0 +1,161 @@
+/*
+The MIT License (MIT)
+
+Copyright (c) 2019 winlin
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in all
+copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+SOFTWARE.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestWebSocketFrameParser(t *testing.T) {
+	var opcodes []byte
+	var codes []int
+	onHeader := func(opcode byte) { opcodes = append(opcodes, opcode) }
+	onClose := func(code int) { codes = append(codes, code) }
+
+	// The text frame with 126 bytes payload, masked close frame with code 1000, and
+	// close frame without code.
+	b := append([]byte{0x81, 126, 0, 126}, make([]byte, 126)...)
+	b = append(b, 0x88, 0x82, 1, 2, 3, 4, 0x03^1, 0xe8^2)
+	b = append(b, 0x88, 0x00)
+
+	// Feed byte by byte, to verify the stream parsing.
+	v := &wsFrameParser{}
+	for i := range b {
+		v.Feed(b[i:i+1], onHeader, onClose)
+		if i == 4 && v.AtBoundary() {
+			t.Errorf("should not at boundary")
+		}
+	}
+	if !v.AtBoundary() || string(opcodes) != "\x01\x08\x08" || len(codes) != 2 || codes[0] != 1000 || codes[1] != wsCloseNoStatus {
+		t.Errorf("invalid opcodes %v, codes %v", opcodes, codes)
+	}
+}
+
+func TestWebSocketProxy(t *testing.T) {
+	// The upstream echos the frames.
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		io.Copy(c, brw)
+	}))
+	defer backend.Close()
+
+	u, _ := url.Parse(backend.URL + "/ws?wsMaxConns=1&wsIdleTimeout=200ms")
+	pool, err := NewUpstreamPool(u)
+	if err != nil {
+		t.Fatalf("pool err %+v", err)
+	}
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		NewComplexProxy(context.Background(), pool, nil, nil, r).ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	dial := func() (net.Conn, *bufio.Reader, *http.Response) {
+		c, err := net.Dial("tcp", proxy.Listener.Addr().String())
+		if err != nil {
+			t.Fatalf("dial err %+v", err)
+		}
+		c.Write([]byte("GET /ws HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+
+		br := bufio.NewReader(c)
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("read err %+v", err)
+		}
+		return c, br, res
+	}
+
+	c, br, res := dial()
+	defer c.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("should upgrade, status %v", res.StatusCode)
+	}
+
+	// Reject the connections more than max.
+	if c2, _, res := dial(); res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("should reject, status %v", res.StatusCode)
+	} else {
+		c2.Close()
+	}
+
+	// Echo the frame, then closed by idle timeout with going away.
+	frame := []byte{0x81, 0x82, 0, 0, 0, 0, 'o', 'k'}
+	c.Write(frame)
+	b := make([]byte, len(frame))
+	if _, err := io.ReadFull(br, b); err != nil || string(b) != string(frame) {
+		t.Errorf("should echo, got %q, err %v", b, err)
+	}
+
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	b = make([]byte, 4)
+	if _, err := io.ReadFull(br, b); err != nil || string(b) != "\x88\x02\x03\xe9" {
+		t.Errorf("should close, got %q, err %v", b, err)
+	}
+}
+
+func TestStatusWriterHijack(t *testing.T) {
+	// The status writer of post-hook wraps the stream writer, which is not a hijacker.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: &streamWriter{ResponseWriter: w, path: "/ws"}}
+		c, brw, err := sw.Hijack()
+		if err != nil {
+			t.Errorf("hijack err %+v", err)
+			return
+		}
+		defer c.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+
+		if sw.Status() != http.StatusSwitchingProtocols {
+			t.Errorf("expect 101, got %v", sw.Status())
+		}
+	}))
+	defer server.Close()
+
+	c, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial err %+v", err)
+	}
+	defer c.Close()
+	c.Write([]byte("GET /ws HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	if res, err := http.ReadResponse(bufio.NewReader(c), nil); err != nil || res.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("should upgrade, res %v, err %v", res, err)
+	}
+}